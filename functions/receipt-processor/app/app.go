@@ -0,0 +1,286 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+	"vibe-coding-project-lambda/shared/imaging"
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+const (
+	defaultBucketName = "lambda-file-uploads"
+	defaultRegion     = "ap-northeast-1"
+	defaultSheetName  = "가계부"  // Default sheet name for household ledger
+	defaultObjectDir  = "data" // Directory of the local object store
+
+	usageMetricsNamespace = "ReceiptProcessor" // CloudWatch namespace of the OpenAI usage metrics
+)
+
+// App holds the dependencies shared by the receipt Lambda entrypoints
+type App struct {
+	AWSConfig      aws.Config
+	Store          repository.ObjectStore
+	ReceiptService *service.ReceiptService
+	SheetsService  *service.SheetsService   // nil when Google Sheets is not configured
+	Fingerprints   service.FingerprintIndex // nil when duplicate detection is disabled
+	Reconcile      openai.ReconcileOptions  // Arithmetic checks of extracted and edited receipts
+}
+
+// New initializes the dependencies from the environment
+// Missing OpenAI or Google credentials only disable the corresponding feature
+func New(ctx context.Context) (*App, error) {
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create repository layer
+	store, err := newObjectStore(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create receipt extractor (optional - gracefully handle if API key is missing)
+	// RECEIPT_EXTRACTOR selects the provider: openai (default), openai-compatible or fake
+	var extractor openai.ReceiptExtractor
+	reconcile := openai.ReconcileOptions{
+		AutoCorrect: os.Getenv("RECEIPT_AUTO_CORRECT") == "true",
+	}
+	usageTracker := openai.NewUsageTracker() // Token usage and cost across warm invocations
+	// Lambda sends standard output to CloudWatch Logs, which keeps the monthly totals as metrics
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" && os.Getenv("RECEIPT_USAGE_METRICS") != "false" {
+		usageTracker.SetMetrics(os.Stdout, usageMetricsNamespace)
+	}
+	provider := os.Getenv("RECEIPT_EXTRACTOR")
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey != "" || (provider != "" && provider != openai.ProviderOpenAI) {
+		extractor, err = openai.NewReceiptExtractor(openai.ServiceConfig{
+			APIKey:          apiKey,
+			Provider:        provider,
+			BaseURL:         os.Getenv("OPENAI_BASE_URL"),
+			Organization:    os.Getenv("OPENAI_ORGANIZATION"),
+			Project:         os.Getenv("OPENAI_PROJECT"),
+			APIVersion:      os.Getenv("OPENAI_API_VERSION"),
+			DefaultCurrency: "JPY",
+			DefaultLanguage: "ja",
+			DefaultTimezone: "Asia/Tokyo",
+			VisionModel:     visionModel(),
+			MaxTokens:       4096,
+			Temperature:     0.1,
+			ResponseFormat:  os.Getenv("OPENAI_RESPONSE_FORMAT"),
+			Retry: openai.RetryPolicy{
+				MaxAttempts: envInt("OPENAI_MAX_ATTEMPTS", openai.DefaultMaxAttempts),
+			},
+			Reconcile:       reconcile,
+			MaxRepairRounds: envInt("OPENAI_MAX_REPAIR_ROUNDS", 0),
+			UsageTracker:    usageTracker,
+		})
+		if err != nil {
+			log.Printf("Warning: Failed to initialize receipt extractor: %v", err)
+			extractor = nil
+		} else {
+			log.Printf("Receipt extractor initialized successfully (provider: %s)", providerName(provider))
+		}
+	} else {
+		log.Printf("Warning: OPENAI_API_KEY not set, receipt OCR will be disabled")
+	}
+
+	// Create service layer
+	receiptService := service.NewReceiptService(store, extractor)
+	receiptService.SetUsageTracker(usageTracker)
+	var fingerprints service.FingerprintIndex
+	if os.Getenv("RECEIPT_DUPLICATE_CHECK") != "false" {
+		fingerprints = service.NewS3FingerprintIndex(store, "")
+		receiptService.SetDuplicateDetection(fingerprints, service.DuplicateOptions{})
+	}
+	receiptService.SetSplitReceipts(os.Getenv("RECEIPT_SPLIT_MULTIPLE") != "false")
+	receiptService.SetConverter(&imaging.Converter{
+		HEICCommand: os.Getenv("RECEIPT_HEIC_CONVERTER"),
+	})
+	if os.Getenv("RECEIPT_IMAGE_PREPROCESS") != "false" {
+		receiptService.SetImagePreprocessing(imaging.Options{
+			MaxDimension: envInt("RECEIPT_IMAGE_MAX_DIMENSION", imaging.DefaultMaxDimension),
+			Grayscale:    os.Getenv("RECEIPT_IMAGE_GRAYSCALE") != "false",
+			Normalize:    true,
+			AutoCrop:     os.Getenv("RECEIPT_IMAGE_AUTOCROP") == "true",
+		})
+	}
+	receiptService.SetImageURLExpiry(EnvDuration("RECEIPT_IMAGE_URL_EXPIRY", service.DefaultImageURLExpiry))
+
+	return &App{
+		AWSConfig:      cfg,
+		Store:          store,
+		ReceiptService: receiptService,
+		SheetsService:  newSheetsService(ctx),
+		Fingerprints:   fingerprints,
+		Reconcile:      reconcile,
+	}, nil
+}
+
+// LoadAWSConfig loads the AWS configuration for the default region
+func LoadAWSConfig(ctx context.Context) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(defaultRegion))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+	return cfg, nil
+}
+
+// NewS3Repository creates the repository of the bucket named by S3_BUCKET_NAME
+// The bucket is not checked; cmd/setup-bucket creates and configures it
+func NewS3Repository(cfg aws.Config) *repository.S3Repository {
+	// Get bucket name from environment variable or use default
+	bucketName := os.Getenv("S3_BUCKET_NAME")
+	if bucketName == "" {
+		bucketName = defaultBucketName
+	}
+	s3Repo := repository.NewS3Repository(s3.NewFromConfig(cfg), bucketName, defaultRegion)
+	err := s3Repo.SetUploadOptions(repository.UploadOptions{
+		PartSize: int64(envInt("S3_UPLOAD_PART_SIZE_MB", 0)) << 20,
+		Checksum: os.Getenv("S3_UPLOAD_CHECKSUM"),
+	})
+	if err != nil {
+		log.Printf("Warning: Invalid S3 upload options, using defaults: %v", err)
+	}
+	s3Repo.SetKeyLayout(newKeyLayout())
+	return s3Repo
+}
+
+// newKeyLayout returns the layout of uploaded file keys from RECEIPT_KEY_TEMPLATE and
+// RECEIPT_KEY_TIMEZONE, falling back to the default date-folder layout in JST
+func newKeyLayout() *repository.KeyLayout {
+	layout, err := repository.NewKeyLayout(os.Getenv("RECEIPT_KEY_TEMPLATE"), os.Getenv("RECEIPT_KEY_TIMEZONE"))
+	if err != nil {
+		log.Printf("Warning: Invalid key layout, using defaults: %v", err)
+		return repository.DefaultKeyLayout()
+	}
+	return layout
+}
+
+// newObjectStore creates the store for images and records selected by RECEIPT_OBJECT_STORE:
+// s3 (default), memory, or local for a directory given by RECEIPT_OBJECT_STORE_DIR
+func newObjectStore(ctx context.Context, cfg aws.Config) (repository.ObjectStore, error) {
+	switch backend := os.Getenv("RECEIPT_OBJECT_STORE"); backend {
+	case "", "s3":
+		s3Repo := NewS3Repository(cfg)
+		// Development stacks may create the bucket once per cold start instead of running setup
+		if os.Getenv("S3_BUCKET_AUTO_CREATE") == "true" {
+			if err := s3Repo.EnsureBucketExists(ctx); err != nil {
+				log.Printf("Warning: Failed to ensure bucket exists: %v", err)
+			}
+		}
+		return s3Repo, nil
+	case "memory":
+		log.Printf("Using in-memory object store, stored receipts are lost on exit")
+		store := repository.NewMemoryObjectStore()
+		store.SetKeyLayout(newKeyLayout())
+		return store, nil
+	case "local":
+		dir := os.Getenv("RECEIPT_OBJECT_STORE_DIR")
+		if dir == "" {
+			dir = defaultObjectDir
+		}
+		store, err := repository.NewFileObjectStore(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open local object store: %w", err)
+		}
+		store.SetKeyLayout(newKeyLayout())
+		log.Printf("Using local object store in %s", dir)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown RECEIPT_OBJECT_STORE %q", backend)
+	}
+}
+
+// newSheetsService creates the Google Sheets service (optional - returns nil if credentials are missing)
+func newSheetsService(ctx context.Context) *service.SheetsService {
+	serviceAccountJSON := os.Getenv("GOOGLE_SERVICE_ACCOUNT_JSON")
+	spreadsheetID := os.Getenv("GOOGLE_SPREADSHEET_ID")
+
+	if serviceAccountJSON == "" || spreadsheetID == "" {
+		log.Printf("Warning: Google Sheets credentials not configured, spreadsheet integration disabled")
+		if serviceAccountJSON == "" {
+			log.Printf("  - GOOGLE_SERVICE_ACCOUNT_JSON is not set")
+		}
+		if spreadsheetID == "" {
+			log.Printf("  - GOOGLE_SPREADSHEET_ID is not set")
+		}
+		return nil
+	}
+
+	log.Printf("Initializing Google Sheets integration...")
+
+	// Parse service account JSON
+	jsonBytes, err := repository.ParseServiceAccountJSON(serviceAccountJSON)
+	if err != nil {
+		log.Printf("Warning: Failed to parse service account JSON: %v", err)
+		return nil
+	}
+
+	// Create Sheets repository
+	sheetsRepo, err := repository.NewSheetsRepository(ctx, repository.SheetsConfig{
+		ServiceAccountJSON: jsonBytes,
+		SpreadsheetID:      spreadsheetID,
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to initialize Google Sheets repository: %v", err)
+		return nil
+	}
+
+	// Create Sheets service
+	sheetsService := service.NewSheetsService(service.SheetsServiceConfig{
+		SheetsRepo: sheetsRepo,
+		SheetName:  defaultSheetName,
+	})
+
+	// Initialize spreadsheet with headers if needed
+	if err := sheetsService.InitializeSpreadsheet(ctx); err != nil {
+		log.Printf("Warning: Failed to initialize spreadsheet headers: %v", err)
+	} else {
+		log.Printf("Google Sheets service initialized successfully (Sheet: %s)", defaultSheetName)
+	}
+	return sheetsService
+}
+
+// visionModel returns the model name from OPENAI_VISION_MODEL or the default
+func visionModel() string {
+	if model := os.Getenv("OPENAI_VISION_MODEL"); model != "" {
+		return model
+	}
+	return "gpt-4o"
+}
+
+// envInt reads a positive integer environment variable, falling back to def
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// EnvDuration reads a positive duration environment variable such as "12h", falling back to def
+func EnvDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// providerName returns the provider name used for logging
+func providerName(provider string) string {
+	if provider == "" {
+		return openai.ProviderOpenAI
+	}
+	return provider
+}
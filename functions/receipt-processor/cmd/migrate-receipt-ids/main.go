@@ -0,0 +1,44 @@
+// Command migrate-receipt-ids back-fills receipt IDs for receipts recorded before
+// they were generated: sidecars, image metadata and the 영수증ID spreadsheet column.
+// It reads the same environment as receipt-processor and is safe to run repeatedly.
+//
+//	go run ./functions/receipt-processor/cmd/migrate-receipt-ids -dry-run
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/app"
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report the IDs that would be assigned without writing them")
+	flag.Parse()
+
+	ctx := context.Background()
+	deps, err := app.New(ctx)
+	if err != nil {
+		log.Fatalf("failed to initialize: %v", err)
+	}
+	if deps.SheetsService == nil {
+		log.Printf("Warning: Google Sheets is not configured, only stored receipts are migrated")
+	}
+
+	report, err := service.BackfillReceiptIDs(ctx, deps.Store, deps.SheetsService, *dryRun)
+	if err != nil {
+		log.Fatalf("migration failed: %v", err)
+	}
+
+	verb := "Assigned"
+	if *dryRun {
+		verb = "Would assign"
+	}
+	log.Printf("%s receipt IDs to %d upload(s) and %d row(s), %d row(s) without a stored upload",
+		verb, report.Uploads, report.Rows, report.Unmatched)
+	if report.Moved > 0 {
+		log.Printf("%d row(s) changed while migrating and were skipped; run the migration again", report.Moved)
+	}
+}
@@ -0,0 +1,75 @@
+// Command setup-bucket creates and configures the receipt bucket named by S3_BUCKET_NAME:
+// default encryption, versioning and lifecycle rules. Run it once per environment with
+// credentials allowed to manage buckets; the Lambda role then only needs object access.
+// It is safe to run again after changing the options.
+//
+//	go run ./functions/receipt-processor/cmd/setup-bucket -encryption sse-kms -versioning
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/app"
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// archiveMinSize keeps small objects, such as the JSON records next to the images, out of
+// the archive rule; archive storage classes bill every object as at least 128 KiB
+const archiveMinSize = 128 * 1024
+
+func main() {
+	encryption := flag.String("encryption", envOr("S3_BUCKET_ENCRYPTION", repository.BucketEncryptionSSES3), "default encryption: sse-s3 or sse-kms")
+	kmsKeyID := flag.String("kms-key-id", os.Getenv("S3_BUCKET_KMS_KEY_ID"), "KMS key ID or ARN for sse-kms (default: the AWS managed key)")
+	versioning := flag.Bool("versioning", false, "keep previous versions of overwritten and deleted objects")
+	noncurrentDays := flag.Int("noncurrent-days", 90, "delete previous versions after this many days when versioning (0 keeps them)")
+	archiveDays := flag.Int("archive-after-days", 365, "move receipt images to the archive storage class after this many days (0 disables)")
+	archiveClass := flag.String("archive-storage-class", "GLACIER_IR", "archive storage class; GLACIER_IR keeps images readable through presigned URLs")
+	idempotencyDays := flag.Int("idempotency-expire-days", 2, "delete stored idempotency records after this many days (0 keeps them)")
+	flag.Parse()
+
+	opts := repository.BucketOptions{
+		Encryption:            *encryption,
+		KMSKeyID:              *kmsKeyID,
+		Versioning:            *versioning,
+		NoncurrentVersionDays: *noncurrentDays,
+	}
+	if *archiveDays > 0 {
+		opts.Lifecycle = append(opts.Lifecycle, repository.LifecycleRule{
+			ID:             "archive-receipt-images",
+			MinSize:        archiveMinSize,
+			TransitionDays: *archiveDays,
+			StorageClass:   *archiveClass,
+		})
+	}
+	if *idempotencyDays > 0 {
+		opts.Lifecycle = append(opts.Lifecycle, repository.LifecycleRule{
+			ID:             "expire-idempotency-records",
+			Prefix:         service.DefaultIdempotencyPrefix,
+			ExpirationDays: *idempotencyDays,
+		})
+	}
+
+	ctx := context.Background()
+	cfg, err := app.LoadAWSConfig(ctx)
+	if err != nil {
+		log.Fatalf("failed to initialize: %v", err)
+	}
+	s3Repo := app.NewS3Repository(cfg)
+	if err := s3Repo.ProvisionBucket(ctx, opts); err != nil {
+		log.Fatalf("bucket setup failed: %v", err)
+	}
+	log.Printf("Bucket ready (encryption: %s, versioning: %t, %d lifecycle rule(s))",
+		opts.Encryption, opts.Versioning, len(opts.Lifecycle))
+}
+
+// envOr returns the environment variable name, or def when it is empty
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// APIAuth selects how callers of the receipt routes authenticate
+// Uploads are not affected: the receipt routes read, change and delete every stored
+// receipt and hand out presigned image URLs, so they stay closed until one of the methods
+// is configured
+type APIAuth struct {
+	Token string // Shared secret expected as "Authorization: Bearer <token>"
+	IAM   bool   // Accept requests the Function URL verified with AWS_IAM auth (SigV4)
+}
+
+// Enabled reports whether any authentication method is configured
+func (a APIAuth) Enabled() bool {
+	return a.Token != "" || a.IAM
+}
+
+// SetAPIAuth sets how callers of the receipt routes authenticate
+// Without it every request to those routes is refused
+func (h *ReceiptHandler) SetAPIAuth(auth APIAuth) {
+	h.auth = auth
+}
+
+// authorized reports whether a request carries valid credentials for the receipt routes
+func (h *ReceiptHandler) authorized(request events.LambdaFunctionURLRequest) bool {
+	// Function URLs with AWS_IAM auth reject unsigned requests before invoking the function
+	// and describe the signer here
+	if h.auth.IAM && request.RequestContext.Authorizer != nil && request.RequestContext.Authorizer.IAM != nil {
+		return true
+	}
+	if h.auth.Token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(headerValue(request.Headers, "Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.auth.Token)) == 1
+}
+
+// unauthorizedResponse answers a request to the receipt routes without valid credentials
+func (h *ReceiptHandler) unauthorizedResponse(timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	response, err := h.errorResponse(401, "Authentication required", "Unauthorized", timestamp)
+	response.Headers["WWW-Authenticate"] = "Bearer"
+	return response, err
+}
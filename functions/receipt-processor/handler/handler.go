@@ -4,6 +4,10 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"strings"
 	"time"
 
@@ -13,10 +17,22 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 )
 
+// unsupportedFormatMessage answers uploads in a format the receipt cannot be read from
+const unsupportedFormatMessage = "Unsupported file format: HEIC/HEIF photos need a converter on this deployment, send a JPEG or PNG instead"
+
+// userHeader names the uploader of a receipt, stored with the images and available to
+// key templates as {user}
+const userHeader = "X-Receipt-User"
+
 // ReceiptHandler handles Lambda requests for receipt processing
 type ReceiptHandler struct {
 	receiptService *service.ReceiptService
 	sheetsService  *service.SheetsService
+	idempotency    *service.Idempotency
+	jobService     *service.JobService
+	receiptStore   service.ReceiptStore
+	receiptEditor  *service.ReceiptEditor
+	auth           APIAuth
 }
 
 // NewReceiptHandler creates a new receipt handler
@@ -31,6 +47,11 @@ func (h *ReceiptHandler) SetSheetsService(sheetsService *service.SheetsService)
 	h.sheetsService = sheetsService
 }
 
+// SetIdempotency enables replaying responses for requests retried with an Idempotency-Key header (optional)
+func (h *ReceiptHandler) SetIdempotency(idempotency *service.Idempotency) {
+	h.idempotency = idempotency
+}
+
 // Handle handles the Lambda function invocation
 func (h *ReceiptHandler) Handle(ctx context.Context, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
 	timestamp := time.Now().Unix()
@@ -41,66 +62,161 @@ func (h *ReceiptHandler) Handle(ctx context.Context, request events.LambdaFuncti
 			StatusCode: 200,
 			Headers: map[string]string{
 				"Access-Control-Allow-Origin":  "*",
-				"Access-Control-Allow-Methods": "POST, OPTIONS",
-				"Access-Control-Allow-Headers": "Content-Type",
+				"Access-Control-Allow-Methods": "GET, POST, PATCH, DELETE, OPTIONS",
+				"Access-Control-Allow-Headers": "Authorization, Content-Type, Idempotency-Key, X-Receipt-User",
 			},
 		}, nil
 	}
 
+	// Read routes: job status and receipt queries
+	if request.RequestContext.HTTP.Method == "GET" {
+		path := strings.TrimSuffix(requestPath(request), "/")
+		// Receipt queries list every receipt and presign image URLs, so they need credentials
+		if isReceiptPath(path) && h.receiptStore != nil && !h.authorized(request) {
+			return h.unauthorizedResponse(timestamp)
+		}
+		switch {
+		case strings.HasPrefix(path, jobsPathPrefix):
+			return h.handleGetJob(ctx, strings.TrimPrefix(path, jobsPathPrefix), timestamp)
+		case path == receiptsPath:
+			return h.handleListReceipts(ctx, request, timestamp)
+		case strings.HasPrefix(path, receiptsPath+"/") && strings.HasSuffix(path, receiptImageSuffix):
+			id := strings.TrimSuffix(strings.TrimPrefix(path, receiptsPath+"/"), receiptImageSuffix)
+			return h.handleReceiptImage(ctx, id, timestamp)
+		case strings.HasPrefix(path, receiptsPath+"/"):
+			return h.handleGetReceipt(ctx, strings.TrimPrefix(path, receiptsPath+"/"), timestamp)
+		}
+	}
+
+	// Receipt corrections: PATCH and DELETE /receipts/{id}
+	if method := request.RequestContext.HTTP.Method; method == "PATCH" || method == "DELETE" {
+		path := strings.TrimSuffix(requestPath(request), "/")
+		if strings.HasPrefix(path, receiptsPath+"/") {
+			if h.receiptEditor != nil && !h.authorized(request) {
+				return h.unauthorizedResponse(timestamp)
+			}
+			id := strings.TrimPrefix(path, receiptsPath+"/")
+			if method == "PATCH" {
+				return h.handleUpdateReceipt(ctx, id, request, timestamp)
+			}
+			return h.handleDeleteReceipt(ctx, id, timestamp)
+		}
+	}
+
 	// Only accept POST method
 	if request.RequestContext.HTTP.Method != "POST" {
 		return h.errorResponse(405, "Method not allowed. Only POST is supported.", "Invalid HTTP method", timestamp)
 	}
 
+	// Retries carrying the same Idempotency-Key get the first response instead of a second upload
+	key := headerValue(request.Headers, "Idempotency-Key")
+	if key == "" || h.idempotency == nil {
+		return h.handleUpload(ctx, request, timestamp)
+	}
+
+	requestHash := service.HashRequest(request.Body, request.RawQueryString)
+	claim, replay, err := h.idempotency.Begin(ctx, key, requestHash)
+	switch {
+	case errors.Is(err, service.ErrIdempotencyInFlight):
+		response, _ := h.errorResponse(409, "Request with this Idempotency-Key is still in progress, retry later", err.Error(), timestamp)
+		response.Headers["Retry-After"] = "5"
+		return response, nil
+	case errors.Is(err, service.ErrIdempotencyMismatch), errors.Is(err, service.ErrInvalidIdempotencyKey):
+		return h.errorResponse(422, "Invalid Idempotency-Key", err.Error(), timestamp)
+	case err != nil:
+		// Without the store, process normally rather than failing the upload
+		log.Printf("Warning: Idempotency check failed, processing without it: %v", err)
+		return h.handleUpload(ctx, request, timestamp)
+	case replay != nil:
+		log.Printf("Replaying response for Idempotency-Key %q from %s", key, replay.CreatedAt.Format(time.RFC3339))
+		return events.LambdaFunctionURLResponse{
+			StatusCode: replay.StatusCode,
+			Headers:    jsonHeaders(map[string]string{"Idempotent-Replayed": "true"}),
+			Body:       replay.Body,
+		}, nil
+	}
+
+	response, err := h.handleUpload(ctx, request, timestamp)
+	if err != nil || response.StatusCode >= 500 {
+		// Let the client's retry try again
+		if releaseErr := claim.Release(ctx); releaseErr != nil {
+			log.Printf("Warning: Failed to release Idempotency-Key %q: %v", key, releaseErr)
+		}
+		return response, err
+	}
+	if err := claim.Complete(ctx, response.StatusCode, response.Body); err != nil {
+		log.Printf("Warning: Failed to store response for Idempotency-Key %q: %v", key, err)
+	}
+	return response, nil
+}
+
+// handleUpload stores and processes the uploaded receipt
+func (h *ReceiptHandler) handleUpload(ctx context.Context, request events.LambdaFunctionURLRequest, timestamp int64) (events.LambdaFunctionURLResponse, error) {
 	// Parse request and extract file data
-	fileName, fileContent, contentType, err := h.parseRequest(request)
+	uploads, err := h.parseRequest(request)
 	if err != nil {
 		return h.errorResponse(400, err.Error(), "Failed to parse request", timestamp)
 	}
 
-	// Validate we have file content
-	if len(fileContent) == 0 {
+	// Process receipt (upload + OCR); ?force=true records uploads that look like duplicates
+	force := request.QueryStringParameters["force"] == "true"
+	opts := service.ProcessOptions{Force: force, User: strings.TrimSpace(headerValue(request.Headers, userHeader))}
+	if h.jobService != nil && wantsAsync(request) {
+		return h.submitJob(ctx, uploads, opts, timestamp)
+	}
+	result, err := h.receiptService.ProcessReceiptPieces(ctx, uploads, opts)
+	if errors.Is(err, service.ErrEmptyUpload) {
 		return h.errorResponse(400, "File content is empty", "Validation error", timestamp)
 	}
-
-	// Process receipt (upload + OCR)
-	result, err := h.receiptService.ProcessReceipt(ctx, fileName, fileContent, contentType)
+	if errors.Is(err, service.ErrUnconvertibleUpload) {
+		return h.errorResponse(415, unsupportedFormatMessage, err.Error(), timestamp)
+	}
 	if err != nil {
 		return h.errorResponse(500, "Failed to process receipt", err.Error(), timestamp)
 	}
 
-	// Add to Google Sheets if available and receipt was processed
-	if h.sheetsService != nil && result.ReceiptData != nil {
+	// Rejected duplicates were not stored, so they skip the spreadsheet too
+	if len(result.Duplicates) > 0 && !force {
+		return h.duplicateResponse(result, timestamp)
+	}
+
+	// Add to Google Sheets if available and receipts were processed, one row per receipt
+	var warnings []string
+	if h.sheetsService != nil {
 		memo := "" // Optional memo field - could be extracted from request if needed
-		if err := h.sheetsService.AddReceiptToSpreadsheet(ctx, result.ReceiptData, result.FileInfo.URL, memo); err != nil {
-			// Log error but don't fail the request
-			// The receipt has already been uploaded to S3 and processed
-			// Sheets sync is a nice-to-have feature
-			_ = err // Ignore error for now
+		if err := h.sheetsService.AddProcessedReceipts(ctx, result, memo); err != nil {
+			// Don't fail the request: the receipt is already stored and processed
+			log.Printf("Warning: Failed to add receipts %s to spreadsheet: %v", strings.Join(result.ReceiptIDs(), ", "), err)
+			warnings = append(warnings, fmt.Sprintf("Failed to add the receipts to the spreadsheet: %v", err))
 		}
 	}
 
 	// Build success response
 	message := "File uploaded successfully"
-	if result.ReceiptData != nil {
+	if len(result.Receipts) == 1 {
 		message = "File uploaded and receipt processed successfully"
+	} else if len(result.Receipts) > 1 {
+		message = fmt.Sprintf("File uploaded and %d receipts processed successfully", len(result.Receipts))
+	}
+
+	var additionalFiles []*FileInfo
+	for _, fileInfo := range result.AdditionalFiles {
+		additionalFiles = append(additionalFiles, h.toHandlerFileInfo(ctx, fileInfo))
 	}
 
 	response := UploadResponse{
-		Success: true,
-		Message: message,
-		FileInfo: &FileInfo{
-			OriginalName: result.FileInfo.OriginalName,
-			FileName:     result.FileInfo.FileName,
-			BucketName:   result.FileInfo.BucketName,
-			Key:          result.FileInfo.Key,
-			Size:         result.FileInfo.Size,
-			ContentType:  result.FileInfo.ContentType,
-			URL:          result.FileInfo.URL,
-			UploadDate:   result.FileInfo.UploadDate,
-		},
-		ReceiptData: result.ReceiptData,
-		Timestamp:   timestamp,
+		Success:            true,
+		Message:            message,
+		FileInfo:           h.toHandlerFileInfo(ctx, result.FileInfo),
+		AdditionalFiles:    additionalFiles,
+		Receipts:           result.Receipts,
+		ReceiptIDs:         result.ReceiptIDs(),
+		ExtractionAttempts: result.ExtractionAttempts,
+		Usage:              result.Usage,
+		ExtractionError:    result.ExtractionError,
+		Duplicates:         result.Duplicates,
+		Warnings:           warnings,
+		Timestamp:          timestamp,
 	}
 
 	responseBody, err := json.Marshal(response)
@@ -110,18 +226,35 @@ func (h *ReceiptHandler) Handle(ctx context.Context, request events.LambdaFuncti
 
 	return events.LambdaFunctionURLResponse{
 		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type":                 "application/json",
-			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "POST, OPTIONS",
-			"Access-Control-Allow-Headers": "Content-Type",
-		},
-		Body: string(responseBody),
+		Headers:    jsonHeaders(nil),
+		Body:       string(responseBody),
 	}, nil
 }
 
-// parseRequest parses the request body (multipart or JSON)
-func (h *ReceiptHandler) parseRequest(request events.LambdaFunctionURLRequest) (fileName string, fileContent []byte, contentType string, err error) {
+// headerValue returns a request header, whose name Lambda Function URLs lowercase
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[strings.ToLower(name)]; ok {
+		return v
+	}
+	return headers[name]
+}
+
+// jsonHeaders returns the standard JSON response headers plus extra
+func jsonHeaders(extra map[string]string) map[string]string {
+	headers := map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, POST, PATCH, DELETE, OPTIONS",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type, Idempotency-Key, X-Receipt-User",
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	return headers
+}
+
+// parseRequest parses the request body (multipart or JSON) into the uploaded files
+func (h *ReceiptHandler) parseRequest(request events.LambdaFunctionURLRequest) ([]service.Upload, error) {
 	// Determine content type
 	requestContentType := request.Headers["content-type"]
 	if requestContentType == "" {
@@ -133,15 +266,15 @@ func (h *ReceiptHandler) parseRequest(request events.LambdaFunctionURLRequest) (
 		return parseMultipartRequest(request.Body, requestContentType)
 	}
 
-	// Parse as JSON (backward compatibility)
+	// Parse as JSON (backward compatibility), reading the body in place
 	var uploadReq UploadRequest
-	if err := json.Unmarshal([]byte(request.Body), &uploadReq); err != nil {
-		return "", nil, "", err
+	if err := json.NewDecoder(strings.NewReader(request.Body)).Decode(&uploadReq); err != nil {
+		return nil, err
 	}
 
 	// Validate required fields
 	if uploadReq.FileName == "" || uploadReq.FileContent == "" {
-		return "", nil, "", err
+		return nil, fmt.Errorf("filename and file_content are required")
 	}
 
 	// Set default content type if not provided
@@ -149,13 +282,47 @@ func (h *ReceiptHandler) parseRequest(request events.LambdaFunctionURLRequest) (
 		uploadReq.ContentType = "application/octet-stream"
 	}
 
-	// Decode base64 file content
-	fileContent, err = base64.StdEncoding.DecodeString(uploadReq.FileContent)
+	// Check the base64 file content, followed by any further pieces of the receipt;
+	// each piece is decoded again while it is stored instead of being copied
+	var uploads []service.Upload
+	for i, encoded := range append([]string{uploadReq.FileContent}, uploadReq.AdditionalFileContents...) {
+		if _, err := io.Copy(io.Discard, base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded))); err != nil {
+			return nil, fmt.Errorf("failed to decode file %d: %w", i+1, err)
+		}
+		uploads = append(uploads, service.Upload{
+			FileName:    uploadReq.FileName,
+			Content:     base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)),
+			ContentType: uploadReq.ContentType,
+		})
+	}
+
+	return uploads, nil
+}
+
+// duplicateResponse reports an upload rejected as a duplicate with status 409
+// The client can resend it with ?force=true to record it anyway
+func (h *ReceiptHandler) duplicateResponse(result *service.ProcessResult, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	response := UploadResponse{
+		Success:            false,
+		Message:            "Duplicate receipt: already uploaded. Resend with ?force=true to add it anyway",
+		Receipts:           result.Receipts,
+		ExtractionAttempts: result.ExtractionAttempts,
+		Usage:              result.Usage,
+		Duplicates:         result.Duplicates,
+		Error:              fmt.Sprintf("matches %d earlier upload(s)", len(result.Duplicates)),
+		Timestamp:          timestamp,
+	}
+
+	responseBody, err := json.Marshal(response)
 	if err != nil {
-		return "", nil, "", err
+		return h.errorResponse(500, "Failed to generate response", err.Error(), timestamp)
 	}
 
-	return uploadReq.FileName, fileContent, uploadReq.ContentType, nil
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 409,
+		Headers:    jsonHeaders(nil),
+		Body:       string(responseBody),
+	}, nil
 }
 
 // errorResponse creates an error response
@@ -169,12 +336,7 @@ func (h *ReceiptHandler) errorResponse(statusCode int, message, errorDetail stri
 
 	responseBody, _ := json.Marshal(response)
 
-	headers := map[string]string{
-		"Content-Type":                 "application/json",
-		"Access-Control-Allow-Origin":  "*",
-		"Access-Control-Allow-Methods": "POST, OPTIONS",
-		"Access-Control-Allow-Headers": "Content-Type",
-	}
+	headers := jsonHeaders(nil)
 	if statusCode == 405 {
 		headers["Allow"] = "POST"
 	}
@@ -187,10 +349,16 @@ func (h *ReceiptHandler) errorResponse(statusCode int, message, errorDetail stri
 }
 
 // Helper to convert repository.FileInfo to handler.FileInfo
-func toHandlerFileInfo(repoInfo *repository.FileInfo) *FileInfo {
+// The URL is presigned, so the image can be viewed although the bucket is private
+func (h *ReceiptHandler) toHandlerFileInfo(ctx context.Context, repoInfo *repository.FileInfo) *FileInfo {
 	if repoInfo == nil {
 		return nil
 	}
+	url, err := h.receiptService.ImageURL(ctx, repoInfo.Key)
+	if err != nil {
+		log.Printf("Warning: Failed to presign %s: %v", repoInfo.Key, err)
+		url = ""
+	}
 	return &FileInfo{
 		OriginalName: repoInfo.OriginalName,
 		FileName:     repoInfo.FileName,
@@ -198,7 +366,9 @@ func toHandlerFileInfo(repoInfo *repository.FileInfo) *FileInfo {
 		Key:          repoInfo.Key,
 		Size:         repoInfo.Size,
 		ContentType:  repoInfo.ContentType,
-		URL:          repoInfo.URL,
+		URL:          url,
 		UploadDate:   repoInfo.UploadDate,
+		ETag:         repoInfo.ETag,
+		Checksum:     repoInfo.Checksum,
 	}
 }
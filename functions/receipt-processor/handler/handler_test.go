@@ -0,0 +1,359 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// testHandler is a handler wired like main.go, against a memory store and the fake extractor
+type testHandler struct {
+	*ReceiptHandler
+	store       *repository.MemoryObjectStore
+	idempotency *service.MemoryIdempotencyStore
+}
+
+// testAPIToken is the shared secret of the receipt routes in tests
+const testAPIToken = "test-token"
+
+// newTestHandler creates a handler with idempotency and the receipt routes enabled
+func newTestHandler(t *testing.T) *testHandler {
+	t.Helper()
+	store := repository.NewMemoryObjectStore()
+	receiptService := service.NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	idempotency := service.NewMemoryIdempotencyStore()
+
+	h := NewReceiptHandler(receiptService)
+	h.SetIdempotency(service.NewIdempotency(idempotency, service.IdempotencyOptions{}))
+	h.SetReceiptStore(service.NewS3ReceiptStore(store))
+	h.SetReceiptEditor(service.NewReceiptEditor(store))
+	h.SetAPIAuth(APIAuth{Token: testAPIToken})
+	return &testHandler{ReceiptHandler: h, store: store, idempotency: idempotency}
+}
+
+// newRequest builds a Function URL request; path may carry a query string
+func newRequest(method, path, body string, headers map[string]string) events.LambdaFunctionURLRequest {
+	path, rawQuery, _ := strings.Cut(path, "?")
+	query := map[string]string{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if name, value, ok := strings.Cut(pair, "="); ok {
+			query[name] = value
+		}
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	return events.LambdaFunctionURLRequest{
+		RawPath:               path,
+		RawQueryString:        rawQuery,
+		QueryStringParameters: query,
+		Headers:               headers,
+		Body:                  body,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: method, Path: path},
+		},
+	}
+}
+
+// authHeaders returns the headers authenticating a request to the receipt routes
+func authHeaders() map[string]string {
+	return map[string]string{"authorization": "Bearer " + testAPIToken}
+}
+
+// receiptPhoto returns a small PNG for the fake extractor
+func receiptPhoto(t *testing.T) []byte {
+	t.Helper()
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	return photo.Bytes()
+}
+
+// uploadBody returns a JSON upload of the receipt photo named name
+func uploadBody(t *testing.T, name string) string {
+	t.Helper()
+	body, _ := json.Marshal(UploadRequest{
+		FileName:    name,
+		FileContent: base64.StdEncoding.EncodeToString(receiptPhoto(t)),
+		ContentType: "image/png",
+	})
+	return string(body)
+}
+
+// handle runs a request and decodes the JSON response body into v when given
+func (h *testHandler) handle(t *testing.T, request events.LambdaFunctionURLRequest, v interface{}) events.LambdaFunctionURLResponse {
+	t.Helper()
+	response, err := h.Handle(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if v != nil && response.Body != "" {
+		if err := json.Unmarshal([]byte(response.Body), v); err != nil {
+			t.Fatalf("Response body %q is not JSON: %v", response.Body, err)
+		}
+	}
+	return response
+}
+
+// images returns the keys of the stored receipt images
+func (h *testHandler) images(t *testing.T) []string {
+	t.Helper()
+	keys, err := h.store.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	var images []string
+	for _, key := range keys {
+		if !service.IsSidecarKey(key) {
+			images = append(images, key)
+		}
+	}
+	return images
+}
+
+func TestHandleIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		inFlight     bool     // An unfinished request holds the key
+		prior        []string // Bodies sent with the key before
+		body         string
+		wantStatus   int
+		wantHeaders  map[string]string
+		wantImages   int
+		wantReplayed bool
+	}{
+		{
+			name:       "First request",
+			body:       "receipt.png",
+			wantStatus: 200,
+			wantImages: 1,
+		},
+		{
+			name:         "Retry of a completed request",
+			prior:        []string{"receipt.png"},
+			body:         "receipt.png",
+			wantStatus:   200,
+			wantHeaders:  map[string]string{"Idempotent-Replayed": "true"},
+			wantImages:   1,
+			wantReplayed: true,
+		},
+		{
+			name:       "Key reused for another upload",
+			prior:      []string{"receipt.png"},
+			body:       "other.png",
+			wantStatus: 422,
+			wantImages: 1,
+		},
+		{
+			name:        "Request still in progress",
+			inFlight:    true,
+			body:        "receipt.png",
+			wantStatus:  409,
+			wantHeaders: map[string]string{"Retry-After": "5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			headers := map[string]string{"idempotency-key": "key-1"}
+			bodies := map[string]string{}
+			body := func(name string) string {
+				if _, ok := bodies[name]; !ok {
+					bodies[name] = uploadBody(t, name)
+				}
+				return bodies[name]
+			}
+
+			if tt.inFlight {
+				h.idempotency.Put(context.Background(), &service.IdempotencyRecord{
+					Key:         "key-1",
+					State:       service.IdempotencyInProgress,
+					RequestHash: service.HashRequest(body(tt.body), ""),
+					ExpiresAt:   time.Now().Add(time.Minute),
+				}, nil)
+			}
+			var first string
+			for _, name := range tt.prior {
+				first = h.handle(t, newRequest("POST", "/", body(name), headers), nil).Body
+			}
+
+			var response UploadResponse
+			got := h.handle(t, newRequest("POST", "/", body(tt.body), headers), &response)
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d: %s", got.StatusCode, tt.wantStatus, got.Body)
+			}
+			for name, want := range tt.wantHeaders {
+				if got.Headers[name] != want {
+					t.Errorf("Header %s = %q, want %q", name, got.Headers[name], want)
+				}
+			}
+			if _, replayed := got.Headers["Idempotent-Replayed"]; replayed != tt.wantReplayed {
+				t.Errorf("Idempotent-Replayed present = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && got.Body != first {
+				t.Errorf("Replayed body = %s, want the first response %s", got.Body, first)
+			}
+			if images := h.images(t); len(images) != tt.wantImages {
+				t.Errorf("Stored images %v, want %d", images, tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestHandleUploadUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string // Key prefix
+	}{
+		{name: "Lowercased header", headers: map[string]string{"x-receipt-user": "alice"}, want: "alice/"},
+		{name: "Canonical header", headers: map[string]string{"X-Receipt-User": " bob "}, want: "bob/"},
+		{name: "No user", want: "unknown/"},
+		{name: "User naming a reserved prefix", headers: map[string]string{"X-Receipt-User": "idempotency"}, want: "_idempotency/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			layout, err := repository.NewKeyLayout("{user}/{rand}{ext}", "")
+			if err != nil {
+				t.Fatalf("NewKeyLayout() error = %v", err)
+			}
+			h.store.SetKeyLayout(layout)
+
+			var response UploadResponse
+			got := h.handle(t, newRequest("POST", "/", uploadBody(t, "receipt.png"), tt.headers), &response)
+			if got.StatusCode != 200 || response.FileInfo == nil {
+				t.Fatalf("StatusCode = %d: %s", got.StatusCode, got.Body)
+			}
+			if !strings.HasPrefix(response.FileInfo.Key, tt.want) {
+				t.Errorf("Key = %q, want prefix %q", response.FileInfo.Key, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleUploadSheetsFailure(t *testing.T) {
+	// A spreadsheet the service account may not write to
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":{"code":403,"message":"The caller does not have permission","status":"PERMISSION_DENIED"}}`)
+	}))
+	defer server.Close()
+	client, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("sheets.NewService() error = %v", err)
+	}
+
+	h := newTestHandler(t)
+	h.SetSheetsService(service.NewSheetsService(service.SheetsServiceConfig{
+		SheetsRepo: repository.NewSheetsRepositoryWithService(client, "spreadsheet"),
+		SheetName:  "Sheet1",
+	}))
+
+	// The stored receipt is reported with a warning instead of failing the upload
+	var response UploadResponse
+	got := h.handle(t, newRequest("POST", "/", uploadBody(t, "receipt.png"), nil), &response)
+	if got.StatusCode != 200 || !response.Success || len(response.ReceiptIDs) != 1 {
+		t.Fatalf("StatusCode = %d: %s", got.StatusCode, got.Body)
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "spreadsheet") {
+		t.Errorf("Warnings = %v, want the spreadsheet failure", response.Warnings)
+	}
+}
+
+func TestHandleUploadHEICWithoutConverter(t *testing.T) {
+	h := newTestHandler(t)
+	body, _ := json.Marshal(UploadRequest{
+		FileName:    "IMG_0001.HEIC",
+		FileContent: base64.StdEncoding.EncodeToString([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")),
+	})
+
+	for _, path := range []string{"/", "/?async=true"} {
+		h.enableJobs()
+		if got := h.handle(t, newRequest("POST", path, string(body), nil), nil); got.StatusCode != 415 {
+			t.Errorf("POST %s = %d, want 415: %s", path, got.StatusCode, got.Body)
+		}
+	}
+	if images := h.images(t); len(images) != 0 {
+		t.Errorf("Stored images %v, want none", images)
+	}
+}
+
+func TestHandleMultipartUpload(t *testing.T) {
+	photo := receiptPhoto(t)
+	form := func(pieces ...[]byte) (string, string) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("note", "long receipt")
+		for i, piece := range pieces {
+			part, _ := writer.CreateFormFile("file", fmt.Sprintf("piece%d.png", i+1))
+			part.Write(piece)
+		}
+		writer.Close()
+		return body.String(), writer.FormDataContentType()
+	}
+
+	tests := []struct {
+		name       string
+		pieces     [][]byte
+		base64     bool // The Function URL delivered the body base64-encoded
+		wantStatus int
+		wantImages int
+	}{
+		{name: "One piece", pieces: [][]byte{photo}, wantStatus: 200, wantImages: 1},
+		{name: "Several pieces", pieces: [][]byte{photo, photo, photo}, wantStatus: 200, wantImages: 3},
+		{name: "Base64 body", pieces: [][]byte{photo, photo}, base64: true, wantStatus: 200, wantImages: 2},
+		{name: "Empty piece", pieces: [][]byte{photo, {}}, wantStatus: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			body, contentType := form(tt.pieces...)
+			if tt.base64 {
+				body = base64.StdEncoding.EncodeToString([]byte(body))
+			}
+
+			got := h.handle(t, newRequest("POST", "/", body, map[string]string{"content-type": contentType}), nil)
+			if got.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode = %d, want %d: %s", got.StatusCode, tt.wantStatus, got.Body)
+			}
+			images := h.images(t)
+			if len(images) != tt.wantImages {
+				t.Fatalf("Stored images %v, want %d", images, tt.wantImages)
+			}
+			for _, key := range images {
+				stored, err := h.store.Get(context.Background(), key)
+				if err != nil {
+					t.Fatalf("Get(%q) error = %v", key, err)
+				}
+				if !bytes.Equal(stored, photo) {
+					t.Errorf("Stored %s is %d bytes, want the %d uploaded", key, len(stored), len(photo))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// jobsPathPrefix is the path of the job status route, GET /jobs/{id}
+const jobsPathPrefix = "/jobs/"
+
+// SetJobService enables asynchronous uploads and the job status route (optional)
+func (h *ReceiptHandler) SetJobService(jobService *service.JobService) {
+	h.jobService = jobService
+}
+
+// wantsAsync reports whether the client asked for the upload to be processed in the background
+// with ?async=true or a "Prefer: respond-async" header
+func wantsAsync(request events.LambdaFunctionURLRequest) bool {
+	if request.QueryStringParameters["async"] == "true" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(headerValue(request.Headers, "Prefer")), "respond-async")
+}
+
+// requestPath returns the path of a Function URL request
+func requestPath(request events.LambdaFunctionURLRequest) string {
+	if request.RawPath != "" {
+		return request.RawPath
+	}
+	return request.RequestContext.HTTP.Path
+}
+
+// submitJob stores the upload and queues it, answering 202 with the job to poll
+func (h *ReceiptHandler) submitJob(ctx context.Context, uploads []service.Upload, opts service.ProcessOptions, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	job, err := h.jobService.Submit(ctx, uploads, opts)
+	if errors.Is(err, service.ErrEmptyUpload) {
+		return h.errorResponse(400, "File content is empty", "Validation error", timestamp)
+	}
+	if errors.Is(err, service.ErrUnconvertibleUpload) {
+		return h.errorResponse(415, unsupportedFormatMessage, err.Error(), timestamp)
+	}
+	if err != nil {
+		return h.errorResponse(500, "Failed to queue receipt", err.Error(), timestamp)
+	}
+
+	if job.Status == service.JobDuplicate {
+		return h.jobResponse(409, JobResponse{
+			Success:   false,
+			Message:   "Duplicate receipt: already uploaded. Resend with ?force=true to add it anyway",
+			Job:       job,
+			Timestamp: timestamp,
+		}, timestamp)
+	}
+
+	statusURL := jobsPathPrefix + job.ID
+	response, err := h.jobResponse(202, JobResponse{
+		Success:   true,
+		Message:   "File uploaded, receipt queued for processing",
+		Job:       job,
+		StatusURL: statusURL,
+		Timestamp: timestamp,
+	}, timestamp)
+	response.Headers["Location"] = statusURL
+	return response, err
+}
+
+// handleGetJob returns the status of a job and, once completed, its receipts
+func (h *ReceiptHandler) handleGetJob(ctx context.Context, id string, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	if h.jobService == nil {
+		return h.errorResponse(404, "Asynchronous processing is not enabled", "Not found", timestamp)
+	}
+	if id == "" || strings.Contains(id, "/") {
+		return h.errorResponse(404, "Job not found", "Invalid job ID", timestamp)
+	}
+
+	job, err := h.jobService.Get(ctx, id)
+	if errors.Is(err, service.ErrJobNotFound) {
+		return h.errorResponse(404, "Job not found", err.Error(), timestamp)
+	}
+	if err != nil {
+		return h.errorResponse(500, "Failed to load job", err.Error(), timestamp)
+	}
+
+	return h.jobResponse(200, JobResponse{
+		Success:   job.Status != service.JobFailed,
+		Message:   "Job " + job.Status,
+		Job:       job,
+		StatusURL: jobsPathPrefix + job.ID,
+		Error:     job.Error,
+		Timestamp: timestamp,
+	}, timestamp)
+}
+
+// jobResponse encodes a job response
+func (h *ReceiptHandler) jobResponse(statusCode int, response JobResponse, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	responseBody, err := json.Marshal(response)
+	if err != nil {
+		return h.errorResponse(500, "Failed to generate response", err.Error(), timestamp)
+	}
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    jsonHeaders(nil),
+		Body:       string(responseBody),
+	}, nil
+}
+
+// HandleSQS is the worker entrypoint: it processes the jobs delivered by SQS
+// Failed messages are reported individually so only they are redelivered
+func (h *ReceiptHandler) HandleSQS(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	var response events.SQSEventResponse
+	for _, message := range event.Records {
+		jobID, err := service.ParseJobMessage(message.Body)
+		if err != nil {
+			// Retrying a malformed message cannot help
+			log.Printf("Warning: Dropping message %s: %v", message.MessageId, err)
+			continue
+		}
+
+		err = h.jobService.Process(ctx, jobID)
+		if errors.Is(err, service.ErrJobNotFound) {
+			log.Printf("Warning: Dropping message %s for unknown job %s", message.MessageId, jobID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: Job %s failed, will be retried: %v", jobID, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// enableJobs turns on asynchronous uploads with in-memory jobs
+func (h *testHandler) enableJobs() *service.JobService {
+	jobs := service.NewJobService(h.receiptService, service.NewMemoryJobStore(), service.NewMemoryJobQueue(10))
+	h.SetJobService(jobs)
+	return jobs
+}
+
+func TestHandleAsyncUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+	}{
+		{name: "Query parameter", path: "/?async=true"},
+		{name: "Prefer header", path: "/", headers: map[string]string{"prefer": "respond-async"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			jobs := h.enableJobs()
+
+			var submitted JobResponse
+			got := h.handle(t, newRequest("POST", tt.path, uploadBody(t, "receipt.png"), tt.headers), &submitted)
+			if got.StatusCode != 202 || submitted.Job == nil {
+				t.Fatalf("StatusCode = %d: %s", got.StatusCode, got.Body)
+			}
+			location := got.Headers["Location"]
+			if location != "/jobs/"+submitted.Job.ID || submitted.StatusURL != location {
+				t.Errorf("Location = %q, status_url = %q, want /jobs/%s", location, submitted.StatusURL, submitted.Job.ID)
+			}
+
+			// Polled before and after the worker ran
+			var status JobResponse
+			if got := h.handle(t, newRequest("GET", location, "", nil), &status); got.StatusCode != 200 || status.Job.Status != service.JobQueued {
+				t.Errorf("GET %s = %d %s, want the queued job", location, got.StatusCode, got.Body)
+			}
+			if err := jobs.Process(context.Background(), submitted.Job.ID); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+			got = h.handle(t, newRequest("GET", location+"/", "", nil), &status)
+			if got.StatusCode != 200 || status.Job.Status != service.JobCompleted || len(status.Job.ReceiptIDs) != 1 {
+				t.Errorf("GET %s = %d %s, want the completed job", location, got.StatusCode, got.Body)
+			}
+		})
+	}
+}
+
+func TestHandleGetJob(t *testing.T) {
+	tests := []struct {
+		name       string
+		jobs       bool
+		path       string
+		wantStatus int
+	}{
+		{name: "Unknown job", jobs: true, path: "/jobs/missing", wantStatus: 404},
+		{name: "Nested path", jobs: true, path: "/jobs/a/b", wantStatus: 404},
+		{name: "Asynchronous processing disabled", path: "/jobs/missing", wantStatus: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			if tt.jobs {
+				h.enableJobs()
+			}
+			if got := h.handle(t, newRequest("GET", tt.path, "", nil), nil); got.StatusCode != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d: %s", got.StatusCode, tt.wantStatus, got.Body)
+			}
+		})
+	}
+}
+
+func TestHandleSQS(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t)
+	jobs := h.enableJobs()
+	photo := receiptPhoto(t)
+	uploads := func() []service.Upload {
+		return []service.Upload{{FileName: "receipt.png", Content: bytes.NewReader(photo), ContentType: "image/png"}}
+	}
+
+	completed, err := jobs.Submit(ctx, uploads(), service.ProcessOptions{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	// A job whose stored upload disappeared fails and is retried
+	failing, err := jobs.Submit(ctx, uploads(), service.ProcessOptions{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if err := h.store.Delete(ctx, failing.Files[0].Key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	response, err := h.HandleSQS(ctx, events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "completed", Body: `{"job_id":"` + completed.ID + `"}`},
+		{MessageId: "malformed", Body: `not json`},
+		{MessageId: "unknown", Body: `{"job_id":"missing"}`},
+		{MessageId: "failing", Body: `{"job_id":"` + failing.ID + `"}`},
+	}})
+	if err != nil {
+		t.Fatalf("HandleSQS() error = %v", err)
+	}
+
+	// Only the failed job is redelivered; malformed and unknown messages cannot succeed later
+	want := []events.SQSBatchItemFailure{{ItemIdentifier: "failing"}}
+	if !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %+v, want %+v", response.BatchItemFailures, want)
+	}
+	if job, _ := jobs.Get(ctx, completed.ID); job.Status != service.JobCompleted {
+		t.Errorf("Job %s status = %s, want completed", completed.ID, job.Status)
+	}
+}
@@ -1,22 +1,60 @@
 package handler
 
-import "vibe-coding-project-lambda/shared/openai"
+import (
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+	"vibe-coding-project-lambda/shared/openai"
+)
 
 // UploadRequest represents the file upload request structure
 type UploadRequest struct {
 	FileName    string `json:"filename"`
 	FileContent string `json:"file_content"` // Base64 encoded file content
 	ContentType string `json:"content_type"`
+
+	// Base64 photos continuing the same long receipt, in order
+	AdditionalFileContents []string `json:"additional_file_contents,omitempty"`
 }
 
 // UploadResponse represents the API response structure
 type UploadResponse struct {
-	Success     bool                `json:"success"`
-	Message     string              `json:"message"`
-	FileInfo    *FileInfo           `json:"file_info,omitempty"`
-	ReceiptData *openai.ReceiptData `json:"receipt_data,omitempty"`
-	Error       string              `json:"error,omitempty"`
-	Timestamp   int64               `json:"timestamp"`
+	Success            bool                      `json:"success"`
+	Message            string                    `json:"message"`
+	FileInfo           *FileInfo                 `json:"file_info,omitempty"`
+	AdditionalFiles    []*FileInfo               `json:"additional_files,omitempty"` // Further pieces of the same receipt
+	Receipts           []openai.ExtractedReceipt `json:"receipts,omitempty"`         // One entry per receipt found
+	ReceiptIDs         []string                  `json:"receipt_ids,omitempty"`      // IDs of Receipts, for GET/PATCH/DELETE /receipts/{id}
+	ExtractionAttempts int                       `json:"extraction_attempts,omitempty"`
+	Usage              *openai.Usage             `json:"usage,omitempty"`
+	ExtractionError    string                    `json:"extraction_error,omitempty"` // Set when the upload was stored but not processed
+	Duplicates         []service.Duplicate       `json:"duplicates,omitempty"`       // Earlier uploads of the same receipt
+	Warnings           []string                  `json:"warnings,omitempty"`         // Steps that failed after the receipt was stored, e.g. the spreadsheet sync
+	Error              string                    `json:"error,omitempty"`
+	Timestamp          int64                     `json:"timestamp"`
+}
+
+// JobResponse is returned for asynchronous uploads and by GET /jobs/{id}
+type JobResponse struct {
+	Success   bool         `json:"success"`
+	Message   string       `json:"message"`
+	Job       *service.Job `json:"job,omitempty"`
+	StatusURL string       `json:"status_url,omitempty"` // Path to poll for the result
+	Error     string       `json:"error,omitempty"`
+	Timestamp int64        `json:"timestamp"`
+}
+
+// ReceiptListResponse is returned by GET /receipts
+type ReceiptListResponse struct {
+	Success    bool                    `json:"success"`
+	Receipts   []service.StoredReceipt `json:"receipts"`
+	NextCursor string                  `json:"next_cursor,omitempty"` // Pass as ?cursor= for the next page
+	Timestamp  int64                   `json:"timestamp"`
+}
+
+// ReceiptResponse is returned by GET /receipts/{id}
+type ReceiptResponse struct {
+	Success   bool                   `json:"success"`
+	Receipt   *service.StoredReceipt `json:"receipt"`
+	Timestamp int64                  `json:"timestamp"`
 }
 
 // FileInfo contains information about the uploaded file
@@ -27,6 +65,8 @@ type FileInfo struct {
 	Key          string `json:"key"`
 	Size         int64  `json:"size"`
 	ContentType  string `json:"content_type"`
-	URL          string `json:"url"`
+	URL          string `json:"url"` // Presigned, valid for RECEIPT_IMAGE_URL_EXPIRY
 	UploadDate   string `json:"upload_date"`
+	ETag         string `json:"etag,omitempty"`
+	Checksum     string `json:"checksum,omitempty"` // Verified on upload, e.g. "SHA256:<base64>"
 }
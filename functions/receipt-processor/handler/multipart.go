@@ -1,77 +1,120 @@
 package handler
 
 import (
-	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"strings"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
 )
 
 // parseMultipartRequest parses a multipart/form-data request
-func parseMultipartRequest(body string, contentType string) (fileName string, fileContent []byte, fileContentType string, err error) {
+// The "file" field may repeat for a long receipt photographed in several pieces
+// The parts are not copied: every upload reads its part from the body while it is stored
+func parseMultipartRequest(body string, contentType string) ([]service.Upload, error) {
 	// Parse the content type to get the boundary
 	_, params, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return "", nil, "", fmt.Errorf("failed to parse content type: %w", err)
+		return nil, fmt.Errorf("failed to parse content type: %w", err)
 	}
 
 	boundary, ok := params["boundary"]
 	if !ok {
-		return "", nil, "", fmt.Errorf("boundary not found in content type")
+		return nil, fmt.Errorf("boundary not found in content type")
 	}
 
-	// Lambda Function URLs with base64 encoding enabled
-	var bodyBytes []byte
-	if strings.Contains(body, "base64") || len(body) > 0 {
-		// Try to decode if it's base64
-		decoded, decodeErr := base64.StdEncoding.DecodeString(body)
-		if decodeErr == nil {
-			bodyBytes = decoded
-		} else {
-			// Not base64, use as is
-			bodyBytes = []byte(body)
-		}
-	} else {
-		bodyBytes = []byte(body)
+	// Lambda Function URLs with base64 encoding enabled deliver the body encoded;
+	// it is decoded while the parts are read rather than copied up front
+	open := func() io.Reader {
+		return base64.NewDecoder(base64.StdEncoding, strings.NewReader(body))
+	}
+	uploads, err := scanMultipartUploads(open, boundary)
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		// Not base64, use as is
+		open = func() io.Reader { return strings.NewReader(body) }
+		uploads, err = scanMultipartUploads(open, boundary)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(uploads) == 0 {
+		return nil, fmt.Errorf("no file found in request (looking for 'file' field)")
 	}
 
-	// Create a multipart reader
-	reader := multipart.NewReader(bytes.NewReader(bodyBytes), boundary)
+	return uploads, nil
+}
+
+// scanMultipartUploads lists the "file" parts of the body returned by open, in order
+// Their content is only checked here; each upload opens the body again to read its part
+func scanMultipartUploads(open func() io.Reader, boundary string) ([]service.Upload, error) {
+	reader := multipart.NewReader(open(), boundary)
 
-	// Read the file part
+	var uploads []service.Upload
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return "", nil, "", fmt.Errorf("failed to read part: %w", err)
+			return nil, fmt.Errorf("failed to read part: %w", err)
 		}
 
 		// Check if this is the file field
-		if part.FormName() == "file" {
-			fileName = part.FileName()
-			fileContentType = part.Header.Get("Content-Type")
-
-			// Read the file content
-			fileContent, err = io.ReadAll(part)
-			if err != nil {
-				return "", nil, "", fmt.Errorf("failed to read file content: %w", err)
+		if isFilePart(part) {
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return nil, fmt.Errorf("failed to read file content: %w", err)
 			}
-
-			part.Close()
-			break
+			uploads = append(uploads, service.Upload{
+				FileName:    part.FileName(),
+				Content:     &multipartFile{open: open, boundary: boundary, index: len(uploads)},
+				ContentType: part.Header.Get("Content-Type"),
+			})
 		}
 
 		part.Close()
 	}
+	return uploads, nil
+}
 
-	if fileName == "" {
-		return "", nil, "", fmt.Errorf("no file found in request (looking for 'file' field)")
-	}
+// isFilePart reports whether a part carries one of the uploaded files
+func isFilePart(part *multipart.Part) bool {
+	return part.FormName() == "file" && part.FileName() != ""
+}
+
+// multipartFile reads the index-th file part of a multipart body, skipping the parts
+// before it on the first read
+type multipartFile struct {
+	open     func() io.Reader
+	boundary string
+	index    int
+	part     *multipart.Part
+}
 
-	return fileName, fileContent, fileContentType, nil
+func (f *multipartFile) Read(p []byte) (int, error) {
+	if f.part == nil {
+		reader := multipart.NewReader(f.open(), f.boundary)
+		for files := 0; ; {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF // The body was scanned before, so the part exists
+			}
+			if err != nil {
+				return 0, fmt.Errorf("failed to read part: %w", err)
+			}
+			if isFilePart(part) {
+				if files == f.index {
+					f.part = part
+					break
+				}
+				files++
+			}
+		}
+	}
+	return f.part.Read(p)
 }
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Receipt routes: GET /receipts, GET, PATCH and DELETE /receipts/{id} and GET /receipts/{id}/image
+const (
+	receiptsPath       = "/receipts"
+	receiptImageSuffix = "/image"
+)
+
+// SetReceiptStore enables the receipt query routes (optional)
+// They answer only callers authenticated as configured with SetAPIAuth
+func (h *ReceiptHandler) SetReceiptStore(store service.ReceiptStore) {
+	h.receiptStore = store
+}
+
+// isReceiptPath reports whether a request path names one of the receipt routes
+func isReceiptPath(path string) bool {
+	return path == receiptsPath || strings.HasPrefix(path, receiptsPath+"/")
+}
+
+// handleListReceipts returns one page of receipts matching the query string filters
+func (h *ReceiptHandler) handleListReceipts(ctx context.Context, request events.LambdaFunctionURLRequest, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	if h.receiptStore == nil {
+		return h.errorResponse(404, "Receipt queries are not enabled", "Not found", timestamp)
+	}
+
+	query, err := parseReceiptQuery(request.QueryStringParameters)
+	if err != nil {
+		return h.errorResponse(400, err.Error(), "Invalid query", timestamp)
+	}
+
+	page, err := h.receiptStore.List(ctx, query)
+	if errors.Is(err, service.ErrInvalidCursor) {
+		return h.errorResponse(400, err.Error(), "Invalid query", timestamp)
+	}
+	if err != nil {
+		return h.errorResponse(500, "Failed to list receipts", err.Error(), timestamp)
+	}
+
+	return h.receiptResponse(ReceiptListResponse{
+		Success:    true,
+		Receipts:   page.Receipts,
+		NextCursor: page.NextCursor,
+		Timestamp:  timestamp,
+	}, timestamp)
+}
+
+// handleGetReceipt returns a single receipt
+func (h *ReceiptHandler) handleGetReceipt(ctx context.Context, id string, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	if h.receiptStore == nil {
+		return h.errorResponse(404, "Receipt queries are not enabled", "Not found", timestamp)
+	}
+
+	receipt, err := h.receiptStore.Get(ctx, id)
+	if errors.Is(err, service.ErrReceiptNotFound) {
+		return h.errorResponse(404, "Receipt not found", err.Error(), timestamp)
+	}
+	if err != nil {
+		return h.errorResponse(500, "Failed to load receipt", err.Error(), timestamp)
+	}
+
+	return h.receiptResponse(ReceiptResponse{
+		Success:   true,
+		Receipt:   receipt,
+		Timestamp: timestamp,
+	}, timestamp)
+}
+
+// handleReceiptImage redirects to a freshly presigned URL of the receipt's image
+func (h *ReceiptHandler) handleReceiptImage(ctx context.Context, id string, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	if h.receiptStore == nil {
+		return h.errorResponse(404, "Receipt queries are not enabled", "Not found", timestamp)
+	}
+
+	receipt, err := h.receiptStore.Get(ctx, id)
+	if errors.Is(err, service.ErrReceiptNotFound) {
+		return h.errorResponse(404, "Receipt not found", err.Error(), timestamp)
+	}
+	if err != nil {
+		return h.errorResponse(500, "Failed to load receipt", err.Error(), timestamp)
+	}
+
+	url, err := h.receiptService.ReceiptImageURL(ctx, receipt)
+	if errors.Is(err, service.ErrNoReceiptImage) {
+		return h.errorResponse(404, "Receipt image not found", err.Error(), timestamp)
+	}
+	if err != nil {
+		return h.errorResponse(500, "Failed to create image URL", err.Error(), timestamp)
+	}
+
+	// The URL expires, so the redirect must not be cached
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 302,
+		Headers: map[string]string{
+			"Location":                    url,
+			"Cache-Control":               "no-store",
+			"Access-Control-Allow-Origin": "*",
+		},
+	}, nil
+}
+
+// SetReceiptEditor enables editing and deleting receipts (optional)
+// Like the query routes they answer only callers authenticated as configured with SetAPIAuth
+func (h *ReceiptHandler) SetReceiptEditor(editor *service.ReceiptEditor) {
+	h.receiptEditor = editor
+}
+
+// handleUpdateReceipt corrects a receipt with the JSON merge patch in the body
+func (h *ReceiptHandler) handleUpdateReceipt(ctx context.Context, id string, request events.LambdaFunctionURLRequest, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	if h.receiptEditor == nil {
+		return h.errorResponse(404, "Receipt editing is not enabled", "Not found", timestamp)
+	}
+
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return h.errorResponse(400, "Invalid base64 body", err.Error(), timestamp)
+		}
+		body = decoded
+	}
+
+	receipt, err := h.receiptEditor.Update(ctx, id, body)
+	if err != nil {
+		return h.editErrorResponse(err, "Failed to update receipt", timestamp)
+	}
+
+	return h.receiptResponse(ReceiptResponse{
+		Success:   true,
+		Receipt:   receipt,
+		Timestamp: timestamp,
+	}, timestamp)
+}
+
+// handleDeleteReceipt removes a receipt from the ledger
+func (h *ReceiptHandler) handleDeleteReceipt(ctx context.Context, id string, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	if h.receiptEditor == nil {
+		return h.errorResponse(404, "Receipt editing is not enabled", "Not found", timestamp)
+	}
+
+	if err := h.receiptEditor.Delete(ctx, id); err != nil {
+		return h.editErrorResponse(err, "Failed to delete receipt", timestamp)
+	}
+
+	return h.receiptResponse(ReceiptResponse{
+		Success:   true,
+		Timestamp: timestamp,
+	}, timestamp)
+}
+
+// editErrorResponse maps receipt editing errors to status codes
+func (h *ReceiptHandler) editErrorResponse(err error, message string, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	switch {
+	case errors.Is(err, service.ErrReceiptNotFound):
+		return h.errorResponse(404, "Receipt not found", err.Error(), timestamp)
+	case errors.Is(err, service.ErrReceiptRowMoved):
+		return h.errorResponse(409, "Spreadsheet changed while editing the receipt, retry", err.Error(), timestamp)
+	case errors.Is(err, service.ErrInvalidReceiptPatch):
+		return h.errorResponse(400, err.Error(), "Invalid patch", timestamp)
+	default:
+		return h.errorResponse(500, message, err.Error(), timestamp)
+	}
+}
+
+// receiptResponse encodes a receipt query response
+func (h *ReceiptHandler) receiptResponse(response interface{}, timestamp int64) (events.LambdaFunctionURLResponse, error) {
+	responseBody, err := json.Marshal(response)
+	if err != nil {
+		return h.errorResponse(500, "Failed to generate response", err.Error(), timestamp)
+	}
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    jsonHeaders(nil),
+		Body:       string(responseBody),
+	}, nil
+}
+
+// parseReceiptQuery reads the listing filters:
+// from, to (YYYY-MM-DD), category, store, min_amount, max_amount, payment_method, limit and cursor
+func parseReceiptQuery(params map[string]string) (service.ReceiptQuery, error) {
+	query := service.ReceiptQuery{
+		Category:      params["category"],
+		Store:         params["store"],
+		PaymentMethod: params["payment_method"],
+		Cursor:        params["cursor"],
+	}
+
+	for name, target := range map[string]*string{"from": &query.From, "to": &query.To} {
+		if v := params[name]; v != "" {
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				return query, fmt.Errorf("%s must be a date in YYYY-MM-DD format", name)
+			}
+			*target = v
+		}
+	}
+
+	for name, target := range map[string]**float64{"min_amount": &query.MinAmount, "max_amount": &query.MaxAmount} {
+		if v := params[name]; v != "" {
+			amount, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return query, fmt.Errorf("%s must be a number", name)
+			}
+			*target = &amount
+		}
+	}
+
+	if v := params["limit"]; v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > service.MaxReceiptPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", service.MaxReceiptPageSize)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
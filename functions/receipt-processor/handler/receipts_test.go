@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandleReceiptRoutes(t *testing.T) {
+	h := newTestHandler(t)
+	var uploaded UploadResponse
+	if got := h.handle(t, newRequest("POST", "/", uploadBody(t, "receipt.png"), nil), &uploaded); got.StatusCode != 200 || len(uploaded.ReceiptIDs) != 1 {
+		t.Fatalf("Upload StatusCode = %d: %s", got.StatusCode, got.Body)
+	}
+	id := uploaded.ReceiptIDs[0]
+	path := "/receipts/" + id
+
+	// Steps run in order against the same receipt
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string            // Substring of the response body
+		wantHeader map[string]string // Exact header values
+	}{
+		{name: "List", method: "GET", path: "/receipts", wantStatus: 200, wantBody: id},
+		{name: "List with filters", method: "GET", path: "/receipts?store=fake&from=2024-01-01&to=2024-01-31&min_amount=1000", wantStatus: 200, wantBody: id},
+		{name: "List excluding the receipt", method: "GET", path: "/receipts?category=식비", wantStatus: 200, wantBody: `"receipts":[]`},
+		{name: "List with an invalid limit", method: "GET", path: "/receipts?limit=0", wantStatus: 400},
+		{name: "List with an invalid date", method: "GET", path: "/receipts?from=01/01/2024", wantStatus: 400},
+		{name: "List with a foreign cursor", method: "GET", path: "/receipts?cursor=!", wantStatus: 400},
+		{name: "Detail", method: "GET", path: path, wantStatus: 200, wantBody: `"store_name":"Fake Store"`},
+		{name: "Detail with a trailing slash", method: "GET", path: path + "/", wantStatus: 200, wantBody: id},
+		{name: "Unknown receipt", method: "GET", path: "/receipts/missing", wantStatus: 404},
+		{name: "Image redirect", method: "GET", path: path + "/image", wantStatus: 302, wantHeader: map[string]string{
+			"Location":      "memory://" + uploaded.FileInfo.Key,
+			"Cache-Control": "no-store",
+		}},
+		{name: "Image of an unknown receipt", method: "GET", path: "/receipts/missing/image", wantStatus: 404},
+		{name: "Update", method: "PATCH", path: path, body: `{"store_name":"Corner Cafe"}`, wantStatus: 200, wantBody: `"store_name":"Corner Cafe"`},
+		{name: "Detail after update", method: "GET", path: path, wantStatus: 200, wantBody: `"store_name":"Corner Cafe"`},
+		{name: "List after update", method: "GET", path: "/receipts?store=corner", wantStatus: 200, wantBody: id},
+		{name: "Update with a non-object patch", method: "PATCH", path: path, body: `[1]`, wantStatus: 400},
+		{name: "Update by row number", method: "PATCH", path: "/receipts/row-2", body: `{}`, wantStatus: 404},
+		{name: "Update of an unknown receipt", method: "PATCH", path: "/receipts/missing", body: `{}`, wantStatus: 404},
+		{name: "Delete", method: "DELETE", path: path, wantStatus: 200},
+		{name: "Detail after delete", method: "GET", path: path, wantStatus: 404},
+		{name: "List after delete", method: "GET", path: "/receipts", wantStatus: 200, wantBody: `"receipts":[]`},
+		{name: "Delete again", method: "DELETE", path: path, wantStatus: 404},
+	}
+
+	for _, step := range steps {
+		got := h.handle(t, newRequest(step.method, step.path, step.body, authHeaders()), nil)
+		if got.StatusCode != step.wantStatus {
+			t.Errorf("%s: %s %s = %d, want %d: %s", step.name, step.method, step.path, got.StatusCode, step.wantStatus, got.Body)
+		}
+		if !strings.Contains(got.Body, step.wantBody) {
+			t.Errorf("%s: body = %s, want it to contain %s", step.name, got.Body, step.wantBody)
+		}
+		for name, want := range step.wantHeader {
+			if got.Headers[name] != want {
+				t.Errorf("%s: header %s = %q, want %q", step.name, name, got.Headers[name], want)
+			}
+		}
+	}
+}
+
+func TestHandleReceiptRoutesDisabled(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetReceiptStore(nil)
+	h.SetReceiptEditor(nil)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/receipts"},
+		{"GET", "/receipts/abc"},
+		{"GET", "/receipts/abc/image"},
+		{"PATCH", "/receipts/abc"},
+		{"DELETE", "/receipts/abc"},
+	}
+
+	for _, tt := range tests {
+		if got := h.handle(t, newRequest(tt.method, tt.path, "{}", nil), nil); got.StatusCode != 404 {
+			t.Errorf("%s %s = %d, want 404: %s", tt.method, tt.path, got.StatusCode, got.Body)
+		}
+	}
+}
+
+func TestHandleReceiptRoutesAuth(t *testing.T) {
+	h := newTestHandler(t)
+	// Set by Function URLs with AWS_IAM auth for signed requests
+	iamAuthorizer := &events.LambdaFunctionURLRequestContextAuthorizerDescription{
+		IAM: &events.LambdaFunctionURLRequestContextAuthorizerIAMDescription{UserARN: "arn:aws:iam::123456789012:user/app"},
+	}
+
+	tests := []struct {
+		name       string
+		auth       APIAuth
+		headers    map[string]string
+		iam        bool
+		wantStatus int
+	}{
+		{name: "Token", auth: APIAuth{Token: testAPIToken}, headers: authHeaders(), wantStatus: 200},
+		{name: "Missing token", auth: APIAuth{Token: testAPIToken}, wantStatus: 401},
+		{name: "Wrong token", auth: APIAuth{Token: testAPIToken}, headers: map[string]string{"authorization": "Bearer guess"}, wantStatus: 401},
+		{name: "Token without the Bearer scheme", auth: APIAuth{Token: testAPIToken}, headers: map[string]string{"authorization": testAPIToken}, wantStatus: 401},
+		{name: "IAM", auth: APIAuth{IAM: true}, iam: true, wantStatus: 200},
+		{name: "Unsigned request with IAM", auth: APIAuth{IAM: true}, wantStatus: 401},
+		{name: "IAM not accepted", auth: APIAuth{Token: testAPIToken}, iam: true, wantStatus: 401},
+		{name: "Not configured", headers: authHeaders(), wantStatus: 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.SetAPIAuth(tt.auth)
+			for _, route := range []struct{ method, path string }{
+				{"GET", "/receipts"},
+				{"GET", "/receipts/abc"},
+				{"GET", "/receipts/abc/image"},
+				{"PATCH", "/receipts/abc"},
+				{"DELETE", "/receipts/abc"},
+			} {
+				request := newRequest(route.method, route.path, "{}", tt.headers)
+				if tt.iam {
+					request.RequestContext.Authorizer = iamAuthorizer
+				}
+				got := h.handle(t, request, nil)
+				// An authenticated request for an unknown receipt gets past the check
+				if want := tt.wantStatus; got.StatusCode != want && !(want == 200 && got.StatusCode == 404) {
+					t.Errorf("%s %s = %d, want %d: %s", route.method, route.path, got.StatusCode, want, got.Body)
+				}
+				if got.StatusCode == 401 && got.Headers["WWW-Authenticate"] != "Bearer" {
+					t.Errorf("%s %s: WWW-Authenticate = %q", route.method, route.path, got.Headers["WWW-Authenticate"])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/service"
+	"vibe-coding-project-lambda/shared/repository"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// S3EventHandler processes receipts put directly into the bucket, e.g. by a scanner sync
+type S3EventHandler struct {
+	receiptService *service.ReceiptService
+	sheetsService  *service.SheetsService
+	prefix         string
+}
+
+// NewS3EventHandler creates a handler for objects created under prefix (all keys when empty)
+func NewS3EventHandler(receiptService *service.ReceiptService, prefix string) *S3EventHandler {
+	return &S3EventHandler{
+		receiptService: receiptService,
+		prefix:         prefix,
+	}
+}
+
+// SetSheetsService sets the Google Sheets service (optional)
+func (h *S3EventHandler) SetSheetsService(sheetsService *service.SheetsService) {
+	h.sheetsService = sheetsService
+}
+
+// Handle processes every created object in the event
+// An error makes Lambda retry the whole event; objects already processed are
+// recognized by their sidecar and skipped on the retry
+func (h *S3EventHandler) Handle(ctx context.Context, event events.S3Event) error {
+	var failed []string
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+
+		// Keys in S3 events are URL-encoded, with spaces as '+'
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			log.Printf("Warning: Skipping undecodable key %q: %v", record.S3.Object.Key, err)
+			continue
+		}
+		if !h.shouldProcess(key) {
+			continue
+		}
+
+		if err := h.processObject(ctx, key); err != nil {
+			log.Printf("Warning: Failed to process %s: %v", key, err)
+			failed = append(failed, key)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to process %d object(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// shouldProcess reports whether key is a receipt this handler is responsible for
+// Sidecars and the service's own JSON records are created in the same bucket
+// and would otherwise trigger the function again
+func (h *S3EventHandler) shouldProcess(key string) bool {
+	return strings.HasPrefix(key, h.prefix) && !strings.HasSuffix(key, "/") && !service.IsSidecarKey(key)
+}
+
+// processObject extracts one object and adds it to the spreadsheet
+func (h *S3EventHandler) processObject(ctx context.Context, key string) error {
+	processed, err := h.receiptService.HasSidecar(ctx, key)
+	if err != nil {
+		return err
+	}
+	if processed {
+		log.Printf("Skipping %s: already has a sidecar", key)
+		return nil
+	}
+
+	result, err := h.receiptService.ProcessStoredObject(ctx, key, service.ProcessOptions{})
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		log.Printf("Skipping %s: object no longer exists", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The service has written the sidecar, so a redelivered event skips this object
+	log.Printf("Processed %s: %d receipt(s)", key, len(result.Receipts))
+
+	// Duplicates of earlier uploads are kept in the bucket but not added to the ledger again
+	if len(result.Duplicates) > 0 {
+		log.Printf("Not adding %s to spreadsheet: duplicates %s", key, result.Duplicates[0].Key)
+		return nil
+	}
+	if h.sheetsService != nil {
+		if err := h.sheetsService.AddProcessedReceipts(ctx, result, ""); err != nil {
+			log.Printf("Warning: Failed to add %s to spreadsheet: %v", key, err)
+		}
+	}
+	return nil
+}
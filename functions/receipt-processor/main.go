@@ -7,19 +7,11 @@ import (
 	"os"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 
+	"vibe-coding-project-lambda/functions/receipt-processor/app"
 	"vibe-coding-project-lambda/functions/receipt-processor/handler"
 	"vibe-coding-project-lambda/functions/receipt-processor/service"
-	"vibe-coding-project-lambda/shared/openai"
-	"vibe-coding-project-lambda/shared/repository"
-)
-
-const (
-	defaultBucketName = "lambda-file-uploads"
-	defaultRegion     = "ap-northeast-1"
-	defaultSheetName  = "가계부" // Default sheet name for household ledger
 )
 
 var receiptHandler *handler.ReceiptHandler
@@ -28,104 +20,84 @@ var receiptHandler *handler.ReceiptHandler
 func init() {
 	ctx := context.Background()
 
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(defaultRegion))
+	deps, err := app.New(ctx)
 	if err != nil {
-		panic(fmt.Sprintf("unable to load SDK config: %v", err))
+		panic(fmt.Sprintf("failed to initialize: %v", err))
 	}
 
-	// Initialize S3 client
-	s3Client := s3.NewFromConfig(cfg)
-
-	// Get bucket name from environment variable or use default
-	bucketName := os.Getenv("S3_BUCKET_NAME")
-	if bucketName == "" {
-		bucketName = defaultBucketName
+	// Create handler layer with optional sheets service
+	receiptHandler = handler.NewReceiptHandler(deps.ReceiptService)
+
+	// Replay responses for retried uploads unless disabled
+	if os.Getenv("IDEMPOTENCY_ENABLED") != "false" {
+		receiptHandler.SetIdempotency(service.NewIdempotency(
+			service.NewS3IdempotencyStore(deps.Store, ""),
+			service.IdempotencyOptions{TTL: app.EnvDuration("IDEMPOTENCY_TTL", service.DefaultIdempotencyTTL)},
+		))
 	}
 
-	// Create repository layer
-	s3Repo := repository.NewS3Repository(s3Client, bucketName, defaultRegion)
-
-	// Create OpenAI service (optional - gracefully handle if API key is missing)
-	var openaiService *openai.Service
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey != "" {
-		openaiService, err = openai.NewService(openai.ServiceConfig{
-			APIKey:          apiKey,
-			DefaultCurrency: "JPY",
-			DefaultLanguage: "ja",
-			DefaultTimezone: "Asia/Tokyo",
-			VisionModel:     "gpt-4o",
-			MaxTokens:       4096,
-			Temperature:     0.1,
-		})
-		if err != nil {
-			log.Printf("Warning: Failed to initialize OpenAI service: %v", err)
-			openaiService = nil
-		} else {
-			log.Printf("OpenAI service initialized successfully")
-		}
-	} else {
-		log.Printf("Warning: OPENAI_API_KEY not set, receipt OCR will be disabled")
+	// Set sheets service if available
+	if deps.SheetsService != nil {
+		receiptHandler.SetSheetsService(deps.SheetsService)
 	}
 
-	// Create Google Sheets service (optional - gracefully handle if credentials are missing)
-	var sheetsService *service.SheetsService
-	serviceAccountJSON := os.Getenv("GOOGLE_SERVICE_ACCOUNT_JSON")
-	spreadsheetID := os.Getenv("GOOGLE_SPREADSHEET_ID")
-
-	if serviceAccountJSON != "" && spreadsheetID != "" {
-		log.Printf("Initializing Google Sheets integration...")
-
-		// Parse service account JSON
-		jsonBytes, err := repository.ParseServiceAccountJSON(serviceAccountJSON)
-		if err != nil {
-			log.Printf("Warning: Failed to parse service account JSON: %v", err)
-		} else {
-			// Create Sheets repository
-			sheetsRepo, err := repository.NewSheetsRepository(ctx, repository.SheetsConfig{
-				ServiceAccountJSON: jsonBytes,
-				SpreadsheetID:      spreadsheetID,
-			})
-			if err != nil {
-				log.Printf("Warning: Failed to initialize Google Sheets repository: %v", err)
-			} else {
-				// Create Sheets service
-				sheetsService = service.NewSheetsService(service.SheetsServiceConfig{
-					SheetsRepo: sheetsRepo,
-					SheetName:  defaultSheetName,
-				})
+	// Receipt queries and edits are opt-in: they need a shared secret or a Function URL with AWS_IAM auth
+	auth := handler.APIAuth{
+		Token: os.Getenv("RECEIPT_API_TOKEN"),
+		IAM:   os.Getenv("RECEIPT_API_AUTH") == "iam",
+	}
+	receiptHandler.SetAPIAuth(auth)
+
+	// Receipt queries read the spreadsheet when configured, otherwise the S3 sidecars
+	// RECEIPT_STORE=s3 or sheets overrides the choice
+	switch store := os.Getenv("RECEIPT_STORE"); {
+	case !auth.Enabled():
+		log.Printf("Receipt queries and edits disabled: set RECEIPT_API_TOKEN or RECEIPT_API_AUTH=iam to enable them")
+	case store == "sheets" && deps.SheetsService == nil:
+		log.Printf("Warning: RECEIPT_STORE=sheets but Google Sheets is not configured, receipt queries disabled")
+	case store == "sheets", store == "" && deps.SheetsService != nil:
+		receiptHandler.SetReceiptStore(service.NewSheetsReceiptStore(deps.SheetsService))
+	default:
+		receiptHandler.SetReceiptStore(service.NewS3ReceiptStore(deps.Store))
+	}
 
-				// Initialize spreadsheet with headers if needed
-				if err := sheetsService.InitializeSpreadsheet(ctx); err != nil {
-					log.Printf("Warning: Failed to initialize spreadsheet headers: %v", err)
-				} else {
-					log.Printf("Google Sheets service initialized successfully (Sheet: %s)", defaultSheetName)
-				}
-			}
-		}
-	} else {
-		log.Printf("Warning: Google Sheets credentials not configured, spreadsheet integration disabled")
-		if serviceAccountJSON == "" {
-			log.Printf("  - GOOGLE_SERVICE_ACCOUNT_JSON is not set")
+	// Receipt corrections update the S3 sidecars and, when configured, the spreadsheet rows
+	// and the duplicate detection fingerprints
+	if auth.Enabled() {
+		receiptEditor := service.NewReceiptEditor(deps.Store)
+		receiptEditor.SetReconcileOptions(deps.Reconcile)
+		if deps.SheetsService != nil {
+			receiptEditor.SetSheetsService(deps.SheetsService)
 		}
-		if spreadsheetID == "" {
-			log.Printf("  - GOOGLE_SPREADSHEET_ID is not set")
+		if deps.Fingerprints != nil {
+			receiptEditor.SetFingerprintIndex(deps.Fingerprints)
 		}
+		receiptHandler.SetReceiptEditor(receiptEditor)
 	}
 
-	// Create service layer
-	receiptService := service.NewReceiptService(s3Repo, openaiService)
-
-	// Create handler layer with optional sheets service
-	receiptHandler = handler.NewReceiptHandler(receiptService)
-
-	// Set sheets service if available
-	if sheetsService != nil {
-		receiptHandler.SetSheetsService(sheetsService)
+	// Asynchronous uploads: queue jobs on SQS for the worker (RECEIPT_PROCESSOR_MODE=worker)
+	if queueURL := os.Getenv("RECEIPT_JOB_QUEUE_URL"); queueURL != "" {
+		jobService := service.NewJobService(
+			deps.ReceiptService,
+			service.NewS3JobStore(deps.Store, ""),
+			service.NewSQSJobQueue(sqs.NewFromConfig(deps.AWSConfig), queueURL),
+		)
+		if deps.SheetsService != nil {
+			jobService.SetSheetsService(deps.SheetsService)
+		}
+		receiptHandler.SetJobService(jobService)
+		log.Printf("Asynchronous processing enabled (queue: %s)", queueURL)
 	}
 }
 
 func main() {
+	// The same binary runs as the SQS-triggered worker
+	if os.Getenv("RECEIPT_PROCESSOR_MODE") == "worker" {
+		if os.Getenv("RECEIPT_JOB_QUEUE_URL") == "" {
+			panic("RECEIPT_PROCESSOR_MODE=worker requires RECEIPT_JOB_QUEUE_URL")
+		}
+		lambda.Start(receiptHandler.HandleSQS)
+		return
+	}
 	lambda.Start(receiptHandler.Handle)
 }
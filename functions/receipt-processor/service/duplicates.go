@@ -0,0 +1,421 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"vibe-coding-project-lambda/shared/imaging"
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// DefaultFingerprintPrefix is the S3 prefix of the fingerprint records, one per upload
+const DefaultFingerprintPrefix = "index/fingerprints/"
+
+// How an upload matched an earlier one
+const (
+	DuplicateContent = "content" // Byte-identical file
+	DuplicateImage   = "image"   // Same photo, re-encoded or resized
+	DuplicateReceipt = "receipt" // Same store, date, total and receipt number
+)
+
+// Duplicate describes an earlier upload that a new upload matches
+type Duplicate struct {
+	Match      string    `json:"match"` // DuplicateContent, DuplicateImage or DuplicateReceipt
+	Key        string    `json:"key"`   // S3 key of the earlier upload
+	URL        string    `json:"url"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Distance   int       `json:"distance,omitempty"` // Perceptual hash distance of image matches
+	Receipt    string    `json:"receipt,omitempty"`  // The matching receipt, for receipt matches
+}
+
+// Fingerprint identifies a recorded upload for duplicate detection
+type Fingerprint struct {
+	Key           string       `json:"key"`
+	ReceiptID     string       `json:"receipt_id,omitempty"` // Receipt ID of the upload
+	URL           string       `json:"url"`
+	UploadedAt    time.Time    `json:"uploaded_at"`
+	ContentHashes []string     `json:"content_hashes"`       // SHA-256 of every uploaded piece
+	ImageHash     string       `json:"image_hash,omitempty"` // Perceptual hash of the first piece (hex)
+	Receipts      []ReceiptKey `json:"receipts,omitempty"`   // Receipts extracted from the upload
+}
+
+// ReceiptKey holds the fields that identify a purchase
+type ReceiptKey struct {
+	Store         string  `json:"store"` // Normalized store name
+	Date          string  `json:"date"`  // YYYY-MM-DD
+	Total         float64 `json:"total"`
+	ReceiptNumber string  `json:"receipt_number,omitempty"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+}
+
+// FingerprintIndex stores the fingerprints of recorded uploads
+type FingerprintIndex interface {
+	Load(ctx context.Context) ([]Fingerprint, error)
+	Add(ctx context.Context, fingerprint Fingerprint) error
+	Remove(ctx context.Context, fingerprint Fingerprint) error
+}
+
+// DuplicateOptions controls duplicate detection
+type DuplicateOptions struct {
+	// Largest perceptual hash distance treated as the same photo
+	// 0 uses imaging.DefaultHashDistance, a negative value disables image matching
+	ImageDistance int
+}
+
+// withDefaults fills in zero values
+func (o DuplicateOptions) withDefaults() DuplicateOptions {
+	if o.ImageDistance == 0 {
+		o.ImageDistance = imaging.DefaultHashDistance
+	}
+	return o
+}
+
+// newFingerprint hashes the stored pieces of an upload
+// The perceptual hash is skipped for formats that cannot be decoded, such as HEIC and PDF
+func newFingerprint(pieces [][]byte) Fingerprint {
+	var fingerprint Fingerprint
+	for _, piece := range pieces {
+		sum := sha256.Sum256(piece)
+		fingerprint.ContentHashes = append(fingerprint.ContentHashes, hex.EncodeToString(sum[:]))
+	}
+	if hash, err := imaging.PerceptualHash(pieces[0]); err == nil {
+		fingerprint.ImageHash = strconv.FormatUint(hash, 16)
+	}
+	return fingerprint
+}
+
+// otherUploads drops the fingerprints of the upload with the given receipt ID
+func otherUploads(known []Fingerprint, receiptID string) []Fingerprint {
+	if receiptID == "" {
+		return known
+	}
+	var others []Fingerprint
+	for _, k := range known {
+		if k.ReceiptID != receiptID {
+			others = append(others, k)
+		}
+	}
+	return others
+}
+
+// newReceiptKey builds the identifying fields of a receipt
+// Receipts without a date or total cannot be compared and return false
+func newReceiptKey(data *openai.ReceiptData) (ReceiptKey, bool) {
+	if data == nil || data.ReceiptDate.IsZero() || data.TotalAmount == 0 {
+		return ReceiptKey{}, false
+	}
+	return ReceiptKey{
+		Store:         normalizeStoreName(data.StoreName),
+		Date:          data.ReceiptDate.Format("2006-01-02"),
+		Total:         data.TotalAmount,
+		ReceiptNumber: strings.TrimSpace(data.ReceiptNumber),
+		TransactionID: strings.TrimSpace(data.TransactionID),
+	}, true
+}
+
+// matches reports whether two keys describe the same purchase
+// Differing receipt numbers or transaction IDs mean separate purchases, e.g. two coffees on one day;
+// without either, the store name has to match
+func (k ReceiptKey) matches(other ReceiptKey) bool {
+	if k.Date != other.Date || math.Abs(k.Total-other.Total) >= 0.005 {
+		return false
+	}
+	if k.ReceiptNumber != "" && other.ReceiptNumber != "" {
+		return k.ReceiptNumber == other.ReceiptNumber
+	}
+	if k.TransactionID != "" && other.TransactionID != "" {
+		return k.TransactionID == other.TransactionID
+	}
+	return k.Store != "" && k.Store == other.Store
+}
+
+// String formats the key for duplicate reports
+func (k ReceiptKey) String() string {
+	s := fmt.Sprintf("%s %s %.2f", k.Date, k.Store, k.Total)
+	if k.ReceiptNumber != "" {
+		s += " #" + k.ReceiptNumber
+	}
+	return s
+}
+
+// normalizeStoreName lowercases a store name and drops spaces and punctuation
+// so "FamilyMart 新宿店" and "Familymart新宿店" compare equal
+func normalizeStoreName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// findUploadDuplicates returns earlier uploads with identical bytes or a near-identical photo
+func findUploadDuplicates(known []Fingerprint, fingerprint Fingerprint, opts DuplicateOptions) []Duplicate {
+	opts = opts.withDefaults()
+	hash, hashErr := strconv.ParseUint(fingerprint.ImageHash, 16, 64)
+
+	var duplicates []Duplicate
+	for _, k := range known {
+		duplicate := Duplicate{Key: k.Key, URL: k.URL, UploadedAt: k.UploadedAt}
+		if sharesHash(k.ContentHashes, fingerprint.ContentHashes) {
+			duplicate.Match = DuplicateContent
+			duplicates = append(duplicates, duplicate)
+			continue
+		}
+		if opts.ImageDistance < 0 || hashErr != nil || k.ImageHash == "" {
+			continue
+		}
+		if knownHash, err := strconv.ParseUint(k.ImageHash, 16, 64); err == nil {
+			if distance := imaging.HashDistance(hash, knownHash); distance <= opts.ImageDistance {
+				duplicate.Match = DuplicateImage
+				duplicate.Distance = distance
+				duplicates = append(duplicates, duplicate)
+			}
+		}
+	}
+	return duplicates
+}
+
+// hasDuplicate reports whether duplicates already holds the same match of the same upload
+func hasDuplicate(duplicates []Duplicate, duplicate Duplicate) bool {
+	for _, d := range duplicates {
+		if d.Key == duplicate.Key && d.Match == duplicate.Match {
+			return true
+		}
+	}
+	return false
+}
+
+// findReceiptDuplicates returns earlier uploads containing the same purchase
+func findReceiptDuplicates(known []Fingerprint, keys []ReceiptKey) []Duplicate {
+	var duplicates []Duplicate
+	for _, k := range known {
+		for _, key := range keys {
+			if receipt, ok := matchingReceipt(k.Receipts, key); ok {
+				duplicates = append(duplicates, Duplicate{
+					Match:      DuplicateReceipt,
+					Key:        k.Key,
+					URL:        k.URL,
+					UploadedAt: k.UploadedAt,
+					Receipt:    receipt.String(),
+				})
+				break
+			}
+		}
+	}
+	return duplicates
+}
+
+// matchingReceipt returns the receipt among keys that matches key
+func matchingReceipt(keys []ReceiptKey, key ReceiptKey) (ReceiptKey, bool) {
+	for _, k := range keys {
+		if k.matches(key) {
+			return k, true
+		}
+	}
+	return ReceiptKey{}, false
+}
+
+// sharesHash reports whether two hash lists have an element in common
+func sharesHash(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MemoryFingerprintIndex keeps fingerprints in memory, for tests and local runs
+type MemoryFingerprintIndex struct {
+	mu           sync.Mutex
+	fingerprints []Fingerprint
+}
+
+// NewMemoryFingerprintIndex creates an empty in-memory index
+func NewMemoryFingerprintIndex() *MemoryFingerprintIndex {
+	return &MemoryFingerprintIndex{}
+}
+
+// Load returns all stored fingerprints
+func (m *MemoryFingerprintIndex) Load(ctx context.Context) ([]Fingerprint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Fingerprint(nil), m.fingerprints...), nil
+}
+
+// Add stores a fingerprint, replacing an earlier one of the same receipt ID
+func (m *MemoryFingerprintIndex) Add(ctx context.Context, fingerprint Fingerprint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, known := range m.fingerprints {
+		if fingerprint.ReceiptID != "" && known.ReceiptID == fingerprint.ReceiptID {
+			m.fingerprints[i] = fingerprint
+			return nil
+		}
+	}
+	m.fingerprints = append(m.fingerprints, fingerprint)
+	return nil
+}
+
+// Remove drops the fingerprint of the same receipt ID, or of the same key without one
+func (m *MemoryFingerprintIndex) Remove(ctx context.Context, fingerprint Fingerprint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.fingerprints[:0]
+	for _, known := range m.fingerprints {
+		if !sameUpload(known, fingerprint) {
+			kept = append(kept, known)
+		}
+	}
+	m.fingerprints = kept
+	return nil
+}
+
+// sameUpload reports whether two fingerprints describe the same upload
+func sameUpload(a, b Fingerprint) bool {
+	if a.ReceiptID != "" || b.ReceiptID != "" {
+		return a.ReceiptID == b.ReceiptID
+	}
+	return a.Key == b.Key
+}
+
+// S3FingerprintIndex keeps one JSON object per fingerprint in the receipts bucket, so
+// uploads finishing at the same moment do not overwrite each other's fingerprints
+// Records are never rewritten, so the ones already read are kept across warm invocations
+// and only records that disappeared are dropped
+type S3FingerprintIndex struct {
+	objectStore repository.ObjectStore
+	prefix      string
+
+	mu     sync.Mutex
+	loaded map[string]Fingerprint // Records read or written so far, by key
+}
+
+// NewS3FingerprintIndex creates an index stored under prefix (DefaultFingerprintPrefix when empty)
+func NewS3FingerprintIndex(objectStore repository.ObjectStore, prefix string) *S3FingerprintIndex {
+	if prefix == "" {
+		prefix = DefaultFingerprintPrefix
+	}
+	return &S3FingerprintIndex{
+		objectStore: objectStore,
+		prefix:      prefix,
+		loaded:      make(map[string]Fingerprint),
+	}
+}
+
+// Load reads the records not read yet and returns all fingerprints, oldest first
+// The index is empty before the first upload
+func (i *S3FingerprintIndex) Load(ctx context.Context) ([]Fingerprint, error) {
+	keys, err := i.objectStore.List(ctx, i.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fingerprint index: %w", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		listed[key] = true
+	}
+	for key := range i.loaded {
+		if !listed[key] {
+			delete(i.loaded, key) // Removed or replaced by another instance
+		}
+	}
+	for _, key := range keys {
+		if _, ok := i.loaded[key]; ok || !IsSidecarKey(key) {
+			continue
+		}
+		var fingerprint Fingerprint
+		err := repository.GetJSON(ctx, i.objectStore, key, &fingerprint)
+		if errors.Is(err, repository.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load fingerprint index: %w", err)
+		}
+		i.loaded[key] = fingerprint
+	}
+
+	fingerprints := make([]Fingerprint, 0, len(i.loaded))
+	for _, fingerprint := range i.loaded {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.SliceStable(fingerprints, func(a, b int) bool {
+		return fingerprints[a].UploadedAt.Before(fingerprints[b].UploadedAt)
+	})
+	return fingerprints, nil
+}
+
+// Add stores a fingerprint as its own record, replacing the earlier records of the upload
+func (i *S3FingerprintIndex) Add(ctx context.Context, fingerprint Fingerprint) error {
+	key := i.recordKey(fingerprint)
+	if err := repository.PutJSON(ctx, i.objectStore, key, fingerprint); err != nil {
+		return fmt.Errorf("failed to record fingerprint: %w", err)
+	}
+
+	i.mu.Lock()
+	i.loaded[key] = fingerprint
+	i.mu.Unlock()
+	return i.removeRecords(ctx, fingerprint, key)
+}
+
+// Remove deletes the records of a fingerprint's upload, so it no longer counts as a duplicate
+func (i *S3FingerprintIndex) Remove(ctx context.Context, fingerprint Fingerprint) error {
+	return i.removeRecords(ctx, fingerprint, "")
+}
+
+// removeRecords deletes the records of an upload except keep
+func (i *S3FingerprintIndex) removeRecords(ctx context.Context, fingerprint Fingerprint, keep string) error {
+	keys, err := i.objectStore.List(ctx, i.recordPrefix(fingerprint))
+	if err != nil {
+		return fmt.Errorf("failed to remove fingerprint: %w", err)
+	}
+	for _, key := range keys {
+		if key == keep {
+			continue
+		}
+		if err := i.objectStore.Delete(ctx, key); err != nil && !errors.Is(err, repository.ErrObjectNotFound) {
+			return fmt.Errorf("failed to remove fingerprint: %w", err)
+		}
+		i.mu.Lock()
+		delete(i.loaded, key)
+		i.mu.Unlock()
+	}
+	return nil
+}
+
+// recordKey returns the key of a fingerprint's record
+// The name changes with the recorded receipts, so an edit made by one instance is a new
+// record to the others rather than a change to one they already read
+func (i *S3FingerprintIndex) recordKey(fingerprint Fingerprint) string {
+	receipts, _ := json.Marshal(fingerprint.Receipts)
+	sum := sha256.Sum256(receipts)
+	return i.recordPrefix(fingerprint) + hex.EncodeToString(sum[:4]) + ".json"
+}
+
+// recordPrefix returns the common prefix of an upload's records
+// Records of uploads with a receipt ID keep their name when the upload moves
+func (i *S3FingerprintIndex) recordPrefix(fingerprint Fingerprint) string {
+	if fingerprint.ReceiptID != "" {
+		return i.prefix + fingerprint.ReceiptID + "."
+	}
+	sum := sha256.Sum256([]byte(fingerprint.Key))
+	return i.prefix + hex.EncodeToString(sum[:]) + "."
+}
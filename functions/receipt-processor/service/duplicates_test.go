@@ -0,0 +1,309 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestReceiptKeyMatches(t *testing.T) {
+	base := ReceiptKey{Store: "familymart新宿店", Date: "2024-10-18", Total: 1250}
+
+	tests := []struct {
+		name  string
+		a, b  ReceiptKey
+		match bool
+	}{
+		{"same store, date and total", base, base, true},
+		{"different total", base, ReceiptKey{Store: base.Store, Date: base.Date, Total: 1251}, false},
+		{"different date", base, ReceiptKey{Store: base.Store, Date: "2024-10-19", Total: 1250}, false},
+		{"different store", base, ReceiptKey{Store: "lawson", Date: base.Date, Total: 1250}, false},
+		{
+			"same receipt number despite store spelling",
+			ReceiptKey{Store: "familymart", Date: base.Date, Total: 1250, ReceiptNumber: "0042"},
+			ReceiptKey{Store: "ファミリーマート", Date: base.Date, Total: 1250, ReceiptNumber: "0042"},
+			true,
+		},
+		{
+			"two purchases with different receipt numbers",
+			ReceiptKey{Store: base.Store, Date: base.Date, Total: 1250, ReceiptNumber: "0042"},
+			ReceiptKey{Store: base.Store, Date: base.Date, Total: 1250, ReceiptNumber: "0043"},
+			false,
+		},
+		{
+			"different transaction IDs",
+			ReceiptKey{Store: base.Store, Date: base.Date, Total: 1250, TransactionID: "T1"},
+			ReceiptKey{Store: base.Store, Date: base.Date, Total: 1250, TransactionID: "T2"},
+			false,
+		},
+		{"no store name", ReceiptKey{Date: base.Date, Total: 1250}, ReceiptKey{Date: base.Date, Total: 1250}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.matches(tt.b); got != tt.match {
+				t.Errorf("matches() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestNewReceiptKey(t *testing.T) {
+	key, ok := newReceiptKey(&openai.ReceiptData{
+		StoreName:     "FamilyMart 新宿店",
+		ReceiptDate:   time.Date(2024, 10, 18, 19, 30, 0, 0, time.UTC),
+		TotalAmount:   1250,
+		ReceiptNumber: " 0042 ",
+	})
+	if !ok {
+		t.Fatal("Expected a key for a complete receipt")
+	}
+	want := ReceiptKey{Store: "familymart新宿店", Date: "2024-10-18", Total: 1250, ReceiptNumber: "0042"}
+	if key != want {
+		t.Errorf("newReceiptKey() = %+v, want %+v", key, want)
+	}
+
+	if _, ok := newReceiptKey(&openai.ReceiptData{StoreName: "Store", TotalAmount: 100}); ok {
+		t.Error("Expected no key for a receipt without date")
+	}
+}
+
+// photo encodes a gradient picture with a dark block at offset, as JPEG or PNG
+func photo(t *testing.T, offset int, asPNG bool) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 300, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 300; x++ {
+			v := uint8((x + y) * 255 / 700)
+			if x > offset && x < offset+80 && y > 100 && y < 200 {
+				v = 10
+			}
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	if asPNG {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		t.Fatalf("failed to encode photo: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFindUploadDuplicates(t *testing.T) {
+	original := photo(t, 40, false)
+	known := newFingerprint([][]byte{original})
+	known.Key = "2024-10-18/receipt.jpg"
+
+	tests := []struct {
+		name    string
+		content []byte
+		opts    DuplicateOptions
+		want    string
+	}{
+		{"identical bytes", original, DuplicateOptions{}, DuplicateContent},
+		{"same photo re-encoded", photo(t, 40, true), DuplicateOptions{}, DuplicateImage},
+		{"same photo, image matching disabled", photo(t, 40, true), DuplicateOptions{ImageDistance: -1}, ""},
+		{"different photo", photo(t, 180, false), DuplicateOptions{}, ""},
+		{"not an image", []byte("%PDF-1.4 receipt"), DuplicateOptions{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duplicates := findUploadDuplicates([]Fingerprint{known}, newFingerprint([][]byte{tt.content}), tt.opts)
+			if tt.want == "" {
+				if len(duplicates) != 0 {
+					t.Errorf("Expected no duplicates, got %+v", duplicates)
+				}
+				return
+			}
+			if len(duplicates) != 1 || duplicates[0].Match != tt.want || duplicates[0].Key != known.Key {
+				t.Errorf("Expected one %s match, got %+v", tt.want, duplicates)
+			}
+		})
+	}
+}
+
+func TestFindReceiptDuplicates(t *testing.T) {
+	known := []Fingerprint{
+		{Key: "a.jpg", Receipts: []ReceiptKey{{Store: "cafe", Date: "2024-10-18", Total: 450}}},
+		{Key: "b.jpg", Receipts: []ReceiptKey{{Store: "bakery", Date: "2024-10-18", Total: 1200}, {Store: "cafe", Date: "2024-10-18", Total: 450}}},
+		{Key: "c.jpg", Receipts: []ReceiptKey{{Store: "cafe", Date: "2024-10-19", Total: 450}}},
+	}
+
+	duplicates := findReceiptDuplicates(known, []ReceiptKey{{Store: "cafe", Date: "2024-10-18", Total: 450}})
+	if len(duplicates) != 2 || duplicates[0].Key != "a.jpg" || duplicates[1].Key != "b.jpg" {
+		t.Fatalf("Expected matches in a.jpg and b.jpg, got %+v", duplicates)
+	}
+	if duplicates[0].Match != DuplicateReceipt || duplicates[0].Receipt != "2024-10-18 cafe 450.00" {
+		t.Errorf("Unexpected duplicate report: %+v", duplicates[0])
+	}
+}
+
+func TestMemoryFingerprintIndex(t *testing.T) {
+	ctx := context.Background()
+	index := NewMemoryFingerprintIndex()
+
+	if err := index.Add(ctx, Fingerprint{Key: "a.jpg"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	fingerprints, err := index.Load(ctx)
+	if err != nil || len(fingerprints) != 1 || fingerprints[0].Key != "a.jpg" {
+		t.Errorf("Load() = %+v, %v", fingerprints, err)
+	}
+}
+
+func TestS3FingerprintIndex(t *testing.T) {
+	ctx := context.Background()
+	store := &readRecordingStore{MemoryObjectStore: repository.NewMemoryObjectStore()}
+	uploadedAt := time.Date(2024, 10, 18, 0, 0, 0, 0, time.UTC)
+
+	// Two instances that loaded the same index both keep their fingerprint
+	first, second := NewS3FingerprintIndex(store, ""), NewS3FingerprintIndex(store, "")
+	for _, index := range []*S3FingerprintIndex{first, second} {
+		if _, err := index.Load(ctx); err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+	}
+	if err := first.Add(ctx, Fingerprint{Key: "a.jpg", UploadedAt: uploadedAt.Add(time.Minute)}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := second.Add(ctx, Fingerprint{Key: "b.jpg", UploadedAt: uploadedAt.Add(2 * time.Minute)}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	// Recording an upload again replaces its fingerprint
+	if err := second.Add(ctx, Fingerprint{Key: "b.jpg", UploadedAt: uploadedAt.Add(2 * time.Minute), ImageHash: "ff"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	fingerprints, err := NewS3FingerprintIndex(store, "").Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	var keys []string
+	for _, fingerprint := range fingerprints {
+		keys = append(keys, fingerprint.Key)
+	}
+	if strings.Join(keys, ",") != "a.jpg,b.jpg" || fingerprints[1].ImageHash != "ff" {
+		t.Errorf("Load() = %+v, want the a and b fingerprints oldest first", fingerprints)
+	}
+
+	// Records already read are not read again
+	store.reads = nil
+	if fingerprints, err := first.Load(ctx); err != nil || len(fingerprints) != 2 {
+		t.Fatalf("Load() = %+v, %v", fingerprints, err)
+	}
+	if len(store.reads) != 1 || !strings.HasPrefix(store.reads[0], DefaultFingerprintPrefix) {
+		t.Errorf("Load() read %v, want only the record added by the other instance", store.reads)
+	}
+	// Edits and removals by one instance reach the others
+	c := Fingerprint{Key: "c.jpg", ReceiptID: "0190a8b2", UploadedAt: uploadedAt.Add(3 * time.Minute)}
+	if err := first.Add(ctx, c); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := second.Load(ctx); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	c.Receipts = []ReceiptKey{{Store: "lawson", Date: "2024-10-18", Total: 980}}
+	if err := first.Add(ctx, c); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := first.Remove(ctx, Fingerprint{Key: "a.jpg"}); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	fingerprints, err = second.Load(ctx)
+	if err != nil || len(fingerprints) != 2 || fingerprints[0].Key != "b.jpg" || len(fingerprints[1].Receipts) != 1 {
+		t.Errorf("Load() = %+v, %v, want b and the edited c", fingerprints, err)
+	}
+}
+
+// countingFingerprintIndex counts the loads of an in-memory index
+type countingFingerprintIndex struct {
+	*MemoryFingerprintIndex
+	loads int
+}
+
+func (c *countingFingerprintIndex) Load(ctx context.Context) ([]Fingerprint, error) {
+	c.loads++
+	return c.MemoryFingerprintIndex.Load(ctx)
+}
+
+func TestReceiptServiceLoadsFingerprintsOnce(t *testing.T) {
+	ctx := context.Background()
+	index := &countingFingerprintIndex{MemoryFingerprintIndex: NewMemoryFingerprintIndex()}
+	receiptService := NewReceiptService(repository.NewMemoryObjectStore(), openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	receiptService.SetDuplicateDetection(index, DuplicateOptions{})
+
+	content := photo(t, 0, true)
+	if _, err := receiptService.ProcessReceipt(ctx, "receipt.png", content, "image/png"); err != nil {
+		t.Fatalf("ProcessReceipt() error = %v", err)
+	}
+	if index.loads != 1 {
+		t.Errorf("Load() called %d times for one upload, want 1", index.loads)
+	}
+
+	result, err := receiptService.ProcessReceipt(ctx, "again.png", content, "image/png")
+	if err != nil {
+		t.Fatalf("ProcessReceipt() error = %v", err)
+	}
+	if len(result.Duplicates) != 1 || result.Duplicates[0].Match != DuplicateContent {
+		t.Errorf("Duplicates = %+v, want the first upload", result.Duplicates)
+	}
+}
+
+func TestReceiptServiceRemovesStoredDuplicates(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   []byte
+		opts      ProcessOptions
+		wantMatch string
+		wantKept  bool
+	}{
+		{"identical bytes", photo(t, 40, false), ProcessOptions{}, DuplicateContent, false},
+		{"same photo re-encoded", photo(t, 40, true), ProcessOptions{}, DuplicateImage, false},
+		{"forced re-upload", photo(t, 40, true), ProcessOptions{Force: true}, DuplicateImage, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := repository.NewMemoryObjectStore()
+			receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+			receiptService.SetDuplicateDetection(NewMemoryFingerprintIndex(), DuplicateOptions{})
+			if _, err := receiptService.ProcessReceipt(ctx, "receipt.jpg", photo(t, 40, false), "image/jpeg"); err != nil {
+				t.Fatalf("ProcessReceipt() error = %v", err)
+			}
+			before, _ := store.List(ctx, "")
+
+			uploads := []Upload{{FileName: "again", Content: bytes.NewReader(tt.content)}}
+			result, err := receiptService.ProcessReceiptPieces(ctx, uploads, tt.opts)
+			if err != nil {
+				t.Fatalf("ProcessReceiptPieces() error = %v", err)
+			}
+			// A forced upload is extracted and also matches the earlier receipt
+			if len(result.Duplicates) == 0 || result.Duplicates[0].Match != tt.wantMatch {
+				t.Errorf("Duplicates = %+v, want a %s match first", result.Duplicates, tt.wantMatch)
+			}
+			after, _ := store.List(ctx, "")
+			if kept := result.FileInfo != nil; kept != tt.wantKept {
+				t.Errorf("Upload kept = %v, want %v", kept, tt.wantKept)
+			}
+			if !tt.wantKept && len(after) != len(before) {
+				t.Errorf("Stored objects %v after the duplicate, want %v", after, before)
+			}
+		})
+	}
+}
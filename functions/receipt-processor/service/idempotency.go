@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Idempotency defaults
+const (
+	DefaultIdempotencyTTL      = 24 * time.Hour   // How long a completed response is replayed
+	DefaultIdempotencyInFlight = 15 * time.Minute // Claim lifetime without a deadline; the Lambda timeout limit
+	DefaultIdempotencyPrefix   = "idempotency/"   // S3 prefix of stored records
+	maxIdempotencyKeyLength    = 255
+	claimDeadlineGrace         = 30 * time.Second // Clock skew allowance past a request's deadline
+)
+
+// Idempotency record states
+const (
+	IdempotencyInProgress = "in_progress"
+	IdempotencyCompleted  = "completed"
+)
+
+var (
+	// ErrIdempotencyInFlight is returned while another request with the same key is being processed
+	ErrIdempotencyInFlight = errors.New("a request with this Idempotency-Key is still being processed")
+	// ErrIdempotencyMismatch is returned when a key is reused for a different request
+	ErrIdempotencyMismatch = errors.New("Idempotency-Key was already used for a different request")
+	// ErrInvalidIdempotencyKey is returned for empty or overlong keys
+	ErrInvalidIdempotencyKey = fmt.Errorf("Idempotency-Key must be 1-%d characters", maxIdempotencyKeyLength)
+	// ErrIdempotencyConflict is returned by IdempotencyStore.Put when the record changed since it was read
+	ErrIdempotencyConflict = errors.New("idempotency record changed since it was read")
+)
+
+// IdempotencyRecord is the stored state of an idempotency key
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`
+	State       string    `json:"state"`        // IdempotencyInProgress or IdempotencyCompleted
+	RequestHash string    `json:"request_hash"` // Detects a key reused for another request
+	Owner       string    `json:"owner"`        // Random token of the request holding the key
+	StatusCode  int       `json:"status_code,omitempty"`
+	Body        string    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	version string // Store version the record was read or written at
+}
+
+// IdempotencyStore persists idempotency records
+// Put writes only while the key still holds previous, or no record when previous is nil,
+// and returns ErrIdempotencyConflict otherwise, so two requests cannot both claim a key
+type IdempotencyStore interface {
+	Get(ctx context.Context, key string) (*IdempotencyRecord, error) // nil when absent
+	Put(ctx context.Context, record, previous *IdempotencyRecord) error
+	Delete(ctx context.Context, key string) error
+}
+
+// IdempotencyOptions controls how long keys are held
+type IdempotencyOptions struct {
+	TTL      time.Duration // Replay window for completed responses (default: 24h)
+	InFlight time.Duration // Lifetime of an unfinished claim when the request has no deadline (default: 15m)
+}
+
+// withDefaults fills in zero values
+func (o IdempotencyOptions) withDefaults() IdempotencyOptions {
+	if o.TTL <= 0 {
+		o.TTL = DefaultIdempotencyTTL
+	}
+	if o.InFlight <= 0 {
+		o.InFlight = DefaultIdempotencyInFlight
+	}
+	return o
+}
+
+// Idempotency replays the first response for requests retried with the same key
+type Idempotency struct {
+	store IdempotencyStore
+	opts  IdempotencyOptions
+	now   func() time.Time
+}
+
+// NewIdempotency creates an idempotency guard backed by store
+func NewIdempotency(store IdempotencyStore, opts IdempotencyOptions) *Idempotency {
+	return &Idempotency{
+		store: store,
+		opts:  opts.withDefaults(),
+		now:   time.Now,
+	}
+}
+
+// IdempotencyClaim is held by the request processing a key
+type IdempotencyClaim struct {
+	idempotency *Idempotency
+	record      IdempotencyRecord
+}
+
+// HashRequest fingerprints a request so a reused key can be told apart from a retry
+func HashRequest(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin claims key for a request
+// It returns a claim when the request should be processed, or the stored record
+// when it is a retry of a completed request. A key held by an unfinished request
+// yields ErrIdempotencyInFlight and a key used for other content ErrIdempotencyMismatch.
+//
+// The claim is a conditional write on the record that was read, so of two requests
+// racing for the same key only one proceeds. It lasts until ctx's deadline, the
+// Lambda function timeout, after which the request cannot still be running
+func (i *Idempotency) Begin(ctx context.Context, key string, requestHash string) (*IdempotencyClaim, *IdempotencyRecord, error) {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return nil, nil, ErrInvalidIdempotencyKey
+	}
+
+	now := i.now()
+	existing, err := i.store.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing != nil && now.Before(existing.ExpiresAt) {
+		if existing.RequestHash != requestHash {
+			return nil, nil, ErrIdempotencyMismatch
+		}
+		if existing.State == IdempotencyCompleted {
+			return nil, existing, nil
+		}
+		return nil, nil, ErrIdempotencyInFlight
+	}
+
+	owner, err := randomToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	record := IdempotencyRecord{
+		Key:         key,
+		State:       IdempotencyInProgress,
+		RequestHash: requestHash,
+		Owner:       owner,
+		CreatedAt:   now,
+		ExpiresAt:   claimExpiry(ctx, now, i.opts.InFlight),
+	}
+	// Another request may have claimed the key since we read it
+	err = i.store.Put(ctx, &record, existing)
+	if errors.Is(err, ErrIdempotencyConflict) {
+		return nil, nil, ErrIdempotencyInFlight
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &IdempotencyClaim{idempotency: i, record: record}, nil, nil
+}
+
+// claimExpiry returns when a claim made at now by work running under ctx is presumed dead:
+// past ctx's deadline, or after fallback when ctx has none
+func claimExpiry(ctx context.Context, now time.Time, fallback time.Duration) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline.Add(claimDeadlineGrace)
+	}
+	return now.Add(fallback)
+}
+
+// Complete stores the response to replay for retries
+// It fails with ErrIdempotencyConflict when the claim expired and another request took the key
+func (c *IdempotencyClaim) Complete(ctx context.Context, statusCode int, body string) error {
+	record := c.record
+	record.State = IdempotencyCompleted
+	record.StatusCode = statusCode
+	record.Body = body
+	record.ExpiresAt = c.idempotency.now().Add(c.idempotency.opts.TTL)
+	return c.idempotency.store.Put(ctx, &record, &c.record)
+}
+
+// Release gives up the key so a retry is processed again, e.g. after a server error
+func (c *IdempotencyClaim) Release(ctx context.Context) error {
+	return c.idempotency.store.Delete(ctx, c.record.Key)
+}
+
+// randomToken returns 16 random bytes as hex
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// MemoryIdempotencyStore keeps records in memory, for tests and local runs
+type MemoryIdempotencyStore struct {
+	mu       sync.Mutex
+	records  map[string]IdempotencyRecord
+	versions int
+}
+
+// NewMemoryIdempotencyStore creates an empty in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records: make(map[string]IdempotencyRecord),
+	}
+}
+
+// Get returns the record for key
+func (m *MemoryIdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.records[key]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Put stores a record while the key still holds previous
+func (m *MemoryIdempotencyStore) Put(ctx context.Context, record, previous *IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.records[record.Key]
+	if ok != (previous != nil) || (ok && current.version != previous.version) {
+		return ErrIdempotencyConflict
+	}
+	m.versions++
+	record.version = strconv.Itoa(m.versions)
+	m.records[record.Key] = *record
+	return nil
+}
+
+// Delete removes the record for key
+func (m *MemoryIdempotencyStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	return nil
+}
+
+// S3IdempotencyStore keeps one JSON object per key in the receipts bucket
+// Keys are hashed into object names; expired records are ignored and can be
+// cleaned up with a lifecycle rule on the prefix
+type S3IdempotencyStore struct {
+	objectStore repository.ObjectStore
+	prefix      string
+}
+
+// NewS3IdempotencyStore creates a store under prefix (DefaultIdempotencyPrefix when empty)
+func NewS3IdempotencyStore(objectStore repository.ObjectStore, prefix string) *S3IdempotencyStore {
+	if prefix == "" {
+		prefix = DefaultIdempotencyPrefix
+	}
+	return &S3IdempotencyStore{
+		objectStore: objectStore,
+		prefix:      prefix,
+	}
+}
+
+// objectKey returns the S3 key holding the record for key
+func (s *S3IdempotencyStore) objectKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return s.prefix + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// Get returns the record for key
+func (s *S3IdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	etag, err := repository.GetJSONVersion(ctx, s.objectStore, s.objectKey(key), &record)
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load idempotency record: %w", err)
+	}
+	record.version = etag
+	return &record, nil
+}
+
+// Put stores a record with a conditional write on previous's ETag
+func (s *S3IdempotencyStore) Put(ctx context.Context, record, previous *IdempotencyRecord) error {
+	var etag string
+	if previous != nil {
+		etag = previous.version
+	}
+	version, err := repository.PutJSONIfMatch(ctx, s.objectStore, s.objectKey(record.Key), record, etag)
+	if errors.Is(err, repository.ErrPreconditionFailed) {
+		return ErrIdempotencyConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store idempotency record: %w", err)
+	}
+	record.version = version
+	return nil
+}
+
+// Delete removes the record for key
+func (s *S3IdempotencyStore) Delete(ctx context.Context, key string) error {
+	return s.objectStore.Delete(ctx, s.objectKey(key))
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestIdempotency(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+	idempotency := NewIdempotency(NewMemoryIdempotencyStore(), IdempotencyOptions{TTL: time.Hour, InFlight: time.Minute})
+	idempotency.now = func() time.Time { return now }
+	hash := HashRequest("body", "")
+
+	claim, replay, err := idempotency.Begin(ctx, "key-1", hash)
+	if err != nil || claim == nil || replay != nil {
+		t.Fatalf("Expected the first request to claim the key, got %v, %v, %v", claim, replay, err)
+	}
+
+	// A concurrent retry is turned away while the first request runs
+	if _, _, err := idempotency.Begin(ctx, "key-1", hash); !errors.Is(err, ErrIdempotencyInFlight) {
+		t.Errorf("Expected ErrIdempotencyInFlight, got %v", err)
+	}
+
+	if err := claim.Complete(ctx, 200, `{"success":true}`); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+
+	// Retries get the stored response
+	_, replay, err = idempotency.Begin(ctx, "key-1", hash)
+	if err != nil || replay == nil || replay.StatusCode != 200 || replay.Body != `{"success":true}` {
+		t.Fatalf("Expected stored response to be replayed, got %+v, %v", replay, err)
+	}
+
+	// The same key for a different upload is rejected
+	if _, _, err := idempotency.Begin(ctx, "key-1", HashRequest("other body", "")); !errors.Is(err, ErrIdempotencyMismatch) {
+		t.Errorf("Expected ErrIdempotencyMismatch, got %v", err)
+	}
+
+	// After the replay window the key can be used again
+	now = now.Add(2 * time.Hour)
+	if claim, _, err := idempotency.Begin(ctx, "key-1", hash); err != nil || claim == nil {
+		t.Errorf("Expected an expired key to be claimable, got %v", err)
+	}
+}
+
+func TestIdempotencyReleaseAndStaleClaims(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+	idempotency := NewIdempotency(NewMemoryIdempotencyStore(), IdempotencyOptions{InFlight: time.Minute})
+	idempotency.now = func() time.Time { return now }
+	hash := HashRequest("body")
+
+	claim, _, _ := idempotency.Begin(ctx, "key-1", hash)
+	if err := claim.Release(ctx); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if claim, _, err := idempotency.Begin(ctx, "key-1", hash); err != nil || claim == nil {
+		t.Fatalf("Expected a released key to be claimable, got %v", err)
+	}
+
+	// A request that died without completing stops blocking retries after InFlight
+	now = now.Add(2 * time.Minute)
+	if claim, _, err := idempotency.Begin(ctx, "key-1", hash); err != nil || claim == nil {
+		t.Errorf("Expected a stale claim to be taken over, got %v", err)
+	}
+
+	if _, _, err := idempotency.Begin(ctx, "", hash); !errors.Is(err, ErrInvalidIdempotencyKey) {
+		t.Errorf("Expected ErrInvalidIdempotencyKey, got %v", err)
+	}
+}
+
+// racingStore simulates another request claiming the key between our read and write
+type racingStore struct {
+	*MemoryIdempotencyStore
+}
+
+func (r racingStore) Put(ctx context.Context, record, previous *IdempotencyRecord) error {
+	other := *record
+	other.Owner = "someone-else"
+	if err := r.MemoryIdempotencyStore.Put(ctx, &other, previous); err != nil {
+		return err
+	}
+	return r.MemoryIdempotencyStore.Put(ctx, record, previous)
+}
+
+func TestIdempotencyLostRace(t *testing.T) {
+	idempotency := NewIdempotency(racingStore{NewMemoryIdempotencyStore()}, IdempotencyOptions{})
+	if _, _, err := idempotency.Begin(context.Background(), "key-1", HashRequest("body")); !errors.Is(err, ErrIdempotencyInFlight) {
+		t.Errorf("Expected the losing request to get ErrIdempotencyInFlight, got %v", err)
+	}
+}
+
+func TestIdempotencyStoresConditionalPut(t *testing.T) {
+	for name, store := range map[string]IdempotencyStore{
+		"memory": NewMemoryIdempotencyStore(),
+		"s3":     NewS3IdempotencyStore(repository.NewMemoryObjectStore(), ""),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Both requests read the same stale claim; only the first write wins
+			ctx := context.Background()
+			stale := &IdempotencyRecord{Key: "key-2", State: IdempotencyInProgress, Owner: "dead"}
+			if err := store.Put(ctx, stale, nil); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			read, err := store.Get(ctx, "key-2")
+			if err != nil || read == nil {
+				t.Fatalf("Get() = %v, %v", read, err)
+			}
+			if err := store.Put(ctx, &IdempotencyRecord{Key: "key-2", Owner: "first"}, read); err != nil {
+				t.Fatalf("Put() first claim error = %v", err)
+			}
+			if err := store.Put(ctx, &IdempotencyRecord{Key: "key-2", Owner: "second"}, read); !errors.Is(err, ErrIdempotencyConflict) {
+				t.Errorf("Put() second claim error = %v, want ErrIdempotencyConflict", err)
+			}
+			if err := store.Put(ctx, &IdempotencyRecord{Key: "key-2", Owner: "third"}, nil); !errors.Is(err, ErrIdempotencyConflict) {
+				t.Errorf("Put() create over an existing record error = %v, want ErrIdempotencyConflict", err)
+			}
+			if stored, _ := store.Get(ctx, "key-2"); stored == nil || stored.Owner != "first" {
+				t.Errorf("Get() = %+v, want the first claim", stored)
+			}
+		})
+	}
+}
+
+func TestIdempotencyClaimLastsUntilDeadline(t *testing.T) {
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+	idempotency := NewIdempotency(NewMemoryIdempotencyStore(), IdempotencyOptions{InFlight: time.Minute})
+	idempotency.now = func() time.Time { return now }
+	hash := HashRequest("body")
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(10*time.Minute))
+	defer cancel()
+	claim, _, err := idempotency.Begin(ctx, "key-1", hash)
+	if err != nil || claim == nil {
+		t.Fatalf("Begin() error = %v", err)
+	}
+
+	// A slow request keeps its key past InFlight, until its invocation must have ended
+	now = now.Add(5 * time.Minute)
+	if _, _, err := idempotency.Begin(context.Background(), "key-1", hash); !errors.Is(err, ErrIdempotencyInFlight) {
+		t.Errorf("Expected the key to stay claimed until the deadline, got %v", err)
+	}
+	now = now.Add(6 * time.Minute)
+	taken, _, err := idempotency.Begin(context.Background(), "key-1", hash)
+	if err != nil || taken == nil {
+		t.Fatalf("Expected the key to be claimable after the deadline, got %v", err)
+	}
+
+	// The first request cannot overwrite the new claim
+	if err := claim.Complete(ctx, 200, "{}"); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Errorf("Complete() of a taken claim error = %v, want ErrIdempotencyConflict", err)
+	}
+	if err := taken.Complete(ctx, 200, "{}"); err != nil {
+		t.Errorf("Complete() error = %v", err)
+	}
+}
@@ -0,0 +1,442 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Job defaults
+const (
+	DefaultJobPrefix = "jobs/"          // S3 prefix of stored job records
+	DefaultJobClaim  = 15 * time.Minute // Claim lifetime when the worker has no deadline
+)
+
+// Job states
+const (
+	JobQueued     = "queued"
+	JobProcessing = "processing"
+	JobCompleted  = "completed" // Extracted, or stored with ExtractionError set
+	JobDuplicate  = "duplicate" // Rejected as a duplicate, files deleted
+	JobFailed     = "failed"
+)
+
+var (
+	// ErrJobNotFound is returned for unknown job IDs
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobInProgress is returned by Process while another delivery of the job is running
+	ErrJobInProgress = errors.New("job is being processed by another worker")
+	// ErrJobConflict is returned by JobStore.Put when the job changed since it was read
+	ErrJobConflict = errors.New("job changed since it was read")
+)
+
+// Job is an upload processed asynchronously by the worker
+type Job struct {
+	ID        string                 `json:"id"`
+	Status    string                 `json:"status"`
+	Files     []*repository.FileInfo `json:"files"` // Stored pieces, in order
+	Force     bool                   `json:"force,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+
+	// While processing, until when the worker holds the job
+	ClaimedUntil time.Time `json:"claimed_until,omitempty"`
+	// Set once the outcome is saved and before its rows are appended, so a retry
+	// neither extracts again nor adds rows a previous delivery already added
+	SheetsPending bool `json:"sheets_pending,omitempty"`
+
+	// Outcome, filled in when the job finishes
+	Receipts           []openai.ExtractedReceipt `json:"receipts,omitempty"`
+	ReceiptIDs         []string                  `json:"receipt_ids,omitempty"` // IDs of Receipts
+	ExtractionAttempts int                       `json:"extraction_attempts,omitempty"`
+	Usage              *openai.Usage             `json:"usage,omitempty"`
+	ExtractionError    string                    `json:"extraction_error,omitempty"`
+	Duplicates         []Duplicate               `json:"duplicates,omitempty"`
+	Warnings           []string                  `json:"warnings,omitempty"` // Steps that failed after the receipt was stored
+	Error              string                    `json:"error,omitempty"`    // Why processing failed
+
+	version string // Store version the job was read or written at
+}
+
+// Done reports whether the job reached a final state
+func (j *Job) Done() bool {
+	return j.Status == JobCompleted || j.Status == JobDuplicate
+}
+
+// JobStore persists job records
+// Put writes only while the stored job is still the version job was read or last
+// written at, or absent for a new job, and returns ErrJobConflict otherwise
+type JobStore interface {
+	Get(ctx context.Context, id string) (*Job, error) // ErrJobNotFound when absent
+	Put(ctx context.Context, job *Job) error
+}
+
+// JobQueue hands job IDs to the worker
+type JobQueue interface {
+	Enqueue(ctx context.Context, jobID string) error
+}
+
+// jobMessage is the queue message body
+type jobMessage struct {
+	JobID string `json:"job_id"`
+}
+
+// ParseJobMessage returns the job ID of a queue message body
+func ParseJobMessage(body string) (string, error) {
+	var message jobMessage
+	if err := json.Unmarshal([]byte(body), &message); err != nil {
+		return "", fmt.Errorf("failed to parse job message: %w", err)
+	}
+	if message.JobID == "" {
+		return "", fmt.Errorf("job message without job_id")
+	}
+	return message.JobID, nil
+}
+
+// JobService stores uploads, queues them and processes them in the worker
+type JobService struct {
+	receiptService *ReceiptService
+	sheetsService  *SheetsService
+	store          JobStore
+	queue          JobQueue
+}
+
+// NewJobService creates a job service
+func NewJobService(receiptService *ReceiptService, store JobStore, queue JobQueue) *JobService {
+	return &JobService{
+		receiptService: receiptService,
+		store:          store,
+		queue:          queue,
+	}
+}
+
+// SetSheetsService sets the Google Sheets service the worker adds receipts to (optional)
+func (j *JobService) SetSheetsService(sheetsService *SheetsService) {
+	j.sheetsService = sheetsService
+}
+
+// Submit stores the uploaded pieces and queues them for extraction
+// Uploads rejected as duplicates are not queued; the job is returned with status duplicate
+func (j *JobService) Submit(ctx context.Context, uploads []Upload, opts ProcessOptions) (*Job, error) {
+	result, err := j.receiptService.StoreReceipt(ctx, uploads, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:         id,
+		Status:     JobQueued,
+		Force:      opts.Force,
+		Duplicates: result.Duplicates,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if result.FileInfo == nil {
+		job.Status = JobDuplicate
+		return job, nil
+	}
+	job.Files = append([]*repository.FileInfo{result.FileInfo}, result.AdditionalFiles...)
+
+	if err := j.store.Put(ctx, job); err != nil {
+		j.receiptService.discardFiles(ctx, result)
+		return nil, err
+	}
+	if err := j.queue.Enqueue(ctx, job.ID); err != nil {
+		// Nothing will process the pieces, so they are removed and the job closed
+		j.receiptService.discardFiles(ctx, result)
+		job.Files = nil
+		j.fail(ctx, job, fmt.Errorf("failed to queue job: %w", err))
+		return nil, fmt.Errorf("failed to queue job: %w", err)
+	}
+	log.Printf("Queued job %s for %s", job.ID, result.FileInfo.Key)
+	return job, nil
+}
+
+// Get returns a job by ID
+func (j *JobService) Get(ctx context.Context, id string) (*Job, error) {
+	return j.store.Get(ctx, id)
+}
+
+// Process runs a queued job: extracts its receipts and adds them to the spreadsheet
+// Finished jobs are skipped, since queues may deliver a message more than once, and
+// a job another delivery is still processing yields ErrJobInProgress.
+// An error means the job should be retried
+func (j *JobService) Process(ctx context.Context, id string) error {
+	job, err := j.store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.Done() {
+		log.Printf("Job %s already %s, skipping", job.ID, job.Status)
+		return nil
+	}
+	now := time.Now()
+	if job.Status == JobProcessing && now.Before(job.ClaimedUntil) {
+		return fmt.Errorf("%w: %s until %s", ErrJobInProgress, job.ID, job.ClaimedUntil.Format(time.RFC3339))
+	}
+	if len(job.Files) == 0 {
+		// Retrying cannot help
+		j.fail(ctx, job, fmt.Errorf("job has no stored files"))
+		return nil
+	}
+
+	// The write is conditional, so of two deliveries reading the same job only one proceeds
+	job.Status = JobProcessing
+	job.ClaimedUntil = claimExpiry(ctx, now, DefaultJobClaim)
+	job.UpdatedAt = now
+	if err := j.store.Put(ctx, job); err != nil {
+		if errors.Is(err, ErrJobConflict) {
+			return fmt.Errorf("%w: %s", ErrJobInProgress, job.ID)
+		}
+		return err
+	}
+
+	if job.SheetsPending {
+		// A previous delivery saved the outcome and may have died while adding the rows
+		return j.addToSpreadsheet(ctx, job, true)
+	}
+
+	result := &ProcessResult{
+		FileInfo:        job.Files[0],
+		AdditionalFiles: job.Files[1:],
+		Duplicates:      job.Duplicates,
+	}
+	// Record where the pieces moved at once, so a retry after a timeout finds them
+	err = j.receiptService.analyzeReceipt(ctx, result, ProcessOptions{Force: job.Force}, func(result *ProcessResult) {
+		job.Files = append([]*repository.FileInfo{result.FileInfo}, result.AdditionalFiles...)
+		job.UpdatedAt = time.Now()
+		if err := j.store.Put(ctx, job); err != nil {
+			log.Printf("Warning: Failed to record relocated files of job %s: %v", job.ID, err)
+		}
+	})
+	if err != nil {
+		j.fail(ctx, job, err)
+		return err
+	}
+
+	job.Receipts = result.Receipts
+	job.ReceiptIDs = result.ReceiptIDs()
+	job.ExtractionAttempts = result.ExtractionAttempts
+	job.Usage = result.Usage
+	job.ExtractionError = result.ExtractionError
+	job.Duplicates = result.Duplicates
+	job.Warnings = nil
+	job.Error = ""
+	if result.FileInfo == nil {
+		job.Files = nil
+		return j.complete(ctx, job)
+	}
+
+	// The pieces may have moved to keys built from the receipt
+	job.Files = append([]*repository.FileInfo{result.FileInfo}, result.AdditionalFiles...)
+	if j.sheetsService == nil || len(job.Receipts) == 0 {
+		return j.complete(ctx, job)
+	}
+	job.SheetsPending = true
+	job.UpdatedAt = time.Now()
+	if err := j.store.Put(ctx, job); err != nil {
+		return err
+	}
+	return j.addToSpreadsheet(ctx, job, false)
+}
+
+// addToSpreadsheet adds the job's receipts to the spreadsheet and completes the job
+// A retry adds only the receipts whose IDs are not in the spreadsheet yet
+func (j *JobService) addToSpreadsheet(ctx context.Context, job *Job, retry bool) error {
+	if j.sheetsService != nil {
+		result := &ProcessResult{FileInfo: job.Files[0], AdditionalFiles: job.Files[1:], Receipts: job.Receipts}
+		add := j.sheetsService.AddProcessedReceipts
+		if retry {
+			add = j.sheetsService.AddMissingReceipts
+		}
+		if err := add(ctx, result, ""); err != nil {
+			log.Printf("Warning: Failed to add job %s (receipts %s) to spreadsheet: %v", job.ID, strings.Join(job.ReceiptIDs, ", "), err)
+			job.Warnings = append(job.Warnings, fmt.Sprintf("Failed to add the receipts to the spreadsheet: %v", err))
+		}
+	}
+	job.SheetsPending = false
+	return j.complete(ctx, job)
+}
+
+// complete records the job's final state; a job whose files were dropped was a duplicate
+func (j *JobService) complete(ctx context.Context, job *Job) error {
+	job.Status = JobCompleted
+	if len(job.Files) == 0 {
+		job.Status = JobDuplicate
+	}
+	job.ClaimedUntil = time.Time{}
+	job.UpdatedAt = time.Now()
+	if err := j.store.Put(ctx, job); err != nil {
+		return err
+	}
+	log.Printf("Job %s %s with %d receipt(s)", job.ID, job.Status, len(job.Receipts))
+	return nil
+}
+
+// fail records a processing error on the job
+func (j *JobService) fail(ctx context.Context, job *Job, cause error) {
+	job.Status = JobFailed
+	job.Error = cause.Error()
+	job.ClaimedUntil = time.Time{}
+	job.UpdatedAt = time.Now()
+	if err := j.store.Put(ctx, job); err != nil {
+		log.Printf("Warning: Failed to record failure of job %s: %v", job.ID, err)
+	}
+}
+
+// MemoryJobStore keeps jobs in memory, for tests and local runs
+type MemoryJobStore struct {
+	mu       sync.Mutex
+	jobs     map[string]Job
+	versions int
+}
+
+// NewMemoryJobStore creates an empty in-memory job store
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		jobs: make(map[string]Job),
+	}
+}
+
+// Get returns a copy of the job
+func (m *MemoryJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+// Put stores a copy of the job while the stored one is still the version job was read at
+func (m *MemoryJobStore) Put(ctx context.Context, job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.jobs[job.ID]
+	if ok != (job.version != "") || (ok && current.version != job.version) {
+		return fmt.Errorf("%w: %s", ErrJobConflict, job.ID)
+	}
+	m.versions++
+	job.version = strconv.Itoa(m.versions)
+	m.jobs[job.ID] = *job
+	return nil
+}
+
+// S3JobStore keeps one JSON object per job in the receipts bucket
+type S3JobStore struct {
+	objectStore repository.ObjectStore
+	prefix      string
+}
+
+// NewS3JobStore creates a job store under prefix (DefaultJobPrefix when empty)
+func NewS3JobStore(objectStore repository.ObjectStore, prefix string) *S3JobStore {
+	if prefix == "" {
+		prefix = DefaultJobPrefix
+	}
+	return &S3JobStore{
+		objectStore: objectStore,
+		prefix:      prefix,
+	}
+}
+
+// Get loads a job
+func (s *S3JobStore) Get(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	etag, err := repository.GetJSONVersion(ctx, s.objectStore, s.prefix+id+".json", &job)
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load job: %w", err)
+	}
+	job.version = etag
+	return &job, nil
+}
+
+// Put stores a job with a conditional write on the ETag it was read at
+func (s *S3JobStore) Put(ctx context.Context, job *Job) error {
+	etag, err := repository.PutJSONIfMatch(ctx, s.objectStore, s.prefix+job.ID+".json", job, job.version)
+	if errors.Is(err, repository.ErrPreconditionFailed) {
+		return fmt.Errorf("%w: %s", ErrJobConflict, job.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store job: %w", err)
+	}
+	job.version = etag
+	return nil
+}
+
+// MemoryJobQueue buffers job IDs in a channel, for tests and local runs
+type MemoryJobQueue struct {
+	jobs chan string
+}
+
+// NewMemoryJobQueue creates a queue holding up to size pending jobs
+func NewMemoryJobQueue(size int) *MemoryJobQueue {
+	return &MemoryJobQueue{
+		jobs: make(chan string, size),
+	}
+}
+
+// Enqueue adds a job ID, failing when the buffer is full
+func (m *MemoryJobQueue) Enqueue(ctx context.Context, jobID string) error {
+	select {
+	case m.jobs <- jobID:
+		return nil
+	default:
+		return fmt.Errorf("job queue full")
+	}
+}
+
+// Jobs returns the channel the worker reads job IDs from
+func (m *MemoryJobQueue) Jobs() <-chan string {
+	return m.jobs
+}
+
+// SQSJobQueue sends job IDs to an SQS queue that triggers the worker Lambda
+type SQSJobQueue struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+// NewSQSJobQueue creates a queue sending to queueURL
+func NewSQSJobQueue(client *sqs.Client, queueURL string) *SQSJobQueue {
+	return &SQSJobQueue{
+		client:   client,
+		queueURL: queueURL,
+	}
+}
+
+// Enqueue sends a job message
+func (q *SQSJobQueue) Enqueue(ctx context.Context, jobID string) error {
+	body, err := json.Marshal(jobMessage{JobID: jobID})
+	if err != nil {
+		return err
+	}
+	_, err = q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send SQS message: %w", err)
+	}
+	return nil
+}
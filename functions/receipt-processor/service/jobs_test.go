@@ -0,0 +1,322 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestParseJobMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"valid", `{"job_id":"abc123"}`, "abc123", false},
+		{"missing job_id", `{}`, "", true},
+		{"not JSON", `abc123`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseJobMessage(tt.body)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseJobMessage() = %q, %v, want %q (error: %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryJobStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryJobStore()
+
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+
+	job := &Job{ID: "job-1", Status: JobQueued}
+	if err := store.Put(ctx, job); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	job.Status = JobFailed // Stored jobs are copies
+
+	got, err := store.Get(ctx, "job-1")
+	if err != nil || got.Status != JobQueued {
+		t.Errorf("Get() = %+v, %v", got, err)
+	}
+}
+
+func TestMemoryJobQueue(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryJobQueue(1)
+
+	if err := queue.Enqueue(ctx, "job-1"); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if err := queue.Enqueue(ctx, "job-2"); err == nil {
+		t.Error("Expected an error when the queue is full")
+	}
+	if got := <-queue.Jobs(); got != "job-1" {
+		t.Errorf("Jobs() delivered %q, want job-1", got)
+	}
+}
+
+func TestJobServiceProcess(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryJobStore()
+	jobs := NewJobService(NewReceiptService(nil, nil), store, NewMemoryJobQueue(1))
+
+	// Redelivered messages for finished jobs are acknowledged without reprocessing
+	store.Put(ctx, &Job{ID: "done", Status: JobCompleted})
+	if err := jobs.Process(ctx, "done"); err != nil {
+		t.Errorf("Process() of a completed job error = %v", err)
+	}
+
+	if err := jobs.Process(ctx, "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+
+	store.Put(ctx, &Job{ID: "empty", Status: JobQueued})
+	if err := jobs.Process(ctx, "empty"); err != nil {
+		t.Errorf("Process() of a job without files error = %v", err)
+	}
+	if job, _ := jobs.Get(ctx, "empty"); job.Status != JobFailed || job.Error == "" {
+		t.Errorf("Expected the job to be marked failed, got %+v", job)
+	}
+}
+
+func TestJobServiceProcessSheetsFailure(t *testing.T) {
+	ctx := context.Background()
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	receiptService := NewReceiptService(repository.NewMemoryObjectStore(), openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	jobs := NewJobService(receiptService, NewMemoryJobStore(), NewMemoryJobQueue(1))
+	sheetsService, fake := newFakeSheetsService(t)
+	fake.denied = true
+	jobs.SetSheetsService(sheetsService)
+
+	job, err := jobs.Submit(ctx, []Upload{{FileName: "receipt.png", Content: bytes.NewReader(photo.Bytes()), ContentType: "image/png"}}, ProcessOptions{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if err := jobs.Process(ctx, job.ID); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	// The receipt is stored and processed; only the ledger row is missing
+	job, _ = jobs.Get(ctx, job.ID)
+	if job.Status != JobCompleted || len(job.ReceiptIDs) != 1 {
+		t.Errorf("Job = %+v, want completed with one receipt", job)
+	}
+	if len(job.Warnings) != 1 || !strings.Contains(job.Warnings[0], "spreadsheet") {
+		t.Errorf("Warnings = %v, want the spreadsheet failure", job.Warnings)
+	}
+}
+
+// snapshotJobStore keeps a copy of every job written, in order
+type snapshotJobStore struct {
+	*MemoryJobStore
+	puts []Job
+}
+
+func (s *snapshotJobStore) Put(ctx context.Context, job *Job) error {
+	snapshot := *job
+	snapshot.Files = append([]*repository.FileInfo(nil), job.Files...)
+	s.puts = append(s.puts, snapshot)
+	return s.MemoryJobStore.Put(ctx, job)
+}
+
+func TestJobServiceProcessRetryAfterRelocation(t *testing.T) {
+	ctx := context.Background()
+	layout, err := repository.NewKeyLayout("{receipt_year}/{receipt_month}/{rand}{ext}", "")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+	objects := repository.NewMemoryObjectStore()
+	objects.SetKeyLayout(layout)
+	receiptService := NewReceiptService(objects, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	receiptService.SetDuplicateDetection(NewMemoryFingerprintIndex(), DuplicateOptions{})
+	store := &snapshotJobStore{MemoryJobStore: NewMemoryJobStore()}
+	jobs := NewJobService(receiptService, store, NewMemoryJobQueue(1))
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	job, err := jobs.Submit(ctx, []Upload{{FileName: "receipt.png", Content: bytes.NewReader(photo.Bytes()), ContentType: "image/png"}}, ProcessOptions{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if err := jobs.Process(ctx, job.ID); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	// The moved keys are recorded while the job is still processing
+	var relocated *Job
+	for i := range store.puts {
+		if put := store.puts[i]; put.Status == JobProcessing && len(put.Files) == 1 && strings.HasPrefix(put.Files[0].Key, "2024/01/") {
+			relocated = &put
+		}
+	}
+	if relocated == nil {
+		t.Fatalf("Puts = %+v, want the relocated files saved before the job finished", store.puts)
+	}
+
+	// A retry of the worker that timed out right after the move finds the pieces
+	// and does not take its own fingerprint for a duplicate
+	current, _ := store.Get(ctx, job.ID)
+	relocated.version = current.version
+	relocated.ClaimedUntil = time.Now().Add(-time.Minute)
+	if err := store.MemoryJobStore.Put(ctx, relocated); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := jobs.Process(ctx, job.ID); err != nil {
+		t.Fatalf("Process() retry error = %v", err)
+	}
+	if job, _ := jobs.Get(ctx, job.ID); job.Status != JobCompleted || len(job.ReceiptIDs) != 1 {
+		t.Errorf("Job = %+v, want completed with one receipt", job)
+	}
+}
+
+// racingJobStore simulates another delivery claiming the job between our read and write
+type racingJobStore struct {
+	*MemoryJobStore
+}
+
+func (r racingJobStore) Put(ctx context.Context, job *Job) error {
+	if job.Status == JobProcessing {
+		other := *job
+		if err := r.MemoryJobStore.Put(ctx, &other); err != nil {
+			return err
+		}
+	}
+	return r.MemoryJobStore.Put(ctx, job)
+}
+
+func TestJobServiceProcessConcurrentDelivery(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryJobStore()
+	jobs := NewJobService(NewReceiptService(repository.NewMemoryObjectStore(), nil), store, NewMemoryJobQueue(1))
+	files := []*repository.FileInfo{{Key: "inbox/receipt.png"}}
+
+	// A delivery arriving while another one holds the job leaves it alone
+	store.Put(ctx, &Job{ID: "running", Status: JobProcessing, Files: files, ClaimedUntil: time.Now().Add(time.Minute)})
+	if err := jobs.Process(ctx, "running"); !errors.Is(err, ErrJobInProgress) {
+		t.Errorf("Process() of a claimed job error = %v, want ErrJobInProgress", err)
+	}
+	if job, _ := jobs.Get(ctx, "running"); job.Status != JobProcessing || job.Error != "" {
+		t.Errorf("Job = %+v, want it untouched", job)
+	}
+
+	// Of two deliveries reading the same queued job, the one writing second backs off
+	racing := NewJobService(NewReceiptService(repository.NewMemoryObjectStore(), nil), racingJobStore{store}, NewMemoryJobQueue(1))
+	store.Put(ctx, &Job{ID: "queued", Status: JobQueued, Files: files})
+	if err := racing.Process(ctx, "queued"); !errors.Is(err, ErrJobInProgress) {
+		t.Errorf("Process() losing the claim error = %v, want ErrJobInProgress", err)
+	}
+}
+
+func TestJobServiceProcessSheetsRetry(t *testing.T) {
+	ctx := context.Background()
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	receiptService := NewReceiptService(repository.NewMemoryObjectStore(), openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	store := &snapshotJobStore{MemoryJobStore: NewMemoryJobStore()}
+	jobs := NewJobService(receiptService, store, NewMemoryJobQueue(1))
+	sheetsService, fake := newFakeSheetsService(t)
+	jobs.SetSheetsService(sheetsService)
+
+	job, err := jobs.Submit(ctx, []Upload{{FileName: "receipt.png", Content: bytes.NewReader(photo.Bytes()), ContentType: "image/png"}}, ProcessOptions{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if err := jobs.Process(ctx, job.ID); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	// The outcome is saved before the rows are appended
+	var pending *Job
+	for i := range store.puts {
+		if put := store.puts[i]; put.SheetsPending && put.Status == JobProcessing && len(put.ReceiptIDs) == 1 {
+			pending = &put
+		}
+	}
+	if pending == nil {
+		t.Fatalf("Puts = %+v, want the outcome saved with the sheets marker", store.puts)
+	}
+
+	tests := []struct {
+		name     string
+		appended bool // Whether the interrupted delivery added the row
+	}{
+		{"died after appending", true},
+		{"died before appending", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.mu.Lock()
+			fake.rows = fake.rows[:1]
+			fake.mu.Unlock()
+			if tt.appended {
+				if err := sheetsService.AddProcessedReceipts(ctx, &ProcessResult{FileInfo: pending.Files[0], Receipts: pending.Receipts}, ""); err != nil {
+					t.Fatalf("AddProcessedReceipts() error = %v", err)
+				}
+			}
+
+			// The retry after the worker timed out adds the row once, without extracting again
+			current, _ := store.Get(ctx, job.ID)
+			retried := *pending
+			retried.version = current.version
+			retried.ClaimedUntil = time.Now().Add(-time.Minute)
+			if err := store.MemoryJobStore.Put(ctx, &retried); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			puts := len(store.puts)
+			if err := jobs.Process(ctx, job.ID); err != nil {
+				t.Fatalf("Process() retry error = %v", err)
+			}
+			if ids := fake.column(receiptIDColumn); len(ids) != 1 || ids[0] != pending.ReceiptIDs[0] {
+				t.Errorf("영수증ID column = %v, want one row for %s", ids, pending.ReceiptIDs[0])
+			}
+			for _, put := range store.puts[puts:] {
+				if put.Status == JobProcessing && !put.SheetsPending {
+					t.Errorf("Retry wrote %+v, want no re-extraction", put)
+				}
+			}
+			if job, _ := jobs.Get(ctx, job.ID); job.Status != JobCompleted || job.SheetsPending {
+				t.Errorf("Job = %+v, want completed", job)
+			}
+		})
+	}
+}
+
+func TestJobServiceSubmitQueueFailure(t *testing.T) {
+	ctx := context.Background()
+	objects := repository.NewMemoryObjectStore()
+	store := &snapshotJobStore{MemoryJobStore: NewMemoryJobStore()}
+	jobs := NewJobService(NewReceiptService(objects, nil), store, NewMemoryJobQueue(0))
+
+	if _, err := jobs.Submit(ctx, []Upload{{FileName: "receipt.png", Content: strings.NewReader("receipt"), ContentType: "image/png"}}, ProcessOptions{}); err == nil {
+		t.Fatal("Submit() error = nil, want the queue failure")
+	}
+	if keys, _ := objects.List(ctx, ""); len(keys) != 0 {
+		t.Errorf("List() = %v, want the stored pieces removed", keys)
+	}
+	if last := store.puts[len(store.puts)-1]; last.Status != JobFailed || len(last.Files) != 0 {
+		t.Errorf("Job = %+v, want it marked failed without files", last)
+	}
+}
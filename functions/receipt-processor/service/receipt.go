@@ -1,89 +1,630 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"strings"
+	"time"
 
+	"vibe-coding-project-lambda/shared/imaging"
 	"vibe-coding-project-lambda/shared/openai"
 	"vibe-coding-project-lambda/shared/repository"
 )
 
+// ErrUnconvertibleUpload is returned for uploads the extractor could not read, such as
+// HEIC photos when no HEIC converter is configured. Nothing is stored for them
+var ErrUnconvertibleUpload = errors.New("upload format cannot be converted for extraction")
+
+// ErrEmptyUpload is returned for uploads with an empty piece. Nothing is stored for them
+var ErrEmptyUpload = errors.New("file content is empty")
+
 // ReceiptService handles receipt processing business logic
 type ReceiptService struct {
-	s3Repo        *repository.S3Repository
-	openaiService *openai.Service
+	objectStore repository.ObjectStore
+	extractor   openai.ReceiptExtractor
+	usage       *openai.UsageTracker
+	imageOpts   *imaging.Options // nil sends images to the extractor unchanged
+	converter   *imaging.Converter
+
+	splitReceipts bool // Ask the extractor for every receipt in a single photo
+
+	fingerprints  FingerprintIndex // nil disables duplicate detection
+	duplicateOpts DuplicateOptions
+
+	imageURLExpiry time.Duration // Lifetime of presigned image URLs
 }
 
 // NewReceiptService creates a new receipt service
-func NewReceiptService(s3Repo *repository.S3Repository, openaiService *openai.Service) *ReceiptService {
+// extractor may be nil, in which case receipts are only uploaded
+func NewReceiptService(objectStore repository.ObjectStore, extractor openai.ReceiptExtractor) *ReceiptService {
 	return &ReceiptService{
-		s3Repo:        s3Repo,
-		openaiService: openaiService,
+		objectStore:    objectStore,
+		extractor:      extractor,
+		converter:      &imaging.Converter{},
+		imageURLExpiry: DefaultImageURLExpiry,
 	}
 }
 
+// SetConverter sets the converter for HEIC, TIFF and PDF uploads (optional)
+func (s *ReceiptService) SetConverter(converter *imaging.Converter) {
+	s.converter = converter
+}
+
+// SetSplitReceipts enables splitting photos that show several receipts (optional)
+// Uploads made of several pieces are always merged into one receipt
+func (s *ReceiptService) SetSplitReceipts(enabled bool) {
+	s.splitReceipts = enabled
+}
+
+// SetDuplicateDetection enables rejecting uploads already recorded in index (optional)
+func (s *ReceiptService) SetDuplicateDetection(index FingerprintIndex, opts DuplicateOptions) {
+	s.fingerprints = index
+	s.duplicateOpts = opts
+}
+
+// SetUsageTracker enables logging the usage of each extraction with the month it is booked to (optional)
+// The same tracker should be passed to the extractor through openai.ServiceConfig
+func (s *ReceiptService) SetUsageTracker(tracker *openai.UsageTracker) {
+	s.usage = tracker
+}
+
+// SetImagePreprocessing enables resizing and cleanup of images before extraction (optional)
+// The original upload is always stored in S3 unchanged
+func (s *ReceiptService) SetImagePreprocessing(opts imaging.Options) {
+	s.imageOpts = &opts
+}
+
+// SetImageURLExpiry sets how long presigned image URLs stay valid (optional)
+func (s *ReceiptService) SetImageURLExpiry(expiry time.Duration) {
+	if expiry > 0 {
+		s.imageURLExpiry = expiry
+	}
+}
+
+// Upload is one uploaded file
+// Content is read once, while the file is stored; extraction reads the stored object
+type Upload struct {
+	FileName    string
+	Content     io.Reader
+	ContentType string
+}
+
 // ProcessResult contains the result of receipt processing
 type ProcessResult struct {
-	FileInfo    *repository.FileInfo
-	ReceiptData *openai.ReceiptData
+	FileInfo           *repository.FileInfo
+	AdditionalFiles    []*repository.FileInfo // Further pieces of the same receipt, in upload order
+	ExtractionAttempts int                    // API attempts used for extraction, including retries
+
+	// Receipts found in the upload with their arithmetic checks (empty when not extracted)
+	// A photo of several receipts yields one entry per receipt
+	Receipts []openai.ExtractedReceipt
+
+	// Tokens and estimated cost of the extraction, including failed attempts
+	Usage *openai.Usage
+
+	// Model, request ID and repair rounds of the extraction
+	Extraction *ExtractionMetadata
+
+	// Why a receipt document was stored without extracted data
+	ExtractionError string
+
+	// Earlier uploads this one duplicates. When set without ProcessOptions.Force,
+	// nothing was kept: the files are not stored and must not be added to the ledger
+	Duplicates []Duplicate
+
+	// Fingerprints read by the duplicate check, reused when the upload is recorded
+	knownFingerprints  []Fingerprint
+	fingerprintsLoaded bool
+}
+
+// UserMetadata is the object metadata key holding the uploader of a file, which key
+// templates use as {user}
+const UserMetadata = "user"
+
+// ProcessOptions controls how an upload is processed
+type ProcessOptions struct {
+	Force     bool   // Record the upload even if it duplicates an earlier one
+	KeepFiles bool   // Never delete rejected duplicates, for objects the service did not upload
+	User      string // Uploader stored as UserMetadata on every piece; optional
 }
 
 // ProcessReceipt processes a receipt: uploads to S3 and extracts data with OpenAI
 func (s *ReceiptService) ProcessReceipt(ctx context.Context, fileName string, fileContent []byte, contentType string) (*ProcessResult, error) {
-	// Upload to S3 first (always succeeds or fails hard)
-	fileInfo, err := s.s3Repo.Upload(ctx, fileName, fileContent, contentType)
-	if err != nil {
+	return s.ProcessReceiptPieces(ctx, []Upload{{FileName: fileName, Content: bytes.NewReader(fileContent), ContentType: contentType}}, ProcessOptions{})
+}
+
+// ProcessReceiptPieces processes a receipt photographed in several pieces, in order
+// Every piece is stored in S3 and all pages are sent to the extractor together,
+// which merges them into a single receipt
+func (s *ReceiptService) ProcessReceiptPieces(ctx context.Context, uploads []Upload, opts ProcessOptions) (*ProcessResult, error) {
+	result, err := s.StoreReceipt(ctx, uploads, opts)
+	if err != nil || result.FileInfo == nil {
+		return result, err
+	}
+	if err := s.AnalyzeReceipt(ctx, result, opts); err != nil {
+		// The pieces are stored; the sidecar records why they were not extracted
+		log.Printf("Warning: Stored receipt not extracted: %v", err)
+		result.ExtractionError = err.Error()
+		s.writeSidecar(ctx, result)
+	}
+	return result, nil
+}
+
+// StoreReceipt streams the uploaded pieces to S3 without extracting them
+// Only the start of each piece is read ahead, to refuse empty pieces and formats the
+// extractor cannot read before anything is stored. Byte-identical re-uploads are
+// recognized from the hashes taken while storing and removed again: a rejected
+// duplicate is returned with Duplicates set and no FileInfo
+func (s *ReceiptService) StoreReceipt(ctx context.Context, uploads []Upload, opts ProcessOptions) (*ProcessResult, error) {
+	if len(uploads) == 0 {
+		return nil, fmt.Errorf("no files to process")
+	}
+
+	pieces := make([]*bufio.Reader, len(uploads))
+	formats := make([]imaging.Format, len(uploads))
+	for i, upload := range uploads {
+		pieces[i] = bufio.NewReaderSize(upload.Content, imaging.SniffLength)
+		head, err := pieces[i].Peek(imaging.SniffLength)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read %s: %w", upload.FileName, err)
+		}
+		if len(head) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrEmptyUpload, upload.FileName)
+		}
+		formats[i] = imaging.DetectFormat(head)
+	}
+	if err := s.checkConvertible(uploads, formats); err != nil {
 		return nil, err
 	}
 
-	result := &ProcessResult{
-		FileInfo: fileInfo,
+	// Every piece carries the upload's receipt ID, tying the objects to the ledger rows
+	metadata := map[string]string{ReceiptIDMetadata: NewReceiptID()}
+	if opts.User != "" {
+		metadata[UserMetadata] = opts.User
 	}
 
-	// Process with OpenAI if it's an image and service is available
-	if s.openaiService != nil && isImageFile(contentType) {
-		log.Printf("Processing receipt image with OpenAI")
+	result := &ProcessResult{}
+	var fingerprint Fingerprint
+	for i, upload := range uploads {
+		// Clients often send HEIC and PDF files as application/octet-stream
+		contentType := upload.ContentType
+		if (contentType == "" || contentType == "application/octet-stream") && formats[i] != imaging.FormatUnknown {
+			contentType = formats[i].ContentType()
+		}
 
-		// Validate image first
-		if err := openai.ValidateImageForOpenAI(fileContent); err != nil {
-			log.Printf("Warning: Image validation failed: %v", err)
-			log.Printf("Image info: Format=%s, %s",
-				openai.GetImageFormatInfo(fileContent),
-				openai.GetImageSizeInfo(fileContent))
-		} else {
-			log.Printf("Image validation passed: Format=%s, %s",
-				openai.GetImageFormatInfo(fileContent),
-				openai.GetImageSizeInfo(fileContent))
-
-			// Process with OpenAI
-			base64Image := openai.EncodeImageToBase64(fileContent)
-			receiptData, err := s.openaiService.ProcessReceiptFromBase64(ctx, base64Image)
-			if err != nil {
-				log.Printf("Warning: Failed to process receipt with OpenAI: %v", err)
-			} else {
-				log.Printf("Successfully processed receipt: %s", receiptData.Summary())
-				result.ReceiptData = receiptData
+		hash := sha256.New()
+		fileInfo, err := s.objectStore.UploadStream(ctx, upload.FileName, io.TeeReader(pieces[i], hash), contentType, metadata)
+		if err != nil {
+			if result.FileInfo != nil {
+				s.discardFiles(ctx, result)
 			}
+			return nil, err
+		}
+		fingerprint.ContentHashes = append(fingerprint.ContentHashes, hex.EncodeToString(hash.Sum(nil)))
+		if i == 0 {
+			result.FileInfo = fileInfo
+		} else {
+			result.AdditionalFiles = append(result.AdditionalFiles, fileInfo)
 		}
 	}
 
+	if duplicates := s.findUploadDuplicates(ctx, result, fingerprint); len(duplicates) > 0 {
+		log.Printf("Upload duplicates %d earlier upload(s), first: %s (%s match)", len(duplicates), duplicates[0].Key, duplicates[0].Match)
+		result.Duplicates = duplicates
+		if !opts.Force {
+			s.discardFiles(ctx, result)
+			return result, nil
+		}
+	}
+	s.assignReceiptID(ctx, result.FileInfo)
 	return result, nil
 }
 
-// isImageFile checks if the content type is an image
-func isImageFile(contentType string) bool {
-	imageTypes := []string{
-		"image/jpeg",
-		"image/jpg",
-		"image/png",
-		"image/gif",
-		"image/webp",
-		"image/bmp",
+// checkConvertible refuses uploads the converter would fail on, unless there is no
+// extractor and the receipts are only stored
+func (s *ReceiptService) checkConvertible(uploads []Upload, formats []imaging.Format) error {
+	if s.extractor == nil {
+		return nil
 	}
-	for _, imgType := range imageTypes {
-		if contentType == imgType {
-			return true
+	for i, format := range formats {
+		if err := s.converter.CheckFormat(format); err != nil {
+			return fmt.Errorf("%w: %s (%s): %v", ErrUnconvertibleUpload, uploads[i].FileName, format, err)
 		}
 	}
-	return false
+	return nil
+}
+
+// AnalyzeReceipt reads the stored pieces of result back and extracts their receipts into
+// it, moves the pieces to the keys the store's layout builds from the receipt, records
+// the upload's fingerprint, labels the pieces with the receipt's fields and writes the
+// result next to the first piece as a sidecar
+// Re-sent photos are recognized before the extraction and, unless forced, removed again
+// An error means the stored pieces could not be read and nothing was done
+func (s *ReceiptService) AnalyzeReceipt(ctx context.Context, result *ProcessResult, opts ProcessOptions) error {
+	return s.analyzeReceipt(ctx, result, opts, nil)
+}
+
+// analyzeReceipt is AnalyzeReceipt, calling relocated once the pieces were moved so
+// callers can record the new keys before anything else can fail
+func (s *ReceiptService) analyzeReceipt(ctx context.Context, result *ProcessResult, opts ProcessOptions, relocated func(*ProcessResult)) error {
+	pieces, err := s.loadPieces(ctx, result)
+	if err != nil {
+		return err
+	}
+	fingerprint := newFingerprint(pieces)
+	if s.fingerprints != nil && s.rejectDuplicate(ctx, result, fingerprint, opts) {
+		return nil
+	}
+
+	if s.extractor != nil {
+		s.extractUploads(ctx, result, pieces)
+	}
+
+	// Objects the service did not upload stay where their uploader put them
+	if !opts.KeepFiles && result.ExtractionError == "" && len(result.Receipts) > 0 {
+		s.relocateFiles(ctx, result)
+		if relocated != nil {
+			relocated(result)
+		}
+	}
+
+	if s.fingerprints != nil && result.ExtractionError == "" {
+		s.recordFingerprint(ctx, result, fingerprint, opts)
+	}
+
+	// Discarded duplicates have nothing to label or write next to
+	if result.FileInfo != nil {
+		if result.ExtractionError == "" {
+			s.labelFiles(ctx, result, opts)
+		}
+		s.writeSidecar(ctx, result)
+	}
+	return nil
+}
+
+// loadPieces downloads the stored pieces of an upload, in order
+func (s *ReceiptService) loadPieces(ctx context.Context, result *ProcessResult) ([][]byte, error) {
+	var pieces [][]byte
+	for _, fileInfo := range append([]*repository.FileInfo{result.FileInfo}, result.AdditionalFiles...) {
+		content, err := s.objectStore.Get(ctx, fileInfo.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stored piece %s: %w", fileInfo.Key, err)
+		}
+		pieces = append(pieces, content)
+	}
+	return pieces, nil
+}
+
+// rejectDuplicate reports duplicates of the stored pieces found since they were stored,
+// such as the same photo re-encoded, and unless forced drops the upload: files the
+// service uploaded are deleted, others only get a sidecar recording the duplicates
+func (s *ReceiptService) rejectDuplicate(ctx context.Context, result *ProcessResult, fingerprint Fingerprint, opts ProcessOptions) bool {
+	var found []Duplicate
+	for _, duplicate := range s.findUploadDuplicates(ctx, result, fingerprint) {
+		if !hasDuplicate(result.Duplicates, duplicate) {
+			found = append(found, duplicate)
+		}
+	}
+	if len(found) == 0 {
+		return false
+	}
+
+	log.Printf("%s duplicates %d earlier upload(s), first: %s (%s match)", result.FileInfo.Key, len(found), found[0].Key, found[0].Match)
+	result.Duplicates = append(result.Duplicates, found...)
+	if opts.Force {
+		return false
+	}
+	if opts.KeepFiles {
+		s.writeSidecar(ctx, result)
+	} else {
+		s.discardFiles(ctx, result)
+	}
+	return true
+}
+
+// ProcessStoredObject extracts the receipts of an object put into the bucket by other
+// means, such as a scanner sync. Duplicates are reported in the result, but the object
+// itself is left in place
+func (s *ReceiptService) ProcessStoredObject(ctx context.Context, key string, opts ProcessOptions) (*ProcessResult, error) {
+	fileInfo, err := s.objectStore.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The object was not uploaded by the service, so unless its uploader set one,
+	// the receipt ID lives only in the sidecar and the index
+	s.assignReceiptID(ctx, fileInfo)
+
+	result := &ProcessResult{FileInfo: fileInfo}
+	opts.KeepFiles = true
+	if err := s.AnalyzeReceipt(ctx, result, opts); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// writeSidecar stores the result next to the receipt; the receipt itself is already safe,
+// so a failure is only logged
+func (s *ReceiptService) writeSidecar(ctx context.Context, result *ProcessResult) {
+	if err := s.WriteSidecar(ctx, result); err != nil {
+		log.Printf("Warning: Failed to write sidecar for %s: %v", result.FileInfo.Key, err)
+	}
+}
+
+// findUploadDuplicates compares an upload's bytes and photo with the recorded fingerprints
+// of other uploads. The loaded fingerprints are kept in result for later checks and
+// recordFingerprint, so the index is read once per upload
+func (s *ReceiptService) findUploadDuplicates(ctx context.Context, result *ProcessResult, fingerprint Fingerprint) []Duplicate {
+	if s.fingerprints == nil {
+		return nil
+	}
+	if !result.fingerprintsLoaded {
+		known, err := s.fingerprints.Load(ctx)
+		if err != nil {
+			log.Printf("Warning: Duplicate detection skipped: %v", err)
+			return nil
+		}
+		result.knownFingerprints = known
+		result.fingerprintsLoaded = true
+	}
+	// A retried job may have recorded this very upload before
+	others := otherUploads(result.knownFingerprints, uploadReceiptID(result.FileInfo))
+	return findUploadDuplicates(others, fingerprint, s.duplicateOpts)
+}
+
+// recordFingerprint adds a processed upload to the fingerprint index
+// Uploads repeating an already recorded purchase are deleted again unless forced
+// The index is only loaded again when the duplicate check ran in another invocation
+func (s *ReceiptService) recordFingerprint(ctx context.Context, result *ProcessResult, fingerprint Fingerprint, opts ProcessOptions) {
+	known := result.knownFingerprints
+	if !result.fingerprintsLoaded {
+		var err error
+		if known, err = s.fingerprints.Load(ctx); err != nil {
+			log.Printf("Warning: Duplicate detection skipped: %v", err)
+		}
+	}
+
+	for _, receipt := range result.Receipts {
+		if key, ok := newReceiptKey(receipt.Data); ok {
+			fingerprint.Receipts = append(fingerprint.Receipts, key)
+		}
+	}
+
+	// A retried job may have recorded this very upload before
+	fingerprint.ReceiptID = uploadReceiptID(result.FileInfo)
+	others := otherUploads(known, fingerprint.ReceiptID)
+
+	if duplicates := findReceiptDuplicates(others, fingerprint.Receipts); len(duplicates) > 0 {
+		log.Printf("Receipt already recorded in %s: %s", duplicates[0].Key, duplicates[0].Receipt)
+		result.Duplicates = append(result.Duplicates, duplicates...)
+		if !opts.Force {
+			if !opts.KeepFiles {
+				s.discardFiles(ctx, result)
+			}
+			return
+		}
+	}
+
+	fingerprint.Key = result.FileInfo.Key
+	fingerprint.URL = result.FileInfo.URL
+	fingerprint.UploadedAt = time.Now()
+	if err := s.fingerprints.Add(ctx, fingerprint); err != nil {
+		log.Printf("Warning: Failed to record upload fingerprint: %v", err)
+	}
+}
+
+// discardFiles deletes the stored files of a rejected upload
+func (s *ReceiptService) discardFiles(ctx context.Context, result *ProcessResult) {
+	for _, fileInfo := range append([]*repository.FileInfo{result.FileInfo}, result.AdditionalFiles...) {
+		if err := s.objectStore.Delete(ctx, fileInfo.Key); err != nil {
+			log.Printf("Warning: Failed to delete duplicate upload: %v", err)
+		}
+	}
+	if id := uploadReceiptID(result.FileInfo); id != "" {
+		if err := s.objectStore.Delete(ctx, receiptIndexKey(id)); err != nil {
+			log.Printf("Warning: Failed to delete receipt ID index: %v", err)
+		}
+	}
+	result.FileInfo = nil
+	result.AdditionalFiles = nil
+}
+
+// relocateFiles moves the stored pieces to the keys built from the first receipt's date,
+// category and store, and points the receipt ID at the new key
+// The move writes the receipt's labels as metadata, saving labelFiles another copy
+// Pieces that cannot be moved are only logged: they stay valid where they are
+func (s *ReceiptService) relocateFiles(ctx context.Context, result *ProcessResult) {
+	values := receiptKeyValues(result.Receipts[0].Data)
+	if values == nil {
+		return
+	}
+	labels := receiptLabels(result)
+
+	uploadedKey := result.FileInfo.Key
+	result.FileInfo = s.relocateFile(ctx, result.FileInfo, values, labels)
+	for i, fileInfo := range result.AdditionalFiles {
+		result.AdditionalFiles[i] = s.relocateFile(ctx, fileInfo, values, labels)
+	}
+
+	if id := uploadReceiptID(result.FileInfo); id != "" && result.FileInfo.Key != uploadedKey {
+		if err := indexReceiptID(ctx, s.objectStore, id, result.FileInfo.Key); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// relocateFile moves one stored piece, returning it unchanged when that fails
+func (s *ReceiptService) relocateFile(ctx context.Context, fileInfo *repository.FileInfo, values, labels map[string]string) *repository.FileInfo {
+	var metadata map[string]string
+	if labels != nil {
+		metadata = labeledMetadata(fileInfo.Metadata, labels)
+	}
+	relocated, err := s.objectStore.Relocate(ctx, fileInfo, values, metadata)
+	if err != nil {
+		log.Printf("Warning: Failed to relocate %s: %v", fileInfo.Key, err)
+		return fileInfo
+	}
+	return relocated
+}
+
+// receiptKeyValues returns the key layout values of an extracted receipt
+func receiptKeyValues(data *openai.ReceiptData) map[string]string {
+	if data == nil {
+		return nil
+	}
+	values := map[string]string{
+		"category": data.ExpenseCategory,
+		"store":    data.StoreName,
+	}
+	if !data.ReceiptDate.IsZero() {
+		values["receipt_date"] = data.ReceiptDate.Format("2006-01-02")
+	}
+	return values
+}
+
+// extractUploads converts the stored pieces and extracts their receipts into result
+func (s *ReceiptService) extractUploads(ctx context.Context, result *ProcessResult, pieces [][]byte) {
+	// Convert HEIC, TIFF and PDF uploads into something the model accepts
+	var images [][]byte
+	var texts []string
+	for i, piece := range pieces {
+		format := imaging.DetectFormat(piece)
+		if format == imaging.FormatUnknown {
+			log.Printf("Skipping extraction for piece %d: not a receipt document", i+1)
+			continue
+		}
+		log.Printf("Processing %s receipt piece %d/%d with extractor", format, i+1, len(pieces))
+
+		doc, err := s.converter.Convert(ctx, piece)
+		if err != nil {
+			log.Printf("Warning: Failed to convert %s upload, stored without extraction: %v", format, err)
+			result.ExtractionError = fmt.Sprintf("failed to convert %s upload: %v", format, err)
+			return
+		}
+		images = append(images, doc.Images...)
+		if doc.Text != "" {
+			texts = append(texts, doc.Text)
+		}
+	}
+
+	switch {
+	case len(images) > 0:
+		s.extractImages(ctx, result, images)
+	case len(texts) > 0:
+		text := strings.Join(texts, "\n\n")
+		log.Printf("No page images in upload, extracting from its text (%d chars)", len(text))
+		s.extractReceipt(ctx, result, openai.ReceiptExtractionRequest{Text: text})
+	}
+}
+
+// extractImages prepares and validates the images of one receipt, then extracts its data
+// A single image may be split into several receipts; several images are merged into one
+func (s *ReceiptService) extractImages(ctx context.Context, result *ProcessResult, images [][]byte) {
+	encoded := make([]string, len(images))
+	for i, imageData := range images {
+		// Shrink and clean up the photo for the vision model
+		imageData = s.prepareImage(imageData)
+
+		// Validate image first
+		if err := openai.ValidateImageForOpenAI(imageData); err != nil {
+			log.Printf("Warning: Image %d validation failed: %v", i+1, err)
+			log.Printf("Image info: Format=%s, %s",
+				openai.GetImageFormatInfo(imageData),
+				openai.GetImageSizeInfo(imageData))
+			result.ExtractionError = err.Error()
+			return
+		}
+		log.Printf("Image %d validation passed: Format=%s, %s", i+1,
+			openai.GetImageFormatInfo(imageData),
+			openai.GetImageSizeInfo(imageData))
+
+		encoded[i] = openai.EncodeImageToBase64(imageData)
+	}
+
+	s.extractReceipt(ctx, result, openai.ReceiptExtractionRequest{
+		ImageData:        encoded[0],
+		AdditionalImages: encoded[1:],
+		MultipleReceipts: s.splitReceipts,
+	})
+}
+
+// extractReceipt runs the extractor and records the outcome in result
+func (s *ReceiptService) extractReceipt(ctx context.Context, result *ProcessResult, req openai.ReceiptExtractionRequest) {
+	start := time.Now()
+	response, err := s.extract(ctx, req)
+	result.ExtractionAttempts = response.Attempts
+	result.Usage = response.Usage
+	result.Extraction = &ExtractionMetadata{
+		Model:     response.Model,
+		RequestID: response.RequestID,
+		LatencyMs: response.LatencyMs,
+		Repairs:   response.Repairs,
+	}
+	s.logUsage(start, response)
+	if err != nil {
+		log.Printf("Warning: Failed to extract receipt data after %d attempt(s): %v", response.Attempts, err)
+		result.ExtractionError = err.Error()
+		return
+	}
+
+	result.Receipts = response.AllReceipts()
+	for _, receipt := range result.Receipts {
+		log.Printf("Successfully processed receipt in %d attempt(s): %s", response.Attempts, receipt.Data.Summary())
+	}
+}
+
+// prepareImage runs the preprocessing pipeline, falling back to the original image on failure
+func (s *ReceiptService) prepareImage(fileContent []byte) []byte {
+	if s.imageOpts == nil {
+		return fileContent
+	}
+
+	processed, err := imaging.Preprocess(fileContent, *s.imageOpts)
+	if err != nil {
+		log.Printf("Warning: Image preprocessing skipped, sending original: %v", err)
+		return fileContent
+	}
+	if !processed.Changed() {
+		return fileContent
+	}
+
+	log.Printf("Preprocessed image: %dx%d -> %dx%d, %d -> %d bytes (orientation=%d, cropped=%v, quality=%d)",
+		processed.OriginalWidth, processed.OriginalHeight, processed.Width, processed.Height,
+		len(fileContent), len(processed.Data), processed.Orientation, processed.Cropped, processed.Quality)
+	return processed.Data
+}
+
+// logUsage logs the usage of one extraction and the month it is booked to
+// Monthly totals across instances come from the tracker's metrics, not from this log
+func (s *ReceiptService) logUsage(start time.Time, response *openai.ReceiptExtractionResponse) {
+	if s.usage == nil || response.Usage == nil {
+		return
+	}
+	log.Printf("OpenAI usage booked to %s (%s): %d tokens, estimated $%.4f",
+		start.Format("2006-01"), response.Model, response.Usage.TotalTokens, response.Usage.CostUSD)
+}
+
+// extract runs the configured extractor
+// The response is returned even on failure so callers can report attempts
+func (s *ReceiptService) extract(ctx context.Context, req openai.ReceiptExtractionRequest) (*openai.ReceiptExtractionResponse, error) {
+	response, err := s.extractor.ExtractReceiptData(ctx, req)
+	if response == nil {
+		response = &openai.ReceiptExtractionResponse{}
+	}
+	if err != nil {
+		return response, fmt.Errorf("failed to extract receipt: %w", err)
+	}
+
+	if !response.Success {
+		return response, fmt.Errorf("extraction failed: %s", response.Error)
+	}
+
+	return response, nil
 }
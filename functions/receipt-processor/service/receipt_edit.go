@@ -0,0 +1,342 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Actions recorded in a sidecar's edit history
+const (
+	ReceiptEditUpdate = "update"
+	ReceiptEditDelete = "delete"
+)
+
+// ErrInvalidReceiptPatch is returned for patches that are not JSON objects or hold unreadable values
+var ErrInvalidReceiptPatch = errors.New("invalid receipt patch")
+
+// maxRowAttempts is how often a spreadsheet row is looked up for one edit
+const maxRowAttempts = 2
+
+// ReceiptEdit records one change made to a receipt through the API
+type ReceiptEdit struct {
+	Receipt int                  `json:"receipt"` // Position of the receipt in the sidecar
+	Action  string               `json:"action"`
+	At      time.Time            `json:"at"`
+	Changes []openai.FieldChange `json:"changes,omitempty"`
+}
+
+// ReceiptEditor corrects and deletes recorded receipts
+// The sidecar is the source of truth; the spreadsheet row carrying the receipt ID follows it
+type ReceiptEditor struct {
+	objectStore   repository.ObjectStore
+	sheetsService *SheetsService
+	fingerprints  FingerprintIndex
+	reconcile     openai.ReconcileOptions
+}
+
+// NewReceiptEditor creates an editor for the receipts stored in the bucket
+func NewReceiptEditor(objectStore repository.ObjectStore) *ReceiptEditor {
+	return &ReceiptEditor{objectStore: objectStore}
+}
+
+// SetSheetsService keeps the spreadsheet in sync with edits (optional)
+func (e *ReceiptEditor) SetSheetsService(sheetsService *SheetsService) {
+	e.sheetsService = sheetsService
+}
+
+// SetFingerprintIndex keeps the duplicate detection fingerprints in sync with edits (optional)
+func (e *ReceiptEditor) SetFingerprintIndex(index FingerprintIndex) {
+	e.fingerprints = index
+}
+
+// SetReconcileOptions checks edited receipts like the extractor checks new ones (optional)
+// Edits keep the values given: auto-correction only applies to extractions
+func (e *ReceiptEditor) SetReconcileOptions(opts openai.ReconcileOptions) {
+	opts.AutoCorrect = false
+	e.reconcile = opts
+}
+
+// Update applies a JSON merge patch (RFC 7396) to a receipt's data, e.g.
+// {"store_name": "Lawson", "total_amount": 980}, and returns the updated receipt
+func (e *ReceiptEditor) Update(ctx context.Context, id string, patch []byte) (*StoredReceipt, error) {
+	key, index, sidecar, err := e.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	extracted := &sidecar.Receipts[index]
+	updated, err := patchReceiptData(extracted.Data, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	if changes := openai.DiffReceipts(extracted.Data, updated); len(changes) > 0 {
+		extracted.Data = updated
+		extracted.Reconciliation = updated.Reconcile(e.reconcile)
+		sidecar.Edits = append(sidecar.Edits, ReceiptEdit{
+			Receipt: index,
+			Action:  ReceiptEditUpdate,
+			At:      time.Now(),
+			Changes: changes,
+		})
+		e.refreshFingerprint(ctx, sidecar)
+		e.relabelFiles(ctx, sidecar)
+		if err := repository.PutJSON(ctx, e.objectStore, SidecarKey(key), sidecar); err != nil {
+			return nil, fmt.Errorf("failed to save receipt: %w", err)
+		}
+		if err := indexSidecar(ctx, e.objectStore, sidecar); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		log.Printf("Updated receipt %s: %d field(s) changed", id, len(changes))
+	}
+
+	// Sync even without changes so a retry repairs a row a failed request left stale
+	if err := e.updateRow(ctx, id, sidecar, index); err != nil {
+		return nil, err
+	}
+
+	receipt, _ := sidecarReceipt(sidecar, index)
+	return &receipt, nil
+}
+
+// Delete removes a receipt's spreadsheet row and marks it deleted in the sidecar
+// The image and sidecar are kept, so the receipt stays auditable
+func (e *ReceiptEditor) Delete(ctx context.Context, id string) error {
+	key, index, sidecar, err := e.load(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// Remove the row first: if saving the sidecar then fails, a retry finds no row and completes
+	if err := e.deleteRow(ctx, id); err != nil {
+		return err
+	}
+
+	sidecar.Edits = append(sidecar.Edits, ReceiptEdit{Receipt: index, Action: ReceiptEditDelete, At: time.Now()})
+	e.refreshFingerprint(ctx, sidecar)
+	e.relabelFiles(ctx, sidecar)
+	if err := repository.PutJSON(ctx, e.objectStore, SidecarKey(key), sidecar); err != nil {
+		return fmt.Errorf("failed to save receipt: %w", err)
+	}
+	if err := indexSidecar(ctx, e.objectStore, sidecar); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	log.Printf("Deleted receipt %s", id)
+	return nil
+}
+
+// load reads the sidecar holding a receipt
+func (e *ReceiptEditor) load(ctx context.Context, id string) (string, int, *Sidecar, error) {
+	key, index, err := locateReceipt(ctx, e.objectStore, id)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	var sidecar Sidecar
+	err = repository.GetJSON(ctx, e.objectStore, SidecarKey(key), &sidecar)
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return "", 0, nil, ErrReceiptNotFound
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	if _, ok := sidecarReceipt(&sidecar, index); !ok {
+		return "", 0, nil, ErrReceiptNotFound
+	}
+	return key, index, &sidecar, nil
+}
+
+// liveReceipts returns the receipts of a sidecar that were not deleted
+func liveReceipts(sidecar *Sidecar) []openai.ExtractedReceipt {
+	var receipts []openai.ExtractedReceipt
+	for i, receipt := range sidecar.Receipts {
+		if _, ok := sidecarReceipt(sidecar, i); ok {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts
+}
+
+// refreshFingerprint records the upload's fingerprint again with the receipts left after
+// an edit, so later uploads are compared with the corrected fields
+// Once every receipt is deleted the fingerprint is removed and the photo can be uploaded again
+// Failures are only logged: the sidecar is the source of truth
+func (e *ReceiptEditor) refreshFingerprint(ctx context.Context, sidecar *Sidecar) {
+	if e.fingerprints == nil {
+		return
+	}
+	known, err := e.fingerprints.Load(ctx)
+	if err != nil {
+		log.Printf("Warning: Fingerprint not updated: %v", err)
+		return
+	}
+
+	id := uploadReceiptID(sidecar.File)
+	for _, fingerprint := range known {
+		if (id == "" || fingerprint.ReceiptID != id) && fingerprint.Key != sidecar.File.Key {
+			continue
+		}
+
+		receipts := liveReceipts(sidecar)
+		if len(receipts) == 0 {
+			err = e.fingerprints.Remove(ctx, fingerprint)
+		} else {
+			fingerprint.Receipts = nil
+			for _, receipt := range receipts {
+				if key, ok := newReceiptKey(receipt.Data); ok {
+					fingerprint.Receipts = append(fingerprint.Receipts, key)
+				}
+			}
+			err = e.fingerprints.Add(ctx, fingerprint)
+		}
+		if err != nil {
+			log.Printf("Warning: Fingerprint not updated: %v", err)
+		}
+		return
+	}
+}
+
+// relabelFiles replaces the receipt labels of the stored pieces after an edit, like labelFiles
+// does after an extraction. Metadata is only rewritten where the service wrote it before
+// Failures are only logged: the sidecar is the source of truth
+func (e *ReceiptEditor) relabelFiles(ctx context.Context, sidecar *Sidecar) {
+	labels := receiptLabels(&ProcessResult{
+		FileInfo:   sidecar.File,
+		Receipts:   liveReceipts(sidecar),
+		Extraction: sidecar.Extraction,
+	})
+	if labels == nil {
+		// Every receipt was deleted, only the receipt ID remains
+		labels = make(map[string]string)
+		if id := uploadReceiptID(sidecar.File); id != "" {
+			labels[ReceiptIDMetadata] = id
+		}
+	}
+
+	for _, fileInfo := range append([]*repository.FileInfo{sidecar.File}, sidecar.AdditionalFiles...) {
+		current, err := e.objectStore.Head(ctx, fileInfo.Key)
+		if err != nil {
+			log.Printf("Warning: Failed to relabel %s: %v", fileInfo.Key, err)
+			continue
+		}
+		fileInfo.Metadata = current.Metadata
+		applyLabels(ctx, e.objectStore, fileInfo, labels, hasReceiptLabels(current.Metadata))
+	}
+}
+
+// updateRow rewrites the receipt's spreadsheet row, keeping its memo
+// A row that moved before it was written is looked up once more
+func (e *ReceiptEditor) updateRow(ctx context.Context, id string, sidecar *Sidecar, index int) error {
+	if e.sheetsService == nil {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		row, values, err := e.sheetsService.FindReceiptRow(ctx, id)
+		if err != nil {
+			return err
+		}
+		if row == 0 {
+			log.Printf("Warning: No spreadsheet row for receipt %s, only the stored data was updated", id)
+			return nil
+		}
+
+		current, _ := parseReceiptRow(row, values)
+		err = e.sheetsService.UpdateReceiptRow(ctx, row, ReceiptEntry{
+			ID:       id,
+			Data:     sidecar.Receipts[index].Data,
+			ImageKey: sidecar.File.Key,
+			Memo:     current.Memo,
+		})
+		if !errors.Is(err, ErrReceiptRowMoved) || attempt == maxRowAttempts {
+			return err
+		}
+	}
+}
+
+// deleteRow removes the receipt's spreadsheet row, if it has one
+// A row that moved before it was deleted is looked up once more
+func (e *ReceiptEditor) deleteRow(ctx context.Context, id string) error {
+	if e.sheetsService == nil {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		row, _, err := e.sheetsService.FindReceiptRow(ctx, id)
+		if err != nil || row == 0 {
+			return err
+		}
+		err = e.sheetsService.DeleteReceiptRow(ctx, row, id)
+		if !errors.Is(err, ErrReceiptRowMoved) || attempt == maxRowAttempts {
+			return err
+		}
+	}
+}
+
+// patchReceiptData returns a copy of data with a JSON merge patch applied
+// Values are decoded as tolerantly as model output; values that still cannot be
+// read reject the patch rather than silently clearing the field
+func patchReceiptData(data *openai.ReceiptData, patch []byte) (*openai.ReceiptData, error) {
+	var changes map[string]interface{}
+	if err := json.Unmarshal(patch, &changes); err != nil || changes == nil {
+		return nil, fmt.Errorf("%w: body must be a JSON object", ErrInvalidReceiptPatch)
+	}
+	if _, ok := changes["parse_warnings"]; ok {
+		return nil, fmt.Errorf("%w: parse_warnings cannot be edited", ErrInvalidReceiptPatch)
+	}
+
+	current, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(current, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode receipt: %w", err)
+	}
+	delete(document, "parse_warnings")
+
+	merged, err := json.Marshal(mergePatch(document, changes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode patched receipt: %w", err)
+	}
+	var updated openai.ReceiptData
+	if err := json.Unmarshal(merged, &updated); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReceiptPatch, err)
+	}
+	if len(updated.ParseWarnings) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidReceiptPatch, strings.Join(updated.ParseWarnings, "; "))
+	}
+
+	updated.ParseWarnings = data.ParseWarnings
+	return &updated, nil
+}
+
+// mergePatch applies a merge patch to a decoded JSON object: null removes a member,
+// objects merge recursively and any other value replaces the member
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for name, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, name)
+		case map[string]interface{}:
+			existing, _ := target[name].(map[string]interface{})
+			target[name] = mergePatch(existing, value)
+		default:
+			target[name] = value
+		}
+	}
+	return target
+}
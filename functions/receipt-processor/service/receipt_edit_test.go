@@ -0,0 +1,259 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestPatchReceiptData(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	data := &openai.ReceiptData{
+		StoreName:     "Lawsn",
+		ReceiptDate:   time.Date(2024, 10, 18, 12, 30, 0, 0, jst),
+		TotalAmount:   890,
+		Currency:      "JPY",
+		Items:         []openai.ReceiptItem{{Name: "Onigiri", TotalPrice: 150}},
+		PaymentMethod: "現金",
+		Notes:         "typo",
+		ParseWarnings: []string{"tax_amount: unreadable"},
+	}
+
+	tests := []struct {
+		name    string
+		patch   string
+		wantErr bool
+		check   func(t *testing.T, updated *openai.ReceiptData)
+	}{
+		{
+			name:  "replaces fields",
+			patch: `{"store_name": "Lawson", "total_amount": "¥980"}`,
+			check: func(t *testing.T, updated *openai.ReceiptData) {
+				if updated.StoreName != "Lawson" || updated.TotalAmount != 980 {
+					t.Errorf("Expected store and total to change, got %+v", updated)
+				}
+				if !updated.ReceiptDate.Equal(data.ReceiptDate) || len(updated.Items) != 1 || updated.PaymentMethod != "現金" {
+					t.Errorf("Expected other fields to be kept, got %+v", updated)
+				}
+				if len(updated.ParseWarnings) != 1 {
+					t.Errorf("Expected the original parse warnings to be kept, got %v", updated.ParseWarnings)
+				}
+			},
+		},
+		{
+			name:  "null removes a field",
+			patch: `{"notes": null, "receipt_date": "2024-10-17"}`,
+			check: func(t *testing.T, updated *openai.ReceiptData) {
+				if updated.Notes != "" || updated.ReceiptDate.Format("2006-01-02") != "2024-10-17" {
+					t.Errorf("Expected notes cleared and date changed, got %+v", updated)
+				}
+			},
+		},
+		{name: "not an object", patch: `["store_name"]`, wantErr: true},
+		{name: "null body", patch: `null`, wantErr: true},
+		{name: "unreadable value", patch: `{"total_amount": "about a thousand"}`, wantErr: true},
+		{name: "parse warnings", patch: `{"parse_warnings": []}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated, err := patchReceiptData(data, []byte(tt.patch))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidReceiptPatch) {
+					t.Errorf("Expected ErrInvalidReceiptPatch, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("patchReceiptData() error = %v", err)
+			}
+			tt.check(t, updated)
+		})
+	}
+
+	if data.StoreName != "Lawsn" {
+		t.Error("Expected the original receipt to be left unchanged")
+	}
+
+	// A patch repeating the current values changes nothing
+	updated, err := patchReceiptData(data, []byte(`{"store_name": "Lawsn"}`))
+	if err != nil {
+		t.Fatalf("patchReceiptData() error = %v", err)
+	}
+	if changes := openai.DiffReceipts(data, updated); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", changes)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	target := map[string]interface{}{
+		"a": "keep",
+		"b": "remove",
+		"c": map[string]interface{}{"x": 1.0, "y": 2.0},
+	}
+	patch := map[string]interface{}{
+		"b": nil,
+		"c": map[string]interface{}{"y": nil, "z": 3.0},
+		"d": map[string]interface{}{"new": true},
+	}
+
+	got := mergePatch(target, patch)
+	if got["a"] != "keep" || got["b"] != nil {
+		t.Errorf("Unexpected top-level members: %v", got)
+	}
+	c := got["c"].(map[string]interface{})
+	if c["x"] != 1.0 || c["z"] != 3.0 || len(c) != 2 {
+		t.Errorf("Expected nested objects to merge, got %v", c)
+	}
+	if d, ok := got["d"].(map[string]interface{}); !ok || d["new"] != true {
+		t.Errorf("Expected a new object member, got %v", got["d"])
+	}
+}
+
+func TestSidecarDeletedReceipts(t *testing.T) {
+	sidecar := &Sidecar{
+		File: &repository.FileInfo{Key: "receipts/a.jpg", Metadata: map[string]string{ReceiptIDMetadata: "0192a3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b"}},
+		Receipts: []openai.ExtractedReceipt{
+			{Data: &openai.ReceiptData{StoreName: "Cafe"}},
+			{Data: &openai.ReceiptData{StoreName: "Bakery"}},
+		},
+		Edits: []ReceiptEdit{
+			{Receipt: 0, Action: ReceiptEditUpdate},
+			{Receipt: 0, Action: ReceiptEditDelete},
+		},
+	}
+
+	if !sidecar.Deleted(0) || sidecar.Deleted(1) {
+		t.Errorf("Deleted() = %v, %v, want true, false", sidecar.Deleted(0), sidecar.Deleted(1))
+	}
+
+	receipts := sidecarReceipts(sidecar)
+	if len(receipts) != 1 || receipts[0].StoreName != "Bakery" {
+		t.Fatalf("Expected only the remaining receipt, got %+v", receipts)
+	}
+	if receipts[0].ID != "0192a3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b.2" {
+		t.Errorf("Expected the remaining receipt to keep its ID, got %q", receipts[0].ID)
+	}
+	if _, ok := sidecarReceipt(sidecar, 0); ok {
+		t.Error("Expected the deleted receipt to be hidden")
+	}
+}
+
+func TestReceiptEditorReconcileOptions(t *testing.T) {
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+
+	// The fake receipt totals 1000 + 100 tax; the patch is off by 50
+	tests := []struct {
+		name           string
+		opts           openai.ReconcileOptions
+		wantConsistent bool
+	}{
+		{name: "Defaults", wantConsistent: false},
+		{name: "Configured tolerance", opts: openai.ReconcileOptions{Tolerance: 100}, wantConsistent: true},
+		{name: "Disabled", opts: openai.ReconcileOptions{Disabled: true}, wantConsistent: true},
+		{name: "Auto-correction keeps the edit", opts: openai.ReconcileOptions{AutoCorrect: true}, wantConsistent: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := repository.NewMemoryObjectStore()
+			receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+			result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+			if err != nil {
+				t.Fatalf("ProcessReceipt() error = %v", err)
+			}
+
+			editor := NewReceiptEditor(store)
+			editor.SetReconcileOptions(tt.opts)
+			updated, err := editor.Update(ctx, result.ReceiptIDs()[0], []byte(`{"total_amount":1150}`))
+			if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			if updated.TotalAmount != 1150 {
+				t.Errorf("Update() total = %v, want the patched 1150", updated.TotalAmount)
+			}
+
+			sidecar, err := receiptService.ReadSidecar(ctx, result.FileInfo.Key)
+			if err != nil {
+				t.Fatalf("ReadSidecar() error = %v", err)
+			}
+			reconciliation := sidecar.Receipts[0].Reconciliation
+			if reconciliation == nil {
+				t.Fatal("Reconciliation = nil, want the edit checked")
+			}
+			if reconciliation.Consistent != tt.wantConsistent {
+				t.Errorf("Reconciliation = %+v, want consistent %v", reconciliation, tt.wantConsistent)
+			}
+			for _, warning := range reconciliation.Warnings {
+				if warning.Corrected {
+					t.Errorf("Warning %s marked corrected, want the edit kept", warning.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiptEditorRefreshesFingerprintsAndLabels(t *testing.T) {
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+
+	ctx := context.Background()
+	store := repository.NewMemoryObjectStore()
+	index := NewMemoryFingerprintIndex()
+	receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	receiptService.SetDuplicateDetection(index, DuplicateOptions{})
+	result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+	if err != nil || result.FileInfo == nil {
+		t.Fatalf("ProcessReceipt() = %+v, %v", result, err)
+	}
+	id := result.ReceiptIDs()[0]
+
+	editor := NewReceiptEditor(store)
+	editor.SetFingerprintIndex(index)
+
+	// An update records the corrected purchase and labels
+	if _, err := editor.Update(ctx, id, []byte(`{"store_name":"Lawson","total_amount":2000}`)); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	fingerprints, _ := index.Load(ctx)
+	if len(fingerprints) != 1 || len(fingerprints[0].Receipts) != 1 || fingerprints[0].Receipts[0].Total != 2000 {
+		t.Errorf("Fingerprints after update = %+v, want the corrected total", fingerprints)
+	}
+	tags, _ := store.GetTags(ctx, result.FileInfo.Key)
+	if tags[ReceiptStoreMetadata] != "Lawson" || tags[ReceiptTotalMetadata] != "2000" {
+		t.Errorf("Tags after update = %v", tags)
+	}
+	fileInfo, err := store.Head(ctx, result.FileInfo.Key)
+	if err != nil || fileInfo.Metadata[ReceiptStoreMetadata] != "Lawson" || fileInfo.Metadata[ReceiptIDMetadata] == "" {
+		t.Errorf("Metadata after update = %+v, %v", fileInfo, err)
+	}
+
+	// A deleted receipt is no duplicate and keeps only its receipt ID label
+	if err := editor.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if fingerprints, _ := index.Load(ctx); len(fingerprints) != 0 {
+		t.Errorf("Fingerprints after delete = %+v, want none", fingerprints)
+	}
+	tags, _ = store.GetTags(ctx, result.FileInfo.Key)
+	if len(tags) != 1 || tags[ReceiptIDMetadata] == "" {
+		t.Errorf("Tags after delete = %v, want only the receipt ID", tags)
+	}
+	again, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+	if err != nil || again.FileInfo == nil || len(again.Duplicates) != 0 {
+		t.Errorf("ProcessReceipt() after delete = %+v, %v, want the photo recorded again", again, err)
+	}
+}
@@ -0,0 +1,383 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Receipt ID storage
+const (
+	ReceiptIDMetadata         = "receipt-id"      // S3 object metadata key holding an upload's receipt ID
+	DefaultReceiptIndexPrefix = "index/receipts/" // S3 prefix of the records mapping receipt IDs to image keys
+)
+
+// NewReceiptID generates the receipt ID of an upload: a time-ordered UUID (version 7)
+func NewReceiptID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return id.String()
+}
+
+// receiptIDFor returns the ID of the index-th receipt found in an upload
+// The first receipt carries the upload's ID; further receipts in the same photo
+// append their position, e.g. "<id>.2"
+func receiptIDFor(uploadID string, index int) string {
+	if index == 0 {
+		return uploadID
+	}
+	return uploadID + "." + strconv.Itoa(index+1)
+}
+
+// parseReceiptID splits a receipt ID into the upload's ID and the receipt's index
+// It returns false for IDs of another form, such as those encoding an image key
+func parseReceiptID(id string) (string, int, bool) {
+	uploadID, position, hasPosition := strings.Cut(id, ".")
+	if _, err := uuid.Parse(uploadID); err != nil || len(uploadID) != 36 {
+		return "", 0, false
+	}
+	if !hasPosition {
+		return uploadID, 0, true
+	}
+	n, err := strconv.Atoi(position)
+	if err != nil || n < 2 {
+		return "", 0, false
+	}
+	return uploadID, n - 1, true
+}
+
+// uploadReceiptID returns the receipt ID recorded for a stored file, if any
+func uploadReceiptID(fileInfo *repository.FileInfo) string {
+	if fileInfo == nil {
+		return ""
+	}
+	return fileInfo.Metadata[ReceiptIDMetadata]
+}
+
+// setUploadReceiptID records a receipt ID on a stored file's metadata
+func setUploadReceiptID(fileInfo *repository.FileInfo, id string) {
+	if fileInfo.Metadata == nil {
+		fileInfo.Metadata = make(map[string]string)
+	}
+	fileInfo.Metadata[ReceiptIDMetadata] = id
+}
+
+// storedReceiptID returns the ID of the index-th receipt of a stored file
+// Files stored before receipt IDs existed have none until migrate-receipt-ids gives them one
+func storedReceiptID(fileInfo *repository.FileInfo, index int) string {
+	if id := uploadReceiptID(fileInfo); id != "" {
+		return receiptIDFor(id, index)
+	}
+	return ""
+}
+
+// ReceiptIDs returns the IDs of the receipts found in the upload, in order
+func (r *ProcessResult) ReceiptIDs() []string {
+	if uploadReceiptID(r.FileInfo) == "" || len(r.Receipts) == 0 {
+		return nil
+	}
+	ids := make([]string, len(r.Receipts))
+	for i := range r.Receipts {
+		ids[i] = storedReceiptID(r.FileInfo, i)
+	}
+	return ids
+}
+
+// receiptIndexEntry records where the upload with a receipt ID is stored
+// Receipts lists the upload's receipts without their data, so listings need not read
+// every sidecar. It is null until the sidecar is written
+type receiptIndexEntry struct {
+	Key      string          `json:"key"`
+	Receipts []StoredReceipt `json:"receipts"`
+}
+
+// receiptIndexKey returns the key of the index record of an upload's receipt ID
+func receiptIndexKey(uploadID string) string {
+	return DefaultReceiptIndexPrefix + uploadID + ".json"
+}
+
+// indexReceiptID records where the upload with the receipt ID is stored
+func indexReceiptID(ctx context.Context, objectStore repository.ObjectStore, uploadID, key string) error {
+	if err := repository.PutJSON(ctx, objectStore, receiptIndexKey(uploadID), receiptIndexEntry{Key: key}); err != nil {
+		return fmt.Errorf("failed to index receipt ID %s: %w", uploadID, err)
+	}
+	return nil
+}
+
+// indexSidecar records the upload of a sidecar with the listing of its receipts
+// Sidecars of uploads without a receipt ID are not indexed
+func indexSidecar(ctx context.Context, objectStore repository.ObjectStore, sidecar *Sidecar) error {
+	uploadID := uploadReceiptID(sidecar.File)
+	if uploadID == "" {
+		return nil
+	}
+
+	entry := receiptIndexEntry{Key: sidecar.File.Key, Receipts: []StoredReceipt{}}
+	for _, receipt := range sidecarReceipts(sidecar) {
+		receipt.Data = nil
+		entry.Receipts = append(entry.Receipts, receipt)
+	}
+	if err := repository.PutJSON(ctx, objectStore, receiptIndexKey(uploadID), entry); err != nil {
+		return fmt.Errorf("failed to index receipt ID %s: %w", uploadID, err)
+	}
+	return nil
+}
+
+// locateReceipt resolves a receipt ID to the key of its image and the receipt's index
+// Only IDs recorded in the index resolve; others, including the key-encoding IDs of
+// rows written before receipt IDs existed, return ErrReceiptNotFound, since they
+// would let callers name any object in the bucket
+func locateReceipt(ctx context.Context, objectStore repository.ObjectStore, id string) (string, int, error) {
+	uploadID, index, ok := parseReceiptID(id)
+	if !ok {
+		return "", 0, ErrReceiptNotFound
+	}
+	var entry receiptIndexEntry
+	err := repository.GetJSON(ctx, objectStore, receiptIndexKey(uploadID), &entry)
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return "", 0, ErrReceiptNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return entry.Key, index, nil
+}
+
+// assignReceiptID gives a stored file without a receipt ID a new one and indexes it
+// Index failures are only logged: the ID is still recorded in the sidecar and ledger
+func (s *ReceiptService) assignReceiptID(ctx context.Context, fileInfo *repository.FileInfo) {
+	id := uploadReceiptID(fileInfo)
+	if id == "" {
+		id = NewReceiptID()
+		setUploadReceiptID(fileInfo, id)
+	}
+	if err := indexReceiptID(ctx, s.objectStore, id, fileInfo.Key); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// ReceiptIDBackfill reports what BackfillReceiptIDs assigned
+type ReceiptIDBackfill struct {
+	Uploads   int // Stored uploads given a receipt ID
+	Rows      int // Spreadsheet rows given a receipt ID
+	Unmatched int // Rows without a stored upload, given an ID of their own
+	Moved     int // Rows that changed while the migration ran, left for the next run
+}
+
+// BackfillReceiptIDs gives receipts recorded before receipt IDs existed an ID
+// Sidecars without an ID get a new one, which is indexed and written to the image's
+// metadata. Spreadsheet rows are matched to their sidecar by the ID written since
+// edits were introduced or else by the 영수증링크 column, in sheet order. Rows of
+// uploads stored before sidecars existed find their image through the same column,
+// which then gets an ID of its own. Running it again only handles what is still
+// missing. sheets may be nil; with dryRun nothing is written
+func BackfillReceiptIDs(ctx context.Context, objectStore repository.ObjectStore, sheets *SheetsService, dryRun bool) (*ReceiptIDBackfill, error) {
+	report := &ReceiptIDBackfill{}
+
+	keys, err := objectStore.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]*repository.FileInfo)
+	byURL := make(map[string]*repository.FileInfo)
+	for _, key := range keys {
+		if !isReceiptSidecar(key) {
+			continue
+		}
+		var sidecar Sidecar
+		if err := repository.GetJSON(ctx, objectStore, key, &sidecar); err != nil {
+			log.Printf("Warning: Skipping unreadable sidecar %s: %v", key, err)
+			continue
+		}
+		if sidecar.File == nil {
+			continue
+		}
+		byKey[sidecar.File.Key] = sidecar.File
+		byURL[sidecar.File.URL] = sidecar.File
+		if uploadReceiptID(sidecar.File) != "" {
+			continue
+		}
+
+		id := NewReceiptID()
+		setUploadReceiptID(sidecar.File, id)
+		report.Uploads++
+		log.Printf("Assigning receipt ID %s to %s", id, sidecar.File.Key)
+		if dryRun {
+			continue
+		}
+
+		// The index and sidecar make the ID usable; the image metadata only mirrors it
+		if err := indexSidecar(ctx, objectStore, &sidecar); err != nil {
+			return nil, err
+		}
+		if err := repository.PutJSON(ctx, objectStore, key, &sidecar); err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range append([]*repository.FileInfo{sidecar.File}, sidecar.AdditionalFiles...) {
+			if err := objectStore.SetMetadata(ctx, fileInfo.Key, mergeMetadata(fileInfo.Metadata, id)); err != nil {
+				log.Printf("Warning: Failed to write receipt ID to %s: %v", fileInfo.Key, err)
+			}
+		}
+	}
+
+	if sheets == nil {
+		return report, nil
+	}
+
+	rows, err := sheets.ReadReceiptRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]int)
+	for i, row := range rows {
+		receipt, ok := parseReceiptRow(i+2, row)
+		if !ok {
+			continue
+		}
+		if _, _, ok := parseReceiptID(receipt.ID); ok {
+			continue
+		}
+
+		var id string
+		if key, index, err := decodeSidecarReceiptID(receipt.ID); err == nil && byKey[key] != nil {
+			id = storedReceiptID(byKey[key], index)
+		} else {
+			fileInfo := rowFile(receipt, byKey, byURL)
+			if fileInfo == nil {
+				var assigned bool
+				fileInfo, assigned, err = backfillRowObject(ctx, objectStore, receipt, dryRun)
+				if err != nil {
+					return nil, err
+				}
+				if fileInfo != nil {
+					byKey[fileInfo.Key] = fileInfo
+					if receipt.ReceiptURL != "" {
+						byURL[receipt.ReceiptURL] = fileInfo
+					}
+				}
+				if assigned {
+					report.Uploads++
+				}
+			}
+			if fileInfo != nil {
+				id = storedReceiptID(fileInfo, seen[fileInfo.Key])
+				seen[fileInfo.Key]++
+			} else {
+				id = NewReceiptID()
+				report.Unmatched++
+			}
+		}
+
+		log.Printf("Assigning receipt ID %s to row %d", id, i+2)
+		if !dryRun {
+			err := sheets.WriteReceiptID(ctx, i+2, row, id)
+			if errors.Is(err, ErrReceiptRowMoved) {
+				log.Printf("Warning: Skipping row %d: %v", i+2, err)
+				report.Moved++
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		report.Rows++
+	}
+	return report, nil
+}
+
+// backfillRowObject finds the image of a ledger row that has no sidecar, recorded before
+// sidecars existed, and gives it a receipt ID in its metadata and the index unless it
+// has one. It returns nil when the row's link does not resolve to a stored object
+func backfillRowObject(ctx context.Context, objectStore repository.ObjectStore, receipt StoredReceipt, dryRun bool) (*repository.FileInfo, bool, error) {
+	// Baseline rows hold the object URL the store reported
+	key, link := receipt.ImageKey, receipt.ReceiptURL
+	if link == "" {
+		link = receipt.ImageKey
+	}
+	if fromURL, ok := objectStore.KeyForURL(link); ok {
+		key = fromURL
+	}
+	if key == "" {
+		return nil, false, nil
+	}
+	fileInfo, err := objectStore.Head(ctx, key)
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	id := uploadReceiptID(fileInfo)
+	assigned := id == ""
+	if assigned {
+		id = NewReceiptID()
+		log.Printf("Assigning receipt ID %s to %s", id, key)
+	}
+	if !dryRun {
+		// Without a sidecar the metadata is the only record of the ID, so it is written first
+		if assigned {
+			if err := objectStore.SetMetadata(ctx, key, mergeMetadata(fileInfo.Metadata, id)); err != nil {
+				return nil, false, fmt.Errorf("failed to write receipt ID to %s: %w", key, err)
+			}
+		}
+		if err := indexReceiptID(ctx, objectStore, id, key); err != nil {
+			return nil, false, err
+		}
+	}
+	setUploadReceiptID(fileInfo, id)
+	return fileInfo, assigned, nil
+}
+
+// decodeSidecarReceiptID splits an ID encoding an image key and receipt index, which
+// ledger rows got before receipt IDs existed, so the migration can find the row's upload
+func decodeSidecarReceiptID(id string) (string, int, error) {
+	encoded, indexText, ok := strings.Cut(id, ".")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed receipt ID")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed receipt ID: %w", err)
+	}
+	index, err := strconv.Atoi(indexText)
+	if err != nil || index < 0 {
+		return "", 0, fmt.Errorf("malformed receipt ID")
+	}
+	if len(raw) == 0 {
+		return "", 0, fmt.Errorf("malformed receipt ID")
+	}
+	return string(raw), index, nil
+}
+
+// rowFile finds the stored upload of a ledger row by its image key or, in older rows, its object URL
+func rowFile(receipt StoredReceipt, byKey, byURL map[string]*repository.FileInfo) *repository.FileInfo {
+	if receipt.ImageKey != "" {
+		return byKey[receipt.ImageKey]
+	}
+	if receipt.ReceiptURL != "" {
+		return byURL[receipt.ReceiptURL]
+	}
+	return nil
+}
+
+// mergeMetadata returns a copy of metadata carrying the receipt ID
+func mergeMetadata(metadata map[string]string, id string) map[string]string {
+	merged := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged[ReceiptIDMetadata] = id
+	return merged
+}
@@ -0,0 +1,313 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// legacyReceiptID returns the ID encoding an image key that ledger rows got before
+// receipt IDs existed
+func legacyReceiptID(key string, index int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key)) + "." + strconv.Itoa(index)
+}
+
+func TestDecodeSidecarReceiptID(t *testing.T) {
+	key, index, err := decodeSidecarReceiptID(legacyReceiptID("2024-10-18/receipt.jpg", 1))
+	if err != nil || key != "2024-10-18/receipt.jpg" || index != 1 {
+		t.Errorf("decodeSidecarReceiptID() = %q, %d, %v", key, index, err)
+	}
+	if _, _, err := decodeSidecarReceiptID("row-4"); err == nil {
+		t.Error("Expected an error for a foreign ID")
+	}
+}
+
+func TestLocateReceiptOnlyIndexedIDs(t *testing.T) {
+	ctx := context.Background()
+	store := repository.NewMemoryObjectStore()
+	if err := store.Put(ctx, "jobs/abc.json", []byte("{}"), "application/json"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	uploadID := NewReceiptID()
+	if err := indexReceiptID(ctx, store, uploadID, "2024-10-18/receipt.jpg"); err != nil {
+		t.Fatalf("indexReceiptID() error = %v", err)
+	}
+
+	if key, index, err := locateReceipt(ctx, store, receiptIDFor(uploadID, 1)); err != nil || key != "2024-10-18/receipt.jpg" || index != 1 {
+		t.Errorf("locateReceipt() = %q, %d, %v", key, index, err)
+	}
+	// An ID naming an object directly is not accepted, even when the object exists
+	for _, id := range []string{legacyReceiptID("jobs/abc", 0), legacyReceiptID("2024-10-18/receipt.jpg", 0), NewReceiptID()} {
+		if _, _, err := locateReceipt(ctx, store, id); !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("locateReceipt(%q) error = %v, want ErrReceiptNotFound", id, err)
+		}
+	}
+}
+
+func TestParseReceiptID(t *testing.T) {
+	uploadID := NewReceiptID()
+
+	tests := []struct {
+		id        string
+		wantIndex int
+		wantOK    bool
+	}{
+		{receiptIDFor(uploadID, 0), 0, true},
+		{receiptIDFor(uploadID, 2), 2, true},
+		{uploadID + ".1", 0, false},
+		{uploadID + ".x", 0, false},
+		{legacyReceiptID("2024-10-18/receipt.jpg", 0), 0, false},
+		{"row-4", 0, false},
+		{"{" + uploadID + "}", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			gotID, gotIndex, ok := parseReceiptID(tt.id)
+			if ok != tt.wantOK {
+				t.Fatalf("parseReceiptID(%q) ok = %v, want %v", tt.id, ok, tt.wantOK)
+			}
+			if ok && (gotID != uploadID || gotIndex != tt.wantIndex) {
+				t.Errorf("parseReceiptID(%q) = %q, %d, want %q, %d", tt.id, gotID, gotIndex, uploadID, tt.wantIndex)
+			}
+		})
+	}
+
+	if receiptIDFor(uploadID, 1) != uploadID+".2" {
+		t.Errorf("Expected the second receipt to be numbered 2, got %q", receiptIDFor(uploadID, 1))
+	}
+	if NewReceiptID() == uploadID {
+		t.Error("Expected a new ID per upload")
+	}
+}
+
+func TestProcessResultReceiptIDs(t *testing.T) {
+	receipts := []openai.ExtractedReceipt{{Data: &openai.ReceiptData{}}, {Data: &openai.ReceiptData{}}}
+
+	fileInfo := &repository.FileInfo{Key: "2024-10-18/receipt.jpg"}
+	setUploadReceiptID(fileInfo, "0192a3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b")
+	result := &ProcessResult{FileInfo: fileInfo, Receipts: receipts}
+	want := []string{"0192a3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b", "0192a3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b.2"}
+	if got := result.ReceiptIDs(); !equalStrings(got, want) {
+		t.Errorf("ReceiptIDs() = %v, want %v", got, want)
+	}
+
+	// Files stored before receipt IDs existed have none until the migration
+	legacy := &ProcessResult{FileInfo: &repository.FileInfo{Key: "2024-10-18/old.jpg"}, Receipts: receipts[:1]}
+	if got := legacy.ReceiptIDs(); got != nil {
+		t.Errorf("Expected no IDs for a legacy file, got %v", got)
+	}
+
+	if got := (&ProcessResult{Receipts: receipts}).ReceiptIDs(); got != nil {
+		t.Errorf("Expected no IDs without a stored file, got %v", got)
+	}
+}
+
+// legacyUploads is a bucket and ledger recorded before receipt IDs existed
+type legacyUploads struct {
+	store  *repository.MemoryObjectStore
+	sheets *SheetsService
+	fake   *fakeSheets
+	files  map[string]*repository.FileInfo // Stored images by name
+	idC    string                          // ID of the one upload that already has one
+}
+
+// newLegacyUploads stores uploads A (one receipt), B (two receipts), C (with an ID),
+// D (ledger row holding its object URL), E (ledger row holding an edit-era sidecar ID)
+// and F (stored before sidecars existed, found through its URL), with one ledger row per
+// receipt and a row without a stored upload
+func newLegacyUploads(t *testing.T) *legacyUploads {
+	t.Helper()
+	ctx := context.Background()
+	l := &legacyUploads{store: repository.NewMemoryObjectStore(), files: map[string]*repository.FileInfo{}, idC: NewReceiptID()}
+
+	receipt := func(store string) openai.ExtractedReceipt {
+		return openai.ExtractedReceipt{Data: &openai.ReceiptData{StoreName: store, ReceiptDate: time.Date(2024, 10, 18, 0, 0, 0, 0, time.UTC), TotalAmount: 500}}
+	}
+	store := func(name string, metadata map[string]string, receipts ...openai.ExtractedReceipt) {
+		fileInfo, err := l.store.Upload(ctx, name+".jpg", []byte(name), "image/jpeg", metadata)
+		if err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+		if name == "D" {
+			fileInfo.URL = "https://receipts.s3.ap-northeast-1.amazonaws.com/" + fileInfo.Key
+		}
+		sidecar := Sidecar{Version: SidecarVersion, File: fileInfo, Receipts: receipts}
+		if err := repository.PutJSON(ctx, l.store, SidecarKey(fileInfo.Key), sidecar); err != nil {
+			t.Fatalf("PutJSON() error = %v", err)
+		}
+		l.files[name] = fileInfo
+	}
+	store("A", nil, receipt("A"))
+	store("B", nil, receipt("B1"), receipt("B2"))
+	store("C", map[string]string{ReceiptIDMetadata: l.idC}, receipt("C"))
+	store("D", nil, receipt("D"))
+	store("E", nil, receipt("E"))
+	legacy, err := l.store.Upload(ctx, "F.jpg", []byte("F"), "image/jpeg", nil)
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	l.files["F"] = legacy
+	if err := indexReceiptID(ctx, l.store, l.idC, l.files["C"].Key); err != nil {
+		t.Fatalf("indexReceiptID() error = %v", err)
+	}
+
+	data := receipt("").Data
+	l.sheets, l.fake = newFakeSheetsService(t,
+		receiptRow(data, l.files["A"].Key, ""),                     // Row 2
+		receiptRow(data, l.files["B"].Key, ""),                     // Row 3
+		receiptRow(data, l.files["B"].Key, ""),                     // Row 4
+		receiptRow(data, l.files["C"].Key, l.idC),                  // Row 5
+		receiptRow(data, l.files["D"].URL, ""),                     // Row 6
+		receiptRow(data, "", ""),                                   // Row 7
+		receiptRow(data, "", legacyReceiptID(l.files["E"].Key, 0)), // Row 8
+		receiptRow(data, l.files["F"].URL, ""),                     // Row 9
+	)
+	return l
+}
+
+// storedID returns the receipt ID recorded in the sidecar of an upload
+func (l *legacyUploads) storedID(t *testing.T, name string) string {
+	t.Helper()
+	var sidecar Sidecar
+	if err := repository.GetJSON(context.Background(), l.store, SidecarKey(l.files[name].Key), &sidecar); err != nil {
+		t.Fatalf("GetJSON() error = %v", err)
+	}
+	return uploadReceiptID(sidecar.File)
+}
+
+func TestBackfillReceiptIDs(t *testing.T) {
+	ctx := context.Background()
+	l := newLegacyUploads(t)
+
+	report, err := BackfillReceiptIDs(ctx, l.store, l.sheets, false)
+	if err != nil {
+		t.Fatalf("BackfillReceiptIDs() error = %v", err)
+	}
+	if want := (ReceiptIDBackfill{Uploads: 5, Rows: 7, Unmatched: 1}); *report != want {
+		t.Errorf("BackfillReceiptIDs() = %+v, want %+v", *report, want)
+	}
+
+	ids := map[string]string{}
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		id := l.storedID(t, name)
+		if _, _, ok := parseReceiptID(id); !ok {
+			t.Fatalf("Sidecar of %s has receipt ID %q", name, id)
+		}
+		ids[name] = id
+
+		// The image metadata and the index follow the sidecar
+		head, err := l.store.Head(ctx, l.files[name].Key)
+		if err != nil || head.Metadata[ReceiptIDMetadata] != id {
+			t.Errorf("Head(%s) = %+v, %v, want receipt ID %s", name, head, err, id)
+		}
+		if key, _, err := locateReceipt(ctx, l.store, id); err != nil || key != l.files[name].Key {
+			t.Errorf("locateReceipt(%s) = %q, %v, want %q", id, key, err, l.files[name].Key)
+		}
+	}
+	if ids["C"] != l.idC {
+		t.Errorf("Receipt ID of C = %s, want the existing %s", ids["C"], l.idC)
+	}
+
+	column := l.fake.column(receiptIDColumn)
+	// F has no sidecar; its ID is only in the image metadata and the index
+	head, err := l.store.Head(ctx, l.files["F"].Key)
+	if err != nil {
+		t.Fatalf("Head(F) error = %v", err)
+	}
+	ids["F"] = head.Metadata[ReceiptIDMetadata]
+	if key, _, err := locateReceipt(ctx, l.store, ids["F"]); err != nil || key != l.files["F"].Key {
+		t.Errorf("locateReceipt(%s) = %q, %v, want %q", ids["F"], key, err, l.files["F"].Key)
+	}
+
+	want := []string{ids["A"], ids["B"], ids["B"] + ".2", l.idC, ids["D"], column[5], ids["E"], ids["F"]}
+	if !reflect.DeepEqual(column, want) {
+		t.Errorf("영수증ID column = %v, want %v", column, want)
+	}
+	if _, _, ok := parseReceiptID(column[5]); !ok {
+		t.Errorf("Row without a stored upload got ID %q, want a new receipt ID", column[5])
+	}
+
+	// The second receipt of a photo resolves to the same image
+	stored, err := NewS3ReceiptStore(l.store).Get(ctx, ids["B"]+".2")
+	if err != nil || stored.ImageKey != l.files["B"].Key || stored.StoreName != "B2" {
+		t.Errorf("Get(%s.2) = %+v, %v", ids["B"], stored, err)
+	}
+}
+
+func TestBackfillReceiptIDsDryRun(t *testing.T) {
+	ctx := context.Background()
+	l := newLegacyUploads(t)
+	keysBefore, _ := l.store.List(ctx, "")
+	columnBefore := l.fake.column(receiptIDColumn)
+
+	report, err := BackfillReceiptIDs(ctx, l.store, l.sheets, true)
+	if err != nil {
+		t.Fatalf("BackfillReceiptIDs() error = %v", err)
+	}
+	if want := (ReceiptIDBackfill{Uploads: 5, Rows: 7, Unmatched: 1}); *report != want {
+		t.Errorf("BackfillReceiptIDs() = %+v, want %+v", *report, want)
+	}
+
+	if l.fake.writes != 0 || !reflect.DeepEqual(l.fake.column(receiptIDColumn), columnBefore) {
+		t.Errorf("Dry run wrote %d time(s) to the sheet", l.fake.writes)
+	}
+	if keys, _ := l.store.List(ctx, ""); !reflect.DeepEqual(keys, keysBefore) {
+		t.Errorf("Dry run stored objects: %v, want %v", keys, keysBefore)
+	}
+	if id := l.storedID(t, "A"); id != "" {
+		t.Errorf("Dry run wrote receipt ID %q to a sidecar", id)
+	}
+	for _, name := range []string{"A", "F"} {
+		if head, _ := l.store.Head(ctx, l.files[name].Key); head.Metadata[ReceiptIDMetadata] != "" {
+			t.Errorf("Dry run wrote metadata %v to %s", head.Metadata, name)
+		}
+	}
+}
+
+func TestBackfillReceiptIDsIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	l := newLegacyUploads(t)
+
+	if _, err := BackfillReceiptIDs(ctx, l.store, l.sheets, false); err != nil {
+		t.Fatalf("BackfillReceiptIDs() error = %v", err)
+	}
+	column, writes := l.fake.column(receiptIDColumn), l.fake.writes
+	idA := l.storedID(t, "A")
+
+	report, err := BackfillReceiptIDs(ctx, l.store, l.sheets, false)
+	if err != nil {
+		t.Fatalf("BackfillReceiptIDs() again error = %v", err)
+	}
+	if *report != (ReceiptIDBackfill{}) {
+		t.Errorf("BackfillReceiptIDs() again = %+v, want nothing assigned", *report)
+	}
+	if l.fake.writes != writes || !reflect.DeepEqual(l.fake.column(receiptIDColumn), column) {
+		t.Errorf("Second run changed the 영수증ID column to %v", l.fake.column(receiptIDColumn))
+	}
+	if id := l.storedID(t, "A"); id != idA {
+		t.Errorf("Second run changed the receipt ID of A from %s to %s", idA, id)
+	}
+}
+
+func TestBackfillReceiptIDsWithoutSheets(t *testing.T) {
+	l := newLegacyUploads(t)
+
+	report, err := BackfillReceiptIDs(context.Background(), l.store, nil, false)
+	if err != nil {
+		t.Fatalf("BackfillReceiptIDs() error = %v", err)
+	}
+	if want := (ReceiptIDBackfill{Uploads: 4}); *report != want {
+		t.Errorf("BackfillReceiptIDs() = %+v, want %+v", *report, want)
+	}
+	if l.fake.writes != 0 {
+		t.Errorf("Wrote %d time(s) to the sheet it was not given", l.fake.writes)
+	}
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultImageURLExpiry is how long presigned receipt image URLs stay valid
+const DefaultImageURLExpiry = 15 * time.Minute
+
+// ErrNoReceiptImage is returned for receipts without an image in the bucket
+var ErrNoReceiptImage = errors.New("receipt has no stored image")
+
+// ImageURL returns a presigned URL for reading the stored object under key
+// The bucket can stay private: the URL grants access to this object only, until it expires
+func (s *ReceiptService) ImageURL(ctx context.Context, key string) (string, error) {
+	return s.objectStore.Presign(ctx, key, s.imageURLExpiry)
+}
+
+// ReceiptImageURL returns a presigned URL for the image of a stored receipt
+// Ledger rows written before keys were recorded hold the object's URL instead
+func (s *ReceiptService) ReceiptImageURL(ctx context.Context, receipt *StoredReceipt) (string, error) {
+	key := receipt.ImageKey
+	if key == "" {
+		var ok bool
+		if key, ok = s.objectStore.KeyForURL(receipt.ReceiptURL); !ok {
+			return "", ErrNoReceiptImage
+		}
+	}
+	return s.ImageURL(ctx, key)
+}
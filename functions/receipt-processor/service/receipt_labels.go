@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Object metadata keys and tag keys describing the extracted receipt of a stored file
+// Together with ReceiptIDMetadata these are written both as metadata and as tags, so
+// lifecycle rules and S3 Inventory can select receipts by category
+const (
+	ReceiptStoreMetadata    = "receipt-store"
+	ReceiptTotalMetadata    = "receipt-total"
+	ReceiptCurrencyMetadata = "receipt-currency"
+	ReceiptCategoryMetadata = "receipt-category"
+	ReceiptDateMetadata     = "receipt-date"
+	ReceiptCountMetadata    = "receipt-count" // Only set when a photo holds several receipts
+	ExtractionModelMetadata = "extraction-model"
+)
+
+// receiptLabels returns the fields of the first extracted receipt to label the stored
+// files with, or nil when nothing was extracted
+func receiptLabels(result *ProcessResult) map[string]string {
+	if len(result.Receipts) == 0 || result.Receipts[0].Data == nil {
+		return nil
+	}
+	data := result.Receipts[0].Data
+
+	labels := map[string]string{
+		ReceiptIDMetadata:       uploadReceiptID(result.FileInfo),
+		ReceiptStoreMetadata:    data.StoreName,
+		ReceiptCurrencyMetadata: data.Currency,
+		ReceiptCategoryMetadata: data.ExpenseCategory,
+		ReceiptTotalMetadata:    strconv.FormatFloat(data.TotalAmount, 'f', -1, 64),
+	}
+	if !data.ReceiptDate.IsZero() {
+		labels[ReceiptDateMetadata] = data.ReceiptDate.Format("2006-01-02")
+	}
+	if len(result.Receipts) > 1 {
+		labels[ReceiptCountMetadata] = strconv.Itoa(len(result.Receipts))
+	}
+	if result.Extraction != nil {
+		labels[ExtractionModelMetadata] = result.Extraction.Model
+	}
+
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+// labelFiles writes the extracted receipt's fields to the stored pieces as tags and,
+// for files the service uploaded, as metadata. Rewriting metadata copies the object,
+// which would announce objects of other uploaders as new again, so those are only tagged
+// Pieces relocated by relocateFiles already carry the metadata and are not copied again
+// Failures are only logged: the sidecar and ledger still hold the fields
+func (s *ReceiptService) labelFiles(ctx context.Context, result *ProcessResult, opts ProcessOptions) {
+	labels := receiptLabels(result)
+	if labels == nil {
+		return
+	}
+
+	for _, fileInfo := range append([]*repository.FileInfo{result.FileInfo}, result.AdditionalFiles...) {
+		applyLabels(ctx, s.objectStore, fileInfo, labels, !opts.KeepFiles)
+	}
+}
+
+// applyLabels tags a stored piece with labels and, when writeMetadata is set, replaces
+// the receipt labels in its metadata
+func applyLabels(ctx context.Context, objectStore repository.ObjectStore, fileInfo *repository.FileInfo, labels map[string]string, writeMetadata bool) {
+	if writeMetadata && !hasLabels(fileInfo.Metadata, labels) {
+		metadata := labeledMetadata(fileInfo.Metadata, labels)
+		if err := objectStore.SetMetadata(ctx, fileInfo.Key, metadata); err != nil {
+			log.Printf("Warning: Failed to write receipt metadata to %s: %v", fileInfo.Key, err)
+		} else {
+			fileInfo.Metadata = metadata
+		}
+	}
+
+	// Tagged after the metadata copy, so the tags apply to the final object
+	if err := objectStore.SetTags(ctx, fileInfo.Key, labels); err != nil {
+		log.Printf("Warning: Failed to tag %s: %v", fileInfo.Key, err)
+	}
+}
+
+// labeledMetadata returns a copy of metadata with its receipt labels replaced by labels
+func labeledMetadata(metadata, labels map[string]string) map[string]string {
+	labeled := make(map[string]string, len(metadata)+len(labels))
+	for k, v := range metadata {
+		if !isReceiptLabel(k) {
+			labeled[k] = v
+		}
+	}
+	for k, v := range labels {
+		labeled[k] = v
+	}
+	return labeled
+}
+
+// isReceiptLabel reports whether a metadata key holds a field of the extracted receipt
+// The receipt ID is not one: it identifies the upload whatever was extracted
+func isReceiptLabel(key string) bool {
+	switch key {
+	case ReceiptStoreMetadata, ReceiptTotalMetadata, ReceiptCurrencyMetadata, ReceiptCategoryMetadata,
+		ReceiptDateMetadata, ReceiptCountMetadata, ExtractionModelMetadata:
+		return true
+	}
+	return false
+}
+
+// hasReceiptLabels reports whether metadata holds any receipt label, i.e. the service wrote it
+func hasReceiptLabels(metadata map[string]string) bool {
+	for k := range metadata {
+		if isReceiptLabel(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLabels reports whether metadata already holds exactly these labels
+func hasLabels(metadata, labels map[string]string) bool {
+	for k, v := range labels {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	for k := range metadata {
+		if _, ok := labels[k]; !ok && isReceiptLabel(k) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"reflect"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestReceiptLabels(t *testing.T) {
+	fileInfo := &repository.FileInfo{Key: "2024-10-18/receipt.jpg", Metadata: map[string]string{ReceiptIDMetadata: "abc"}}
+	receipt := &openai.ReceiptData{
+		StoreName:       "Corner Cafe",
+		ReceiptDate:     time.Date(2024, 10, 18, 15, 30, 0, 0, time.UTC),
+		TotalAmount:     1234.5,
+		Currency:        "JPY",
+		ExpenseCategory: "식비",
+	}
+
+	tests := []struct {
+		name   string
+		result *ProcessResult
+		want   map[string]string
+	}{
+		{
+			name:   "Nothing extracted",
+			result: &ProcessResult{FileInfo: fileInfo},
+		},
+		{
+			name: "One receipt",
+			result: &ProcessResult{
+				FileInfo:   fileInfo,
+				Receipts:   []openai.ExtractedReceipt{{Data: receipt}},
+				Extraction: &ExtractionMetadata{Model: "gpt-4o"},
+			},
+			want: map[string]string{
+				"receipt-id":       "abc",
+				"receipt-store":    "Corner Cafe",
+				"receipt-total":    "1234.5",
+				"receipt-currency": "JPY",
+				"receipt-category": "식비",
+				"receipt-date":     "2024-10-18",
+				"extraction-model": "gpt-4o",
+			},
+		},
+		{
+			name: "Several receipts without optional fields",
+			result: &ProcessResult{
+				FileInfo: fileInfo,
+				Receipts: []openai.ExtractedReceipt{{Data: &openai.ReceiptData{TotalAmount: 500}}, {Data: receipt}},
+			},
+			want: map[string]string{
+				"receipt-id":    "abc",
+				"receipt-total": "500",
+				"receipt-count": "2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := receiptLabels(tt.result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("receiptLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiptServiceLabelsStoredFiles(t *testing.T) {
+	ctx := context.Background()
+	store := repository.NewMemoryObjectStore()
+	receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+
+	// Uploads get metadata and tags
+	result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+	if err != nil {
+		t.Fatalf("ProcessReceipt() error = %v", err)
+	}
+	head, err := store.Head(ctx, result.FileInfo.Key)
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if head.Metadata[ReceiptCategoryMetadata] != "기타" || head.Metadata[ReceiptTotalMetadata] != "1100" || head.Metadata[ReceiptIDMetadata] != uploadReceiptID(result.FileInfo) {
+		t.Errorf("Head() metadata = %v", head.Metadata)
+	}
+	if !reflect.DeepEqual(result.FileInfo.Metadata, head.Metadata) {
+		t.Errorf("FileInfo metadata = %v, want %v", result.FileInfo.Metadata, head.Metadata)
+	}
+	tags, err := store.GetTags(ctx, result.FileInfo.Key)
+	if err != nil || tags[ReceiptStoreMetadata] != "Fake Store" || tags[ReceiptDateMetadata] != "2024-01-01" || tags[ReceiptCurrencyMetadata] != "JPY" {
+		t.Errorf("GetTags() = %v, %v", tags, err)
+	}
+
+	// Objects of other uploaders are only tagged
+	if err := store.Put(ctx, "inbox/scan.png", photo.Bytes(), "image/png"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if _, err := receiptService.ProcessStoredObject(ctx, "inbox/scan.png", ProcessOptions{Force: true}); err != nil {
+		t.Fatalf("ProcessStoredObject() error = %v", err)
+	}
+	if head, _ := store.Head(ctx, "inbox/scan.png"); len(head.Metadata) != 0 {
+		t.Errorf("Head() metadata of a stored object = %v, want none", head.Metadata)
+	}
+	if tags, _ := store.GetTags(ctx, "inbox/scan.png"); tags[ReceiptCategoryMetadata] != "기타" || tags[ReceiptIDMetadata] == "" {
+		t.Errorf("GetTags() of a stored object = %v", tags)
+	}
+}
+
+// metadataCountingStore counts the metadata rewrites, each a copy of the object in S3
+type metadataCountingStore struct {
+	*repository.MemoryObjectStore
+	setMetadata int
+}
+
+func (m *metadataCountingStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	m.setMetadata++
+	return m.MemoryObjectStore.SetMetadata(ctx, key, metadata)
+}
+
+func TestReceiptServiceLabelsRelocatedFilesOnce(t *testing.T) {
+	ctx := context.Background()
+	layout, err := repository.NewKeyLayout("{receipt_year}/{category}/{rand}{ext}", "")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+	store := &metadataCountingStore{MemoryObjectStore: repository.NewMemoryObjectStore()}
+	store.SetKeyLayout(layout)
+	receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+	if err != nil {
+		t.Fatalf("ProcessReceipt() error = %v", err)
+	}
+
+	if store.setMetadata != 0 {
+		t.Errorf("SetMetadata() called %d times, want the labels written by the relocation", store.setMetadata)
+	}
+	head, err := store.Head(ctx, result.FileInfo.Key)
+	if err != nil || head.Metadata[ReceiptCategoryMetadata] != "기타" || head.Metadata[ReceiptIDMetadata] == "" {
+		t.Errorf("Head() of the relocated file = %+v, %v", head, err)
+	}
+	if tags, _ := store.GetTags(ctx, result.FileInfo.Key); tags[ReceiptCategoryMetadata] != "기타" {
+		t.Errorf("GetTags() = %v", tags)
+	}
+}
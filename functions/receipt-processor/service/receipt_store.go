@@ -0,0 +1,463 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Receipt listing page sizes
+const (
+	DefaultReceiptPageSize = 50
+	MaxReceiptPageSize     = 200
+	receiptIndexBatch      = 200 // Index keys listed per request by S3ReceiptStore
+)
+
+var (
+	// ErrReceiptNotFound is returned for unknown receipt IDs
+	ErrReceiptNotFound = errors.New("receipt not found")
+	// ErrInvalidCursor is returned for pagination cursors not issued by List
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// StoredReceipt is a receipt read back from a ReceiptStore
+type StoredReceipt struct {
+	ID            string              `json:"id"`
+	Date          string              `json:"date"` // YYYY-MM-DD, empty when unknown
+	Category      string              `json:"category"`
+	StoreName     string              `json:"store_name"`
+	TotalAmount   float64             `json:"total_amount"`
+	ItemCount     int                 `json:"item_count"`
+	ItemsSummary  string              `json:"items_summary,omitempty"`
+	PaymentMethod string              `json:"payment_method"`
+	ImageKey      string              `json:"image_key,omitempty"`   // S3 key of the image; fetch it through GET /receipts/{id}/image
+	ReceiptURL    string              `json:"receipt_url,omitempty"` // Object URL recorded by rows written before image keys
+	Memo          string              `json:"memo,omitempty"`
+	Data          *openai.ReceiptData `json:"data,omitempty"` // Full extraction result, when the store keeps it
+
+	row int // Sheet row, which orders spreadsheet rows without an ID in listings
+}
+
+// listingID returns the ID ordering a receipt in listings and cursors
+// Rows without an ID sort after the receipts of their day. Their row number only
+// keeps pages apart; it is never exposed as an ID since deletes shift it
+func (r StoredReceipt) listingID() string {
+	if r.ID != "" || r.row == 0 {
+		return r.ID
+	}
+	return fmt.Sprintf("~row-%09d", r.row)
+}
+
+// ReceiptQuery filters and pages a receipt listing; zero fields do not filter
+type ReceiptQuery struct {
+	From          string   // Earliest receipt date, YYYY-MM-DD inclusive
+	To            string   // Latest receipt date, YYYY-MM-DD inclusive
+	Category      string   // Exact match, ignoring case
+	Store         string   // Substring of the store name, ignoring case
+	MinAmount     *float64 // Smallest total
+	MaxAmount     *float64 // Largest total
+	PaymentMethod string   // Exact match, ignoring case
+	Limit         int      // Page size (default: DefaultReceiptPageSize, at most MaxReceiptPageSize)
+	Cursor        string   // NextCursor of the previous page
+}
+
+// ReceiptPage is one page of a receipt listing
+type ReceiptPage struct {
+	Receipts   []StoredReceipt `json:"receipts"`
+	NextCursor string          `json:"next_cursor,omitempty"` // Empty on the last page
+}
+
+// ReceiptStore reads recorded receipts
+type ReceiptStore interface {
+	List(ctx context.Context, query ReceiptQuery) (*ReceiptPage, error)
+	Get(ctx context.Context, id string) (*StoredReceipt, error) // ErrReceiptNotFound when absent
+}
+
+// matches reports whether a receipt passes the query's filters
+func (q ReceiptQuery) matches(r StoredReceipt) bool {
+	if q.From != "" && (r.Date == "" || r.Date < q.From) {
+		return false
+	}
+	if q.To != "" && (r.Date == "" || r.Date > q.To) {
+		return false
+	}
+	if q.Category != "" && !strings.EqualFold(r.Category, q.Category) {
+		return false
+	}
+	if q.Store != "" && !strings.Contains(strings.ToLower(r.StoreName), strings.ToLower(q.Store)) {
+		return false
+	}
+	if q.MinAmount != nil && r.TotalAmount < *q.MinAmount {
+		return false
+	}
+	if q.MaxAmount != nil && r.TotalAmount > *q.MaxAmount {
+		return false
+	}
+	if q.PaymentMethod != "" && !strings.EqualFold(r.PaymentMethod, q.PaymentMethod) {
+		return false
+	}
+	return true
+}
+
+// pageSize returns the query's page size within the allowed range
+func (q ReceiptQuery) pageSize() int {
+	if q.Limit <= 0 {
+		return DefaultReceiptPageSize
+	}
+	return min(q.Limit, MaxReceiptPageSize)
+}
+
+// pageReceipts filters, sorts and pages receipts
+// Receipts are ordered newest first, then by ID. The cursor holds the position of the last
+// returned receipt rather than an offset, so receipts added meanwhile do not shift pages
+func pageReceipts(receipts []StoredReceipt, query ReceiptQuery) (*ReceiptPage, error) {
+	limit := query.pageSize()
+
+	var matched []StoredReceipt
+	for _, receipt := range receipts {
+		if query.matches(receipt) {
+			matched = append(matched, receipt)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return receiptBefore(matched[i].Date, matched[i].listingID(), matched[j].Date, matched[j].listingID())
+	})
+
+	start := 0
+	if query.Cursor != "" {
+		date, id, err := decodeReceiptCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(matched), func(i int) bool {
+			return receiptBefore(date, id, matched[i].Date, matched[i].listingID())
+		})
+	}
+
+	end := min(start+limit, len(matched))
+	page := &ReceiptPage{Receipts: matched[start:end]}
+	if page.Receipts == nil {
+		page.Receipts = []StoredReceipt{}
+	}
+	if end < len(matched) {
+		last := matched[end-1]
+		page.NextCursor = encodeReceiptCursor(last.Date, last.listingID())
+	}
+	return page, nil
+}
+
+// receiptBefore reports whether receipt a is listed before receipt b
+func receiptBefore(dateA, idA, dateB, idB string) bool {
+	if dateA != dateB {
+		return dateA > dateB
+	}
+	return idA < idB
+}
+
+// encodeReceiptCursor encodes a listing position
+func encodeReceiptCursor(date, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(date + "\n" + id))
+}
+
+// decodeReceiptCursor decodes a listing position
+func decodeReceiptCursor(cursor string) (string, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", ErrInvalidCursor
+	}
+	date, id, ok := strings.Cut(string(raw), "\n")
+	if !ok {
+		return "", "", ErrInvalidCursor
+	}
+	return date, id, nil
+}
+
+// SheetsReceiptStore reads receipts from the ledger spreadsheet
+// IDs come from the 영수증ID column. Rows written before it existed are listed without
+// an ID and cannot be fetched until migrate-receipt-ids gives them one: row numbers
+// shift with every delete, so they would name different receipts over time.
+// Rows hold only the summary columns
+type SheetsReceiptStore struct {
+	sheets *SheetsService
+}
+
+// NewSheetsReceiptStore creates a store reading from the spreadsheet
+func NewSheetsReceiptStore(sheets *SheetsService) *SheetsReceiptStore {
+	return &SheetsReceiptStore{sheets: sheets}
+}
+
+// List reads every row and returns the requested page
+func (s *SheetsReceiptStore) List(ctx context.Context, query ReceiptQuery) (*ReceiptPage, error) {
+	rows, err := s.sheets.ReadReceiptRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	receipts := make([]StoredReceipt, 0, len(rows))
+	for i, row := range rows {
+		if receipt, ok := parseReceiptRow(i+2, row); ok {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return pageReceipts(receipts, query)
+}
+
+// Get reads the row carrying the receipt ID
+func (s *SheetsReceiptStore) Get(ctx context.Context, id string) (*StoredReceipt, error) {
+	if id == "" {
+		return nil, ErrReceiptNotFound
+	}
+	rowNumber, row, err := s.sheets.FindReceiptRow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	receipt, ok := parseReceiptRow(rowNumber, row)
+	if !ok {
+		return nil, ErrReceiptNotFound
+	}
+	return &receipt, nil
+}
+
+// parseReceiptRow reads a row written by formatReceiptRow
+// Columns: 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모,영수증ID
+// Blank rows return false
+func parseReceiptRow(rowNumber int, row []interface{}) (StoredReceipt, bool) {
+	cell := func(i int) string {
+		if i >= len(row) || row[i] == nil {
+			return ""
+		}
+		return strings.TrimSpace(fmt.Sprint(row[i]))
+	}
+
+	receipt := StoredReceipt{
+		ID:            cell(receiptIDColumn),
+		Date:          normalizeSheetDate(cell(0)),
+		Category:      cell(1),
+		StoreName:     cell(2),
+		TotalAmount:   parseAmount(cell(3)),
+		ItemsSummary:  cell(5),
+		PaymentMethod: cell(6),
+		Memo:          cell(8),
+	}
+	// 영수증링크 holds the image key, or an object URL in older rows
+	if link := cell(7); strings.HasPrefix(link, "https://") || strings.HasPrefix(link, "http://") {
+		receipt.ReceiptURL = link
+	} else {
+		receipt.ImageKey = link
+	}
+	receipt.ItemCount, _ = strconv.Atoi(cell(4))
+	receipt.row = rowNumber
+
+	blank := true
+	for i := range row {
+		if cell(i) != "" {
+			blank = false
+			break
+		}
+	}
+	return receipt, !blank
+}
+
+// normalizeSheetDate converts a date cell to YYYY-MM-DD
+// Sheets turns the written dates into date values and formats them per locale when read
+func normalizeSheetDate(s string) string {
+	for _, layout := range []string{"2006-01-02", "2006/01/02", "2006/1/2", "2006.1.2", "1/2/2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return s
+}
+
+// parseAmount reads a total as formatted by Sheets, e.g. "1,250" or "¥1,250.50"
+func parseAmount(s string) float64 {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	amount, _ := strconv.ParseFloat(b.String(), 64)
+	return amount
+}
+
+// S3ReceiptStore reads receipts from the JSON sidecars next to the stored images
+// Listings read the receipt ID index, whose records list each upload's receipts, so only
+// uploads with a receipt ID are listed; single receipts are read from their sidecar
+type S3ReceiptStore struct {
+	objectStore repository.ObjectStore
+}
+
+// NewS3ReceiptStore creates a store reading sidecars from the receipts bucket
+func NewS3ReceiptStore(objectStore repository.ObjectStore) *S3ReceiptStore {
+	return &S3ReceiptStore{objectStore: objectStore}
+}
+
+// List returns a page of receipts in upload order, oldest first
+// Receipt IDs are time-ordered UUIDs, so the index lists uploads in that order and a page
+// only reads the index records it returns, plus the next matching one to tell whether
+// another page follows. The cursor holds the index key and ID of the last returned receipt
+func (s *S3ReceiptStore) List(ctx context.Context, query ReceiptQuery) (*ReceiptPage, error) {
+	limit := query.pageSize()
+	page := &ReceiptPage{Receipts: []StoredReceipt{}}
+	var pageKey string // Index key of the last returned receipt
+	// add appends a matching receipt and reports false once the page is full
+	add := func(key string, receipt StoredReceipt) bool {
+		if !query.matches(receipt) {
+			return true
+		}
+		if len(page.Receipts) == limit {
+			page.NextCursor = encodeReceiptCursor(pageKey, page.Receipts[limit-1].ID)
+			return false
+		}
+		page.Receipts = append(page.Receipts, receipt)
+		pageKey = key
+		return true
+	}
+
+	var after string
+	if query.Cursor != "" {
+		key, id, err := decodeReceiptCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		_, last, ok := parseReceiptID(id)
+		if !ok || !strings.HasPrefix(key, DefaultReceiptIndexPrefix) {
+			return nil, ErrInvalidCursor
+		}
+		// The rest of the upload the previous page ended in
+		for _, receipt := range s.indexedReceipts(ctx, key) {
+			if _, index, _ := parseReceiptID(receipt.ID); index > last && !add(key, receipt) {
+				return page, nil
+			}
+		}
+		after = key
+	}
+
+	for {
+		keys, err := s.objectStore.ListAfter(ctx, DefaultReceiptIndexPrefix, after, receiptIndexBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !IsSidecarKey(key) {
+				continue
+			}
+			for _, receipt := range s.indexedReceipts(ctx, key) {
+				if !add(key, receipt) {
+					return page, nil
+				}
+			}
+		}
+		if len(keys) < receiptIndexBatch {
+			return page, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// indexedReceipts returns the receipts of the upload of an index record, without data
+// Records written before they listed receipts fall back to the upload's sidecar;
+// unreadable records are skipped
+func (s *S3ReceiptStore) indexedReceipts(ctx context.Context, key string) []StoredReceipt {
+	var entry receiptIndexEntry
+	if err := repository.GetJSON(ctx, s.objectStore, key, &entry); err != nil {
+		log.Printf("Warning: Skipping unreadable index record %s: %v", key, err)
+		return nil
+	}
+	if entry.Receipts != nil {
+		return entry.Receipts
+	}
+
+	var sidecar Sidecar
+	if err := repository.GetJSON(ctx, s.objectStore, SidecarKey(entry.Key), &sidecar); err != nil {
+		log.Printf("Warning: Skipping unreadable sidecar of %s: %v", entry.Key, err)
+		return nil
+	}
+	receipts := sidecarReceipts(&sidecar)
+	for i := range receipts {
+		receipts[i].Data = nil
+	}
+	return receipts
+}
+
+// Get reads the sidecar holding the receipt
+func (s *S3ReceiptStore) Get(ctx context.Context, id string) (*StoredReceipt, error) {
+	key, index, err := locateReceipt(ctx, s.objectStore, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var sidecar Sidecar
+	err = repository.GetJSON(ctx, s.objectStore, SidecarKey(key), &sidecar)
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return nil, ErrReceiptNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	receipt, ok := sidecarReceipt(&sidecar, index)
+	if !ok {
+		return nil, ErrReceiptNotFound
+	}
+	return &receipt, nil
+}
+
+// isReceiptSidecar reports whether key is the sidecar of a receipt image rather than
+// one of the service's own records, which are also JSON
+func isReceiptSidecar(key string) bool {
+	if !IsSidecarKey(key) || strings.HasPrefix(key, DefaultFingerprintPrefix) || strings.HasPrefix(key, DefaultReceiptIndexPrefix) {
+		return false
+	}
+	return !strings.HasPrefix(key, DefaultIdempotencyPrefix) && !strings.HasPrefix(key, DefaultJobPrefix)
+}
+
+// sidecarReceipts converts the receipts of a sidecar
+// Sidecars of duplicates and failed extractions hold no receipts
+func sidecarReceipts(sidecar *Sidecar) []StoredReceipt {
+	var receipts []StoredReceipt
+	for i := range sidecar.Receipts {
+		if receipt, ok := sidecarReceipt(sidecar, i); ok {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts
+}
+
+// sidecarReceipt converts the index-th receipt of a sidecar
+// Deleted receipts and receipts without data return false
+func sidecarReceipt(sidecar *Sidecar, index int) (StoredReceipt, bool) {
+	if sidecar.File == nil || index >= len(sidecar.Receipts) || sidecar.Deleted(index) {
+		return StoredReceipt{}, false
+	}
+	data := sidecar.Receipts[index].Data
+	if data == nil {
+		return StoredReceipt{}, false
+	}
+
+	receipt := StoredReceipt{
+		ID:            storedReceiptID(sidecar.File, index),
+		Category:      data.ExpenseCategory,
+		StoreName:     data.StoreName,
+		TotalAmount:   data.TotalAmount,
+		ItemCount:     len(data.Items),
+		ItemsSummary:  summarizeItems(data.Items),
+		PaymentMethod: data.PaymentMethod,
+		ImageKey:      sidecar.File.Key,
+		Data:          data,
+	}
+	if !data.ReceiptDate.IsZero() {
+		receipt.Date = data.ReceiptDate.Format("2006-01-02")
+	}
+	return receipt, true
+}
@@ -0,0 +1,431 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func testReceipts() []StoredReceipt {
+	return []StoredReceipt{
+		{ID: "row-2", Date: "2024-10-16", Category: "食費", StoreName: "FamilyMart 新宿店", TotalAmount: 450, PaymentMethod: "現金"},
+		{ID: "row-3", Date: "2024-10-18", Category: "日用品", StoreName: "Matsukiyo", TotalAmount: 1280, PaymentMethod: "クレジットカード"},
+		{ID: "row-4", Date: "2024-10-18", Category: "食費", StoreName: "Lawson", TotalAmount: 980, PaymentMethod: "現金"},
+		{ID: "row-5", Date: "2024-10-20", Category: "交通費", StoreName: "JR East", TotalAmount: 2200, PaymentMethod: "Suica"},
+		{ID: "row-6", Date: "", Category: "미분류", StoreName: "Unknown", TotalAmount: 300},
+	}
+}
+
+func TestPageReceiptsFilters(t *testing.T) {
+	amount := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		query ReceiptQuery
+		want  []string
+	}{
+		{"all, newest first", ReceiptQuery{}, []string{"row-5", "row-3", "row-4", "row-2", "row-6"}},
+		{"date range", ReceiptQuery{From: "2024-10-17", To: "2024-10-18"}, []string{"row-3", "row-4"}},
+		{"category ignores case", ReceiptQuery{Category: "食費"}, []string{"row-4", "row-2"}},
+		{"store substring", ReceiptQuery{Store: "familymart"}, []string{"row-2"}},
+		{"amount range", ReceiptQuery{MinAmount: amount(900), MaxAmount: amount(1300)}, []string{"row-3", "row-4"}},
+		{"payment method", ReceiptQuery{PaymentMethod: "suica"}, []string{"row-5"}},
+		{"no match", ReceiptQuery{Store: "Seven"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := pageReceipts(testReceipts(), tt.query)
+			if err != nil {
+				t.Fatalf("pageReceipts() error = %v", err)
+			}
+			if got := receiptIDs(page.Receipts); !equalStrings(got, tt.want) {
+				t.Errorf("pageReceipts() = %v, want %v", got, tt.want)
+			}
+			if page.Receipts == nil {
+				t.Error("Expected an empty list rather than null")
+			}
+		})
+	}
+}
+
+func TestPageReceiptsCursor(t *testing.T) {
+	receipts := testReceipts()
+
+	var all []string
+	query := ReceiptQuery{Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("Pagination did not terminate")
+		}
+		page, err := pageReceipts(receipts, query)
+		if err != nil {
+			t.Fatalf("pageReceipts() error = %v", err)
+		}
+		all = append(all, receiptIDs(page.Receipts)...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+
+		// A receipt added between pages does not shift the following pages
+		receipts = append(receipts, StoredReceipt{ID: "row-99", Date: "2024-12-31"})
+	}
+
+	want := []string{"row-5", "row-3", "row-4", "row-2", "row-6"}
+	if !equalStrings(all, want) {
+		t.Errorf("Paged through %v, want %v", all, want)
+	}
+
+	if _, err := pageReceipts(receipts, ReceiptQuery{Cursor: "not a cursor!"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestParseReceiptRow(t *testing.T) {
+	row := (&SheetsService{}).formatReceiptRow(&openai.ReceiptData{
+		StoreName:       "Lawson",
+		ReceiptDate:     time.Date(2024, 10, 18, 0, 0, 0, 0, time.UTC),
+		TotalAmount:     980,
+		ExpenseCategory: "食費",
+		Items:           []openai.ReceiptItem{{Name: "Onigiri"}, {Name: "Tea"}},
+		PaymentMethod:   "現金",
+	}, "https://example.com/r.jpg", "memo", "")
+
+	receipt, ok := parseReceiptRow(4, row)
+	if !ok {
+		t.Fatal("Expected a receipt")
+	}
+	// Rows without a receipt ID are not addressable
+	want := StoredReceipt{
+		Date: "2024-10-18", Category: "食費", StoreName: "Lawson", TotalAmount: 980,
+		ItemCount: 2, ItemsSummary: "Onigiri, Tea", PaymentMethod: "現金", ReceiptURL: "https://example.com/r.jpg", Memo: "memo",
+		row: 4,
+	}
+	if receipt != want {
+		t.Errorf("parseReceiptRow() = %+v, want %+v", receipt, want)
+	}
+
+	// Values as Sheets formats them when read back
+	receipt, _ = parseReceiptRow(5, []interface{}{"2024/10/18", "食費", "Lawson", "¥1,280"})
+	if receipt.Date != "2024-10-18" || receipt.TotalAmount != 1280 {
+		t.Errorf("Expected formatted cells to be normalized, got %+v", receipt)
+	}
+
+	// Rows written with a receipt ID are addressed by it
+	row[receiptIDColumn] = "aW5ib3gvYS5qcGc.0"
+	if receipt, _ := parseReceiptRow(7, row); receipt.ID != "aW5ib3gvYS5qcGc.0" {
+		t.Errorf("Expected the ID column to be used, got %q", receipt.ID)
+	}
+
+	// Rows written since keys replaced URLs
+	row[7] = "2024-10-18/r.jpg"
+	if receipt, _ := parseReceiptRow(8, row); receipt.ImageKey != "2024-10-18/r.jpg" || receipt.ReceiptURL != "" {
+		t.Errorf("Expected an image key, got %+v", receipt)
+	}
+
+	if _, ok := parseReceiptRow(6, []interface{}{"", " "}); ok {
+		t.Error("Expected a blank row to be skipped")
+	}
+}
+
+func TestSheetsReceiptStore(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2024, 10, 18, 0, 0, 0, 0, time.UTC)
+	sheetsService, _ := newFakeSheetsService(t,
+		receiptRow(&openai.ReceiptData{StoreName: "Lawson", ReceiptDate: day, TotalAmount: 980}, "a.jpg", "id-a"),
+		receiptRow(&openai.ReceiptData{StoreName: "Old Row", ReceiptDate: day, TotalAmount: 100}, "", ""),
+		receiptRow(&openai.ReceiptData{StoreName: "Older Row", ReceiptDate: day, TotalAmount: 200}, "", ""),
+	)
+	store := NewSheetsReceiptStore(sheetsService)
+
+	// Rows without an ID are listed, one per page, without an ID of their own
+	var stores []string
+	query := ReceiptQuery{Limit: 1}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("Pagination did not terminate")
+		}
+		page, err := store.List(ctx, query)
+		if err != nil {
+			t.Fatalf("List() error = %v", err)
+		}
+		for _, receipt := range page.Receipts {
+			stores = append(stores, receipt.StoreName+"="+receipt.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if want := []string{"Lawson=id-a", "Old Row=", "Older Row="}; !equalStrings(stores, want) {
+		t.Errorf("Paged through %v, want %v", stores, want)
+	}
+
+	if receipt, err := store.Get(ctx, "id-a"); err != nil || receipt.StoreName != "Lawson" {
+		t.Errorf("Get(id-a) = %+v, %v", receipt, err)
+	}
+	for _, id := range []string{"row-3", ""} {
+		if _, err := store.Get(ctx, id); !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("Get(%q) error = %v, want ErrReceiptNotFound", id, err)
+		}
+	}
+}
+
+func TestSidecarReceipts(t *testing.T) {
+	sidecar := &Sidecar{
+		File: &repository.FileInfo{Key: "2024-10-18/receipts.jpg", URL: "https://example.com/receipts.jpg"},
+		Receipts: []openai.ExtractedReceipt{
+			{Data: &openai.ReceiptData{
+				StoreName:       "Cafe",
+				ReceiptDate:     time.Date(2024, 10, 18, 0, 0, 0, 0, time.UTC),
+				TotalAmount:     450,
+				ExpenseCategory: "식비",
+				PaymentMethod:   "카드",
+				Items:           []openai.ReceiptItem{{Name: "Latte"}, {Name: ""}, {Name: "Scone"}},
+			}},
+			{Data: &openai.ReceiptData{StoreName: "Bakery", TotalAmount: 1200.5}},
+		},
+	}
+
+	receipts := sidecarReceipts(sidecar)
+	if len(receipts) != 2 {
+		t.Fatalf("Expected 2 receipts, got %d", len(receipts))
+	}
+	if receipts[0].Date != "2024-10-18" || receipts[0].StoreName != "Cafe" || receipts[0].Data == nil {
+		t.Errorf("Unexpected first receipt: %+v", receipts[0])
+	}
+	if receipts[1].TotalAmount != 1200.5 || receipts[1].ImageKey != sidecar.File.Key || receipts[1].ReceiptURL != "" {
+		t.Errorf("Unexpected second receipt: %+v", receipts[1])
+	}
+	// Missing fields stay empty rather than taking the ledger's placeholders
+	if receipts[1].Category != "" || receipts[1].PaymentMethod != "" || receipts[1].Date != "" {
+		t.Errorf("Unexpected placeholders in the second receipt: %+v", receipts[1])
+	}
+	if receipts[0].ItemCount != 3 || receipts[0].ItemsSummary != "Latte, Scone" || receipts[0].Category != "식비" || receipts[0].PaymentMethod != "카드" {
+		t.Errorf("Unexpected fields in the first receipt: %+v", receipts[0])
+	}
+}
+
+func TestIsReceiptSidecar(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"2024-10-18/receipt.jpg.json", true},
+		{"inbox/scan001.pdf.json", true},
+		{"2024-10-18/receipt.jpg", false},
+		{DefaultFingerprintPrefix + "abc.json", false},
+		{DefaultIdempotencyPrefix + "abc.json", false},
+		{DefaultJobPrefix + "abc.json", false},
+		{receiptIndexKey("0192a3c4-5d6e-7f80-9a1b-2c3d4e5f6a7b"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isReceiptSidecar(tt.key); got != tt.want {
+			t.Errorf("isReceiptSidecar(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func receiptIDs(receipts []StoredReceipt) []string {
+	var ids []string
+	for _, r := range receipts {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// readRecordingStore records the keys read from a memory store
+type readRecordingStore struct {
+	*repository.MemoryObjectStore
+	reads []string
+}
+
+func (r *readRecordingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	r.reads = append(r.reads, key)
+	return r.MemoryObjectStore.Get(ctx, key)
+}
+
+func TestS3ReceiptStoreList(t *testing.T) {
+	ctx := context.Background()
+	store := &readRecordingStore{MemoryObjectStore: repository.NewMemoryObjectStore()}
+	receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+	editor := NewReceiptEditor(store)
+	receipts := NewS3ReceiptStore(store)
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	var ids []string
+	for i := 0; i < 2; i++ {
+		result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+		if err != nil {
+			t.Fatalf("ProcessReceipt() error = %v", err)
+		}
+		ids = append(ids, result.ReceiptIDs()...)
+	}
+	if _, err := editor.Update(ctx, ids[0], []byte(`{"store_name":"Corner Cafe"}`)); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	// An upload indexed before index records listed receipts, and one never given an ID
+	legacyID := NewReceiptID()
+	for _, id := range []string{legacyID, ""} {
+		var metadata map[string]string
+		if id != "" {
+			metadata = map[string]string{ReceiptIDMetadata: id}
+		}
+		fileInfo, err := store.Upload(ctx, "legacy.jpg", []byte("legacy"), "image/jpeg", metadata)
+		if err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+		sidecar := Sidecar{Version: SidecarVersion, File: fileInfo, Receipts: []openai.ExtractedReceipt{{Data: &openai.ReceiptData{StoreName: "Legacy Mart", TotalAmount: 300}}}}
+		if err := repository.PutJSON(ctx, store, SidecarKey(fileInfo.Key), sidecar); err != nil {
+			t.Fatalf("PutJSON() error = %v", err)
+		}
+		if id != "" {
+			if err := indexReceiptID(ctx, store, id, fileInfo.Key); err != nil {
+				t.Fatalf("indexReceiptID() error = %v", err)
+			}
+		}
+	}
+
+	store.reads = nil
+	page, err := receipts.List(ctx, ReceiptQuery{})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	stores := map[string]string{}
+	for _, receipt := range page.Receipts {
+		stores[receipt.ID] = receipt.StoreName
+		if receipt.Data != nil {
+			t.Errorf("List() returned the data of %s", receipt.ID)
+		}
+	}
+	want := map[string]string{ids[0]: "Corner Cafe", ids[1]: "Fake Store", legacyID: "Legacy Mart"}
+	if len(stores) != len(want) {
+		t.Errorf("List() = %v, want %v", stores, want)
+	}
+	for id, name := range want {
+		if stores[id] != name {
+			t.Errorf("List() store of %s = %q, want %q", id, stores[id], name)
+		}
+	}
+
+	// Only the index and the sidecar of the older record are read
+	var sidecarReads []string
+	for _, key := range store.reads {
+		if !strings.HasPrefix(key, DefaultReceiptIndexPrefix) {
+			sidecarReads = append(sidecarReads, key)
+		}
+	}
+	if len(store.reads) != 4 || len(sidecarReads) != 1 || !strings.Contains(sidecarReads[0], "legacy") {
+		sort.Strings(store.reads)
+		t.Errorf("List() read %v, want the three index records and one legacy sidecar", store.reads)
+	}
+
+	// Deleted receipts leave the listing
+	if err := editor.Delete(ctx, ids[1]); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	page, err = receipts.List(ctx, ReceiptQuery{})
+	if err != nil {
+		t.Fatalf("List() after Delete() error = %v", err)
+	}
+	for _, receipt := range page.Receipts {
+		if receipt.ID == ids[1] {
+			t.Errorf("List() after Delete() still holds %s", ids[1])
+		}
+	}
+}
+
+func TestS3ReceiptStoreListPages(t *testing.T) {
+	ctx := context.Background()
+	store := &readRecordingStore{MemoryObjectStore: repository.NewMemoryObjectStore()}
+	receipts := NewS3ReceiptStore(store)
+
+	// Three uploads in upload order, the first holding three receipts
+	a, b, c := "01900000-0000-7000-8000-00000000000a", "01900000-0000-7000-8000-00000000000b", "01900000-0000-7000-8000-00000000000c"
+	index := func(uploadID string, entries ...StoredReceipt) {
+		t.Helper()
+		if err := repository.PutJSON(ctx, store, receiptIndexKey(uploadID), receiptIndexEntry{Key: uploadID + ".jpg", Receipts: entries}); err != nil {
+			t.Fatalf("PutJSON() error = %v", err)
+		}
+	}
+	index(a, StoredReceipt{ID: a}, StoredReceipt{ID: a + ".2"}, StoredReceipt{ID: a + ".3"})
+	index(b, StoredReceipt{ID: b, Category: "교통"})
+	index(c, StoredReceipt{ID: c})
+
+	ids := func(page *ReceiptPage) []string {
+		var ids []string
+		for _, receipt := range page.Receipts {
+			ids = append(ids, receipt.ID)
+		}
+		return ids
+	}
+
+	// A page reads only the index records it needs
+	store.reads = nil
+	page, err := receipts.List(ctx, ReceiptQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if got := ids(page); !equalStrings(got, []string{a, a + ".2"}) || page.NextCursor == "" {
+		t.Fatalf("List() first page = %v, cursor %q", got, page.NextCursor)
+	}
+	if len(store.reads) != 1 {
+		t.Errorf("List() read %v, want only the first index record", store.reads)
+	}
+
+	// The next page resumes inside the upload, even after a receipt before the cursor is deleted
+	index(a, StoredReceipt{ID: a}, StoredReceipt{ID: a + ".3"})
+	page, err = receipts.List(ctx, ReceiptQuery{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("List() second page error = %v", err)
+	}
+	if got := ids(page); !equalStrings(got, []string{a + ".3", b}) || page.NextCursor == "" {
+		t.Fatalf("List() second page = %v, cursor %q", got, page.NextCursor)
+	}
+	page, err = receipts.List(ctx, ReceiptQuery{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("List() last page error = %v", err)
+	}
+	if got := ids(page); !equalStrings(got, []string{c}) || page.NextCursor != "" {
+		t.Errorf("List() last page = %v, cursor %q, want no cursor", got, page.NextCursor)
+	}
+
+	// Filters skip records without ending the listing early
+	page, err = receipts.List(ctx, ReceiptQuery{Limit: 1, Category: "교통"})
+	if err != nil || !equalStrings(ids(page), []string{b}) || page.NextCursor != "" {
+		t.Errorf("List() by category = %v, %q, %v", ids(page), page.NextCursor, err)
+	}
+
+	for _, cursor := range []string{"not base64!", encodeReceiptCursor("2024-10-18", a), encodeReceiptCursor(receiptIndexKey(a), "row-2")} {
+		if _, err := receipts.List(ctx, ReceiptQuery{Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("List() with cursor %q error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestReceiptServiceWithMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := repository.NewMemoryObjectStore()
+	receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+	if err != nil {
+		t.Fatalf("ProcessReceipt() error = %v", err)
+	}
+	ids := result.ReceiptIDs()
+	if len(ids) != 1 {
+		t.Fatalf("ReceiptIDs() = %v, want one ID", ids)
+	}
+	if _, err := store.Head(ctx, result.FileInfo.Key); err != nil {
+		t.Errorf("Head() of the uploaded image error = %v", err)
+	}
+
+	receipts := NewS3ReceiptStore(store)
+	stored, err := receipts.Get(ctx, ids[0])
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored.StoreName != "Fake Store" || stored.ImageKey != result.FileInfo.Key {
+		t.Errorf("Get() = %+v", stored)
+	}
+
+	editor := NewReceiptEditor(store)
+	if _, err := editor.Update(ctx, ids[0], []byte(`{"store_name":"Corner Cafe"}`)); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if stored, _ := receipts.Get(ctx, ids[0]); stored == nil || stored.StoreName != "Corner Cafe" {
+		t.Errorf("Get() after Update() = %+v", stored)
+	}
+
+	if err := editor.Delete(ctx, ids[0]); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := receipts.Get(ctx, ids[0]); !errors.Is(err, ErrReceiptNotFound) {
+		t.Errorf("Get() after Delete() error = %v, want ErrReceiptNotFound", err)
+	}
+}
+
+func TestReceiptServiceRelocatesByReceipt(t *testing.T) {
+	ctx := context.Background()
+	layout, err := repository.NewKeyLayout("{receipt_year}/{receipt_month}/{category}/{receipt_id}_{rand}{ext}", "")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+	store := repository.NewMemoryObjectStore()
+	store.SetKeyLayout(layout)
+	receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	result, err := receiptService.ProcessReceipt(ctx, "receipt.png", photo.Bytes(), "image/png")
+	if err != nil {
+		t.Fatalf("ProcessReceipt() error = %v", err)
+	}
+
+	// The fake receipt is dated 2024-01-01 and filed under 기타
+	id := uploadReceiptID(result.FileInfo)
+	if want := "2024/01/기타/" + id + "_"; !strings.HasPrefix(result.FileInfo.Key, want) {
+		t.Errorf("Key = %q, want prefix %q", result.FileInfo.Key, want)
+	}
+	if _, err := store.Head(ctx, result.FileInfo.Key); err != nil {
+		t.Errorf("Head() of the relocated image error = %v", err)
+	}
+	if keys, _ := store.List(ctx, ""); len(keys) != 3 {
+		t.Errorf("List() = %v, want the image, its sidecar and the index", keys)
+	}
+
+	stored, err := NewS3ReceiptStore(store).Get(ctx, result.ReceiptIDs()[0])
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored.ImageKey != result.FileInfo.Key {
+		t.Errorf("Get() image key = %q, want %q", stored.ImageKey, result.FileInfo.Key)
+	}
+}
+
+func TestReceiptServiceKeysByUser(t *testing.T) {
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		wantKey  string
+		wantUser string
+	}{
+		{name: "Uploader given", user: "alice", wantKey: "alice/2024/01/기타/", wantUser: "alice"},
+		{name: "Uploader unsafe in keys", user: "../bob", wantKey: "_bob/2024/01/기타/", wantUser: "../bob"},
+		{name: "No uploader", wantKey: "unknown/2024/01/기타/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			layout, err := repository.NewKeyLayout("{user}/{receipt_year}/{receipt_month}/{category}/{receipt_id}_{rand}{ext}", "")
+			if err != nil {
+				t.Fatalf("NewKeyLayout() error = %v", err)
+			}
+			store := repository.NewMemoryObjectStore()
+			store.SetKeyLayout(layout)
+			receiptService := NewReceiptService(store, openai.NewFakeExtractor(openai.ServiceConfig{DefaultCurrency: "JPY"}))
+
+			uploads := []Upload{{FileName: "receipt.png", Content: bytes.NewReader(photo.Bytes()), ContentType: "image/png"}}
+			result, err := receiptService.ProcessReceiptPieces(ctx, uploads, ProcessOptions{User: tt.user})
+			if err != nil {
+				t.Fatalf("ProcessReceiptPieces() error = %v", err)
+			}
+
+			if !strings.HasPrefix(result.FileInfo.Key, tt.wantKey) {
+				t.Errorf("Key = %q, want prefix %q", result.FileInfo.Key, tt.wantKey)
+			}
+			head, err := store.Head(ctx, result.FileInfo.Key)
+			if err != nil {
+				t.Fatalf("Head() error = %v", err)
+			}
+			if head.Metadata[UserMetadata] != tt.wantUser {
+				t.Errorf("Head() user metadata = %q, want %q", head.Metadata[UserMetadata], tt.wantUser)
+			}
+		})
+	}
+}
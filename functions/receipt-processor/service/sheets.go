@@ -2,13 +2,19 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 
 	"vibe-coding-project-lambda/shared/openai"
 	"vibe-coding-project-lambda/shared/repository"
 )
 
+// ErrReceiptRowMoved is returned when a row no longer carries the receipt it was found
+// for, because rows above it were deleted or inserted meanwhile
+var ErrReceiptRowMoved = errors.New("receipt row moved")
+
 // SheetsService handles business logic for Google Sheets operations
 type SheetsService struct {
 	sheetsRepo *repository.SheetsRepository
@@ -41,7 +47,7 @@ func (s *SheetsService) AddReceiptToSpreadsheet(ctx context.Context, receiptData
 		return fmt.Errorf("sheets repository not initialized")
 	}
 
-	row := s.formatReceiptRow(receiptData, receiptURL, memo)
+	row := s.formatReceiptRow(receiptData, receiptURL, memo, "")
 
 	log.Printf("Adding receipt to spreadsheet: date=%s, store=%s, total=%s",
 		row[0], row[1], row[2])
@@ -67,7 +73,7 @@ func (s *SheetsService) AddMultipleReceipts(ctx context.Context, receipts []Rece
 
 	rows := make([][]interface{}, len(receipts))
 	for i, receipt := range receipts {
-		rows[i] = s.formatReceiptRow(receipt.Data, receipt.ReceiptURL, receipt.Memo)
+		rows[i] = s.formatReceiptRow(receipt.Data, receipt.ImageKey, receipt.Memo, receipt.ID)
 	}
 
 	log.Printf("Adding %d receipts to spreadsheet", len(receipts))
@@ -81,16 +87,74 @@ func (s *SheetsService) AddMultipleReceipts(ctx context.Context, receipts []Rece
 	return nil
 }
 
+// AddProcessedReceipts adds one row per receipt extracted from a processed upload
+func (s *SheetsService) AddProcessedReceipts(ctx context.Context, result *ProcessResult, memo string) error {
+	entries := processedReceiptEntries(result, memo)
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.AddMultipleReceipts(ctx, entries)
+}
+
+// AddMissingReceipts is AddProcessedReceipts for a retry: it skips receipts whose ID
+// a row already carries, so rows an interrupted attempt added are not added twice
+func (s *SheetsService) AddMissingReceipts(ctx context.Context, result *ProcessResult, memo string) error {
+	entries := processedReceiptEntries(result, memo)
+	if len(entries) == 0 {
+		return nil
+	}
+	rows, err := s.ReadReceiptRows(ctx)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		if receiptIDColumn < len(row) {
+			present[fmt.Sprint(row[receiptIDColumn])] = true
+		}
+	}
+
+	var missing []ReceiptEntry
+	for _, entry := range entries {
+		if !present[entry.ID] {
+			missing = append(missing, entry)
+		}
+	}
+	return s.AddMultipleReceipts(ctx, missing)
+}
+
+// processedReceiptEntries returns the rows of a processed upload's receipts
+func processedReceiptEntries(result *ProcessResult, memo string) []ReceiptEntry {
+	if result == nil || result.FileInfo == nil || len(result.Receipts) == 0 {
+		return nil
+	}
+
+	entries := make([]ReceiptEntry, len(result.Receipts))
+	for i, receipt := range result.Receipts {
+		entries[i] = ReceiptEntry{
+			ID:       storedReceiptID(result.FileInfo, i),
+			Data:     receipt.Data,
+			ImageKey: result.FileInfo.Key,
+			Memo:     memo,
+		}
+	}
+	return entries
+}
+
 // ReceiptEntry represents a single receipt entry to be added to the spreadsheet
 type ReceiptEntry struct {
-	Data       *openai.ReceiptData
-	ReceiptURL string
-	Memo       string
+	ID       string // Receipt ID used to find the row again when the receipt is edited
+	Data     *openai.ReceiptData
+	ImageKey string // S3 key of the image, rather than a URL that only works for public buckets
+	Memo     string
 }
 
+// receiptIDColumn is the index of the 영수증ID column (J)
+const receiptIDColumn = 9
+
 // formatReceiptRow formats receipt data into a spreadsheet row
-// Columns: 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모
-func (s *SheetsService) formatReceiptRow(data *openai.ReceiptData, receiptURL string, memo string) []interface{} {
+// Columns: 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모,영수증ID
+func (s *SheetsService) formatReceiptRow(data *openai.ReceiptData, receiptLink string, memo string, receiptID string) []interface{} {
 	// Default values
 	date := ""
 	category := ""
@@ -127,21 +191,7 @@ func (s *SheetsService) formatReceiptRow(data *openai.ReceiptData, receiptURL st
 
 		// Item count and summary (항목수, 항목내역)
 		itemCount = len(data.Items)
-		if itemCount > 0 {
-			itemNames := make([]string, 0, itemCount)
-			for _, item := range data.Items {
-				if item.Name != "" {
-					itemNames = append(itemNames, item.Name)
-				}
-			}
-			// Join with comma and space for readability
-			if len(itemNames) > 0 {
-				itemsSummary = fmt.Sprintf("%s", itemNames[0])
-				for i := 1; i < len(itemNames); i++ {
-					itemsSummary += ", " + itemNames[i]
-				}
-			}
-		}
+		itemsSummary = summarizeItems(data.Items)
 
 		// Payment method (결제방법)
 		if data.PaymentMethod != "" {
@@ -151,7 +201,7 @@ func (s *SheetsService) formatReceiptRow(data *openai.ReceiptData, receiptURL st
 		}
 	}
 
-	// Build row: 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모
+	// Build row: 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모,영수증ID
 	return []interface{}{
 		date,          // 날짜
 		category,      // 카테고리
@@ -160,11 +210,23 @@ func (s *SheetsService) formatReceiptRow(data *openai.ReceiptData, receiptURL st
 		itemCount,     // 항목수
 		itemsSummary,  // 항목내역 (comma-separated item names)
 		paymentMethod, // 결제방법
-		receiptURL,    // 영수증링크
+		receiptLink,   // 영수증링크 (image key)
 		memo,          // 메모
+		receiptID,     // 영수증ID
 	}
 }
 
+// summarizeItems joins the item names with comma and space for readability
+func summarizeItems(items []openai.ReceiptItem) string {
+	itemNames := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Name != "" {
+			itemNames = append(itemNames, item.Name)
+		}
+	}
+	return strings.Join(itemNames, ", ")
+}
+
 // InitializeSpreadsheet sets up the spreadsheet with headers if needed
 func (s *SheetsService) InitializeSpreadsheet(ctx context.Context) error {
 	if s.sheetsRepo == nil {
@@ -172,7 +234,7 @@ func (s *SheetsService) InitializeSpreadsheet(ctx context.Context) error {
 	}
 
 	// Check if sheet already has data
-	rangeNotation := fmt.Sprintf("%s!A1:I1", s.sheetName)
+	rangeNotation := fmt.Sprintf("%s!A1:J1", s.sheetName)
 	values, err := s.sheetsRepo.ReadRange(ctx, rangeNotation)
 	if err != nil {
 		// If error reading, assume sheet doesn't exist or is empty
@@ -191,6 +253,7 @@ func (s *SheetsService) InitializeSpreadsheet(ctx context.Context) error {
 			"결제방법",
 			"영수증링크",
 			"메모",
+			"영수증ID",
 		}
 
 		log.Printf("Adding headers to spreadsheet: %s", s.sheetName)
@@ -199,6 +262,13 @@ func (s *SheetsService) InitializeSpreadsheet(ctx context.Context) error {
 			return fmt.Errorf("failed to add headers: %w", err)
 		}
 		log.Printf("Successfully initialized spreadsheet with headers")
+	} else if len(values[0]) < receiptIDColumn+1 {
+		// Sheets created before receipt IDs were recorded lack the last header
+		header := fmt.Sprintf("%s!J1", s.sheetName)
+		if err := s.sheetsRepo.UpdateRange(ctx, header, [][]interface{}{{"영수증ID"}}); err != nil {
+			return fmt.Errorf("failed to add receipt ID header: %w", err)
+		}
+		log.Printf("Added receipt ID header to spreadsheet: %s", s.sheetName)
 	} else {
 		log.Printf("Spreadsheet already has headers, skipping initialization")
 	}
@@ -213,7 +283,7 @@ func (s *SheetsService) GetRecentReceipts(ctx context.Context, limit int) ([][]i
 	}
 
 	// Read recent rows (skip header row)
-	rangeNotation := fmt.Sprintf("%s!A2:I%d", s.sheetName, limit+1)
+	rangeNotation := fmt.Sprintf("%s!A2:J%d", s.sheetName, limit+1)
 	values, err := s.sheetsRepo.ReadRange(ctx, rangeNotation)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read recent receipts: %w", err)
@@ -221,3 +291,140 @@ func (s *SheetsService) GetRecentReceipts(ctx context.Context, limit int) ([][]i
 
 	return values, nil
 }
+
+// ReadReceiptRows reads every receipt row below the header, in sheet order
+// Row i of the result is sheet row i+2
+func (s *SheetsService) ReadReceiptRows(ctx context.Context) ([][]interface{}, error) {
+	if s.sheetsRepo == nil {
+		return nil, fmt.Errorf("sheets repository not initialized")
+	}
+
+	values, err := s.sheetsRepo.ReadRange(ctx, fmt.Sprintf("%s!A2:J", s.sheetName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipts: %w", err)
+	}
+	return values, nil
+}
+
+// ReadReceiptRow reads one sheet row; it is empty when the row does not exist
+func (s *SheetsService) ReadReceiptRow(ctx context.Context, row int) ([]interface{}, error) {
+	if s.sheetsRepo == nil {
+		return nil, fmt.Errorf("sheets repository not initialized")
+	}
+
+	values, err := s.sheetsRepo.ReadRange(ctx, fmt.Sprintf("%s!A%d:J%d", s.sheetName, row, row))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipt row %d: %w", row, err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values[0], nil
+}
+
+// FindReceiptRow locates the row carrying a receipt ID
+// Returns row number 0 when no row has the ID
+func (s *SheetsService) FindReceiptRow(ctx context.Context, id string) (int, []interface{}, error) {
+	rows, err := s.ReadReceiptRows(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for i, row := range rows {
+		if receiptIDColumn < len(row) && fmt.Sprint(row[receiptIDColumn]) == id {
+			return i + 2, row, nil
+		}
+	}
+	return 0, nil, nil
+}
+
+// checkReceiptRow re-reads a row found by FindReceiptRow and confirms it still carries id
+// Sheets has no conditional writes, so this narrows the window for writing to a moved row
+// rather than closing it
+func (s *SheetsService) checkReceiptRow(ctx context.Context, row int, id string) error {
+	values, err := s.ReadReceiptRow(ctx, row)
+	if err != nil {
+		return err
+	}
+	if receiptIDColumn >= len(values) || fmt.Sprint(values[receiptIDColumn]) != id {
+		return fmt.Errorf("%w: row %d no longer holds receipt %s", ErrReceiptRowMoved, row, id)
+	}
+	return nil
+}
+
+// UpdateReceiptRow overwrites the receipt row found for entry.ID
+// Returns ErrReceiptRowMoved when the row no longer carries the ID
+func (s *SheetsService) UpdateReceiptRow(ctx context.Context, row int, entry ReceiptEntry) error {
+	if s.sheetsRepo == nil {
+		return fmt.Errorf("sheets repository not initialized")
+	}
+	if err := s.checkReceiptRow(ctx, row, entry.ID); err != nil {
+		return err
+	}
+
+	values := s.formatReceiptRow(entry.Data, entry.ImageKey, entry.Memo, entry.ID)
+	rangeNotation := fmt.Sprintf("%s!A%d:J%d", s.sheetName, row, row)
+	if err := s.sheetsRepo.UpdateRange(ctx, rangeNotation, [][]interface{}{values}); err != nil {
+		return fmt.Errorf("failed to update receipt row %d: %w", row, err)
+	}
+
+	log.Printf("Updated receipt row %d", row)
+	return nil
+}
+
+// DeleteReceiptRow removes the row found for receipt id
+// Returns ErrReceiptRowMoved when the row no longer carries the ID
+func (s *SheetsService) DeleteReceiptRow(ctx context.Context, row int, id string) error {
+	if s.sheetsRepo == nil {
+		return fmt.Errorf("sheets repository not initialized")
+	}
+	if err := s.checkReceiptRow(ctx, row, id); err != nil {
+		return err
+	}
+
+	if err := s.sheetsRepo.DeleteRow(ctx, s.sheetName, row); err != nil {
+		return fmt.Errorf("failed to delete receipt row %d: %w", row, err)
+	}
+
+	log.Printf("Deleted receipt row %d", row)
+	return nil
+}
+
+// WriteReceiptID writes the 영수증ID of a row read by ReadReceiptRows
+// The row is re-read first and must still hold the values it was read with, so the ID
+// does not land on another receipt after a delete or re-sort; ErrReceiptRowMoved otherwise
+func (s *SheetsService) WriteReceiptID(ctx context.Context, row int, read []interface{}, id string) error {
+	if s.sheetsRepo == nil {
+		return fmt.Errorf("sheets repository not initialized")
+	}
+	values, err := s.ReadReceiptRow(ctx, row)
+	if err != nil {
+		return err
+	}
+	if !sameRowValues(values, read) {
+		return fmt.Errorf("%w: row %d changed since it was read", ErrReceiptRowMoved, row)
+	}
+
+	rangeNotation := fmt.Sprintf("%s!J%d", s.sheetName, row)
+	if err := s.sheetsRepo.UpdateRange(ctx, rangeNotation, [][]interface{}{{id}}); err != nil {
+		return fmt.Errorf("failed to write receipt ID to row %d: %w", row, err)
+	}
+	return nil
+}
+
+// sameRowValues compares two reads of a row cell by cell
+// The API leaves out trailing empty cells, so missing cells count as empty
+func sameRowValues(a, b []interface{}) bool {
+	cell := func(row []interface{}, i int) string {
+		if i >= len(row) || row[i] == nil {
+			return ""
+		}
+		return fmt.Sprint(row[i])
+	}
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if cell(a, i) != cell(b, i) {
+			return false
+		}
+	}
+	return true
+}
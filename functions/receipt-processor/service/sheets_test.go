@@ -1,10 +1,23 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+
 	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
 )
 
 func TestFormatReceiptRow(t *testing.T) {
@@ -62,10 +75,10 @@ func TestFormatReceiptRow(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			row := service.formatReceiptRow(tt.receiptData, tt.receiptURL, tt.memo)
+			row := service.formatReceiptRow(tt.receiptData, tt.receiptURL, tt.memo, "")
 
 			// Check row length
-			expectedLength := 9 // 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모
+			expectedLength := 10 // 날짜,카테고리,상점명,총금액,항목수,항목내역,결제방법,영수증링크,메모,영수증ID
 			if len(row) != expectedLength {
 				t.Errorf("Row length = %d, want %d", len(row), expectedLength)
 			}
@@ -108,7 +121,7 @@ func TestFormatReceiptRow_NumberTypeForCalculations(t *testing.T) {
 		PaymentMethod: "Cash",
 	}
 
-	row := service.formatReceiptRow(receiptData, "https://example.com/receipt.jpg", "")
+	row := service.formatReceiptRow(receiptData, "https://example.com/receipt.jpg", "", "")
 
 	// The total amount should be at index 3 (날짜, 카테고리, 상점명, 총금액...)
 	totalAmount := row[3]
@@ -186,7 +199,7 @@ func TestFormatReceiptRow_ItemsSummaryColumn(t *testing.T) {
 				Items:       tt.items,
 			}
 
-			row := service.formatReceiptRow(receiptData, "https://example.com/receipt.jpg", "")
+			row := service.formatReceiptRow(receiptData, "https://example.com/receipt.jpg", "", "")
 
 			// Items summary should be at index 5 (날짜, 카테고리, 상점명, 총금액, 항목수, 항목내역, ...)
 			itemsSummary := row[5]
@@ -251,7 +264,7 @@ func TestFormatReceiptRow_CategoryColumn(t *testing.T) {
 				ExpenseCategory: tt.expenseCategory,
 			}
 
-			row := service.formatReceiptRow(receiptData, "https://example.com/receipt.jpg", "")
+			row := service.formatReceiptRow(receiptData, "https://example.com/receipt.jpg", "", "")
 
 			// Category should be at index 1 (날짜, 카테고리, ...)
 			category := row[1]
@@ -268,3 +281,213 @@ func TestFormatReceiptRow_CategoryColumn(t *testing.T) {
 		})
 	}
 }
+
+func TestDeleteReceiptRowMoved(t *testing.T) {
+	ctx := context.Background()
+	data := &openai.ReceiptData{StoreName: "Lawson", TotalAmount: 980}
+	sheetsService, fake := newFakeSheetsService(t, receiptRow(data, "a.jpg", "id-a"), receiptRow(data, "b.jpg", "id-b"))
+
+	row, _, err := sheetsService.FindReceiptRow(ctx, "id-b")
+	if err != nil || row != 3 {
+		t.Fatalf("FindReceiptRow() = %d, %v", row, err)
+	}
+
+	// Another request deletes the row above before this one deletes its row
+	fake.rows = append(fake.rows[:1], fake.rows[2:]...)
+	if err := sheetsService.DeleteReceiptRow(ctx, row, "id-b"); !errors.Is(err, ErrReceiptRowMoved) {
+		t.Fatalf("DeleteReceiptRow() error = %v, want ErrReceiptRowMoved", err)
+	}
+	if ids := fake.column(receiptIDColumn); !equalStrings(ids, []string{"id-b"}) {
+		t.Fatalf("IDs after a refused delete = %v, want id-b kept", ids)
+	}
+
+	// The editor looks the row up again
+	editor := NewReceiptEditor(nil)
+	editor.SetSheetsService(sheetsService)
+	if err := editor.deleteRow(ctx, "id-b"); err != nil {
+		t.Fatalf("deleteRow() error = %v", err)
+	}
+	if ids := fake.column(receiptIDColumn); len(ids) != 0 {
+		t.Errorf("IDs after delete = %v, want none", ids)
+	}
+}
+
+func TestWriteReceiptIDMoved(t *testing.T) {
+	ctx := context.Background()
+	data := &openai.ReceiptData{StoreName: "Lawson", TotalAmount: 980}
+	sheetsService, fake := newFakeSheetsService(t, receiptRow(data, "a.jpg", ""), receiptRow(data, "b.jpg", ""))
+	rows, err := sheetsService.ReadReceiptRows(ctx)
+	if err != nil {
+		t.Fatalf("ReadReceiptRows() error = %v", err)
+	}
+
+	// A receipt above is deleted between reading the rows and writing the IDs
+	fake.rows = append(fake.rows[:1], fake.rows[2:]...)
+	if err := sheetsService.WriteReceiptID(ctx, 3, rows[1], "id-b"); !errors.Is(err, ErrReceiptRowMoved) {
+		t.Fatalf("WriteReceiptID() error = %v, want ErrReceiptRowMoved", err)
+	}
+	if err := sheetsService.WriteReceiptID(ctx, 2, rows[1], "id-b"); err != nil {
+		t.Fatalf("WriteReceiptID() error = %v", err)
+	}
+	if ids := fake.column(receiptIDColumn); !equalStrings(ids, []string{"id-b"}) {
+		t.Errorf("IDs = %v, want id-b on b.jpg only", ids)
+	}
+}
+
+// fakeSheets is an in-memory fake of the Sheets API for a spreadsheet with one tab
+// Cells are returned as strings, like the formatted values the API returns by default
+type fakeSheets struct {
+	mu     sync.Mutex
+	rows   [][]string // Sheet rows, starting with row 1
+	writes int        // Update, append and delete requests received
+	denied bool       // Answer every request with 403, like a sheet not shared with the service account
+}
+
+// newFakeSheetsService returns a SheetsService of a fake spreadsheet holding the header
+// and rows, formatted like the service writes them
+func newFakeSheetsService(t *testing.T, rows ...[]interface{}) (*SheetsService, *fakeSheets) {
+	t.Helper()
+	fake := &fakeSheets{rows: [][]string{{"날짜", "카테고리", "상점명", "총금액", "항목수", "항목내역", "결제방법", "영수증링크", "메모", "영수증ID"}}}
+	for _, row := range rows {
+		fake.rows = append(fake.rows, sheetCells(row))
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("sheets.NewService() error = %v", err)
+	}
+	return NewSheetsService(SheetsServiceConfig{
+		SheetsRepo: repository.NewSheetsRepositoryWithService(client, "spreadsheet"),
+		SheetName:  "Sheet1",
+	}), fake
+}
+
+// receiptRow returns the row the service writes for a receipt
+func receiptRow(data *openai.ReceiptData, imageKey, id string) []interface{} {
+	return (&SheetsService{}).formatReceiptRow(data, imageKey, "", id)
+}
+
+// column returns one column of the sheet below the header
+func (f *fakeSheets) column(index int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var values []string
+	for _, row := range f.rows[1:] {
+		value := ""
+		if index < len(row) {
+			value = row[index]
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func (f *fakeSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.denied {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":{"code":403,"message":"The caller does not have permission","status":"PERMISSION_DENIED"}}`)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v4/spreadsheets/spreadsheet")
+
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		fmt.Fprint(w, `{"sheets":[{"properties":{"sheetId":0,"title":"Sheet1"}}]}`)
+
+	case r.Method == http.MethodPost && path == ":batchUpdate":
+		var batch sheets.BatchUpdateSpreadsheetRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+		for _, req := range batch.Requests {
+			if d := req.DeleteDimension; d != nil && int(d.Range.EndIndex) <= len(f.rows) {
+				f.rows = append(f.rows[:d.Range.StartIndex], f.rows[d.Range.EndIndex:]...)
+			}
+		}
+		f.writes++
+		fmt.Fprint(w, `{}`)
+
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":append"):
+		var body sheets.ValueRange
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, row := range body.Values {
+			f.rows = append(f.rows, sheetCells(row))
+		}
+		f.writes++
+		fmt.Fprint(w, `{}`)
+
+	case strings.HasPrefix(path, "/values/"):
+		col, row, endCol, endRow := parseA1(strings.TrimPrefix(path, "/values/"))
+		if r.Method == http.MethodPut {
+			var body sheets.ValueRange
+			json.NewDecoder(r.Body).Decode(&body)
+			for i, values := range body.Values {
+				for j, value := range values {
+					f.set(row+i, col+j, fmt.Sprint(value))
+				}
+			}
+			f.writes++
+			fmt.Fprint(w, `{}`)
+			return
+		}
+
+		var values [][]string
+		for i := row; i < len(f.rows) && (endRow < 0 || i <= endRow); i++ {
+			var cells []string
+			for j := col; j < len(f.rows[i]) && j <= endCol; j++ {
+				cells = append(cells, f.rows[i][j])
+			}
+			values = append(values, cells)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": values})
+
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+// set writes one cell, growing the sheet as needed
+func (f *fakeSheets) set(row, col int, value string) {
+	for len(f.rows) <= row {
+		f.rows = append(f.rows, nil)
+	}
+	for len(f.rows[row]) <= col {
+		f.rows[row] = append(f.rows[row], "")
+	}
+	f.rows[row][col] = value
+}
+
+// parseA1 parses a range such as "Sheet1!A2:J" into 0-based bounds; endRow is -1 when open
+func parseA1(notation string) (col, row, endCol, endRow int) {
+	_, cells, _ := strings.Cut(notation, "!")
+	start, end, _ := strings.Cut(cells, ":")
+	col, row = parseA1Cell(start)
+	endCol, endRow = parseA1Cell(end)
+	return col, row, endCol, endRow
+}
+
+// parseA1Cell parses a cell such as "J5" or a column such as "J"
+func parseA1Cell(cell string) (int, int) {
+	letters := strings.TrimRight(cell, "0123456789")
+	col := 0
+	for _, r := range letters {
+		col = col*26 + int(r-'A'+1)
+	}
+	row, err := strconv.Atoi(cell[len(letters):])
+	if err != nil {
+		return col - 1, -1
+	}
+	return col - 1, row - 1
+}
+
+// sheetCells formats written values the way Sheets displays them
+func sheetCells(values []interface{}) []string {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		cells[i] = fmt.Sprint(value)
+	}
+	return cells
+}
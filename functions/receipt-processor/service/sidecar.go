@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+// Sidecar object naming and format
+const (
+	SidecarSuffix  = ".json" // Appended to a receipt's S3 key to name its result object
+	SidecarVersion = 1       // Bumped when the sidecar layout changes incompatibly
+)
+
+// Sidecar is the extraction result stored next to a receipt image as <key>.json
+// It keeps everything the spreadsheet row drops, so receipts can be re-exported,
+// re-categorised and audited later
+type Sidecar struct {
+	Version         int                    `json:"version"`
+	File            *repository.FileInfo   `json:"file"`
+	AdditionalFiles []*repository.FileInfo `json:"additional_files,omitempty"`
+	ProcessedAt     time.Time              `json:"processed_at"`
+
+	// Full receipt data (items, tax, receipt number, raw model output) with the
+	// arithmetic checks of each receipt
+	Receipts []openai.ExtractedReceipt `json:"receipts,omitempty"`
+
+	Extraction         *ExtractionMetadata `json:"extraction,omitempty"`
+	ExtractionAttempts int                 `json:"extraction_attempts,omitempty"`
+	Usage              *openai.Usage       `json:"usage,omitempty"`
+	ExtractionError    string              `json:"extraction_error,omitempty"`
+	Duplicates         []Duplicate         `json:"duplicates,omitempty"`
+
+	// Corrections and deletions made through the API, oldest first
+	Edits []ReceiptEdit `json:"edits,omitempty"`
+}
+
+// ExtractionMetadata identifies the model call that produced the receipts
+type ExtractionMetadata struct {
+	Model     string               `json:"model,omitempty"`
+	RequestID string               `json:"request_id,omitempty"`
+	LatencyMs int64                `json:"latency_ms,omitempty"`
+	Repairs   []openai.RepairRound `json:"repairs,omitempty"` // Validation problems the model was asked to correct
+}
+
+// SidecarKey returns the key of the sidecar object for a receipt key
+func SidecarKey(key string) string {
+	return key + SidecarSuffix
+}
+
+// IsSidecarKey reports whether key names a JSON object rather than a receipt,
+// such as a sidecar or one of the service's own index and job records
+func IsSidecarKey(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), SidecarSuffix)
+}
+
+// NewSidecar builds the sidecar of a processed receipt
+func NewSidecar(result *ProcessResult) *Sidecar {
+	return &Sidecar{
+		Version:            SidecarVersion,
+		File:               result.FileInfo,
+		AdditionalFiles:    result.AdditionalFiles,
+		ProcessedAt:        time.Now(),
+		Receipts:           result.Receipts,
+		Extraction:         result.Extraction,
+		ExtractionAttempts: result.ExtractionAttempts,
+		Usage:              result.Usage,
+		ExtractionError:    result.ExtractionError,
+		Duplicates:         result.Duplicates,
+	}
+}
+
+// Deleted reports whether the index-th receipt was deleted
+// Deleted receipts stay in the sidecar so the history remains auditable
+func (s *Sidecar) Deleted(index int) bool {
+	for _, edit := range s.Edits {
+		if edit.Receipt == index && edit.Action == ReceiptEditDelete {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSidecar reports whether the receipt stored under key was already processed
+func (s *ReceiptService) HasSidecar(ctx context.Context, key string) (bool, error) {
+	_, err := s.objectStore.Head(ctx, SidecarKey(key))
+	if errors.Is(err, repository.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WriteSidecar stores the result of a processed receipt next to its image and lists
+// its receipts in the receipt ID index
+// Index failures are only logged: the receipts stay readable by ID through the sidecar
+func (s *ReceiptService) WriteSidecar(ctx context.Context, result *ProcessResult) error {
+	if result.FileInfo == nil {
+		return fmt.Errorf("no stored file to write a sidecar for")
+	}
+	sidecar := NewSidecar(result)
+	if err := repository.PutJSON(ctx, s.objectStore, SidecarKey(result.FileInfo.Key), sidecar); err != nil {
+		return err
+	}
+	if err := indexSidecar(ctx, s.objectStore, sidecar); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// ReadSidecar loads the stored result of the receipt under key
+// Returns repository.ErrObjectNotFound when the receipt was not processed
+func (s *ReceiptService) ReadSidecar(ctx context.Context, key string) (*Sidecar, error) {
+	var sidecar Sidecar
+	if err := repository.GetJSON(ctx, s.objectStore, SidecarKey(key), &sidecar); err != nil {
+		return nil, err
+	}
+	return &sidecar, nil
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+
+	"vibe-coding-project-lambda/shared/openai"
+	"vibe-coding-project-lambda/shared/repository"
+)
+
+func TestIsSidecarKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"inbox/scan001.jpg", false},
+		{"inbox/scan001.jpg.json", true},
+		{"inbox/SCAN001.JPG.JSON", true},
+		{"index/fingerprints/abc.json", true},
+		{"inbox/receipt.pdf", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := IsSidecarKey(tt.key); got != tt.want {
+				t.Errorf("IsSidecarKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	if got := SidecarKey("inbox/scan001.jpg"); got != "inbox/scan001.jpg.json" || !IsSidecarKey(got) {
+		t.Errorf("SidecarKey() = %q", got)
+	}
+}
+
+func TestNewSidecar(t *testing.T) {
+	result := &ProcessResult{
+		FileInfo:           &repository.FileInfo{Key: "inbox/scan001.jpg"},
+		Receipts:           []openai.ExtractedReceipt{{Data: &openai.ReceiptData{StoreName: "Cafe"}}},
+		ExtractionAttempts: 2,
+		Extraction:         &ExtractionMetadata{Model: "gpt-4o", RequestID: "req_1"},
+	}
+
+	sidecar := NewSidecar(result)
+	if sidecar.File.Key != "inbox/scan001.jpg" || len(sidecar.Receipts) != 1 || sidecar.ExtractionAttempts != 2 {
+		t.Errorf("NewSidecar() = %+v", sidecar)
+	}
+	if sidecar.Version != SidecarVersion || sidecar.Extraction.Model != "gpt-4o" {
+		t.Errorf("Expected version and model metadata, got %+v", sidecar)
+	}
+	if sidecar.ProcessedAt.IsZero() {
+		t.Error("Expected ProcessedAt to be set")
+	}
+}
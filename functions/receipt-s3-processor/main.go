@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"vibe-coding-project-lambda/functions/receipt-processor/app"
+	"vibe-coding-project-lambda/functions/receipt-processor/handler"
+)
+
+// defaultInboxPrefix is where receipts dropped into the bucket are picked up
+// Uploads through receipt-processor land in date folders and are processed there
+const defaultInboxPrefix = "inbox/"
+
+var s3EventHandler *handler.S3EventHandler
+
+// init initializes all dependencies
+func init() {
+	ctx := context.Background()
+
+	deps, err := app.New(ctx)
+	if err != nil {
+		panic(fmt.Sprintf("failed to initialize: %v", err))
+	}
+
+	// RECEIPT_INBOX_PREFIX="" processes every key in the bucket
+	prefix, ok := os.LookupEnv("RECEIPT_INBOX_PREFIX")
+	if !ok {
+		prefix = defaultInboxPrefix
+	}
+	log.Printf("Processing receipts created under %q", prefix)
+
+	s3EventHandler = handler.NewS3EventHandler(deps.ReceiptService, prefix)
+	if deps.SheetsService != nil {
+		s3EventHandler.SetSheetsService(deps.SheetsService)
+	}
+}
+
+func main() {
+	lambda.Start(s3EventHandler.Handle)
+}
@@ -0,0 +1,148 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	// Register pure-Go decoders for formats the vision API does not accept
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// ErrHEICConverterMissing is returned for HEIC/HEIF uploads when no converter command is configured
+// There is no pure-Go HEVC decoder, so HEIC needs an external tool such as heif-convert or ImageMagick
+var ErrHEICConverterMissing = errors.New("HEIC/HEIF conversion requires an external converter (set HEICCommand)")
+
+// Document is an upload converted into input the vision API accepts
+type Document struct {
+	Format Format   // Detected format of the upload
+	Images [][]byte // Page images in a vision-supported format (one for photos)
+	Text   string   // Text layer of PDFs without page images
+}
+
+// Converter turns HEIC/HEIF, TIFF, BMP and PDF uploads into vision input
+type Converter struct {
+	// HEICCommand converts HEIC/HEIF files, invoked as "<command> <input> <output.jpg>"
+	// Both heif-convert (libheif) and ImageMagick's magick accept this form
+	HEICCommand string
+
+	// MaxPixels is the largest image decoded from a TIFF, BMP or PDF upload (default: 50 megapixels)
+	MaxPixels int
+}
+
+// Convert detects the upload's format and converts it when needed
+// Formats the vision API accepts are returned unchanged
+func (c *Converter) Convert(ctx context.Context, data []byte) (*Document, error) {
+	format := DetectFormat(data)
+	doc := &Document{Format: format}
+
+	switch {
+	case format.VisionSupported():
+		doc.Images = [][]byte{data}
+	case format == FormatTIFF || format == FormatBMP:
+		converted, err := decodeToJPEG(data, c.maxPixels())
+		if err != nil {
+			return nil, err
+		}
+		doc.Images = [][]byte{converted}
+	case format == FormatHEIC || format == FormatHEIF:
+		converted, err := c.convertHEIC(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+		doc.Images = [][]byte{converted}
+	case format == FormatPDF:
+		content, err := ExtractPDF(data, c.maxPixels())
+		if err != nil {
+			return nil, err
+		}
+		// Page images keep the receipt's layout; fall back to the text of e-receipts
+		if len(content.Images) > 0 {
+			doc.Images = content.Images
+		} else {
+			doc.Text = content.Text
+		}
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	return doc, nil
+}
+
+// CheckFormat reports whether Convert can handle uploads of format, so uploads it would
+// fail on can be refused before they are stored
+func (c *Converter) CheckFormat(format Format) error {
+	if (format == FormatHEIC || format == FormatHEIF) && c.HEICCommand == "" {
+		return ErrHEICConverterMissing
+	}
+	return nil
+}
+
+// maxPixels returns MaxPixels or its default
+func (c *Converter) maxPixels() int {
+	if c.MaxPixels <= 0 {
+		return DefaultMaxPixels
+	}
+	return c.MaxPixels
+}
+
+// decodeToJPEG re-encodes any image the registered decoders understand as JPEG
+func decodeToJPEG(data []byte, maxPixels int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("image too large to convert: %dx%d", config.Width, config.Height)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: DefaultJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to convert %s to JPEG: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// convertHEIC runs the external HEIC converter through temporary files
+func (c *Converter) convertHEIC(ctx context.Context, data []byte) ([]byte, error) {
+	if c.HEICCommand == "" {
+		return nil, ErrHEICConverterMissing
+	}
+
+	dir, err := os.MkdirTemp("", "heic-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.heic")
+	output := filepath.Join(dir, "output.jpg")
+	if err := os.WriteFile(input, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write HEIC file: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, c.HEICCommand, input, output)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to convert HEIC with %s: %w: %s", c.HEICCommand, err, bytes.TrimSpace(out))
+	}
+
+	converted, err := os.ReadFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("HEIC converter produced no output: %w", err)
+	}
+	if DetectFormat(converted) != FormatJPEG {
+		return nil, fmt.Errorf("HEIC converter output is not a JPEG")
+	}
+	return converted, nil
+}
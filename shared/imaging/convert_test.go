@@ -0,0 +1,92 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestConvertPassesThroughSupportedImages(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(10, 10, color.White))
+
+	doc, err := (&Converter{}).Convert(context.Background(), buf.Bytes())
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if doc.Format != FormatPNG || len(doc.Images) != 1 || !bytes.Equal(doc.Images[0], buf.Bytes()) {
+		t.Errorf("Expected the PNG unchanged, got format %q with %d image(s)", doc.Format, len(doc.Images))
+	}
+}
+
+func TestConvertTIFF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := tiff.Encode(&buf, solidImage(40, 30, color.White), nil); err != nil {
+		t.Fatalf("failed to encode TIFF: %v", err)
+	}
+
+	doc, err := (&Converter{}).Convert(context.Background(), buf.Bytes())
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if doc.Format != FormatTIFF || len(doc.Images) != 1 || DetectFormat(doc.Images[0]) != FormatJPEG {
+		t.Errorf("Expected TIFF converted to one JPEG, got format %q", doc.Format)
+	}
+}
+
+func TestConvertPDFText(t *testing.T) {
+	pdf := buildPDF(
+		"<< /Type /Page /Contents 2 0 R >>",
+		streamObject("", []byte("BT (Receipt total 12.00) Tj ET"), false),
+	)
+
+	doc, err := (&Converter{}).Convert(context.Background(), pdf)
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if doc.Format != FormatPDF || len(doc.Images) != 0 || doc.Text != "Receipt total 12.00" {
+		t.Errorf("Unexpected document: %+v", doc)
+	}
+}
+
+func TestConvertHEIC(t *testing.T) {
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+
+	if _, err := (&Converter{}).Convert(context.Background(), heic); !errors.Is(err, ErrHEICConverterMissing) {
+		t.Errorf("Expected ErrHEICConverterMissing, got %v", err)
+	}
+
+	// Stand-in converter that writes a JPEG to its output argument
+	dir := t.TempDir()
+	jpegPath := filepath.Join(dir, "converted.jpg")
+	os.WriteFile(jpegPath, testJPEG(t, solidImage(8, 8, color.White), 0), 0o600)
+	script := filepath.Join(dir, "heif-convert")
+	os.WriteFile(script, []byte("#!/bin/sh\ncp \""+jpegPath+"\" \"$2\"\n"), 0o700)
+
+	doc, err := (&Converter{HEICCommand: script}).Convert(context.Background(), heic)
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if doc.Format != FormatHEIC || len(doc.Images) != 1 || DetectFormat(doc.Images[0]) != FormatJPEG {
+		t.Errorf("Expected HEIC converted to JPEG, got %+v", doc.Format)
+	}
+
+	failing := filepath.Join(dir, "broken")
+	os.WriteFile(failing, []byte("#!/bin/sh\necho 'no decoder' >&2\nexit 1\n"), 0o700)
+	if _, err := (&Converter{HEICCommand: failing}).Convert(context.Background(), heic); err == nil {
+		t.Error("Expected an error from a failing converter")
+	}
+}
+
+func TestConvertUnknownFormat(t *testing.T) {
+	if _, err := (&Converter{}).Convert(context.Background(), []byte("just some text")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
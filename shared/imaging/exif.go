@@ -0,0 +1,94 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// EXIF orientation values (TIFF tag 0x0112)
+const (
+	OrientationNormal     = 1
+	OrientationFlipH      = 2
+	OrientationRotate180  = 3
+	OrientationFlipV      = 4
+	OrientationTranspose  = 5
+	OrientationRotate90   = 6 // Rotate 90° clockwise to display
+	OrientationTransverse = 7
+	OrientationRotate270  = 8 // Rotate 90° counter-clockwise to display
+)
+
+const exifOrientationTag = 0x0112
+
+// ReadOrientation returns the EXIF orientation of a JPEG, or OrientationNormal if absent
+func ReadOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return OrientationNormal
+	}
+
+	// Walk the JPEG segments until the APP1 Exif segment or the image data
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return OrientationNormal
+		}
+		marker := data[pos+1]
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no EXIF before the pixels
+			return OrientationNormal
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(data) {
+			return OrientationNormal
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return orientationFromTIFF(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return OrientationNormal
+}
+
+// orientationFromTIFF reads the orientation tag from IFD0 of a TIFF header
+func orientationFromTIFF(tiff []byte) int {
+	if len(tiff) < 8 {
+		return OrientationNormal
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return OrientationNormal
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return OrientationNormal
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:entry+2]) != exifOrientationTag {
+			continue
+		}
+		// SHORT value stored in the first two bytes of the value field
+		orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+		if orientation < OrientationNormal || orientation > OrientationRotate270 {
+			return OrientationNormal
+		}
+		return orientation
+	}
+	return OrientationNormal
+}
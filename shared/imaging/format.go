@@ -0,0 +1,117 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Format is a file format detected from magic bytes
+type Format string
+
+// Detected formats
+const (
+	FormatUnknown Format = ""
+	FormatJPEG    Format = "jpeg"
+	FormatPNG     Format = "png"
+	FormatGIF     Format = "gif"
+	FormatWebP    Format = "webp"
+	FormatBMP     Format = "bmp"
+	FormatTIFF    Format = "tiff"
+	FormatHEIC    Format = "heic" // HEVC-coded HEIF, the iPhone camera default
+	FormatHEIF    Format = "heif" // Other HEIF brands (e.g. AVIF-coded or generic mif1)
+	FormatPDF     Format = "pdf"
+)
+
+// heicBrands are ISO BMFF brands of HEVC-coded HEIF images
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "hevc": true, "hevx": true,
+	"heim": true, "heis": true, "hevm": true, "hevs": true,
+}
+
+// heifBrands are generic HEIF brands, which may still contain HEVC images
+var heifBrands = map[string]bool{
+	"mif1": true, "msf1": true, "avif": true, "avis": true,
+}
+
+// SniffLength is how many leading bytes DetectFormat looks at
+const SniffLength = 1024
+
+// DetectFormat identifies a file from its leading bytes
+func DetectFormat(data []byte) Format {
+	switch {
+	case len(data) < 4:
+		return FormatUnknown
+	case bytes.HasPrefix(data, []byte("\xFF\xD8\xFF")):
+		return FormatJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return FormatGIF
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) >= 14:
+		return FormatBMP
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return FormatTIFF
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return FormatPDF
+	}
+
+	// A PDF may be preceded by junk (e.g. a BOM or mail headers) within the first KiB
+	if bytes.Contains(data[:min(len(data), SniffLength)], []byte("%PDF-")) {
+		return FormatPDF
+	}
+	return detectHEIF(data)
+}
+
+// detectHEIF checks the ISO BMFF ftyp box for HEIF brands
+func detectHEIF(data []byte) Format {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return FormatUnknown
+	}
+	size := int(binary.BigEndian.Uint32(data[0:4]))
+	if size < 16 || size > len(data) {
+		size = min(len(data), 64)
+	}
+
+	// Major brand followed by minor version and compatible brands
+	brands := []string{string(data[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(data[i:i+4]))
+	}
+
+	generic := false
+	for _, brand := range brands {
+		if heicBrands[brand] {
+			return FormatHEIC
+		}
+		if heifBrands[brand] {
+			generic = true
+		}
+	}
+	if generic {
+		return FormatHEIF
+	}
+	return FormatUnknown
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatPDF:
+		return "application/pdf"
+	case FormatUnknown:
+		return "application/octet-stream"
+	default:
+		return "image/" + string(f)
+	}
+}
+
+// VisionSupported reports whether the vision API accepts the format as is
+func (f Format) VisionSupported() bool {
+	switch f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+		return true
+	}
+	return false
+}
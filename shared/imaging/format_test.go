@@ -0,0 +1,49 @@
+package imaging
+
+import "testing"
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Format
+	}{
+		{"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF", FormatJPEG},
+		{"png", "\x89PNG\r\n\x1a\n", FormatPNG},
+		{"gif", "GIF89a", FormatGIF},
+		{"webp", "RIFF\x00\x00\x00\x00WEBPVP8 ", FormatWebP},
+		{"bmp", "BM\x00\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00", FormatBMP},
+		{"tiff little endian", "II*\x00\x08\x00\x00\x00", FormatTIFF},
+		{"tiff big endian", "MM\x00*\x00\x00\x00\x08", FormatTIFF},
+		{"pdf", "%PDF-1.7\n", FormatPDF},
+		{"pdf after junk", "\xEF\xBB\xBF\n%PDF-1.4\n", FormatPDF},
+		{"iphone heic", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", FormatHEIC},
+		{"heic compatible brand", "\x00\x00\x00\x1cftypmif1\x00\x00\x00\x00mif1miafheic", FormatHEIC},
+		{"generic heif", "\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1miaf", FormatHEIF},
+		{"mp4 is not heif", "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2", FormatUnknown},
+		{"text", "hello world", FormatUnknown},
+		{"too short", "ab", FormatUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat([]byte(tt.data)); got != tt.want {
+				t.Errorf("DetectFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatContentType(t *testing.T) {
+	tests := map[Format]string{
+		FormatJPEG:    "image/jpeg",
+		FormatHEIC:    "image/heic",
+		FormatPDF:     "application/pdf",
+		FormatUnknown: "application/octet-stream",
+	}
+	for format, want := range tests {
+		if got := format.ContentType(); got != want {
+			t.Errorf("%q.ContentType() = %s, want %s", format, got, want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	// Register decoders for image.Decode
+	_ "image/gif"
+	_ "image/png"
+)
+
+// Defaults match how the vision API scales "high" detail images: anything larger
+// than 2048px on the long side or 768px on the short side is downscaled by the API
+// anyway, so sending more pixels only costs upload time
+const (
+	DefaultMaxDimension   = 2048
+	DefaultMaxShortSide   = 768
+	DefaultJPEGQuality    = 85
+	DefaultMaxPixels      = 50_000_000 // Refuse to decode larger images (decompression bombs)
+	minJPEGQuality        = 50
+	autoCropThumbnailSize = 512
+)
+
+// ErrUnsupportedFormat is returned for images no registered decoder understands (e.g. HEIC, PDF)
+var ErrUnsupportedFormat = errors.New("unsupported image format for preprocessing")
+
+// Options controls the preprocessing pipeline
+type Options struct {
+	MaxDimension int  // Longest side in pixels (default: 2048)
+	MaxShortSide int  // Shortest side in pixels (default: 768)
+	JPEGQuality  int  // Starting JPEG quality (default: 85)
+	MaxBytes     int  // Lower the JPEG quality until the output fits (0: no target)
+	Grayscale    bool // Drop color, which receipts rarely need
+	Normalize    bool // Stretch contrast for faded thermal paper and dim photos
+	AutoCrop     bool // Crop to the bright paper area when it stands out from the background
+	MaxPixels    int  // Largest decodable image (default: 50 megapixels)
+}
+
+// Result is a preprocessed image
+type Result struct {
+	Data           []byte
+	ContentType    string
+	Width          int
+	Height         int
+	OriginalWidth  int
+	OriginalHeight int
+	Orientation    int  // EXIF orientation that was applied
+	Cropped        bool // Auto-crop removed background
+	Quality        int  // JPEG quality used (0 when the original was kept)
+}
+
+// Changed reports whether the result differs from the original image
+func (r *Result) Changed() bool {
+	return r.Quality > 0
+}
+
+// withDefaults fills in zero values
+func (o Options) withDefaults() Options {
+	if o.MaxDimension <= 0 {
+		o.MaxDimension = DefaultMaxDimension
+	}
+	if o.MaxShortSide <= 0 {
+		o.MaxShortSide = DefaultMaxShortSide
+	}
+	if o.JPEGQuality <= 0 || o.JPEGQuality > 100 {
+		o.JPEGQuality = DefaultJPEGQuality
+	}
+	if o.MaxPixels <= 0 {
+		o.MaxPixels = DefaultMaxPixels
+	}
+	return o
+}
+
+// Preprocess prepares a receipt photo for the vision API
+// It applies the EXIF orientation, optionally crops to the paper, downscales to the
+// model's useful resolution, optionally converts to grayscale with normalized contrast
+// and re-encodes as JPEG. The original is returned unchanged when re-encoding would
+// neither shrink nor transform it
+func Preprocess(data []byte, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, ErrUnsupportedFormat
+		}
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width*config.Height > opts.MaxPixels {
+		return nil, fmt.Errorf("image too large to preprocess: %dx%d", config.Width, config.Height)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+
+	result := &Result{
+		OriginalWidth:  config.Width,
+		OriginalHeight: config.Height,
+		Orientation:    OrientationNormal,
+	}
+	transformed := false
+
+	img := toRGBA(decoded)
+	if format == "jpeg" {
+		result.Orientation = ReadOrientation(data)
+		if result.Orientation != OrientationNormal {
+			img = applyOrientation(img, result.Orientation)
+			transformed = true
+		}
+	}
+
+	if opts.AutoCrop {
+		if bounds, ok := paperBoundsScaled(img); ok {
+			img = crop(img, bounds)
+			result.Cropped = true
+			transformed = true
+		}
+	}
+
+	w, h := fitSize(img.Rect.Dx(), img.Rect.Dy(), opts.MaxDimension, opts.MaxShortSide)
+	if w != img.Rect.Dx() || h != img.Rect.Dy() {
+		img = resize(img, w, h)
+		transformed = true
+	}
+
+	if opts.Normalize && normalizeContrast(img) {
+		transformed = true
+	}
+
+	var output image.Image = img
+	if opts.Grayscale {
+		output = toGray(img)
+		transformed = true
+	}
+
+	encoded, quality, err := encodeJPEG(output, opts.JPEGQuality, opts.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-encoding an untouched image only loses quality unless it saves space
+	if !transformed && len(encoded) >= len(data) {
+		result.Data = data
+		result.ContentType = "image/" + format
+		result.Width, result.Height = config.Width, config.Height
+		return result, nil
+	}
+
+	result.Data = encoded
+	result.ContentType = "image/jpeg"
+	result.Width, result.Height = w, h
+	result.Quality = quality
+	return result, nil
+}
+
+// encodeJPEG encodes at the given quality, lowering it until the output fits maxBytes
+func encodeJPEG(img image.Image, quality, maxBytes int) ([]byte, int, error) {
+	var buf bytes.Buffer
+	for {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, 0, fmt.Errorf("failed to encode JPEG: %w", err)
+		}
+		if maxBytes <= 0 || buf.Len() <= maxBytes || quality <= minJPEGQuality {
+			return buf.Bytes(), quality, nil
+		}
+		quality = max(minJPEGQuality, quality-10)
+	}
+}
+
+// paperBoundsScaled finds the paper area on a thumbnail and maps it back to full size
+func paperBoundsScaled(img *image.RGBA) (image.Rectangle, bool) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	tw, th := fitSize(w, h, autoCropThumbnailSize, 0)
+	bounds, ok := paperBounds(resize(img, tw, th))
+	if !ok {
+		return image.Rectangle{}, false
+	}
+
+	scaleX := float64(w) / float64(tw)
+	scaleY := float64(h) / float64(th)
+	full := image.Rect(
+		int(float64(bounds.Min.X)*scaleX),
+		int(float64(bounds.Min.Y)*scaleY),
+		int(float64(bounds.Max.X)*scaleX+0.5),
+		int(float64(bounds.Max.Y)*scaleY+0.5),
+	)
+	return full.Intersect(img.Rect), true
+}
@@ -0,0 +1,268 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testJPEG encodes an image as JPEG, inserting an EXIF orientation segment when orientation > 0
+func testJPEG(t *testing.T, img image.Image, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode test JPEG: %v", err)
+	}
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+
+	// Big-endian TIFF header with one IFD0 entry: orientation SHORT
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], exifOrientationTag)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0) // No next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	result := append([]byte{}, data[:2]...)
+	result = append(result, segment...)
+	return append(result, data[2:]...)
+}
+
+// solidImage returns an image filled with one color
+func solidImage(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestReadOrientation(t *testing.T) {
+	img := solidImage(8, 4, color.White)
+	for orientation := OrientationNormal; orientation <= OrientationRotate270; orientation++ {
+		if got := ReadOrientation(testJPEG(t, img, orientation)); got != orientation {
+			t.Errorf("ReadOrientation() = %d, want %d", got, orientation)
+		}
+	}
+	if got := ReadOrientation(testJPEG(t, img, 0)); got != OrientationNormal {
+		t.Errorf("ReadOrientation() without EXIF = %d, want 1", got)
+	}
+	if got := ReadOrientation([]byte("not a jpeg")); got != OrientationNormal {
+		t.Errorf("ReadOrientation() for garbage = %d, want 1", got)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2x1 image: red on the left, blue on the right
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.RGBA{0, 0, 255, 255})
+
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		redAt       image.Point
+	}{
+		{OrientationNormal, 2, 1, image.Pt(0, 0)},
+		{OrientationFlipH, 2, 1, image.Pt(1, 0)},
+		{OrientationRotate180, 2, 1, image.Pt(1, 0)},
+		{OrientationRotate90, 1, 2, image.Pt(0, 0)},  // Left edge rotates to the top
+		{OrientationRotate270, 1, 2, image.Pt(0, 1)}, // Left edge rotates to the bottom
+		{OrientationTranspose, 1, 2, image.Pt(0, 0)},
+		{OrientationTransverse, 1, 2, image.Pt(0, 1)},
+	}
+
+	for _, tt := range tests {
+		dst := applyOrientation(src, tt.orientation)
+		if dst.Rect.Dx() != tt.width || dst.Rect.Dy() != tt.height {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d", tt.orientation, dst.Rect.Dx(), dst.Rect.Dy(), tt.width, tt.height)
+			continue
+		}
+		if r, _, _, _ := dst.At(tt.redAt.X, tt.redAt.Y).RGBA(); r>>8 != 255 {
+			t.Errorf("orientation %d: expected red pixel at %v", tt.orientation, tt.redAt)
+		}
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		w, h     int
+		wantW    int
+		wantH    int
+		maxLong  int
+		maxShort int
+	}{
+		{"phone photo", 3024, 4032, 768, 1024, 2048, 768},
+		{"long receipt", 1000, 5000, 410, 2048, 2048, 768},
+		{"already small", 600, 800, 600, 800, 2048, 768},
+		{"landscape", 4000, 3000, 1024, 768, 2048, 768},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := fitSize(tt.w, tt.h, tt.maxLong, tt.maxShort)
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("fitSize() = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestPreprocessOrientsAndDownscales(t *testing.T) {
+	// A landscape sensor image that should be displayed rotated to portrait
+	data := testJPEG(t, solidImage(2000, 1500, color.Gray{200}), OrientationRotate90)
+
+	result, err := Preprocess(data, Options{})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	if result.Orientation != OrientationRotate90 {
+		t.Errorf("Orientation = %d, want 6", result.Orientation)
+	}
+	if result.Width != 768 || result.Height != 1024 {
+		t.Errorf("Size = %dx%d, want 768x1024", result.Width, result.Height)
+	}
+	if !result.Changed() || result.ContentType != "image/jpeg" {
+		t.Errorf("Expected a re-encoded JPEG, got %s (changed=%v)", result.ContentType, result.Changed())
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatalf("output is not a valid JPEG: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 768 || b.Dy() != 1024 {
+		t.Errorf("Decoded size = %dx%d, want 768x1024", b.Dx(), b.Dy())
+	}
+}
+
+func TestPreprocessKeepsSmallOriginal(t *testing.T) {
+	data := testJPEG(t, solidImage(300, 400, color.White), 0)
+
+	result, err := Preprocess(data, Options{})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	if result.Changed() && len(result.Data) >= len(data) {
+		t.Errorf("Expected original or smaller output, got %d bytes from %d", len(result.Data), len(data))
+	}
+	if result.Width != 300 || result.Height != 400 {
+		t.Errorf("Size = %dx%d, want 300x400", result.Width, result.Height)
+	}
+}
+
+func TestPreprocessGrayscaleAndNormalize(t *testing.T) {
+	// Faded receipt: dark gray text on light gray paper
+	img := solidImage(200, 200, color.RGBA{170, 160, 150, 255})
+	for y := 80; y < 120; y++ {
+		for x := 20; x < 180; x++ {
+			img.Set(x, y, color.RGBA{110, 100, 90, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	result, err := Preprocess(buf.Bytes(), Options{Grayscale: true, Normalize: true})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatalf("output is not a valid JPEG: %v", err)
+	}
+	if _, ok := decoded.(*image.Gray); !ok {
+		t.Errorf("Expected a grayscale JPEG, got %T", decoded)
+	}
+
+	paper := color.GrayModel.Convert(decoded.At(10, 10)).(color.Gray).Y
+	text := color.GrayModel.Convert(decoded.At(100, 100)).(color.Gray).Y
+	if paper < 230 || text > 25 {
+		t.Errorf("Expected stretched contrast, got paper=%d text=%d", paper, text)
+	}
+}
+
+func TestPreprocessAutoCrop(t *testing.T) {
+	// White receipt in the middle of a dark table
+	img := solidImage(1000, 1000, color.RGBA{40, 35, 30, 255})
+	for y := 100; y < 900; y++ {
+		for x := 350; x < 650; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	result, err := Preprocess(buf.Bytes(), Options{AutoCrop: true})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	if !result.Cropped {
+		t.Fatal("Expected the paper area to be cropped")
+	}
+	// Paper is 300x800 plus a 2% margin on each side
+	if result.Width < 300 || result.Width > 360 || result.Height < 800 || result.Height > 860 {
+		t.Errorf("Cropped size = %dx%d, want about 340x840", result.Width, result.Height)
+	}
+}
+
+func TestPreprocessAutoCropSkipsFullFrame(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(400, 600, color.White))
+
+	result, err := Preprocess(buf.Bytes(), Options{AutoCrop: true})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	if result.Cropped {
+		t.Error("Expected no crop for an image that is all paper")
+	}
+}
+
+func TestPreprocessMaxBytes(t *testing.T) {
+	// Noise compresses poorly, forcing lower quality
+	img := image.NewRGBA(image.Rect(0, 0, 600, 600))
+	for i := range img.Pix {
+		img.Pix[i] = uint8((i * 7919) % 251)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	unbounded, err := Preprocess(buf.Bytes(), Options{Normalize: true})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	result, err := Preprocess(buf.Bytes(), Options{Normalize: true, MaxBytes: len(unbounded.Data) / 2})
+	if err != nil {
+		t.Fatalf("Preprocess() error = %v", err)
+	}
+	if result.Quality >= DefaultJPEGQuality {
+		t.Errorf("Expected quality below %d, got %d", DefaultJPEGQuality, result.Quality)
+	}
+	if len(result.Data) >= len(unbounded.Data) {
+		t.Errorf("Expected smaller output with MaxBytes, got %d >= %d", len(result.Data), len(unbounded.Data))
+	}
+}
+
+func TestPreprocessUnsupportedFormat(t *testing.T) {
+	_, err := Preprocess([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), Options{})
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
@@ -0,0 +1,913 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// minPageImageSize filters logos and icons out of the page images of a PDF
+const minPageImageSize = 300
+
+// ErrNoPDFContent is returned for PDFs with neither usable page images nor text
+var ErrNoPDFContent = errors.New("PDF has no extractable page images or text")
+
+// ErrPDFTextUnreadable is returned for PDFs without page images whose text is drawn
+// with fonts that have no usable Unicode mapping, which would only yield glyph numbers
+var ErrPDFTextUnreadable = errors.New("PDF text cannot be decoded to Unicode")
+
+// ErrPDFStreamTooLarge is returned for PDFs with a stream that inflates beyond what any
+// page image of the allowed size needs (decompression bombs)
+var ErrPDFStreamTooLarge = errors.New("PDF stream inflates beyond the size limit")
+
+var (
+	pdfObjectPattern   = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	pdfLengthPattern   = regexp.MustCompile(`/Length\s+(\d+)(\s+(\d+)\s+R)?`)
+	pdfFilterPattern   = regexp.MustCompile(`/Filter\s*(\[[^\]]*\]|/[A-Za-z0-9]+)`)
+	pdfNamePattern     = regexp.MustCompile(`/([A-Za-z0-9]+)`)
+	pdfIntPattern      = regexp.MustCompile(`^\s*(\d+)\s*$`)
+	pdfHexPairPattern  = regexp.MustCompile(`<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>`)
+	pdfBfRangePattern  = regexp.MustCompile(`<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>`)
+	pdfRefPattern      = regexp.MustCompile(`(\d+)\s+\d+\s+R`)
+	pdfNamedRefPattern = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R`)
+	pdfPageTypePattern = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfObjStmPattern   = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfType0Pattern    = regexp.MustCompile(`/Subtype\s*/Type0\b`)
+)
+
+// PDFContent is what can be recovered from a PDF without a rendering engine
+// Scanned receipts yield page images; e-receipts generated by shops yield text
+type PDFContent struct {
+	Images [][]byte // JPEG page images in file order
+	Text   string   // Text drawn by the page content streams
+}
+
+// pdfObject is an indirect object with its stream, if any
+type pdfObject struct {
+	dict   string
+	stream []byte
+}
+
+// ExtractPDF recovers embedded page images and the text layer of a PDF
+// Only the common cases are handled: JPEG (DCTDecode) and 8-bit or 1-bit Flate images,
+// and text in Flate-compressed page content streams decoded through each font's
+// ToUnicode map. Objects packed into object streams (PDF 1.5) are read as well
+// Page images larger than maxPixels are skipped (0: DefaultMaxPixels)
+func ExtractPDF(data []byte, maxPixels int) (*PDFContent, error) {
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxPixels
+	}
+	objects := parsePDFObjects(data)
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("failed to parse PDF: no objects found")
+	}
+	limit := maxPDFStreamSize(maxPixels)
+	if err := expandObjectStreams(objects, limit); err != nil {
+		return nil, err
+	}
+
+	content := &PDFContent{}
+	for _, num := range sortedObjectNumbers(objects) {
+		obj := objects[num]
+		if obj.stream == nil || !(strings.Contains(obj.dict, "/Subtype/Image") || strings.Contains(obj.dict, "/Subtype /Image")) {
+			continue
+		}
+		decoded, jpegData, err := decodePDFStream(obj, limit)
+		if errors.Is(err, ErrPDFStreamTooLarge) {
+			return nil, err
+		}
+		if err != nil {
+			continue // Unsupported filter, e.g. CCITT fax or JBIG2 scans
+		}
+		if img := pageImage(obj.dict, decoded, jpegData, maxPixels); img != nil {
+			content.Images = append(content.Images, img)
+		}
+	}
+
+	text, err := extractPDFPages(objects, limit)
+	switch {
+	case errors.Is(err, ErrPDFStreamTooLarge):
+		return nil, err
+	case err != nil && len(content.Images) == 0:
+		return nil, err
+	case err == nil:
+		// Text that cannot be decoded is dropped when there are page images to read instead
+		content.Text = text
+	}
+
+	if len(content.Images) == 0 && content.Text == "" {
+		return nil, ErrNoPDFContent
+	}
+	return content, nil
+}
+
+// parsePDFObjects indexes the indirect objects of a PDF by object number
+// Later definitions win, which matches incremental updates
+func parsePDFObjects(data []byte) map[int]*pdfObject {
+	objects := make(map[int]*pdfObject)
+	matches := pdfObjectPattern.FindAllSubmatchIndex(data, -1)
+
+	for i, m := range matches {
+		num, _ := strconv.Atoi(string(data[m[2]:m[3]]))
+		end := len(data)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		body := data[m[1]:end]
+		if idx := bytes.Index(body, []byte("endobj")); idx >= 0 && !bytes.Contains(body[:idx], []byte("stream")) {
+			body = body[:idx]
+		}
+
+		obj := &pdfObject{dict: string(body)}
+		if idx := bytes.Index(body, []byte("stream")); idx >= 0 {
+			obj.dict = string(body[:idx])
+			start := idx + len("stream")
+			if bytes.HasPrefix(body[start:], []byte("\r\n")) {
+				start += 2
+			} else if start < len(body) && (body[start] == '\n' || body[start] == '\r') {
+				start++
+			}
+			obj.stream = body[start:]
+		}
+		objects[num] = obj
+	}
+
+	// Trim streams to their /Length, resolving indirect lengths
+	for _, obj := range objects {
+		if obj.stream == nil {
+			continue
+		}
+		length := -1
+		if m := pdfLengthPattern.FindStringSubmatch(obj.dict); m != nil {
+			if m[2] == "" {
+				length, _ = strconv.Atoi(m[1])
+			} else if ref, err := strconv.Atoi(m[1]); err == nil && objects[ref] != nil {
+				if lm := pdfIntPattern.FindStringSubmatch(objects[ref].dict); lm != nil {
+					length, _ = strconv.Atoi(lm[1])
+				}
+			}
+		}
+		if length >= 0 && length <= len(obj.stream) {
+			obj.stream = obj.stream[:length]
+		} else if idx := bytes.Index(obj.stream, []byte("endstream")); idx >= 0 {
+			obj.stream = bytes.TrimRight(obj.stream[:idx], "\r\n")
+		}
+	}
+	return objects
+}
+
+// expandObjectStreams adds the objects packed into object streams, which PDF 1.5 writers
+// use for fonts and page dictionaries. Objects defined outside them are kept
+func expandObjectStreams(objects map[int]*pdfObject, limit int64) error {
+	for _, num := range sortedObjectNumbers(objects) {
+		obj := objects[num]
+		if obj.stream == nil || !pdfObjStmPattern.MatchString(obj.dict) {
+			continue
+		}
+		decoded, _, err := decodePDFStream(obj, limit)
+		if errors.Is(err, ErrPDFStreamTooLarge) {
+			return err
+		}
+		first := pdfIntValue(obj.dict, "First")
+		if err != nil || first <= 0 || first > len(decoded) {
+			continue
+		}
+
+		// The header lists pairs of object number and offset from First
+		header := strings.Fields(string(decoded[:first]))
+		for i := 0; i+1 < len(header); i += 2 {
+			objNum, err1 := strconv.Atoi(header[i])
+			start, err2 := strconv.Atoi(header[i+1])
+			end := len(decoded) - first
+			if i+3 < len(header) {
+				end, _ = strconv.Atoi(header[i+3])
+			}
+			if err1 != nil || err2 != nil || start < 0 || start > end || first+end > len(decoded) {
+				break
+			}
+			if objects[objNum] == nil {
+				objects[objNum] = &pdfObject{dict: string(decoded[first+start : first+end])}
+			}
+		}
+	}
+	return nil
+}
+
+// sortedObjectNumbers returns object numbers in ascending order, which is usually page order
+func sortedObjectNumbers(objects map[int]*pdfObject) []int {
+	nums := make([]int, 0, len(objects))
+	for num := range objects {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// maxPDFStreamSize is the most a stream may inflate to: an RGB page image of maxPixels
+// with a PNG predictor byte per row. Content streams of receipts are far smaller
+func maxPDFStreamSize(maxPixels int) int64 {
+	return 4 * int64(maxPixels)
+}
+
+// decodePDFStream applies the stream's filters, inflating at most limit bytes
+// JPEG data is returned separately since it is kept encoded
+func decodePDFStream(obj *pdfObject, limit int64) (decoded []byte, jpegData []byte, err error) {
+	var filters []string
+	if m := pdfFilterPattern.FindStringSubmatch(obj.dict); m != nil {
+		for _, name := range pdfNamePattern.FindAllStringSubmatch(m[1], -1) {
+			filters = append(filters, name[1])
+		}
+	}
+
+	data := obj.stream
+	for _, filter := range filters {
+		switch filter {
+		case "FlateDecode", "Fl":
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to inflate stream: %w", err)
+			}
+			inflated, err := io.ReadAll(io.LimitReader(reader, limit+1))
+			if err != nil && len(inflated) == 0 {
+				return nil, nil, fmt.Errorf("failed to inflate stream: %w", err)
+			}
+			if int64(len(inflated)) > limit {
+				return nil, nil, fmt.Errorf("%w (%d bytes)", ErrPDFStreamTooLarge, limit)
+			}
+			data = inflated
+		case "DCTDecode", "DCT":
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported PDF filter %s", filter)
+		}
+	}
+	return data, nil, nil
+}
+
+// pageImage converts an image XObject to JPEG, skipping small images such as logos
+// and images with missing or oversized dimensions
+func pageImage(dict string, decoded, jpegData []byte, maxPixels int) []byte {
+	width := pdfIntValue(dict, "Width")
+	height := pdfIntValue(dict, "Height")
+	if width <= 0 || height <= 0 || width > maxPixels/height {
+		return nil
+	}
+	if width < minPageImageSize && height < minPageImageSize {
+		return nil
+	}
+	if jpegData != nil {
+		return jpegData
+	}
+
+	bits := pdfIntValue(dict, "BitsPerComponent")
+	components := 0
+	switch {
+	case strings.Contains(dict, "/DeviceGray") || strings.Contains(dict, "/ImageMask"):
+		components = 1
+	case strings.Contains(dict, "/DeviceRGB"):
+		components = 3
+	default:
+		return nil // Indexed, CMYK and ICC color spaces are not handled
+	}
+	if strings.Contains(dict, "/ImageMask") {
+		bits = 1
+	}
+	if bits != 1 && bits != 8 {
+		return nil // 2, 4 and 16-bit samples are not handled
+	}
+
+	rowBytes := (width*components*bits + 7) / 8
+	if predictor := pdfIntValue(dict, "Predictor"); predictor >= 10 {
+		var err error
+		decoded, err = undoPNGPredictor(decoded, rowBytes, (components*bits+7)/8)
+		if err != nil {
+			return nil
+		}
+	}
+	if len(decoded) < rowBytes*height {
+		return nil
+	}
+
+	var img image.Image
+	switch {
+	case components == 1 && bits == 8:
+		gray := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			copy(gray.Pix[y*gray.Stride:y*gray.Stride+width], decoded[y*rowBytes:])
+		}
+		img = gray
+	case components == 1 && bits == 1:
+		gray := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if decoded[y*rowBytes+x/8]&(0x80>>(x%8)) != 0 {
+					gray.Pix[y*gray.Stride+x] = 0xFF
+				}
+			}
+		}
+		img = gray
+	case components == 3 && bits == 8:
+		rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				si := y*rowBytes + x*3
+				di := y*rgba.Stride + x*4
+				rgba.Pix[di], rgba.Pix[di+1], rgba.Pix[di+2], rgba.Pix[di+3] = decoded[si], decoded[si+1], decoded[si+2], 0xFF
+			}
+		}
+		img = rgba
+	default:
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: DefaultJPEGQuality}); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// undoPNGPredictor reverses PNG row filters used by Flate image streams
+func undoPNGPredictor(data []byte, rowBytes, bpp int) ([]byte, error) {
+	stride := rowBytes + 1
+	if len(data) < stride {
+		return nil, fmt.Errorf("invalid predictor data")
+	}
+	rows := len(data) / stride
+	out := make([]byte, rows*rowBytes)
+	prev := make([]byte, rowBytes)
+
+	for r := 0; r < rows; r++ {
+		filter := data[r*stride]
+		row := out[r*rowBytes : (r+1)*rowBytes]
+		copy(row, data[r*stride+1:(r+1)*stride])
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			switch filter {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += prev[i]
+			case 3:
+				row[i] += byte((int(left) + int(prev[i])) / 2)
+			case 4:
+				row[i] += paeth(left, prev[i], upLeft)
+			}
+		}
+		prev = row
+	}
+	return out, nil
+}
+
+// paeth is the PNG Paeth predictor
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// pdfIntValue reads an integer dictionary entry such as /Width 1200
+func pdfIntValue(dict, key string) int {
+	m := regexp.MustCompile(`/` + key + `\s+(\d+)`).FindStringSubmatch(dict)
+	if m == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(m[1])
+	return v
+}
+
+// pdfFont is what the text of a font needs to be decoded
+type pdfFont struct {
+	toUnicode map[string]string // ToUnicode CMap keyed by hex character code; nil without one
+	composite bool              // Type0 font, whose 2-byte codes are meaningless without toUnicode
+}
+
+// extractPDFPages returns the text drawn by the content streams of every page, in
+// object order, decoding each string with the font selected for it
+func extractPDFPages(objects map[int]*pdfObject, limit int64) (string, error) {
+	fonts := make(map[int]*pdfFont)
+	var text strings.Builder
+	for _, num := range sortedObjectNumbers(objects) {
+		page := objects[num]
+		if !pdfPageTypePattern.MatchString(page.dict) {
+			continue
+		}
+		pageFonts, err := resolvePageFonts(objects, page, fonts, limit)
+		if err != nil {
+			return "", err
+		}
+		for _, m := range pdfRefPattern.FindAllStringSubmatch(pdfDictEntry(page.dict, "Contents"), -1) {
+			ref, _ := strconv.Atoi(m[1])
+			stream := objects[ref]
+			if stream == nil || stream.stream == nil {
+				continue
+			}
+			decoded, _, err := decodePDFStream(stream, limit)
+			if errors.Is(err, ErrPDFStreamTooLarge) {
+				return "", err
+			}
+			if err != nil {
+				continue
+			}
+			streamText, err := extractPDFText(decoded, pageFonts)
+			if err != nil {
+				return "", err
+			}
+			text.WriteString(streamText)
+			text.WriteString("\n")
+		}
+	}
+	return cleanText(text.String()), nil
+}
+
+// resolvePageFonts maps the font resource names of a page to their fonts, following
+// inherited resources up the page tree. fonts caches fonts by object number
+func resolvePageFonts(objects map[int]*pdfObject, page *pdfObject, fonts map[int]*pdfFont, limit int64) (map[string]*pdfFont, error) {
+	resources := ""
+	for node, depth := page, 0; node != nil && resources == "" && depth < 32; depth++ {
+		resources = resolvePDFValue(objects, pdfDictEntry(node.dict, "Resources"))
+		parent := pdfRefPattern.FindStringSubmatch(pdfDictEntry(node.dict, "Parent"))
+		if parent == nil {
+			break
+		}
+		num, _ := strconv.Atoi(parent[1])
+		node = objects[num]
+	}
+
+	pageFonts := make(map[string]*pdfFont)
+	for _, m := range pdfNamedRefPattern.FindAllStringSubmatch(resolvePDFValue(objects, pdfDictEntry(resources, "Font")), -1) {
+		num, _ := strconv.Atoi(m[2])
+		if fonts[num] == nil {
+			font, err := loadPDFFont(objects, objects[num], limit)
+			if err != nil {
+				return nil, err
+			}
+			fonts[num] = font
+		}
+		pageFonts[m[1]] = fonts[num]
+	}
+	return pageFonts, nil
+}
+
+// loadPDFFont reads the ToUnicode map of a font dictionary
+func loadPDFFont(objects map[int]*pdfObject, obj *pdfObject, limit int64) (*pdfFont, error) {
+	font := &pdfFont{}
+	if obj == nil {
+		return font, nil
+	}
+	font.composite = pdfType0Pattern.MatchString(obj.dict)
+	m := pdfRefPattern.FindStringSubmatch(pdfDictEntry(obj.dict, "ToUnicode"))
+	if m == nil {
+		return font, nil
+	}
+	num, _ := strconv.Atoi(m[1])
+	if cmap := objects[num]; cmap != nil && cmap.stream != nil {
+		decoded, _, err := decodePDFStream(cmap, limit)
+		if errors.Is(err, ErrPDFStreamTooLarge) {
+			return nil, err
+		}
+		if err == nil {
+			font.toUnicode = parseToUnicode(decoded)
+		}
+	}
+	return font, nil
+}
+
+// pdfDictEntry returns the raw value of key in a dictionary: a reference, a nested
+// dictionary or array, or a single token. Empty when the key is missing
+func pdfDictEntry(dict, key string) string {
+	for offset := 0; ; {
+		idx := strings.Index(dict[offset:], "/"+key)
+		if idx < 0 {
+			return ""
+		}
+		start := offset + idx + 1 + len(key)
+		offset = start
+		if start < len(dict) && !isPDFDelimiter(dict[start]) {
+			continue // A longer name such as /FontDescriptor
+		}
+		value := strings.TrimLeft(dict[start:], " \t\r\n\f")
+		switch {
+		case strings.HasPrefix(value, "<<"):
+			return balancedPDFValue(value, "<<", ">>")
+		case strings.HasPrefix(value, "["):
+			return balancedPDFValue(value, "[", "]")
+		}
+		if m := pdfRefPattern.FindStringIndex(value); m != nil && m[0] == 0 {
+			return value[:m[1]]
+		}
+		end := 1
+		for end < len(value) && !isPDFDelimiter(value[end]) {
+			end++
+		}
+		return value[:end]
+	}
+}
+
+// balancedPDFValue returns the prefix of value up to the close matching its leading open
+func balancedPDFValue(value, open, close string) string {
+	depth := 0
+	for i := 0; i < len(value); {
+		switch {
+		case strings.HasPrefix(value[i:], open):
+			depth++
+			i += len(open)
+		case strings.HasPrefix(value[i:], close):
+			depth--
+			i += len(close)
+			if depth == 0 {
+				return value[:i]
+			}
+		default:
+			i++
+		}
+	}
+	return value
+}
+
+// resolvePDFValue returns the dictionary of the object a reference points to, or the
+// value itself when it is not a reference
+func resolvePDFValue(objects map[int]*pdfObject, value string) string {
+	m := pdfRefPattern.FindStringSubmatch(value)
+	if m == nil || m[0] != strings.TrimSpace(value) {
+		return value
+	}
+	num, _ := strconv.Atoi(m[1])
+	if objects[num] == nil {
+		return ""
+	}
+	return objects[num].dict
+}
+
+// parseToUnicode reads the mappings of a ToUnicode CMap, keyed by hex character code
+func parseToUnicode(cmap []byte) map[string]string {
+	mapping := make(map[string]string)
+	text := string(cmap)
+	for _, section := range sectionsBetween(text, "beginbfchar", "endbfchar") {
+		for _, m := range pdfHexPairPattern.FindAllStringSubmatch(section, -1) {
+			mapping[strings.ToUpper(m[1])] = decodeUTF16Hex(m[2])
+		}
+	}
+	for _, section := range sectionsBetween(text, "beginbfrange", "endbfrange") {
+		for _, m := range pdfBfRangePattern.FindAllStringSubmatch(section, -1) {
+			lo, err1 := strconv.ParseUint(m[1], 16, 32)
+			hi, err2 := strconv.ParseUint(m[2], 16, 32)
+			dst, err3 := strconv.ParseUint(m[3], 16, 32)
+			if err1 != nil || err2 != nil || err3 != nil || hi < lo || hi-lo > 0xFFFF {
+				continue
+			}
+			for code := lo; code <= hi; code++ {
+				key := fmt.Sprintf("%0*X", len(m[1]), code)
+				mapping[key] = string(rune(dst + code - lo))
+			}
+		}
+	}
+	return mapping
+}
+
+// sectionsBetween returns the text between each begin and end marker
+func sectionsBetween(text, begin, end string) []string {
+	var sections []string
+	for {
+		start := strings.Index(text, begin)
+		if start < 0 {
+			return sections
+		}
+		text = text[start+len(begin):]
+		stop := strings.Index(text, end)
+		if stop < 0 {
+			return sections
+		}
+		sections = append(sections, text[:stop])
+		text = text[stop+len(end):]
+	}
+}
+
+// decodeUTF16Hex decodes a UTF-16BE hex string from a CMap
+func decodeUTF16Hex(h string) string {
+	raw, err := hex.DecodeString(h)
+	if err != nil {
+		return ""
+	}
+	return decodeUTF16(raw)
+}
+
+// decodeUTF16 decodes big-endian UTF-16 bytes
+func decodeUTF16(raw []byte) string {
+	units := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// pdfToken is an operand in a content stream
+type pdfToken struct {
+	kind  byte // 's' literal string, 'h' hex string, 'n' number, '[' and ']' array markers, '/' name
+	value string
+}
+
+// extractPDFText interprets the text operators of a content stream, decoding strings
+// with the font the last Tf selected from fonts
+func extractPDFText(stream []byte, fonts map[string]*pdfFont) (string, error) {
+	var out strings.Builder
+	var operands []pdfToken
+	var font *pdfFont
+	lastY := ""
+
+	for i := 0; i < len(stream); {
+		c := stream[i]
+		switch {
+		case c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0:
+			i++
+		case c == '%':
+			for i < len(stream) && stream[i] != '\n' && stream[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			s, next := readLiteralString(stream, i)
+			operands = append(operands, pdfToken{kind: 's', value: s})
+			i = next
+		case c == '<' && i+1 < len(stream) && stream[i+1] == '<':
+			i += 2
+		case c == '>' && i+1 < len(stream) && stream[i+1] == '>':
+			i += 2
+		case c == '<':
+			end := bytes.IndexByte(stream[i:], '>')
+			if end < 0 {
+				return out.String(), nil
+			}
+			operands = append(operands, pdfToken{kind: 'h', value: string(stream[i+1 : i+end])})
+			i += end + 1
+		case c == '[' || c == ']':
+			operands = append(operands, pdfToken{kind: c})
+			i++
+		case c == '/':
+			j := i + 1
+			for j < len(stream) && !isPDFDelimiter(stream[j]) {
+				j++
+			}
+			operands = append(operands, pdfToken{kind: '/', value: string(stream[i+1 : j])})
+			i = j
+		case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(stream) && (stream[j] == '.' || (stream[j] >= '0' && stream[j] <= '9')) {
+				j++
+			}
+			operands = append(operands, pdfToken{kind: 'n', value: string(stream[i:j])})
+			i = j
+		default:
+			j := i + 1
+			for j < len(stream) && !isPDFDelimiter(stream[j]) {
+				j++
+			}
+			op := string(stream[i:j])
+			i = j
+
+			var err error
+			switch op {
+			case "Tf":
+				if len(operands) >= 1 && operands[0].kind == '/' {
+					font = fonts[operands[0].value]
+				}
+			case "Tj":
+				err = writePDFString(&out, lastString(operands), font)
+			case "'", "\"":
+				out.WriteString("\n")
+				err = writePDFString(&out, lastString(operands), font)
+			case "TJ":
+				for _, tok := range operands {
+					switch tok.kind {
+					case 's', 'h':
+						if err == nil {
+							err = writePDFString(&out, &tok, font)
+						}
+					case 'n':
+						// Large negative adjustments separate words
+						if v, err := strconv.ParseFloat(tok.value, 64); err == nil && v < -200 {
+							out.WriteString(" ")
+						}
+					}
+				}
+			case "T*":
+				out.WriteString("\n")
+			case "Td", "TD":
+				if len(operands) >= 2 {
+					if ty, err := strconv.ParseFloat(operands[len(operands)-1].value, 64); err == nil && ty != 0 {
+						out.WriteString("\n")
+					} else {
+						out.WriteString(" ")
+					}
+				}
+			case "Tm":
+				if len(operands) >= 6 {
+					y := operands[len(operands)-1].value
+					if y != lastY {
+						out.WriteString("\n")
+					} else {
+						out.WriteString(" ")
+					}
+					lastY = y
+				}
+			case "ET":
+				out.WriteString("\n")
+			case "ID":
+				// Skip inline image data up to EI
+				end := bytes.Index(stream[i:], []byte("EI"))
+				if end < 0 {
+					return out.String(), nil
+				}
+				i += end + 2
+			}
+			if err != nil {
+				return "", err
+			}
+			operands = operands[:0]
+		}
+	}
+	return out.String(), nil
+}
+
+// isPDFDelimiter reports whether c ends a name or operator
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n\f\x00()<>[]{}/%", c) >= 0
+}
+
+// lastString returns the last string operand
+func lastString(operands []pdfToken) *pdfToken {
+	for i := len(operands) - 1; i >= 0; i-- {
+		if operands[i].kind == 's' || operands[i].kind == 'h' {
+			return &operands[i]
+		}
+	}
+	return nil
+}
+
+// readLiteralString reads a (string) with nesting and escapes starting at stream[start]
+func readLiteralString(stream []byte, start int) (string, int) {
+	var buf bytes.Buffer
+	depth := 0
+	i := start
+	for i < len(stream) {
+		c := stream[i]
+		switch {
+		case c == '\\' && i+1 < len(stream):
+			i++
+			switch e := stream[i]; e {
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case 'b':
+				buf.WriteByte('\b')
+			case 'f':
+				buf.WriteByte('\f')
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v, n := 0, 0
+					for n < 3 && i < len(stream) && stream[i] >= '0' && stream[i] <= '7' {
+						v = v*8 + int(stream[i]-'0')
+						i++
+						n++
+					}
+					buf.WriteByte(byte(v))
+					continue
+				}
+				buf.WriteByte(e)
+			}
+		case c == '(':
+			if depth > 0 {
+				buf.WriteByte(c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return buf.String(), i + 1
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+		i++
+	}
+	return buf.String(), i
+}
+
+// writePDFString decodes a string operand through the font's ToUnicode map, or as
+// UTF-16/PDFDocEncoding for simple fonts without one
+// Codes a composite font does not map are glyph numbers, so they fail ErrPDFTextUnreadable
+func writePDFString(out *strings.Builder, tok *pdfToken, font *pdfFont) error {
+	if tok == nil {
+		return nil
+	}
+	raw := []byte(tok.value)
+	if tok.kind == 'h' {
+		h := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" \t\r\n", r) {
+				return -1
+			}
+			return r
+		}, tok.value)
+		if len(h)%2 == 1 {
+			h += "0"
+		}
+		decoded, err := hex.DecodeString(h)
+		if err != nil {
+			return nil
+		}
+		raw = decoded
+	}
+
+	if font != nil && font.toUnicode != nil {
+		if text, ok := decodeWithCMap(raw, font.toUnicode, font.composite); ok {
+			out.WriteString(text)
+			return nil
+		}
+	}
+	if font != nil && font.composite {
+		return fmt.Errorf("%w: composite font without a mapping for <%X>", ErrPDFTextUnreadable, raw)
+	}
+	if bytes.HasPrefix(raw, []byte{0xFE, 0xFF}) {
+		out.WriteString(decodeUTF16(raw[2:]))
+		return nil
+	}
+	if utf8.Valid(raw) {
+		out.Write(raw)
+		return nil
+	}
+	for _, b := range raw {
+		out.WriteRune(rune(b))
+	}
+	return nil
+}
+
+// decodeWithCMap maps 2-byte, then 1-byte character codes through a ToUnicode map
+// Composite fonts only use 2-byte codes
+func decodeWithCMap(raw []byte, cmap map[string]string, composite bool) (string, bool) {
+	for _, width := range []int{2, 1} {
+		if width == 1 && composite {
+			break
+		}
+		if len(raw)%width != 0 {
+			continue
+		}
+		var b strings.Builder
+		ok := true
+		for i := 0; i < len(raw); i += width {
+			text, found := cmap[fmt.Sprintf("%X", raw[i:i+width])]
+			if !found {
+				ok = false
+				break
+			}
+			b.WriteString(text)
+		}
+		if ok {
+			return b.String(), true
+		}
+	}
+	return "", false
+}
+
+// cleanText trims lines and collapses blank lines
+func cleanText(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
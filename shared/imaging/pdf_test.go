@@ -0,0 +1,261 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// buildPDF assembles a minimal PDF from object bodies, numbering them from 1
+func buildPDF(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return buf.Bytes()
+}
+
+// streamObject builds a stream object, optionally Flate-compressed
+func streamObject(dict string, data []byte, flate bool) string {
+	if flate {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		data = buf.Bytes()
+		dict += " /Filter /FlateDecode"
+	}
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+func TestExtractPDFText(t *testing.T) {
+	content := `BT /F1 12 Tf 72 720 Td (COFFEE SHOP) Tj 0 -14 Td (Latte) Tj [(  4) -300 (50)] TJ T* (Total \(incl. tax\) 4.50) Tj ET`
+	pdf := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		streamObject("", []byte(content), true),
+	)
+
+	result, err := ExtractPDF(pdf, 0)
+	if err != nil {
+		t.Fatalf("ExtractPDF() error = %v", err)
+	}
+	if len(result.Images) != 0 {
+		t.Errorf("Expected no images, got %d", len(result.Images))
+	}
+	want := "COFFEE SHOP\nLatte 4 50\nTotal (incl. tax) 4.50"
+	if result.Text != want {
+		t.Errorf("Text = %q, want %q", result.Text, want)
+	}
+}
+
+// toUnicodeCMap builds a ToUnicode CMap from bfchar code and Unicode pairs
+func toUnicodeCMap(pairs ...string) []byte {
+	var cmap strings.Builder
+	cmap.WriteString("/CIDInit /ProcSet findresource begin\nbegincmap\n")
+	fmt.Fprintf(&cmap, "%d beginbfchar\n", len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fmt.Fprintf(&cmap, "<%s> <%s>\n", pairs[i], pairs[i+1])
+	}
+	cmap.WriteString("endbfchar\nendcmap")
+	return []byte(cmap.String())
+}
+
+func TestExtractPDFTextWithToUnicode(t *testing.T) {
+	// Identity-H font: glyph IDs 0001-0003 map to "領収書", 0010-0012 to "ABC"
+	cmap := `/CIDInit /ProcSet findresource begin
+begincmap
+2 beginbfchar
+<0001> <9818>
+<0002> <53CE>
+endbfchar
+1 beginbfchar
+<0003> <66F8>
+endbfchar
+1 beginbfrange
+<0010> <0012> <0041>
+endbfrange
+endcmap`
+	content := `BT /F1 10 Tf 1 0 0 1 50 700 Tm <000100020003> Tj 1 0 0 1 50 680 Tm <00100011 0012> Tj ET`
+	pdf := buildPDF(
+		"<< /Type /Page /Resources << /Font << /F1 4 0 R >> >> /Contents 2 0 R >>",
+		streamObject("", []byte(content), true),
+		streamObject("", []byte(cmap), true),
+		"<< /Type /Font /Subtype /Type0 /Encoding /Identity-H /ToUnicode 3 0 R >>",
+	)
+
+	result, err := ExtractPDF(pdf, 0)
+	if err != nil {
+		t.Fatalf("ExtractPDF() error = %v", err)
+	}
+	if result.Text != "領収書\nABC" {
+		t.Errorf("Text = %q, want %q", result.Text, "領収書\nABC")
+	}
+}
+
+func TestExtractPDFTextWithTwoFonts(t *testing.T) {
+	// Subset fonts number their glyphs from 1, so both fonts use <0001>-<0003>
+	content := `BT /F1 10 Tf 1 0 0 1 50 700 Tm <000100020003> Tj /F2 10 Tf 1 0 0 1 50 680 Tm [<0003> -400 <00010002>] TJ ET`
+	pdf := buildPDF(
+		"<< /Type /Pages /Kids [2 0 R] /Count 1 /Resources 3 0 R >>",
+		"<< /Type /Page /Parent 1 0 R /Contents 4 0 R >>",
+		"<< /Font << /F1 5 0 R /F2 6 0 R >> >>",
+		streamObject("", []byte(content), true),
+		"<< /Type /Font /Subtype /Type0 /Encoding /Identity-H /ToUnicode 7 0 R >>",
+		"<< /Type /Font /Subtype /Type0 /Encoding /Identity-H /ToUnicode 8 0 R >>",
+		streamObject("", toUnicodeCMap("0001", "9818", "0002", "53CE", "0003", "66F8"), true),
+		streamObject("", toUnicodeCMap("0001", "0031", "0002", "0030", "0003", "0054"), true),
+	)
+
+	result, err := ExtractPDF(pdf, 0)
+	if err != nil {
+		t.Fatalf("ExtractPDF() error = %v", err)
+	}
+	if want := "領収書\nT 10"; result.Text != want {
+		t.Errorf("Text = %q, want %q", result.Text, want)
+	}
+}
+
+func TestExtractPDFObjectStream(t *testing.T) {
+	// PDF 1.5 writers pack the page and font dictionaries into an object stream
+	packed := []string{
+		"<< /Type /Page /Resources << /Font << /F1 3 0 R >> >> /Contents 4 0 R >>",
+		"<< /Type /Font /Subtype /Type0 /Encoding /Identity-H /ToUnicode 5 0 R >>",
+	}
+	header := fmt.Sprintf("2 0 3 %d ", len(packed[0])+1)
+	body := header + packed[0] + " " + packed[1]
+	pdf := buildPDF(
+		streamObject(fmt.Sprintf("/Type /ObjStm /N 2 /First %d", len(header)), []byte(body), true),
+		"",
+		"",
+		streamObject("", []byte(`BT /F1 10 Tf <00010002> Tj ET`), true),
+		streamObject("", toUnicodeCMap("0001", "0041", "0002", "0042"), true),
+	)
+	// Objects 2 and 3 only exist inside the object stream
+	pdf = bytes.Replace(pdf, []byte("2 0 obj\n\nendobj\n3 0 obj\n\nendobj\n"), nil, 1)
+
+	result, err := ExtractPDF(pdf, 0)
+	if err != nil {
+		t.Fatalf("ExtractPDF() error = %v", err)
+	}
+	if result.Text != "AB" {
+		t.Errorf("Text = %q, want %q", result.Text, "AB")
+	}
+}
+
+func TestExtractPDFTextUnreadable(t *testing.T) {
+	tests := []struct {
+		name string
+		font string
+	}{
+		{"Composite font without ToUnicode", "<< /Type /Font /Subtype /Type0 /Encoding /Identity-H >>"},
+		{"Code missing from ToUnicode", "<< /Type /Font /Subtype /Type0 /Encoding /Identity-H /ToUnicode 4 0 R >>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdf := buildPDF(
+				"<< /Type /Page /Resources << /Font << /F1 2 0 R >> >> /Contents 3 0 R >>",
+				tt.font,
+				streamObject("", []byte(`BT /F1 10 Tf <00010002> Tj ET`), true),
+				streamObject("", toUnicodeCMap("0001", "0041"), true),
+			)
+			if _, err := ExtractPDF(pdf, 0); !errors.Is(err, ErrPDFTextUnreadable) {
+				t.Errorf("Expected ErrPDFTextUnreadable, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractPDFImages(t *testing.T) {
+	var scan bytes.Buffer
+	jpeg.Encode(&scan, solidImage(400, 800, color.White), nil)
+
+	// 8-bit grayscale Flate image with PNG "Up" predictor rows
+	width, height := 320, 320
+	var raw []byte
+	for y := 0; y < height; y++ {
+		raw = append(raw, 2) // Up filter
+		row := make([]byte, width)
+		if y == 0 {
+			for x := range row {
+				row[x] = 200
+			}
+		}
+		raw = append(raw, row...)
+	}
+
+	pdf := buildPDF(
+		"<< /Type /Page /Resources << /XObject << /Im1 2 0 R /Im2 3 0 R /Logo 4 0 R >> >> >>",
+		streamObject("/Type /XObject /Subtype /Image /Width 400 /Height 800 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", scan.Bytes(), false),
+		streamObject(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /DecodeParms << /Predictor 15 /Columns %d >>", width, height, width), raw, true),
+		streamObject("/Type /XObject /Subtype /Image /Width 64 /Height 64 /ColorSpace /DeviceGray /BitsPerComponent 8", make([]byte, 64*64), false),
+	)
+
+	result, err := ExtractPDF(pdf, 0)
+	if err != nil {
+		t.Fatalf("ExtractPDF() error = %v", err)
+	}
+	if len(result.Images) != 2 {
+		t.Fatalf("Expected 2 page images (logo skipped), got %d", len(result.Images))
+	}
+	if !bytes.Equal(result.Images[0], scan.Bytes()) {
+		t.Error("Expected the JPEG scan to be returned unchanged")
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(result.Images[1]))
+	if err != nil {
+		t.Fatalf("Flate image was not converted to JPEG: %v", err)
+	}
+	if decoded.Bounds() != image.Rect(0, 0, width, height) {
+		t.Errorf("Decoded bounds = %v", decoded.Bounds())
+	}
+	// The Up predictor repeats the first row all the way down
+	if y := color.GrayModel.Convert(decoded.At(10, 300)).(color.Gray).Y; y < 190 || y > 210 {
+		t.Errorf("Expected predicted pixel value near 200, got %d", y)
+	}
+}
+
+func TestExtractPDFEmpty(t *testing.T) {
+	pdf := buildPDF("<< /Type /Catalog >>", "<< /Type /Page >>")
+	if _, err := ExtractPDF(pdf, 0); !errors.Is(err, ErrNoPDFContent) {
+		t.Errorf("Expected ErrNoPDFContent, got %v", err)
+	}
+	if _, err := ExtractPDF([]byte("%PDF-1.4 garbage"), 0); err == nil || !strings.Contains(err.Error(), "no objects") {
+		t.Errorf("Expected parse error, got %v", err)
+	}
+}
+
+func TestExtractPDFLimits(t *testing.T) {
+	// 1 MB of zeros deflates to about 1 KB but needs more than a 1000 pixel page
+	bomb := buildPDF(streamObject("/Type /XObject /Subtype /Image /Width 20 /Height 50 /ColorSpace /DeviceGray /BitsPerComponent 8", make([]byte, 1<<20), true))
+	if _, err := ExtractPDF(bomb, 1000); !errors.Is(err, ErrPDFStreamTooLarge) {
+		t.Errorf("Expected ErrPDFStreamTooLarge, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		dict string
+	}{
+		{"More pixels than allowed", "/Width 5000 /Height 5000 /ColorSpace /DeviceGray /BitsPerComponent 8"},
+		{"Overflowing dimensions", "/Width 99999999999999999999 /Height 99999999999999999999 /ColorSpace /DeviceRGB /BitsPerComponent 8"},
+		{"No height", "/Width 400 /ColorSpace /DeviceGray /BitsPerComponent 8"},
+		{"Unhandled bit depth", "/Width 400 /Height 400 /ColorSpace /DeviceGray /BitsPerComponent 16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdf := buildPDF(streamObject("/Type /XObject /Subtype /Image "+tt.dict, make([]byte, 400*400), true))
+			if _, err := ExtractPDF(pdf, 1_000_000); !errors.Is(err, ErrNoPDFContent) {
+				t.Errorf("Expected the image to be skipped, got %v", err)
+			}
+		})
+	}
+}
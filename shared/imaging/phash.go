@@ -0,0 +1,61 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+)
+
+// DefaultHashDistance is the largest Hamming distance between two perceptual
+// hashes that still counts as the same photo. Re-encoding, resizing and messenger
+// compression stay well below it, different receipts are usually above 20
+const DefaultHashDistance = 6
+
+// PerceptualHash returns a 64-bit difference hash (dHash) of an image
+// The image is oriented per EXIF, shrunk to 9x8 grayscale and each bit records
+// whether a pixel is brighter than its right neighbour, so the hash survives
+// re-encoding, scaling and small brightness changes
+func PerceptualHash(data []byte) (uint64, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return 0, ErrUnsupportedFormat
+		}
+		return 0, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width*config.Height > DefaultMaxPixels {
+		return 0, fmt.Errorf("image too large to hash: %dx%d", config.Width, config.Height)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+
+	// Orient a thumbnail rather than the full photo, then shrink to the hash grid
+	img := toRGBA(decoded)
+	img = resize(img, max(9, min(img.Rect.Dx(), 64)), max(9, min(img.Rect.Dy(), 64)))
+	if format == "jpeg" {
+		img = applyOrientation(img, ReadOrientation(data))
+	}
+	gray := toGray(resize(img, 9, 8))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := gray.Pix[y*gray.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x] > row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// HashDistance returns the number of differing bits between two perceptual hashes
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,63 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// gradientImage draws a diagonal gradient with a dark block, so its hash has both bit values
+func gradientImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*255/w + y*255/h) / 2)
+			if x > w/3 && x < w/2 && y > h/4 && y < h/2 {
+				v = 20
+			}
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash(t *testing.T) {
+	original := gradientImage(400, 600)
+	base, err := PerceptualHash(testJPEG(t, original, 0))
+	if err != nil {
+		t.Fatalf("PerceptualHash() error = %v", err)
+	}
+
+	// The same photo re-encoded as a smaller PNG
+	var small bytes.Buffer
+	png.Encode(&small, resize(original, 200, 300))
+	resized, err := PerceptualHash(small.Bytes())
+	if err != nil {
+		t.Fatalf("PerceptualHash() error = %v", err)
+	}
+	if d := HashDistance(base, resized); d > DefaultHashDistance {
+		t.Errorf("Expected resized copy within %d bits, got %d", DefaultHashDistance, d)
+	}
+
+	// A rotated copy is the same photo once EXIF orientation is applied
+	rotated, err := PerceptualHash(testJPEG(t, applyOrientation(original, OrientationRotate270), OrientationRotate90))
+	if err != nil {
+		t.Fatalf("PerceptualHash() error = %v", err)
+	}
+	if d := HashDistance(base, rotated); d > DefaultHashDistance {
+		t.Errorf("Expected EXIF-rotated copy within %d bits, got %d", DefaultHashDistance, d)
+	}
+
+	// A different picture is far away
+	other, _ := PerceptualHash(testJPEG(t, applyOrientation(original, OrientationFlipH), 0))
+	if d := HashDistance(base, other); d <= DefaultHashDistance {
+		t.Errorf("Expected mirrored picture to differ, distance %d", d)
+	}
+
+	if _, err := PerceptualHash([]byte("%PDF-1.4")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
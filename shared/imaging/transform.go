@@ -0,0 +1,295 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// toRGBA converts any image to an RGBA image with origin (0, 0)
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// applyOrientation returns the image as it should be displayed for an EXIF orientation
+func applyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= OrientationNormal || orientation > OrientationRotate270 {
+		return src
+	}
+
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= OrientationTranspose {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case OrientationFlipH:
+				sx, sy = w-1-x, y
+			case OrientationRotate180:
+				sx, sy = w-1-x, h-1-y
+			case OrientationFlipV:
+				sx, sy = x, h-1-y
+			case OrientationTranspose:
+				sx, sy = y, x
+			case OrientationRotate90:
+				sx, sy = y, h-1-x
+			case OrientationTransverse:
+				sx, sy = w-1-y, h-1-x
+			case OrientationRotate270:
+				sx, sy = w-1-y, x
+			}
+			si := sy*src.Stride + sx*4
+			di := y*dst.Stride + x*4
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// fitSize returns the largest size within maxLong × maxShort that keeps the aspect ratio
+// Sizes already within the limits are returned unchanged
+func fitSize(w, h, maxLong, maxShort int) (int, int) {
+	long, short := w, h
+	if h > w {
+		long, short = h, w
+	}
+
+	scale := 1.0
+	if maxLong > 0 && long > maxLong {
+		scale = math.Min(scale, float64(maxLong)/float64(long))
+	}
+	if maxShort > 0 && short > maxShort {
+		scale = math.Min(scale, float64(maxShort)/float64(short))
+	}
+	if scale >= 1 {
+		return w, h
+	}
+	return max(1, int(math.Round(float64(w)*scale))), max(1, int(math.Round(float64(h)*scale)))
+}
+
+// resize downscales an image with an area-averaging box filter, which keeps thin text legible
+func resize(src *image.RGBA, dw, dh int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if dw == sw && dh == sh {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	xScale := float64(sw) / float64(dw)
+	yScale := float64(sh) / float64(dh)
+
+	for y := 0; y < dh; y++ {
+		y0 := int(float64(y) * yScale)
+		y1 := max(y0+1, min(sh, int(math.Ceil(float64(y+1)*yScale))))
+		for x := 0; x < dw; x++ {
+			x0 := int(float64(x) * xScale)
+			x1 := max(x0+1, min(sw, int(math.Ceil(float64(x+1)*xScale))))
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := sy*src.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			di := y*dst.Stride + x*4
+			dst.Pix[di] = uint8(r / n)
+			dst.Pix[di+1] = uint8(g / n)
+			dst.Pix[di+2] = uint8(b / n)
+			dst.Pix[di+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// luminance returns the Rec. 601 luma of an RGBA pixel
+func luminance(pix []uint8) uint8 {
+	return uint8((299*int(pix[0]) + 587*int(pix[1]) + 114*int(pix[2]) + 500) / 1000)
+}
+
+// toGray converts an RGBA image to grayscale
+func toGray(src *image.RGBA) *image.Gray {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Pix[y*dst.Stride+x] = luminance(src.Pix[y*src.Stride+x*4:])
+		}
+	}
+	return dst
+}
+
+// contrastRange returns the 1st and 99th luminance percentiles, ignoring outliers such as glare
+func contrastRange(src *image.RGBA) (uint8, uint8) {
+	var histogram [256]int
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			histogram[luminance(src.Pix[y*src.Stride+x*4:])]++
+		}
+	}
+
+	total := w * h
+	low, high := 0, 255
+	for count := 0; low < 255; low++ {
+		count += histogram[low]
+		if count > total/100 {
+			break
+		}
+	}
+	for count := 0; high > 0; high-- {
+		count += histogram[high]
+		if count > total/100 {
+			break
+		}
+	}
+	return uint8(low), uint8(high)
+}
+
+// normalizeContrast stretches the luminance range of an image to the full 0-255 scale in place
+// Images that already use most of the range are left alone
+func normalizeContrast(img *image.RGBA) bool {
+	low, high := contrastRange(img)
+	if high <= low || (low <= 8 && high >= 247) {
+		return false
+	}
+
+	var lut [256]uint8
+	span := float64(high) - float64(low)
+	for v := range lut {
+		scaled := (float64(v) - float64(low)) * 255 / span
+		lut[v] = uint8(math.Max(0, math.Min(255, math.Round(scaled))))
+	}
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h; y++ {
+		i := y * img.Stride
+		for x := 0; x < w; x++ {
+			img.Pix[i] = lut[img.Pix[i]]
+			img.Pix[i+1] = lut[img.Pix[i+1]]
+			img.Pix[i+2] = lut[img.Pix[i+2]]
+			i += 4
+		}
+	}
+	return true
+}
+
+// paperBounds finds the bright paper area of a receipt photographed on a darker surface
+// It returns false when no clear paper region stands out from the background
+func paperBounds(img *image.RGBA) (image.Rectangle, bool) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w < 16 || h < 16 {
+		return image.Rectangle{}, false
+	}
+
+	threshold := otsuThreshold(img)
+
+	// Count bright pixels per row and column
+	rowBright := make([]int, h)
+	colBright := make([]int, w)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if luminance(img.Pix[y*img.Stride+x*4:]) > threshold {
+				rowBright[y]++
+				colBright[x]++
+			}
+		}
+	}
+
+	y0, y1 := brightSpan(rowBright)
+	x0, x1 := brightSpan(colBright)
+	if x1 <= x0 || y1 <= y0 {
+		return image.Rectangle{}, false
+	}
+
+	// Keep a small margin so text at the paper's edge is not cut off
+	marginX, marginY := w/50, h/50
+	bounds := image.Rect(x0-marginX, y0-marginY, x1+marginX, y1+marginY).Intersect(img.Rect)
+
+	area := float64(bounds.Dx()*bounds.Dy()) / float64(w*h)
+	if area < 0.2 || area > 0.9 {
+		// Either not a receipt-shaped region or nothing worth cropping
+		return image.Rectangle{}, false
+	}
+	return bounds, true
+}
+
+// brightSpan returns the range of lines with at least half as many bright pixels as the brightest line
+func brightSpan(counts []int) (int, int) {
+	peak := 0
+	for _, count := range counts {
+		peak = max(peak, count)
+	}
+
+	first, last := -1, -1
+	for i, count := range counts {
+		if peak > 0 && count*2 >= peak {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	return first, last + 1
+}
+
+// otsuThreshold picks the luminance threshold that best separates paper from background
+func otsuThreshold(img *image.RGBA) uint8 {
+	var histogram [256]int
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			histogram[luminance(img.Pix[y*img.Stride+x*4:])]++
+		}
+	}
+
+	total := float64(w * h)
+	var sum float64
+	for v, count := range histogram {
+		sum += float64(v * count)
+	}
+
+	var sumBackground, weightBackground, best float64
+	threshold := 0
+	for v, count := range histogram {
+		weightBackground += float64(count)
+		if weightBackground == 0 {
+			continue
+		}
+		weightForeground := total - weightBackground
+		if weightForeground == 0 {
+			break
+		}
+		sumBackground += float64(v * count)
+		meanBackground := sumBackground / weightBackground
+		meanForeground := (sum - sumBackground) / weightForeground
+		between := weightBackground * weightForeground * (meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if between > best {
+			best = between
+			threshold = v
+		}
+	}
+	return uint8(threshold)
+}
+
+// crop returns a copy of the given region with origin (0, 0)
+func crop(src *image.RGBA, r image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, r.Min, draw.Src)
+	return dst
+}
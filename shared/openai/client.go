@@ -3,13 +3,50 @@ package openai
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultBaseURL is the root of the public OpenAI REST API
+	defaultBaseURL = "https://api.openai.com/v1"
+	// defaultRequestTimeout bounds a single API call or image download
+	defaultRequestTimeout = 60 * time.Second
 )
 
 // ServiceConfig holds configuration for the OpenAI service
 type ServiceConfig struct {
 	APIKey string
 
+	// Provider selects the ReceiptExtractor implementation (see NewReceiptExtractor)
+	Provider string
+	// BaseURL is the API root for OpenAI-compatible endpoints (default: https://api.openai.com/v1)
+	// For Azure OpenAI use https://<resource>.openai.azure.com/openai/deployments/<deployment>
+	BaseURL string
+
+	// HTTP settings
+	HTTPClient     *http.Client  // Shared client, reused across calls and Lambda invocations
+	RequestTimeout time.Duration // Per-call timeout applied through the request context (default: 60s)
+	Organization   string        // Sent as OpenAI-Organization header when set
+	Project        string        // Sent as OpenAI-Project header when set
+	APIVersion     string        // Azure OpenAI api-version; when set the key is sent in the api-key header
+
+	// Retry policy for transient API failures (429, 5xx, network errors)
+	Retry RetryPolicy
+
+	// Arithmetic consistency checks applied to every extraction
+	Reconcile ReconcileOptions
+
+	// Follow-up turns asking the model to fix answers that fail validation (0 disables)
+	MaxRepairRounds int
+
+	// Cost accounting
+	ModelPrices  map[string]ModelPrice // Overrides and additions to DefaultModelPrices
+	UsageTracker *UsageTracker         // Receives the usage of every extraction when set
+
 	// Context-specific settings for receipt processing
 	DefaultCurrency string
 	DefaultLanguage string
@@ -20,12 +57,15 @@ type ServiceConfig struct {
 	CompletionModel string
 	MaxTokens       int
 	Temperature     float32
+	ResponseFormat  string // ResponseFormatJSONSchema (default) or ResponseFormatJSONObject
 }
 
 // Service provides methods to interact with OpenAI API
 type Service struct {
-	config ServiceConfig
-	apiKey string
+	config     ServiceConfig
+	apiKey     string
+	httpClient *http.Client
+	location   *time.Location // Loaded from DefaultTimezone, used for dates without an offset
 }
 
 // NewService creates a new OpenAI service instance
@@ -36,11 +76,26 @@ func NewService(config ServiceConfig) (*Service, error) {
 		apiKey = os.Getenv("OPENAI_API_KEY")
 	}
 
-	if apiKey == "" {
+	// OpenAI-compatible local endpoints usually run without authentication
+	if apiKey == "" && config.Provider != ProviderOpenAICompatible {
 		return nil, fmt.Errorf("OpenAI API key is required. Set OPENAI_API_KEY environment variable or provide it in config")
 	}
+	if config.Provider == ProviderOpenAICompatible && config.BaseURL == "" {
+		return nil, fmt.Errorf("base URL is required for provider %q", ProviderOpenAICompatible)
+	}
 
 	// Set defaults if not provided
+	if config.Provider == "" {
+		config.Provider = ProviderOpenAI
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = defaultBaseURL
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	config.Retry = config.Retry.withDefaults()
 	if config.VisionModel == "" {
 		config.VisionModel = "gpt-4o" // Latest vision model
 	}
@@ -50,6 +105,9 @@ func NewService(config ServiceConfig) (*Service, error) {
 	if config.MaxTokens == 0 {
 		config.MaxTokens = 4096
 	}
+	if config.ResponseFormat == "" {
+		config.ResponseFormat = ResponseFormatJSONSchema
+	}
 	if config.Temperature == 0 {
 		config.Temperature = 0.1 // Low temperature for consistent extraction
 	}
@@ -63,9 +121,21 @@ func NewService(config ServiceConfig) (*Service, error) {
 		config.DefaultTimezone = "UTC"
 	}
 
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	location, err := time.LoadLocation(config.DefaultTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default timezone %q: %w", config.DefaultTimezone, err)
+	}
+
 	return &Service{
-		config: config,
-		apiKey: apiKey,
+		config:     config,
+		apiKey:     apiKey,
+		httpClient: httpClient,
+		location:   location,
 	}, nil
 }
 
@@ -79,6 +149,46 @@ func (s *Service) UpdateConfig(config ServiceConfig) {
 	if config.APIKey != "" {
 		s.apiKey = config.APIKey
 	}
+	if config.BaseURL != "" {
+		s.config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	}
+	if config.HTTPClient != nil {
+		s.config.HTTPClient = config.HTTPClient
+		s.httpClient = config.HTTPClient
+	}
+	if config.RequestTimeout > 0 {
+		s.config.RequestTimeout = config.RequestTimeout
+	}
+	if config.Organization != "" {
+		s.config.Organization = config.Organization
+	}
+	if config.Project != "" {
+		s.config.Project = config.Project
+	}
+	if config.APIVersion != "" {
+		s.config.APIVersion = config.APIVersion
+	}
+	if config.Retry.MaxAttempts > 0 {
+		s.config.Retry.MaxAttempts = config.Retry.MaxAttempts
+	}
+	if config.Retry.BaseDelay > 0 {
+		s.config.Retry.BaseDelay = config.Retry.BaseDelay
+	}
+	if config.Retry.MaxDelay > 0 {
+		s.config.Retry.MaxDelay = config.Retry.MaxDelay
+	}
+	if config.MaxRepairRounds > 0 {
+		s.config.MaxRepairRounds = config.MaxRepairRounds
+	}
+	if config.ModelPrices != nil {
+		s.config.ModelPrices = config.ModelPrices
+	}
+	if config.UsageTracker != nil {
+		s.config.UsageTracker = config.UsageTracker
+	}
+	if config.Reconcile != (ReconcileOptions{}) {
+		s.config.Reconcile = config.Reconcile
+	}
 	if config.VisionModel != "" {
 		s.config.VisionModel = config.VisionModel
 	}
@@ -88,6 +198,9 @@ func (s *Service) UpdateConfig(config ServiceConfig) {
 	if config.MaxTokens > 0 {
 		s.config.MaxTokens = config.MaxTokens
 	}
+	if config.ResponseFormat != "" {
+		s.config.ResponseFormat = config.ResponseFormat
+	}
 	if config.Temperature >= 0 {
 		s.config.Temperature = config.Temperature
 	}
@@ -98,15 +211,46 @@ func (s *Service) UpdateConfig(config ServiceConfig) {
 		s.config.DefaultLanguage = config.DefaultLanguage
 	}
 	if config.DefaultTimezone != "" {
-		s.config.DefaultTimezone = config.DefaultTimezone
+		if location, err := time.LoadLocation(config.DefaultTimezone); err == nil {
+			s.config.DefaultTimezone = config.DefaultTimezone
+			s.location = location
+		}
 	}
 }
 
 // ValidateConnection checks if the API key is valid by making a simple API call
 func (s *Service) ValidateConnection(ctx context.Context) error {
 	// This is a placeholder - we'll implement actual validation when we add the API calls
-	if s.apiKey == "" {
+	if s.apiKey == "" && s.config.Provider != ProviderOpenAICompatible {
 		return fmt.Errorf("API key is not set")
 	}
 	return nil
 }
+
+// endpointURL builds the full URL for an API path such as "/chat/completions"
+func (s *Service) endpointURL(path string) string {
+	endpoint := s.config.BaseURL + path
+	if s.config.APIVersion != "" {
+		endpoint += "?api-version=" + url.QueryEscape(s.config.APIVersion)
+	}
+	return endpoint
+}
+
+// setHeaders sets authentication and content headers on an API request
+func (s *Service) setHeaders(req *http.Request) {
+	req.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		if s.config.APIVersion != "" {
+			// Azure OpenAI authenticates with an api-key header
+			req.Header.Set("api-key", s.apiKey)
+		} else {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.apiKey))
+		}
+	}
+	if s.config.Organization != "" {
+		req.Header.Set("OpenAI-Organization", s.config.Organization)
+	}
+	if s.config.Project != "" {
+		req.Header.Set("OpenAI-Project", s.config.Project)
+	}
+}
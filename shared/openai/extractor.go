@@ -0,0 +1,129 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Supported extraction providers
+const (
+	ProviderOpenAI           = "openai"            // api.openai.com
+	ProviderOpenAICompatible = "openai-compatible" // Any endpoint speaking the chat completions API (e.g. local models)
+	ProviderFake             = "fake"              // Deterministic offline extractor for tests and local runs
+)
+
+// ReceiptExtractor extracts structured receipt data from an image
+// The image is passed as base64 data or URL in the request, together with optional hints
+type ReceiptExtractor interface {
+	ExtractReceiptData(ctx context.Context, req ReceiptExtractionRequest) (*ReceiptExtractionResponse, error)
+}
+
+// Service implements ReceiptExtractor
+var _ ReceiptExtractor = (*Service)(nil)
+
+// NewReceiptExtractor creates the extractor selected by config.Provider
+// An empty provider defaults to OpenAI
+func NewReceiptExtractor(config ServiceConfig) (ReceiptExtractor, error) {
+	switch config.Provider {
+	case "", ProviderOpenAI, ProviderOpenAICompatible:
+		return NewService(config)
+	case ProviderFake:
+		return NewFakeExtractor(config), nil
+	default:
+		return nil, fmt.Errorf("unknown receipt extractor provider: %q", config.Provider)
+	}
+}
+
+// FakeExtractor is a deterministic ReceiptExtractor that never calls the network
+// It returns a copy of Data (or a fixed sample receipt) for every request
+type FakeExtractor struct {
+	// Data is returned for every request. A sample receipt is used when nil
+	Data *ReceiptData
+	// Err, when set, makes every request fail with this error
+	Err error
+
+	defaultCurrency string
+}
+
+// NewFakeExtractor creates a fake extractor using the config's default currency
+func NewFakeExtractor(config ServiceConfig) *FakeExtractor {
+	currency := config.DefaultCurrency
+	if currency == "" {
+		currency = "USD"
+	}
+	return &FakeExtractor{
+		defaultCurrency: currency,
+	}
+}
+
+// ExtractReceiptData returns the configured receipt data without inspecting the image
+func (f *FakeExtractor) ExtractReceiptData(ctx context.Context, req ReceiptExtractionRequest) (*ReceiptExtractionResponse, error) {
+	if req.imageCount() == 0 && req.Text == "" {
+		return &ReceiptExtractionResponse{
+			Success: false,
+			Error:   "either image_data, image_url or text must be provided",
+		}, fmt.Errorf("no image data provided")
+	}
+
+	if f.Err != nil {
+		return &ReceiptExtractionResponse{
+			Success: false,
+			Error:   f.Err.Error(),
+		}, f.Err
+	}
+
+	data := f.sampleReceipt(req)
+	if f.Data != nil {
+		copied := *f.Data
+		copied.Items = append([]ReceiptItem(nil), f.Data.Items...)
+		data = &copied
+	}
+
+	rawText, err := data.ToJSON()
+	if err != nil {
+		return &ReceiptExtractionResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, err
+	}
+	data.RawText = rawText
+
+	return &ReceiptExtractionResponse{
+		Success:  true,
+		Data:     data,
+		RawText:  rawText,
+		Receipts: []ExtractedReceipt{{Data: data}},
+	}, nil
+}
+
+// sampleReceipt builds the fixed receipt returned when no Data is configured
+func (f *FakeExtractor) sampleReceipt(req ReceiptExtractionRequest) *ReceiptData {
+	storeName := "Fake Store"
+	if req.StoreHint != "" {
+		storeName = req.StoreHint
+	}
+
+	currency := f.defaultCurrency
+	if req.ExpectedCurrency != "" {
+		currency = req.ExpectedCurrency
+	}
+	if currency == "" {
+		currency = "USD"
+	}
+
+	return &ReceiptData{
+		StoreName:   storeName,
+		ReceiptDate: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		TotalAmount: 1100,
+		Currency:    currency,
+		Items: []ReceiptItem{
+			{Name: "Sample Item", Quantity: 1, UnitPrice: 1000, TotalPrice: 1000},
+		},
+		SubtotalAmount:  1000,
+		TaxAmount:       100,
+		PaymentMethod:   "Cash",
+		ExpenseCategory: "기타",
+		ConfidenceLevel: 1,
+	}
+}
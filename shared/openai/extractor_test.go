@@ -0,0 +1,133 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestNewReceiptExtractor(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ServiceConfig
+		wantType string
+		wantErr  bool
+	}{
+		{
+			name:     "default provider is OpenAI",
+			config:   ServiceConfig{APIKey: "test-key"},
+			wantType: "*openai.Service",
+		},
+		{
+			name:     "OpenAI-compatible endpoint without API key",
+			config:   ServiceConfig{Provider: ProviderOpenAICompatible, BaseURL: "http://localhost:11434/v1"},
+			wantType: "*openai.Service",
+		},
+		{
+			name:    "OpenAI-compatible endpoint without base URL",
+			config:  ServiceConfig{Provider: ProviderOpenAICompatible},
+			wantErr: true,
+		},
+		{
+			name:     "fake provider",
+			config:   ServiceConfig{Provider: ProviderFake},
+			wantType: "*openai.FakeExtractor",
+		},
+		{
+			name:    "unknown provider",
+			config:  ServiceConfig{Provider: "tesseract", APIKey: "test-key"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldKey := os.Getenv("OPENAI_API_KEY")
+			os.Unsetenv("OPENAI_API_KEY")
+			defer os.Setenv("OPENAI_API_KEY", oldKey)
+
+			extractor, err := NewReceiptExtractor(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewReceiptExtractor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			switch tt.wantType {
+			case "*openai.Service":
+				if _, ok := extractor.(*Service); !ok {
+					t.Errorf("Expected *Service, got %T", extractor)
+				}
+			case "*openai.FakeExtractor":
+				if _, ok := extractor.(*FakeExtractor); !ok {
+					t.Errorf("Expected *FakeExtractor, got %T", extractor)
+				}
+			}
+		})
+	}
+}
+
+func TestFakeExtractor(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("sample receipt uses hints", func(t *testing.T) {
+		fake := NewFakeExtractor(ServiceConfig{DefaultCurrency: "JPY"})
+
+		resp, err := fake.ExtractReceiptData(ctx, ReceiptExtractionRequest{
+			ImageData: "base64data",
+			StoreHint: "Lawson",
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !resp.Success || resp.Data == nil {
+			t.Fatal("Expected successful response with data")
+		}
+		if resp.Data.StoreName != "Lawson" {
+			t.Errorf("Expected store name Lawson, got %s", resp.Data.StoreName)
+		}
+		if resp.Data.Currency != "JPY" {
+			t.Errorf("Expected currency JPY, got %s", resp.Data.Currency)
+		}
+		if err := resp.Data.Validate(); err != nil {
+			t.Errorf("Sample receipt should be valid: %v", err)
+		}
+	})
+
+	t.Run("configured data is copied", func(t *testing.T) {
+		fake := NewFakeExtractor(ServiceConfig{})
+		fake.Data = &ReceiptData{
+			StoreName: "Configured",
+			Items:     []ReceiptItem{{Name: "Milk"}},
+		}
+
+		resp, err := fake.ExtractReceiptData(ctx, ReceiptExtractionRequest{ImageURL: "https://example.com/r.jpg"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Data.Items[0].Name = "Changed"
+		if fake.Data.Items[0].Name != "Milk" {
+			t.Error("Expected configured data to be left untouched")
+		}
+	})
+
+	t.Run("configured error", func(t *testing.T) {
+		fake := NewFakeExtractor(ServiceConfig{})
+		fake.Err = errors.New("boom")
+
+		resp, err := fake.ExtractReceiptData(ctx, ReceiptExtractionRequest{ImageData: "base64data"})
+		if err == nil || resp.Success {
+			t.Error("Expected configured error to be returned")
+		}
+	})
+
+	t.Run("no image", func(t *testing.T) {
+		fake := NewFakeExtractor(ServiceConfig{})
+
+		if _, err := fake.ExtractReceiptData(ctx, ReceiptExtractionRequest{}); err == nil {
+			t.Error("Expected error when no image data provided")
+		}
+	})
+}
@@ -63,14 +63,16 @@ func (s *Service) ProcessReceiptWithContext(ctx context.Context, imageSource str
 
 // DownloadAndProcessReceipt downloads an image from a URL and processes it
 func (s *Service) DownloadAndProcessReceipt(ctx context.Context, imageURL string) (*ReceiptData, error) {
-	// Download the image
-	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	// Download the image within the per-call timeout
+	downloadCtx, cancel := context.WithTimeout(ctx, s.config.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(downloadCtx, "GET", imageURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download image: %w", err)
 	}
@@ -6,9 +6,9 @@ import "time"
 type ReceiptData struct {
 	// Core fields
 	StoreName   string    `json:"store_name"`
-	ReceiptDate time.Time `json:"receipt_date"`
+	ReceiptDate time.Time `json:"receipt_date" description:"Date and time of purchase in ISO 8601 format (YYYY-MM-DDTHH:MM:SSZ)"`
 	TotalAmount float64   `json:"total_amount"`
-	Currency    string    `json:"currency"`
+	Currency    string    `json:"currency" description:"ISO 4217 currency code"`
 
 	// Items
 	Items []ReceiptItem `json:"items"`
@@ -32,13 +32,16 @@ type ReceiptData struct {
 	RegisterNumber string `json:"register_number,omitempty"`
 
 	// Expense tracking for household budget
-	ExpenseCategory string `json:"expense_category,omitempty"` // 식비, 교통비, 생활용품, 의료, 문화/여가, 교육, 통신, 기타
+	ExpenseCategory string `json:"expense_category,omitempty" schema:"enum=식비|교통비|생활용품|의료|문화/여가|교육|통신|기타"` // See ExpenseCategories
 
 	// Additional information
 	Notes           string            `json:"notes,omitempty"`
-	CustomFields    map[string]string `json:"custom_fields,omitempty"`
-	RawText         string            `json:"raw_text,omitempty"`         // Original OCR text
-	ConfidenceLevel float64           `json:"confidence_level,omitempty"` // 0-1 scale
+	CustomFields    map[string]string `json:"custom_fields,omitempty" schema:"-"`                 // Free-form, not part of the model schema
+	RawText         string            `json:"raw_text,omitempty" schema:"-"`                      // Original OCR text
+	ConfidenceLevel float64           `json:"confidence_level,omitempty" description:"0-1 scale"` // 0-1 scale
+
+	// Fields the model returned in a format that could not be parsed
+	ParseWarnings []string `json:"parse_warnings,omitempty" schema:"-"`
 }
 
 // ReceiptItem represents a single item from a receipt
@@ -52,6 +55,8 @@ type ReceiptItem struct {
 	Discount    float64 `json:"discount,omitempty"`
 	TaxAmount   float64 `json:"tax_amount,omitempty"`
 	Description string  `json:"description,omitempty"`
+
+	parseWarnings []string // Collected by UnmarshalJSON and moved to ReceiptData.ParseWarnings
 }
 
 // ReceiptExtractionRequest represents the request to extract receipt data
@@ -60,6 +65,17 @@ type ReceiptExtractionRequest struct {
 	ImageData string `json:"image_data"`
 	ImageURL  string `json:"image_url,omitempty"`
 
+	// Further pieces of the same long receipt, in order (base64 or data URI)
+	// All images are sent in one call and merged into a single receipt
+	AdditionalImages []string `json:"additional_images,omitempty"`
+
+	// The photo may show several separate receipts, each returned on its own
+	// Ignored when AdditionalImages is set, since pieces belong to one receipt
+	MultipleReceipts bool `json:"multiple_receipts,omitempty"`
+
+	// Text of a digital receipt without an image, e.g. the text layer of a PDF
+	Text string `json:"text,omitempty"`
+
 	// Optional hints for better extraction
 	ExpectedCurrency string `json:"expected_currency,omitempty"`
 	ExpectedLanguage string `json:"expected_language,omitempty"`
@@ -68,8 +84,56 @@ type ReceiptExtractionRequest struct {
 
 // ReceiptExtractionResponse represents the response from receipt extraction
 type ReceiptExtractionResponse struct {
-	Success bool         `json:"success"`
-	Data    *ReceiptData `json:"data,omitempty"`
-	Error   string       `json:"error,omitempty"`
-	RawText string       `json:"raw_text,omitempty"`
+	Success  bool         `json:"success"`
+	Data     *ReceiptData `json:"data,omitempty"` // The first receipt found
+	Error    string       `json:"error,omitempty"`
+	RawText  string       `json:"raw_text,omitempty"`
+	Attempts int          `json:"attempts,omitempty"` // Number of API attempts made, including retries
+
+	// Arithmetic consistency checks on the extracted data
+	Reconciliation *ReconciliationResult `json:"reconciliation,omitempty"`
+
+	// Every receipt found, in image order; Data and Reconciliation repeat the first
+	Receipts []ExtractedReceipt `json:"receipts,omitempty"`
+
+	// Follow-up rounds that asked the model to correct an invalid answer
+	Repairs []RepairRound `json:"repairs,omitempty"`
+
+	// Cost accounting, summed over retries and repair rounds
+	Usage     *Usage `json:"usage,omitempty"`
+	Model     string `json:"model,omitempty"`      // Model reported by the API
+	RequestID string `json:"request_id,omitempty"` // x-request-id of the last API call
+	LatencyMs int64  `json:"latency_ms,omitempty"` // Wall-clock time of the extraction
+}
+
+// ExtractedReceipt is one receipt found in the submitted image(s)
+type ExtractedReceipt struct {
+	Data           *ReceiptData          `json:"data"`
+	Reconciliation *ReconciliationResult `json:"reconciliation,omitempty"`
+}
+
+// AllReceipts returns every extracted receipt
+// Extractors that only fill Data yield a single receipt
+func (r *ReceiptExtractionResponse) AllReceipts() []ExtractedReceipt {
+	if len(r.Receipts) > 0 {
+		return r.Receipts
+	}
+	if r.Data == nil {
+		return nil
+	}
+	return []ExtractedReceipt{{Data: r.Data, Reconciliation: r.Reconciliation}}
+}
+
+// imageCount returns the number of images in the request
+func (r ReceiptExtractionRequest) imageCount() int {
+	count := len(r.AdditionalImages)
+	if r.ImageData != "" || r.ImageURL != "" {
+		count++
+	}
+	return count
+}
+
+// splitReceipts reports whether the model should return a list of receipts
+func (r ReceiptExtractionRequest) splitReceipts() bool {
+	return r.MultipleReceipts && r.imageCount() == 1
 }
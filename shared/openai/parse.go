@@ -0,0 +1,434 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseReceiptJSON decodes model output into ReceiptData
+// Dates without a timezone are interpreted in loc (UTC when nil). Fields that
+// cannot be parsed are left empty and reported in ParseWarnings instead of
+// failing the whole receipt
+func ParseReceiptJSON(content []byte, loc *time.Location) (*ReceiptData, error) {
+	var data ReceiptData
+	if err := data.decode(content, loc); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// ParseReceiptListJSON decodes model output of the form {"receipts": [...]}
+// Each receipt is parsed like ParseReceiptJSON and keeps its own JSON as RawText.
+// An empty list is an error
+func ParseReceiptListJSON(content []byte, loc *time.Location) ([]*ReceiptData, error) {
+	var list struct {
+		Receipts []json.RawMessage `json:"receipts"`
+	}
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, err
+	}
+	if len(list.Receipts) == 0 {
+		return nil, fmt.Errorf("no receipts found in image")
+	}
+
+	receipts := make([]*ReceiptData, 0, len(list.Receipts))
+	for i, raw := range list.Receipts {
+		data, err := ParseReceiptJSON(raw, loc)
+		if err != nil {
+			return nil, fmt.Errorf("receipt %d: %w", i+1, err)
+		}
+		data.RawText = string(raw)
+		receipts = append(receipts, data)
+	}
+	return receipts, nil
+}
+
+// UnmarshalJSON decodes receipt JSON tolerantly, interpreting naive dates in UTC
+func (r *ReceiptData) UnmarshalJSON(b []byte) error {
+	return r.decode(b, time.UTC)
+}
+
+// receiptDataFields has the same fields as ReceiptData without its methods
+type receiptDataFields ReceiptData
+
+// decode decodes receipt JSON, replacing fields that commonly arrive in odd formats
+func (r *ReceiptData) decode(b []byte, loc *time.Location) error {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	// Outer fields shadow the embedded ones with the same JSON name
+	aux := struct {
+		*receiptDataFields
+		ReceiptDate     json.RawMessage `json:"receipt_date"`
+		TotalAmount     flexFloat       `json:"total_amount"`
+		TaxAmount       flexFloat       `json:"tax_amount"`
+		SubtotalAmount  flexFloat       `json:"subtotal_amount"`
+		DiscountAmount  flexFloat       `json:"discount_amount"`
+		TipAmount       flexFloat       `json:"tip_amount"`
+		ConfidenceLevel flexFloat       `json:"confidence_level"`
+		StorePhone      flexString      `json:"store_phone"`
+		CardLastDigits  flexString      `json:"card_last_digits"`
+		ReceiptNumber   flexString      `json:"receipt_number"`
+		TransactionID   flexString      `json:"transaction_id"`
+		RegisterNumber  flexString      `json:"register_number"`
+	}{receiptDataFields: (*receiptDataFields)(r)}
+
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	var warnings []string
+	if len(aux.ReceiptDate) > 0 {
+		date, err := parseReceiptDateJSON(aux.ReceiptDate, loc)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("receipt_date: %v", err))
+		}
+		r.ReceiptDate = date
+	}
+
+	r.TotalAmount = aux.TotalAmount.value("total_amount", &warnings)
+	r.TaxAmount = aux.TaxAmount.value("tax_amount", &warnings)
+	r.SubtotalAmount = aux.SubtotalAmount.value("subtotal_amount", &warnings)
+	r.DiscountAmount = aux.DiscountAmount.value("discount_amount", &warnings)
+	r.TipAmount = aux.TipAmount.value("tip_amount", &warnings)
+	r.ConfidenceLevel = aux.ConfidenceLevel.value("confidence_level", &warnings)
+	r.StorePhone = string(aux.StorePhone)
+	r.CardLastDigits = string(aux.CardLastDigits)
+	r.ReceiptNumber = string(aux.ReceiptNumber)
+	r.TransactionID = string(aux.TransactionID)
+	r.RegisterNumber = string(aux.RegisterNumber)
+
+	for i, item := range r.Items {
+		for _, w := range item.parseWarnings {
+			warnings = append(warnings, fmt.Sprintf("items[%d].%s", i, w))
+		}
+		r.Items[i].parseWarnings = nil
+	}
+
+	// Keep warnings carried over from a previous encode (e.g. FromJSON round trips)
+	r.ParseWarnings = append(r.ParseWarnings, warnings...)
+	return nil
+}
+
+// receiptItemFields has the same fields as ReceiptItem without its methods
+type receiptItemFields ReceiptItem
+
+// UnmarshalJSON decodes a receipt item, accepting amounts formatted as strings
+func (i *ReceiptItem) UnmarshalJSON(b []byte) error {
+	aux := struct {
+		*receiptItemFields
+		Quantity   flexFloat  `json:"quantity"`
+		UnitPrice  flexFloat  `json:"unit_price"`
+		TotalPrice flexFloat  `json:"total_price"`
+		Discount   flexFloat  `json:"discount"`
+		TaxAmount  flexFloat  `json:"tax_amount"`
+		SKU        flexString `json:"sku"`
+	}{receiptItemFields: (*receiptItemFields)(i)}
+
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	var warnings []string
+	i.Quantity = aux.Quantity.value("quantity", &warnings)
+	i.UnitPrice = aux.UnitPrice.value("unit_price", &warnings)
+	i.TotalPrice = aux.TotalPrice.value("total_price", &warnings)
+	i.Discount = aux.Discount.value("discount", &warnings)
+	i.TaxAmount = aux.TaxAmount.value("tax_amount", &warnings)
+	i.SKU = string(aux.SKU)
+	i.parseWarnings = warnings
+	return nil
+}
+
+// flexFloat accepts JSON numbers, null and strings such as "1,280", "¥1,280" or "12,50 €"
+type flexFloat struct {
+	v   float64
+	raw string // Set when the input could not be parsed
+}
+
+func (f *flexFloat) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || string(b) == "null" {
+		return nil
+	}
+
+	s := string(b)
+	if b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			f.raw = string(b)
+			return nil
+		}
+	}
+
+	v, err := ParseAmount(s)
+	if err != nil {
+		f.raw = s
+		return nil
+	}
+	f.v = v
+	return nil
+}
+
+// value returns the parsed number, recording a warning for unparseable input
+func (f flexFloat) value(field string, warnings *[]string) float64 {
+	if f.raw != "" {
+		*warnings = append(*warnings, fmt.Sprintf("%s: cannot parse amount %q", field, f.raw))
+	}
+	return f.v
+}
+
+// flexString accepts JSON strings, numbers and null
+type flexString string
+
+func (s *flexString) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	switch {
+	case len(b) == 0 || string(b) == "null":
+		*s = ""
+	case b[0] == '"':
+		var str string
+		if err := json.Unmarshal(b, &str); err != nil {
+			return err
+		}
+		*s = flexString(str)
+	default:
+		*s = flexString(b)
+	}
+	return nil
+}
+
+// fullWidthReplacer maps full-width digits and punctuation to ASCII
+var fullWidthReplacer = strings.NewReplacer(
+	"０", "0", "１", "1", "２", "2", "３", "3", "４", "4",
+	"５", "5", "６", "6", "７", "7", "８", "8", "９", "9",
+	"，", ",", "．", ".", "：", ":", "／", "/", "－", "-", "　", " ",
+)
+
+// ParseAmount parses a money amount written the way receipts print it
+// Currency symbols and codes are ignored, "1,280" is read as 1280 and "12,50" as 12.5.
+// A leading minus, parentheses or the Japanese ▲/△ marker make the amount negative
+func ParseAmount(s string) (float64, error) {
+	original := s
+	s = strings.TrimSpace(fullWidthReplacer.Replace(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+	}
+
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '.' || r == ',':
+			// Separators before the first digit only count when a digit follows (".50", not "Rs. 100")
+			if b.Len() > 0 || (i+1 < len(runes) && runes[i+1] >= '0' && runes[i+1] <= '9') {
+				b.WriteRune(r)
+			}
+		case r == '-' || r == '▲' || r == '△':
+			if b.Len() == 0 {
+				negative = true
+			}
+		}
+	}
+	number := b.String()
+	if number == "" || strings.Trim(number, ".,") == "" {
+		return 0, fmt.Errorf("no digits in %q", original)
+	}
+
+	number = normalizeDecimalSeparator(number)
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", original)
+	}
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+// normalizeDecimalSeparator rewrites a number to use "." as the only decimal separator
+func normalizeDecimalSeparator(number string) string {
+	lastComma := strings.LastIndex(number, ",")
+	lastDot := strings.LastIndex(number, ".")
+
+	switch {
+	case lastComma >= 0 && lastDot >= 0:
+		// Whichever separator comes last is the decimal point: "1,280.50" or "1.280,50"
+		if lastComma > lastDot {
+			number = strings.ReplaceAll(number, ".", "")
+			return strings.Replace(number, ",", ".", 1)
+		}
+		return strings.ReplaceAll(number, ",", "")
+	case lastComma >= 0:
+		// A single comma followed by one or two digits is a decimal comma: "12,50"
+		if strings.Count(number, ",") == 1 && len(number)-lastComma-1 <= 2 {
+			return strings.Replace(number, ",", ".", 1)
+		}
+		return strings.ReplaceAll(number, ",", "")
+	case strings.Count(number, ".") > 1:
+		// "1.280.000" uses dots as thousands separators
+		return strings.ReplaceAll(number, ".", "")
+	default:
+		return number
+	}
+}
+
+// parseReceiptDateJSON parses the receipt_date JSON value
+func parseReceiptDateJSON(raw json.RawMessage, loc *time.Location) (time.Time, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return time.Time{}, fmt.Errorf("expected a date string, got %s", string(raw))
+	}
+	return ParseReceiptDate(s, loc)
+}
+
+// zonedLayouts are date formats that carry their own timezone
+var zonedLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// Japanese eras and the Korean Dangi calendar, as offsets added to the era year
+var eraOffsets = map[string]int{
+	"令和": 2018, "R": 2018,
+	"平成": 1988, "H": 1988,
+	"昭和": 1925, "S": 1925,
+	"단기": -2333,
+}
+
+var (
+	// Year-first dates: 2024-03-05, 2024/3/5, 2024.03.05, 2024年3月5日, 2024년 3월 5일, 令和6年3月5日, R6.3.5
+	ymdPattern = regexp.MustCompile(`^(令和|平成|昭和|단기|[RHS])?\s*(元|\d{1,4})\s*(?:年|년|[./-])\s*(\d{1,2})\s*(?:月|월|[./-])\s*(\d{1,2})\s*(?:日|일|\.)?`)
+	// Month-first US dates: 03/05/2024
+	mdyPattern = regexp.MustCompile(`^(\d{1,2})/(\d{1,2})/(\d{4})`)
+	// Compact dates: 20240305
+	compactPattern = regexp.MustCompile(`^(\d{4})(\d{2})(\d{2})`)
+	// Weekday annotations such as (火), （화） or (Tue)
+	weekdayPattern = regexp.MustCompile(`^[(（][^)）]*[)）]`)
+	// Times such as 14:22, 14:22:05, 午後2時22分, 오후 2시 22분, 2:22 PM
+	timePattern = regexp.MustCompile(`^(?:T\s*)?(午前|午後|오전|오후|AM|PM|am|pm)?\s*(\d{1,2})\s*(?::|時|시)\s*(\d{1,2})?\s*(?:分|분)?\s*(?::?\s*(\d{1,2})\s*(?:秒|초)?)?\s*(AM|PM|am|pm)?`)
+)
+
+// ParseReceiptDate parses the many date formats printed on receipts
+// Dates without a timezone are interpreted in loc (UTC when nil); date-only values are midnight
+func ParseReceiptDate(s string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	s = strings.TrimSpace(fullWidthReplacer.Replace(s))
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range zonedLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	year, month, day, rest, ok := parseDatePart(s)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+	}
+
+	rest = strings.TrimSpace(rest)
+	rest = strings.TrimSpace(weekdayPattern.ReplaceAllString(rest, ""))
+
+	hour, minute, second := 0, 0, 0
+	if rest != "" {
+		m := timePattern.FindStringSubmatch(rest)
+		if m == nil {
+			return time.Time{}, fmt.Errorf("unrecognized time in %q", s)
+		}
+		hour, _ = strconv.Atoi(m[2])
+		minute, _ = strconv.Atoi(m[3])
+		second, _ = strconv.Atoi(m[4])
+
+		meridiem := m[1]
+		if meridiem == "" {
+			meridiem = m[5]
+		}
+		switch strings.ToUpper(meridiem) {
+		case "午後", "오후", "PM":
+			if hour < 12 {
+				hour += 12
+			}
+		case "午前", "오전", "AM":
+			if hour == 12 {
+				hour = 0
+			}
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, fmt.Errorf("date out of range %q", s)
+	}
+
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, loc)
+	if t.Day() != day {
+		return time.Time{}, fmt.Errorf("invalid day in %q", s)
+	}
+	return t, nil
+}
+
+// parseDatePart extracts year, month and day from the start of s
+// Returns the unparsed remainder (usually the time of day)
+func parseDatePart(s string) (year, month, day int, rest string, ok bool) {
+	if m := mdyPattern.FindStringSubmatch(s); m != nil {
+		month, _ = strconv.Atoi(m[1])
+		day, _ = strconv.Atoi(m[2])
+		year, _ = strconv.Atoi(m[3])
+		if month > 12 {
+			// Day-first (05/03/2024 style) when the first number cannot be a month
+			month, day = day, month
+		}
+		return year, month, day, s[len(m[0]):], true
+	}
+
+	if m := ymdPattern.FindStringSubmatch(s); m != nil {
+		if m[2] == "元" {
+			year = 1 // 元年 is the first year of an era
+		} else {
+			year, _ = strconv.Atoi(m[2])
+		}
+		if offset, isEra := eraOffsets[m[1]]; isEra {
+			year += offset
+		} else if year < 100 {
+			year += 2000 // Two-digit years such as 24/03/05
+		}
+		month, _ = strconv.Atoi(m[3])
+		day, _ = strconv.Atoi(m[4])
+		return year, month, day, s[len(m[0]):], true
+	}
+
+	if m := compactPattern.FindStringSubmatch(s); m != nil {
+		year, _ = strconv.Atoi(m[1])
+		month, _ = strconv.Atoi(m[2])
+		day, _ = strconv.Atoi(m[3])
+		return year, month, day, s[len(m[0]):], true
+	}
+
+	return 0, 0, 0, "", false
+}
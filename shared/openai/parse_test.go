@@ -0,0 +1,187 @@
+package openai
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    float64
+		wantErr bool
+	}{
+		{input: "1280", want: 1280},
+		{input: "1,280", want: 1280},
+		{input: "¥1,280", want: 1280},
+		{input: "￥１，２８０円", want: 1280},
+		{input: "$12.50", want: 12.5},
+		{input: "12,50 €", want: 12.5},
+		{input: "1.280,50", want: 1280.5},
+		{input: "1,280.50", want: 1280.5},
+		{input: "1.280.000", want: 1280000},
+		{input: "Rs. 1,280", want: 1280},
+		{input: "-500", want: -500},
+		{input: "▲100", want: -100},
+		{input: "(3.00)", want: -3},
+		{input: "2個", want: 2},
+		{input: "", want: 0},
+		{input: "free", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseAmount(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAmount(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAmount(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReceiptDate(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("timezone data not available: %v", err)
+	}
+
+	tests := []struct {
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{input: "2024-03-05T14:22:00Z", want: time.Date(2024, 3, 5, 14, 22, 0, 0, time.UTC)},
+		{input: "2024-03-05T14:22:00+09:00", want: time.Date(2024, 3, 5, 14, 22, 0, 0, jst)},
+		{input: "2024-03-05T14:22:00", want: time.Date(2024, 3, 5, 14, 22, 0, 0, jst)},
+		{input: "2024-03-05", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "2024/03/05 14:22", want: time.Date(2024, 3, 5, 14, 22, 0, 0, jst)},
+		{input: "2024.3.5", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "20240305", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "24/03/05", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "03/05/2024", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "25/03/2024", want: time.Date(2024, 3, 25, 0, 0, 0, 0, jst)},
+		{input: "2024年3月5日", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "２０２４年３月５日（火）１４：２２", want: time.Date(2024, 3, 5, 14, 22, 0, 0, jst)},
+		{input: "令和6年3月5日", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "令和元年5月1日 午後2時5分", want: time.Date(2019, 5, 1, 14, 5, 0, 0, jst)},
+		{input: "H31.4.30", want: time.Date(2019, 4, 30, 0, 0, 0, 0, jst)},
+		{input: "2024년 3월 5일 (화) 오후 2:22", want: time.Date(2024, 3, 5, 14, 22, 0, 0, jst)},
+		{input: "2024. 3. 5. 오전 12:10", want: time.Date(2024, 3, 5, 0, 10, 0, 0, jst)},
+		{input: "단기 4357년 3월 5일", want: time.Date(2024, 3, 5, 0, 0, 0, 0, jst)},
+		{input: "2024-03-05 2:22 PM", want: time.Date(2024, 3, 5, 14, 22, 0, 0, jst)},
+		{input: "", want: time.Time{}},
+		{input: "2024-02-30", wantErr: true},
+		{input: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseReceiptDate(tt.input, jst)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReceiptDate(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseReceiptDate(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReceiptJSON(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("timezone data not available: %v", err)
+	}
+
+	content := `{
+		"store_name": "ローソン",
+		"receipt_date": "令和6年3月5日 14:22",
+		"total_amount": "¥1,280",
+		"tax_amount": null,
+		"currency": "JPY",
+		"receipt_number": 12345,
+		"items": [
+			{"name": "おにぎり", "quantity": "2", "unit_price": "¥150", "total_price": "300"},
+			{"name": "お茶", "quantity": 1, "unit_price": "unknown", "total_price": 980}
+		]
+	}`
+
+	data, err := ParseReceiptJSON([]byte(content), jst)
+	if err != nil {
+		t.Fatalf("ParseReceiptJSON() error = %v", err)
+	}
+
+	if want := time.Date(2024, 3, 5, 14, 22, 0, 0, jst); !data.ReceiptDate.Equal(want) {
+		t.Errorf("ReceiptDate = %v, want %v", data.ReceiptDate, want)
+	}
+	if data.TotalAmount != 1280 {
+		t.Errorf("TotalAmount = %v, want 1280", data.TotalAmount)
+	}
+	if data.ReceiptNumber != "12345" {
+		t.Errorf("ReceiptNumber = %q, want 12345", data.ReceiptNumber)
+	}
+	if data.Items[0].Quantity != 2 || data.Items[0].UnitPrice != 150 {
+		t.Errorf("Unexpected first item: %+v", data.Items[0])
+	}
+	if len(data.ParseWarnings) != 1 || !contains(data.ParseWarnings[0], "items[1].unit_price") {
+		t.Errorf("Expected a single unit_price warning, got %v", data.ParseWarnings)
+	}
+}
+
+func TestParseReceiptJSONBadDateKeepsReceipt(t *testing.T) {
+	data, err := FromJSON(`{"store_name":"Store","receipt_date":"sometime","total_amount":100,"currency":"USD"}`)
+	if err != nil {
+		t.Fatalf("FromJSON() error = %v", err)
+	}
+	if data.StoreName != "Store" || data.TotalAmount != 100 {
+		t.Errorf("Expected remaining fields to be parsed, got %+v", data)
+	}
+	if !data.ReceiptDate.IsZero() || len(data.ParseWarnings) != 1 {
+		t.Errorf("Expected zero date with a warning, got %v / %v", data.ReceiptDate, data.ParseWarnings)
+	}
+}
+
+func TestReceiptDataJSONRoundTrip(t *testing.T) {
+	original := &ReceiptData{
+		StoreName:   "Round Trip",
+		ReceiptDate: time.Date(2024, 3, 5, 14, 22, 0, 0, time.UTC),
+		TotalAmount: 12.5,
+		Currency:    "USD",
+		Items:       []ReceiptItem{{Name: "Coffee", Quantity: 1, UnitPrice: 12.5, TotalPrice: 12.5}},
+	}
+
+	jsonStr, err := original.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON() error = %v", err)
+	}
+	decoded, err := FromJSON(jsonStr)
+	if err != nil {
+		t.Fatalf("FromJSON() error = %v", err)
+	}
+	if !decoded.ReceiptDate.Equal(original.ReceiptDate) || decoded.TotalAmount != original.TotalAmount || decoded.Items[0].TotalPrice != 12.5 {
+		t.Errorf("Round trip mismatch: %+v", decoded)
+	}
+	if len(decoded.ParseWarnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", decoded.ParseWarnings)
+	}
+}
+
+func TestParseReceiptListJSON(t *testing.T) {
+	receipts, err := ParseReceiptListJSON([]byte(`{"receipts":[{"store_name":"A","total_amount":"¥500"},{"store_name":"B","total_amount":700}]}`), time.UTC)
+	if err != nil {
+		t.Fatalf("ParseReceiptListJSON() error = %v", err)
+	}
+	if len(receipts) != 2 || receipts[0].TotalAmount != 500 || receipts[1].StoreName != "B" {
+		t.Errorf("Unexpected receipts: %+v", receipts)
+	}
+	if receipts[1].RawText != `{"store_name":"B","total_amount":700}` {
+		t.Errorf("Expected each receipt to keep its own JSON, got %q", receipts[1].RawText)
+	}
+
+	if _, err := ParseReceiptListJSON([]byte(`{"receipts":[]}`), time.UTC); err == nil {
+		t.Error("Expected an error for an empty list")
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -37,7 +41,14 @@ type openAIImageURL struct {
 }
 
 type openAIResponseFormat struct {
-	Type string `json:"type"`
+	Type       string            `json:"type"`
+	JSONSchema *openAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type openAIJSONSchema struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
 }
 
 type openAIChatResponse struct {
@@ -48,6 +59,8 @@ type openAIChatResponse struct {
 	Choices []openAIChoice `json:"choices"`
 	Usage   openAIUsage    `json:"usage"`
 	Error   *openAIError   `json:"error,omitempty"`
+
+	requestID string // x-request-id response header
 }
 
 type openAIChoice struct {
@@ -59,6 +72,7 @@ type openAIChoice struct {
 type openAIMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	Refusal string `json:"refusal,omitempty"`
 }
 
 type openAIUsage struct {
@@ -75,47 +89,120 @@ type openAIError struct {
 
 // ExtractReceiptData extracts structured data from a receipt image
 func (s *Service) ExtractReceiptData(ctx context.Context, req ReceiptExtractionRequest) (*ReceiptExtractionResponse, error) {
+	start := time.Now()
+
 	// Validate request
-	if req.ImageData == "" && req.ImageURL == "" {
+	if req.imageCount() == 0 && req.Text == "" {
 		return &ReceiptExtractionResponse{
 			Success: false,
-			Error:   "either image_data or image_url must be provided",
+			Error:   "either image_data, image_url or text must be provided",
 		}, fmt.Errorf("no image data provided")
 	}
+	if req.imageCount() > MaxImagesPerRequest {
+		err := fmt.Errorf("too many images: %d (maximum %d per request)", req.imageCount(), MaxImagesPerRequest)
+		return &ReceiptExtractionResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, err
+	}
 
-	// Prepare image URL for API
-	imageURL := req.ImageURL
-	if imageURL == "" && req.ImageData != "" {
-		// Check if it's already base64 encoded with data URI
-		if len(req.ImageData) > 5 && req.ImageData[:5] == "data:" {
-			imageURL = req.ImageData
-		} else {
-			// Detect image format from base64 data or use default
-			mimeType := detectImageMimeType(req.ImageData)
-			imageURL = fmt.Sprintf("data:%s;base64,%s", mimeType, req.ImageData)
-		}
+	// Prepare image URLs for API, the main image first
+	var imageURLs []string
+	if req.ImageURL != "" {
+		imageURLs = append(imageURLs, req.ImageURL)
+	} else if req.ImageData != "" {
+		imageURLs = append(imageURLs, imageDataURI(req.ImageData))
+	}
+	for _, image := range req.AdditionalImages {
+		imageURLs = append(imageURLs, imageDataURI(image))
 	}
 
 	// Build the extraction prompt
 	prompt := s.buildReceiptExtractionPrompt(req)
 
-	// Call OpenAI Vision API
-	receiptData, rawText, err := s.callVisionAPI(ctx, imageURL, prompt)
+	// Call OpenAI Vision API, or send the receipt text when there is no image
+	multiple := req.splitReceipts()
+	messages := visionMessages(imageURLs, prompt)
+	if len(imageURLs) == 0 {
+		messages = textMessages(req.Text, prompt)
+	}
+	receipts, result, err := s.callVisionAPI(ctx, messages, multiple)
 	if err != nil {
-		return &ReceiptExtractionResponse{
-			Success: false,
-			Error:   err.Error(),
-			RawText: rawText,
-		}, err
+		response := &ReceiptExtractionResponse{
+			Success:  false,
+			Error:    err.Error(),
+			RawText:  result.RawText,
+			Attempts: result.Attempts,
+		}
+		s.recordUsage(response, result, start)
+		return response, err
+	}
+
+	// Ask the model to fix receipts that fail validation
+	receipts, result, repairs := s.repairReceipt(ctx, messages, receipts, result, multiple)
+	if len(receipts) == 1 {
+		receipts[0].RawText = result.RawText
+	} else {
+		log.Printf("Found %d receipts in one image", len(receipts))
+	}
+
+	extracted := make([]ExtractedReceipt, len(receipts))
+	for i, receiptData := range receipts {
+		extracted[i] = s.reconcileReceipt(receiptData)
+	}
+
+	response := &ReceiptExtractionResponse{
+		Success:        true,
+		Data:           extracted[0].Data,
+		RawText:        result.RawText,
+		Attempts:       result.Attempts,
+		Reconciliation: extracted[0].Reconciliation,
+		Receipts:       extracted,
+		Repairs:        repairs,
+	}
+	s.recordUsage(response, result, start)
+	return response, nil
+}
+
+// reconcileReceipt checks a receipt's arithmetic and lowers confidence for inconsistencies
+// The auto-corrected copy replaces the receipt when correction is enabled
+func (s *Service) reconcileReceipt(receiptData *ReceiptData) ExtractedReceipt {
+	reconciliation := receiptData.Reconcile(s.config.Reconcile)
+	if !reconciliation.Consistent {
+		log.Printf("Warning: receipt arithmetic inconsistent: %s", strings.Join(reconciliation.Messages(), "; "))
+	}
+	if reconciliation.Corrected != nil {
+		receiptData = reconciliation.Corrected
+	} else {
+		receiptData.ConfidenceLevel = math.Max(0, receiptData.ConfidenceLevel-reconciliation.Penalty)
+	}
+	return ExtractedReceipt{Data: receiptData, Reconciliation: reconciliation}
+}
+
+// imageDataURI turns base64 image data into a data URI, leaving URLs and data URIs unchanged
+func imageDataURI(image string) string {
+	if strings.HasPrefix(image, "data:") || strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "http://") {
+		return image
 	}
+	// Detect image format from base64 data or use default
+	return fmt.Sprintf("data:%s;base64,%s", detectImageMimeType(image), image)
+}
+
+// recordUsage fills the cost accounting fields and reports them to the usage tracker
+// The cost is booked in the month of the call, which is when OpenAI bills it
+func (s *Service) recordUsage(response *ReceiptExtractionResponse, result *visionResult, start time.Time) {
+	usage := result.Usage
+	response.Usage = &usage
+	response.Model = result.Model
+	response.RequestID = result.RequestID
+	response.LatencyMs = time.Since(start).Milliseconds()
 
-	receiptData.RawText = rawText
+	log.Printf("OpenAI usage: model=%s request_id=%s prompt_tokens=%d completion_tokens=%d cost_usd=%.6f latency_ms=%d",
+		response.Model, response.RequestID, usage.PromptTokens, usage.CompletionTokens, usage.CostUSD, response.LatencyMs)
 
-	return &ReceiptExtractionResponse{
-		Success: true,
-		Data:    receiptData,
-		RawText: rawText,
-	}, nil
+	if s.config.UsageTracker != nil && usage.TotalTokens > 0 {
+		s.config.UsageTracker.Record(start, response.Model, usage)
+	}
 }
 
 // ExtractReceiptDataFromBase64 is a convenience method for base64 encoded images
@@ -197,8 +284,46 @@ Instructions:
    - "통신" (Communication) - phone bills, internet
    - "기타" (Other) - anything else
 
-Return ONLY a valid JSON object matching this structure:
-{
+%s%sDo not include any markdown formatting, explanations, or text outside the JSON object.`, currency, language, layoutInstructions(req), s.outputInstructions(req.splitReceipts()))
+
+	if req.StoreHint != "" {
+		prompt += fmt.Sprintf("\n\nAdditional context: This receipt is likely from %s", req.StoreHint)
+	}
+
+	return prompt
+}
+
+// layoutInstructions explains how the submitted images map to receipts
+func layoutInstructions(req ReceiptExtractionRequest) string {
+	switch {
+	case req.imageCount() > 1:
+		return fmt.Sprintf(`The %d images are consecutive photos of ONE long receipt, in order from top to bottom. Neighbouring photos may overlap: list every line item exactly once and combine everything into a single receipt. Take the totals from the end of the receipt.
+
+`, req.imageCount())
+	case req.splitReceipts():
+		return `The image may show several separate receipts, for example laid out on a table. Return each receipt as its own entry in the "receipts" array, ordered left to right and top to bottom. Never mix the items or totals of different receipts. If there is only one receipt, return an array with one entry.
+
+`
+	}
+	return ""
+}
+
+// outputInstructions describes the expected JSON shape for the prompt
+// With strict structured outputs the schema is enforced by the API, so only null handling is explained
+func (s *Service) outputInstructions(multiple bool) string {
+	if s.config.ResponseFormat != ResponseFormatJSONObject {
+		return `Return a JSON object matching the provided schema. Use null for any field that is not visible on the receipt.
+
+`
+	}
+	if multiple {
+		return "Return ONLY a valid JSON object of the form {\"receipts\": [...]}, where each receipt matches this structure:\n" + receiptJSONExample + "\n\n"
+	}
+	return "Return ONLY a valid JSON object matching this structure:\n" + receiptJSONExample + "\n\n"
+}
+
+// receiptJSONExample shows the ReceiptData structure for the json_object response format
+const receiptJSONExample = `{
   "store_name": "string",
   "receipt_date": "2024-01-01T12:00:00Z",
   "total_amount": 0.0,
@@ -231,109 +356,243 @@ Return ONLY a valid JSON object matching this structure:
   "expense_category": "식비",
   "notes": "string",
   "confidence_level": 0.95
+}`
+
+// visionMessages builds the initial conversation: the extraction prompt and the receipt images
+func visionMessages(imageURLs []string, prompt string) []openAIChatMessage {
+	content := []openAIMessageContent{
+		{
+			Type: "text",
+			Text: prompt,
+		},
+	}
+	for _, imageURL := range imageURLs {
+		content = append(content, openAIMessageContent{
+			Type: "image_url",
+			ImageURL: &openAIImageURL{
+				URL:    imageURL,
+				Detail: "high", // Use high detail for better accuracy
+			},
+		})
+	}
+	return []openAIChatMessage{
+		{
+			Role:    "user",
+			Content: content,
+		},
+	}
 }
 
-Do not include any markdown formatting, explanations, or text outside the JSON object.`, currency, language)
-
-	if req.StoreHint != "" {
-		prompt += fmt.Sprintf("\n\nAdditional context: This receipt is likely from %s", req.StoreHint)
+// textMessages builds the initial conversation for a receipt known only by its text
+func textMessages(text string, prompt string) []openAIChatMessage {
+	return []openAIChatMessage{
+		{
+			Role: "user",
+			Content: []openAIMessageContent{
+				{
+					Type: "text",
+					Text: prompt + "\n\nNo image is available. This is the text of the receipt, extracted from a PDF:\n\n" + text,
+				},
+			},
+		},
 	}
-
-	return prompt
 }
 
 // callVisionAPI makes the actual API call to OpenAI
-func (s *Service) callVisionAPI(ctx context.Context, imageURL string, prompt string) (*ReceiptData, string, error) {
+// With multiple set the model returns a list of receipts, otherwise exactly one
+func (s *Service) callVisionAPI(ctx context.Context, messages []openAIChatMessage, multiple bool) ([]*ReceiptData, *visionResult, error) {
 	// Prepare the API request
 	apiReq := openAIChatRequest{
-		Model:       s.config.VisionModel,
-		MaxTokens:   s.config.MaxTokens,
-		Temperature: s.config.Temperature,
-		Messages: []openAIChatMessage{
-			{
-				Role: "user",
-				Content: []openAIMessageContent{
-					{
-						Type: "text",
-						Text: prompt,
-					},
-					{
-						Type: "image_url",
-						ImageURL: &openAIImageURL{
-							URL:    imageURL,
-							Detail: "high", // Use high detail for better accuracy
-						},
-					},
-				},
-			},
-		},
-		ResponseFormat: &openAIResponseFormat{
-			Type: "json_object",
-		},
+		Model:          s.config.VisionModel,
+		MaxTokens:      s.config.MaxTokens,
+		Temperature:    s.config.Temperature,
+		Messages:       messages,
+		ResponseFormat: s.responseFormat(multiple),
 	}
 
 	// Marshal request to JSON
 	requestBody, err := json.Marshal(apiReq)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal request: %w", err)
+		return nil, &visionResult{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Send the request, retrying transient failures
+	apiResp, attempts, err := s.postChatCompletion(ctx, requestBody)
+	result := &visionResult{Attempts: attempts, Model: s.config.VisionModel}
+	if err != nil {
+		return nil, result, err
+	}
+
+	// Account for the tokens even if the answer turns out unusable
+	if apiResp.Model != "" {
+		result.Model = apiResp.Model
+	}
+	result.RequestID = apiResp.requestID
+	result.Usage = Usage{
+		PromptTokens:     apiResp.Usage.PromptTokens,
+		CompletionTokens: apiResp.Usage.CompletionTokens,
+		TotalTokens:      apiResp.Usage.TotalTokens,
+		CostUSD:          EstimateCost(result.Model, apiResp.Usage.PromptTokens, apiResp.Usage.CompletionTokens, s.config.ModelPrices),
+	}
+
+	// Extract the content
+	if len(apiResp.Choices) == 0 {
+		return nil, result, fmt.Errorf("no choices returned from API")
+	}
+
+	choice := apiResp.Choices[0]
+	content := choice.Message.Content
+	result.RawText = content
+
+	// The model may decline to answer instead of producing schema output
+	if choice.Message.Refusal != "" {
+		return nil, result, fmt.Errorf("model refused to extract receipt: %s", choice.Message.Refusal)
+	}
+	if choice.FinishReason == "length" {
+		return nil, result, fmt.Errorf("model output truncated at max_tokens (%d)", s.config.MaxTokens)
+	}
+
+	// Parse the JSON response into ReceiptData, interpreting naive dates in the default timezone
+	var receipts []*ReceiptData
+	if multiple {
+		receipts, err = ParseReceiptListJSON([]byte(content), s.location)
+	} else {
+		var receiptData *ReceiptData
+		receiptData, err = ParseReceiptJSON([]byte(content), s.location)
+		receipts = []*ReceiptData{receiptData}
+	}
+	if err != nil {
+		return nil, result, fmt.Errorf("failed to parse receipt data: %w", err)
+	}
+	for _, receiptData := range receipts {
+		if len(receiptData.ParseWarnings) > 0 {
+			log.Printf("Warning: receipt parsed with %d unreadable field(s): %v", len(receiptData.ParseWarnings), receiptData.ParseWarnings)
+		}
+	}
+
+	return receipts, result, nil
+}
+
+// responseFormat returns the response_format for the configured output mode
+// multiple selects the receipt list schema for photos showing several receipts
+func (s *Service) responseFormat(multiple bool) *openAIResponseFormat {
+	if s.config.ResponseFormat == ResponseFormatJSONObject {
+		return &openAIResponseFormat{Type: ResponseFormatJSONObject}
+	}
+	schema := &openAIJSONSchema{
+		Name:   receiptSchemaName,
+		Strict: true,
+		Schema: ReceiptJSONSchema(),
+	}
+	if multiple {
+		schema.Name = receiptListSchemaName
+		schema.Schema = ReceiptListJSONSchema()
 	}
+	return &openAIResponseFormat{
+		Type:       ResponseFormatJSONSchema,
+		JSONSchema: schema,
+	}
+}
+
+// visionResult describes a completed vision API call
+type visionResult struct {
+	RawText   string // Raw model output
+	Attempts  int    // Number of HTTP attempts made
+	Usage     Usage  // Tokens used by the successful attempt
+	Model     string // Model reported by the API
+	RequestID string // x-request-id of the successful attempt
+}
+
+// postChatCompletion sends a chat completion request, retrying according to the retry policy
+// Returns the parsed response and the number of attempts made
+func (s *Service) postChatCompletion(ctx context.Context, requestBody []byte) (*openAIChatResponse, int, error) {
+	policy := s.config.Retry.withDefaults()
+
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		apiResp, err := s.sendChatCompletion(ctx, requestBody)
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("OpenAI API call succeeded after %d attempts", attempt)
+			}
+			return apiResp, attempt, nil
+		}
+		lastErr = err
+
+		if attempt == policy.MaxAttempts || !isRetryableError(ctx, err) {
+			return nil, attempt, err
+		}
+
+		var serverDelay time.Duration
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			serverDelay = apiErr.RetryAfter
+		}
+		delay := policy.backoff(attempt, serverDelay)
+
+		log.Printf("OpenAI API attempt %d/%d failed: %v (retrying in %s)", attempt, policy.MaxAttempts, err, delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, attempt, fmt.Errorf("%w (gave up waiting to retry: %v)", lastErr, err)
+		}
+	}
+
+	return nil, policy.MaxAttempts, lastErr
+}
+
+// sendChatCompletion performs a single chat completion HTTP request
+// Non-200 responses are returned as *APIError
+func (s *Service) sendChatCompletion(ctx context.Context, requestBody []byte) (*openAIChatResponse, error) {
+	// Apply per-call timeout
+	ctx, cancel := context.WithTimeout(ctx, s.config.RequestTimeout)
+	defer cancel()
 
 	// Create HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(requestBody))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.endpointURL("/chat/completions"), bytes.NewReader(requestBody))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.apiKey))
+	s.setHeaders(httpReq)
 
 	// Make the request
-	client := &http.Client{
-		Timeout: 60 * time.Second,
-	}
-
-	resp, err := client.Do(httpReq)
+	resp, err := s.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to call OpenAI API: %w", err)
+		return nil, fmt.Errorf("failed to call OpenAI API: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response body
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	// Check for HTTP errors
 	if resp.StatusCode != http.StatusOK {
-		var apiError openAIChatResponse
-		if err := json.Unmarshal(responseBody, &apiError); err == nil && apiError.Error != nil {
-			return nil, "", fmt.Errorf("OpenAI API error: %s", apiError.Error.Message)
+		apiErr := &APIError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: retryDelayFromHeaders(resp.Header, time.Now()),
+		}
+		var errResp openAIChatResponse
+		if err := json.Unmarshal(responseBody, &errResp); err == nil && errResp.Error != nil {
+			apiErr.Message = errResp.Error.Message
+			apiErr.Type = errResp.Error.Type
+			apiErr.Code = errResp.Error.Code
+		} else {
+			apiErr.Message = fmt.Sprintf("status %d: %s", resp.StatusCode, string(responseBody))
 		}
-		return nil, "", fmt.Errorf("OpenAI API returned status %d: %s", resp.StatusCode, string(responseBody))
+		return nil, apiErr
 	}
 
 	// Parse response
 	var apiResp openAIChatResponse
 	if err := json.Unmarshal(responseBody, &apiResp); err != nil {
-		return nil, "", fmt.Errorf("failed to parse response: %w", err)
-	}
-
-	// Extract the content
-	if len(apiResp.Choices) == 0 {
-		return nil, "", fmt.Errorf("no choices returned from API")
-	}
-
-	content := apiResp.Choices[0].Message.Content
-
-	// Parse the JSON response into ReceiptData
-	var receiptData ReceiptData
-	if err := json.Unmarshal([]byte(content), &receiptData); err != nil {
-		return nil, content, fmt.Errorf("failed to parse receipt data: %w", err)
+		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
+	apiResp.requestID = resp.Header.Get("x-request-id")
 
-	return &receiptData, content, nil
+	return &apiResp, nil
 }
 
 // detectImageMimeType detects the image MIME type from base64 encoded data
@@ -2,8 +2,12 @@ package openai
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestNewService(t *testing.T) {
@@ -218,6 +222,148 @@ func TestExtractReceiptDataValidation(t *testing.T) {
 	}
 }
 
+func TestExtractReceiptDataWithTestServer(t *testing.T) {
+	content := `{"store_name":"Test Mart","receipt_date":"2024-03-05T14:22:00Z","total_amount":1280,"currency":"JPY","items":[{"name":"Milk","quantity":1,"unit_price":1280,"total_price":1280}]}`
+
+	var gotPath, gotAuth, gotOrg, gotProject string
+	var gotRequest openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		gotOrg = r.Header.Get("OpenAI-Organization")
+		gotProject = r.Header.Get("OpenAI-Project")
+		json.NewDecoder(r.Body).Decode(&gotRequest)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    "chatcmpl-test",
+			"model": "gpt-4o",
+			"choices": []map[string]interface{}{
+				{"index": 0, "message": map[string]string{"role": "assistant", "content": content}, "finish_reason": "stop"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:       "test-key",
+		BaseURL:      server.URL + "/v1/",
+		HTTPClient:   server.Client(),
+		Organization: "org-123",
+		Project:      "proj-456",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+
+	if gotPath != "/v1/chat/completions" {
+		t.Errorf("Expected path /v1/chat/completions, got %s", gotPath)
+	}
+	if gotAuth != "Bearer test-key" {
+		t.Errorf("Expected bearer authorization, got %q", gotAuth)
+	}
+	if gotOrg != "org-123" || gotProject != "proj-456" {
+		t.Errorf("Expected organization/project headers, got %q/%q", gotOrg, gotProject)
+	}
+	if gotRequest.Model != "gpt-4o" {
+		t.Errorf("Expected model gpt-4o, got %s", gotRequest.Model)
+	}
+	if !resp.Success || resp.Data == nil {
+		t.Fatal("Expected successful response with data")
+	}
+	if resp.Data.StoreName != "Test Mart" || resp.Data.TotalAmount != 1280 {
+		t.Errorf("Unexpected receipt data: %s", resp.Data.Summary())
+	}
+}
+
+func TestExtractReceiptDataAzureHeaders(t *testing.T) {
+	var gotAPIKey, gotAuth, gotVersion string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAPIKey = r.Header.Get("api-key")
+		gotAuth = r.Header.Get("Authorization")
+		gotVersion = r.URL.Query().Get("api-version")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"invalid key","type":"invalid_request_error","code":"invalid_api_key"}}`))
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:     "azure-key",
+		BaseURL:    server.URL + "/openai/deployments/gpt-4o",
+		APIVersion: "2024-10-21",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err == nil || resp.Success {
+		t.Fatal("Expected API error to be returned")
+	}
+	if !contains(err.Error(), "invalid key") {
+		t.Errorf("Expected API error message, got %v", err)
+	}
+	if gotAPIKey != "azure-key" || gotAuth != "" {
+		t.Errorf("Expected api-key header only, got api-key=%q authorization=%q", gotAPIKey, gotAuth)
+	}
+	if gotVersion != "2024-10-21" {
+		t.Errorf("Expected api-version query parameter, got %q", gotVersion)
+	}
+}
+
+func TestExtractReceiptDataRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:         "test-key",
+		BaseURL:        server.URL,
+		RequestTimeout: 50 * time.Millisecond,
+		Retry:          RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	if _, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"}); err == nil {
+		t.Error("Expected timeout error")
+	}
+}
+
+func TestExtractReceiptDataRefusal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]interface{}{"role": "assistant", "content": nil, "refusal": "I can't help with that."}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{APIKey: "test-key", BaseURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err == nil || resp.Success {
+		t.Fatal("Expected refusal to be reported as an error")
+	}
+	if !contains(err.Error(), "refused") {
+		t.Errorf("Expected refusal error, got %v", err)
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && hasSubstring(s, substr))
@@ -231,3 +377,132 @@ func hasSubstring(s, substr string) bool {
 	}
 	return false
 }
+
+func TestExtractReceiptDataFromText(t *testing.T) {
+	var received openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": `{"store_name":"Online Shop","total_amount":12,"currency":"USD"}`}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{APIKey: "test-key", BaseURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{Text: "Online Shop\nTotal 12.00"})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+	if resp.Data.StoreName != "Online Shop" {
+		t.Errorf("Expected store name from text receipt, got %q", resp.Data.StoreName)
+	}
+
+	content := received.Messages[0].Content
+	if len(content) != 1 || content[0].ImageURL != nil {
+		t.Fatalf("Expected a single text part without image, got %+v", content)
+	}
+	if !contains(content[0].Text, "Online Shop\nTotal 12.00") {
+		t.Error("Expected the receipt text in the prompt")
+	}
+}
+
+func TestExtractReceiptDataMultiplePieces(t *testing.T) {
+	var received openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": `{"store_name":"Long Receipt Mart","total_amount":3000,"currency":"JPY"}`}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{APIKey: "test-key", BaseURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{
+		ImageData:        "base64top",
+		AdditionalImages: []string{"base64middle", "data:image/png;base64,base64bottom"},
+		MultipleReceipts: true, // Ignored for pieces of one receipt
+	})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+	if len(resp.Receipts) != 1 || resp.Data.StoreName != "Long Receipt Mart" {
+		t.Fatalf("Expected one merged receipt, got %+v", resp.Receipts)
+	}
+
+	content := received.Messages[0].Content
+	if len(content) != 4 {
+		t.Fatalf("Expected prompt and 3 images in one message, got %d parts", len(content))
+	}
+	if !contains(content[0].Text, "3 images are consecutive photos of ONE long receipt") {
+		t.Error("Expected the prompt to explain the image pieces")
+	}
+	if content[1].ImageURL.URL != "data:image/jpeg;base64,base64top" || content[3].ImageURL.URL != "data:image/png;base64,base64bottom" {
+		t.Errorf("Expected images in submitted order, got %s ... %s", content[1].ImageURL.URL, content[3].ImageURL.URL)
+	}
+	if received.ResponseFormat.JSONSchema.Name != receiptSchemaName {
+		t.Errorf("Expected the single receipt schema, got %s", received.ResponseFormat.JSONSchema.Name)
+	}
+}
+
+func TestExtractReceiptDataMultipleReceipts(t *testing.T) {
+	var received openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": `{"receipts":[
+					{"store_name":"Cafe","receipt_date":"2024-05-01","total_amount":450,"currency":"JPY"},
+					{"store_name":"Bakery","total_amount":"1,200","currency":"JPY","subtotal_amount":1000,"tax_amount":100}
+				]}`}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{APIKey: "test-key", BaseURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data", MultipleReceipts: true})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+	if received.ResponseFormat.JSONSchema.Name != receiptListSchemaName {
+		t.Errorf("Expected the receipt list schema, got %s", received.ResponseFormat.JSONSchema.Name)
+	}
+	if len(resp.Receipts) != 2 {
+		t.Fatalf("Expected 2 receipts, got %d", len(resp.Receipts))
+	}
+	if resp.Data != resp.Receipts[0].Data || resp.Receipts[1].Data.StoreName != "Bakery" || resp.Receipts[1].Data.TotalAmount != 1200 {
+		t.Errorf("Unexpected receipts: %+v, %+v", resp.Receipts[0].Data, resp.Receipts[1].Data)
+	}
+	// Each receipt is reconciled on its own: 1000 + 100 != 1200
+	if resp.Receipts[0].Reconciliation == nil || resp.Receipts[1].Reconciliation.Consistent {
+		t.Errorf("Expected the bakery receipt to be flagged inconsistent")
+	}
+}
+
+func TestExtractReceiptDataTooManyImages(t *testing.T) {
+	service, err := NewService(ServiceConfig{APIKey: "test-key"})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	req := ReceiptExtractionRequest{ImageData: "base64data", AdditionalImages: make([]string, MaxImagesPerRequest)}
+	if _, err := service.ExtractReceiptData(context.Background(), req); err == nil || !contains(err.Error(), "too many images") {
+		t.Errorf("Expected too many images error, got %v", err)
+	}
+}
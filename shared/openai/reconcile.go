@@ -0,0 +1,250 @@
+package openai
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Reconciliation warning codes
+const (
+	WarningItemLineTotal   = "item_line_total_mismatch" // quantity × unit price − discount != line total
+	WarningItemsSubtotal   = "items_subtotal_mismatch"  // sum(items) != subtotal
+	WarningTotalMismatch   = "total_mismatch"           // subtotal + tax − discount + tip != total
+	WarningMissingTotal    = "missing_total"            // total could be derived from other amounts
+	WarningMissingSubtotal = "missing_subtotal"         // subtotal could be derived from items
+)
+
+// Default reconciliation settings
+const (
+	DefaultConfidencePenalty = 0.1 // Subtracted from ConfidenceLevel per warning
+)
+
+// zeroDecimalCurrencies are currencies without minor units, compared with a tolerance of 1
+var zeroDecimalCurrencies = map[string]bool{
+	"JPY": true, "KRW": true, "VND": true, "CLP": true, "ISK": true, "TWD": true, "HUF": true,
+}
+
+// ReconcileOptions controls the arithmetic consistency checks
+type ReconcileOptions struct {
+	Disabled          bool    // Skip reconciliation entirely
+	AutoCorrect       bool    // Return a corrected copy of the receipt
+	Tolerance         float64 // Allowed rounding difference (default: 1 for zero-decimal currencies, 0.05 otherwise)
+	ConfidencePenalty float64 // Subtracted from ConfidenceLevel per warning (default: 0.1)
+}
+
+// ReconciliationWarning describes a single arithmetic inconsistency
+type ReconciliationWarning struct {
+	Code      string  `json:"code"`
+	Field     string  `json:"field"`
+	Message   string  `json:"message"`
+	Expected  float64 `json:"expected"`
+	Actual    float64 `json:"actual"`
+	Corrected bool    `json:"corrected,omitempty"` // The corrected copy uses Expected for Field
+}
+
+// ReconciliationResult is the outcome of Reconcile
+type ReconciliationResult struct {
+	Consistent   bool                    `json:"consistent"`
+	TaxInclusive bool                    `json:"tax_inclusive"` // Item prices and subtotal already include tax (内税)
+	Warnings     []ReconciliationWarning `json:"warnings,omitempty"`
+	Penalty      float64                 `json:"confidence_penalty,omitempty"` // Only mismatches are penalized, not filled-in amounts
+	Corrected    *ReceiptData            `json:"-"`                            // Set when AutoCorrect is enabled
+}
+
+// Messages returns the warning messages, e.g. for logging or a repair prompt
+func (r *ReconciliationResult) Messages() []string {
+	messages := make([]string, len(r.Warnings))
+	for i, w := range r.Warnings {
+		messages[i] = w.Message
+	}
+	return messages
+}
+
+// Reconcile checks the receipt's arithmetic without modifying it
+// It verifies item line totals, sum(items) against the subtotal and
+// subtotal + tax − discount + tip against the total, accepting tax-inclusive
+// pricing. With AutoCorrect the result carries a corrected copy whose
+// ConfidenceLevel is reduced by the penalty
+func (r *ReceiptData) Reconcile(opts ReconcileOptions) *ReconciliationResult {
+	result := &ReconciliationResult{}
+	if opts.Disabled {
+		result.Consistent = true
+		return result
+	}
+
+	tolerance := opts.Tolerance
+	if tolerance <= 0 {
+		tolerance = amountTolerance(r.Currency)
+	}
+	penaltyPerWarning := opts.ConfidencePenalty
+	if penaltyPerWarning <= 0 {
+		penaltyPerWarning = DefaultConfidencePenalty
+	}
+
+	fixed := r.copy()
+	near := func(a, b float64) bool { return math.Abs(a-b) <= tolerance }
+
+	// Line totals: quantity × unit price − discount
+	for i, item := range fixed.Items {
+		if item.Quantity <= 0 || item.UnitPrice <= 0 {
+			continue
+		}
+		gross := item.Quantity * item.UnitPrice
+		if item.TotalPrice == 0 || near(gross, item.TotalPrice) || near(gross-item.Discount, item.TotalPrice) {
+			if item.TotalPrice == 0 {
+				fixed.Items[i].TotalPrice = roundAmount(gross-item.Discount, fixed.Currency)
+			}
+			continue
+		}
+
+		expected := roundAmount(gross-item.Discount, fixed.Currency)
+		warning := ReconciliationWarning{
+			Code: WarningItemLineTotal,
+			Message: fmt.Sprintf("%s: %s × %s − %s = %s but line total is %s",
+				itemLabel(item, i), formatAmount(item.Quantity), formatAmount(item.UnitPrice),
+				formatAmount(item.Discount), formatAmount(expected), formatAmount(item.TotalPrice)),
+		}
+
+		// The printed line total is usually right; a misread quantity is the most common cause
+		if qty := (item.TotalPrice + item.Discount) / item.UnitPrice; math.Round(qty) >= 1 && math.Abs(qty-math.Round(qty)) < 0.01 {
+			warning.Field = fmt.Sprintf("items[%d].quantity", i)
+			warning.Expected = math.Round(qty)
+			warning.Actual = item.Quantity
+			fixed.Items[i].Quantity = math.Round(qty)
+		} else {
+			warning.Field = fmt.Sprintf("items[%d].unit_price", i)
+			warning.Expected = roundAmount((item.TotalPrice+item.Discount)/item.Quantity, fixed.Currency)
+			warning.Actual = item.UnitPrice
+			fixed.Items[i].UnitPrice = warning.Expected
+		}
+		warning.Corrected = true
+		result.Warnings = append(result.Warnings, warning)
+	}
+
+	// sum(items) against subtotal
+	itemsTotal := 0.0
+	for _, item := range fixed.Items {
+		itemsTotal += item.TotalPrice
+	}
+	if len(fixed.Items) > 0 && itemsTotal > 0 {
+		if fixed.SubtotalAmount == 0 {
+			result.Warnings = append(result.Warnings, ReconciliationWarning{
+				Code:      WarningMissingSubtotal,
+				Field:     "subtotal_amount",
+				Expected:  roundAmount(itemsTotal, fixed.Currency),
+				Message:   fmt.Sprintf("subtotal missing, items sum to %s", formatAmount(itemsTotal)),
+				Corrected: true,
+			})
+			fixed.SubtotalAmount = roundAmount(itemsTotal, fixed.Currency)
+		} else {
+			switch {
+			case near(itemsTotal, fixed.SubtotalAmount),
+				near(itemsTotal-fixed.DiscountAmount, fixed.SubtotalAmount):
+			case fixed.TaxAmount > 0 && near(itemsTotal, fixed.SubtotalAmount+fixed.TaxAmount):
+				// Item prices include tax while the subtotal does not
+			case near(itemsTotal, fixed.TotalAmount):
+				// Some receipts print the pre-discount total as 小計
+			default:
+				result.Warnings = append(result.Warnings, ReconciliationWarning{
+					Code:     WarningItemsSubtotal,
+					Field:    "subtotal_amount",
+					Expected: roundAmount(itemsTotal, fixed.Currency),
+					Actual:   fixed.SubtotalAmount,
+					Message: fmt.Sprintf("items sum to %s but subtotal is %s",
+						formatAmount(itemsTotal), formatAmount(fixed.SubtotalAmount)),
+				})
+			}
+		}
+	}
+
+	// subtotal + tax − discount + tip against total
+	if fixed.SubtotalAmount > 0 {
+		exclusive := fixed.SubtotalAmount + fixed.TaxAmount - fixed.DiscountAmount + fixed.TipAmount
+		inclusive := fixed.SubtotalAmount - fixed.DiscountAmount + fixed.TipAmount
+
+		switch {
+		case fixed.TotalAmount == 0:
+			result.Warnings = append(result.Warnings, ReconciliationWarning{
+				Code:      WarningMissingTotal,
+				Field:     "total_amount",
+				Expected:  roundAmount(exclusive, fixed.Currency),
+				Message:   fmt.Sprintf("total missing, subtotal + tax − discount + tip = %s", formatAmount(exclusive)),
+				Corrected: true,
+			})
+			fixed.TotalAmount = roundAmount(exclusive, fixed.Currency)
+		case near(exclusive, fixed.TotalAmount):
+		case fixed.TaxAmount > 0 && near(inclusive, fixed.TotalAmount):
+			// 内税: the subtotal already contains the tax shown on the receipt
+			result.TaxInclusive = true
+		case fixed.TaxAmount > 0 && near(fixed.SubtotalAmount+fixed.TipAmount, fixed.TotalAmount):
+			// Discount already applied to the subtotal of a tax-inclusive receipt
+			result.TaxInclusive = true
+		case near(fixed.SubtotalAmount+fixed.TaxAmount+fixed.TipAmount, fixed.TotalAmount):
+			// Discount already applied to the subtotal
+		default:
+			result.Warnings = append(result.Warnings, ReconciliationWarning{
+				Code:     WarningTotalMismatch,
+				Field:    "total_amount",
+				Expected: roundAmount(exclusive, fixed.Currency),
+				Actual:   fixed.TotalAmount,
+				Message: fmt.Sprintf("subtotal %s + tax %s − discount %s + tip %s = %s but total is %s",
+					formatAmount(fixed.SubtotalAmount), formatAmount(fixed.TaxAmount),
+					formatAmount(fixed.DiscountAmount), formatAmount(fixed.TipAmount),
+					formatAmount(exclusive), formatAmount(fixed.TotalAmount)),
+			})
+		}
+	}
+
+	// Filling in a missing amount is not an inconsistency and costs no confidence
+	mismatches := 0
+	for _, w := range result.Warnings {
+		if w.Code != WarningMissingSubtotal && w.Code != WarningMissingTotal {
+			mismatches++
+		}
+	}
+	result.Consistent = mismatches == 0
+	result.Penalty = math.Min(1, penaltyPerWarning*float64(mismatches))
+	fixed.ConfidenceLevel = math.Max(0, fixed.ConfidenceLevel-result.Penalty)
+
+	if opts.AutoCorrect {
+		result.Corrected = fixed
+	}
+	return result
+}
+
+// copy returns a copy of the receipt with its own item slice
+func (r *ReceiptData) copy() *ReceiptData {
+	c := *r
+	c.Items = append([]ReceiptItem(nil), r.Items...)
+	return &c
+}
+
+// amountTolerance returns the rounding tolerance for a currency
+func amountTolerance(currency string) float64 {
+	if zeroDecimalCurrencies[strings.ToUpper(currency)] {
+		return 1
+	}
+	return 0.05
+}
+
+// roundAmount rounds to the currency's minor unit
+func roundAmount(v float64, currency string) float64 {
+	if zeroDecimalCurrencies[strings.ToUpper(currency)] {
+		return math.Round(v)
+	}
+	return math.Round(v*100) / 100
+}
+
+// formatAmount formats an amount without trailing zeros
+func formatAmount(v float64) string {
+	return fmt.Sprintf("%g", math.Round(v*100)/100)
+}
+
+// itemLabel names an item for warning messages
+func itemLabel(item ReceiptItem, index int) string {
+	if item.Name != "" {
+		return fmt.Sprintf("item %d (%s)", index+1, item.Name)
+	}
+	return fmt.Sprintf("item %d", index+1)
+}
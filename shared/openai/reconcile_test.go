@@ -0,0 +1,153 @@
+package openai
+
+import (
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name             string
+		data             ReceiptData
+		wantConsistent   bool
+		wantTaxInclusive bool
+		wantCodes        []string
+	}{
+		{
+			name: "consistent tax-exclusive receipt",
+			data: ReceiptData{
+				Currency:       "USD",
+				Items:          []ReceiptItem{{Name: "Coffee", Quantity: 2, UnitPrice: 3.5, TotalPrice: 7}, {Name: "Bagel", Quantity: 1, UnitPrice: 2.25, TotalPrice: 2.25}},
+				SubtotalAmount: 9.25,
+				TaxAmount:      0.74,
+				TipAmount:      2,
+				TotalAmount:    11.99,
+			},
+			wantConsistent: true,
+		},
+		{
+			name: "tax-inclusive JPY receipt",
+			data: ReceiptData{
+				Currency:       "JPY",
+				Items:          []ReceiptItem{{Name: "おにぎり", Quantity: 2, UnitPrice: 162, TotalPrice: 324}, {Name: "お茶", Quantity: 1, UnitPrice: 151, TotalPrice: 151}},
+				SubtotalAmount: 475,
+				TaxAmount:      35,
+				TotalAmount:    475,
+			},
+			wantConsistent:   true,
+			wantTaxInclusive: true,
+		},
+		{
+			name: "JPY rounding within tolerance",
+			data: ReceiptData{
+				Currency:       "JPY",
+				Items:          []ReceiptItem{{Name: "弁当", Quantity: 1, UnitPrice: 498, TotalPrice: 498}},
+				SubtotalAmount: 498,
+				TaxAmount:      39.84,
+				TotalAmount:    538,
+			},
+			wantConsistent: true,
+		},
+		{
+			name: "line total mismatch",
+			data: ReceiptData{
+				Currency:       "USD",
+				Items:          []ReceiptItem{{Name: "Apples", Quantity: 1, UnitPrice: 1.5, TotalPrice: 4.5}},
+				SubtotalAmount: 4.5,
+				TotalAmount:    4.5,
+			},
+			wantCodes: []string{WarningItemLineTotal},
+		},
+		{
+			name: "subtotal and total mismatch",
+			data: ReceiptData{
+				Currency:       "USD",
+				Items:          []ReceiptItem{{Name: "A", Quantity: 1, UnitPrice: 10, TotalPrice: 10}},
+				SubtotalAmount: 12,
+				TaxAmount:      1,
+				TotalAmount:    20,
+			},
+			wantCodes: []string{WarningItemsSubtotal, WarningTotalMismatch},
+		},
+		{
+			name: "missing subtotal and total are filled in",
+			data: ReceiptData{
+				Currency: "USD",
+				Items:    []ReceiptItem{{Name: "A", Quantity: 1, UnitPrice: 10, TotalPrice: 10}},
+			},
+			wantConsistent: true,
+			wantCodes:      []string{WarningMissingSubtotal, WarningMissingTotal},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.data.Reconcile(ReconcileOptions{})
+
+			if result.Consistent != tt.wantConsistent {
+				t.Errorf("Consistent = %v, want %v (warnings: %v)", result.Consistent, tt.wantConsistent, result.Messages())
+			}
+			if result.TaxInclusive != tt.wantTaxInclusive {
+				t.Errorf("TaxInclusive = %v, want %v", result.TaxInclusive, tt.wantTaxInclusive)
+			}
+			if len(result.Warnings) != len(tt.wantCodes) {
+				t.Fatalf("Got %d warnings %v, want %v", len(result.Warnings), result.Messages(), tt.wantCodes)
+			}
+			for i, code := range tt.wantCodes {
+				if result.Warnings[i].Code != code {
+					t.Errorf("Warning %d code = %s, want %s", i, result.Warnings[i].Code, code)
+				}
+			}
+			if result.Corrected != nil {
+				t.Error("Expected no corrected copy without AutoCorrect")
+			}
+		})
+	}
+}
+
+func TestReconcileAutoCorrect(t *testing.T) {
+	data := &ReceiptData{
+		Currency: "USD",
+		Items: []ReceiptItem{
+			{Name: "Apples", Quantity: 1, UnitPrice: 1.5, TotalPrice: 4.5},
+			{Name: "Bread", Quantity: 2, UnitPrice: 0, TotalPrice: 5},
+			{Name: "Cheese", Quantity: 2, UnitPrice: 3.3, TotalPrice: 7},
+		},
+		TaxAmount:       1.65,
+		TotalAmount:     18.15,
+		ConfidenceLevel: 0.9,
+	}
+
+	result := data.Reconcile(ReconcileOptions{AutoCorrect: true})
+	fixed := result.Corrected
+	if fixed == nil {
+		t.Fatal("Expected corrected copy")
+	}
+
+	if fixed.Items[0].Quantity != 3 {
+		t.Errorf("Expected quantity corrected to 3, got %v", fixed.Items[0].Quantity)
+	}
+	if fixed.Items[2].UnitPrice != 3.5 {
+		t.Errorf("Expected unit price corrected to 3.5, got %v", fixed.Items[2].UnitPrice)
+	}
+	if fixed.SubtotalAmount != 16.5 {
+		t.Errorf("Expected subtotal filled in as 16.5, got %v", fixed.SubtotalAmount)
+	}
+	if data.Items[0].Quantity != 1 || data.SubtotalAmount != 0 {
+		t.Error("Reconcile must not modify the original receipt")
+	}
+
+	// Two corrected mismatches cost 0.2 confidence; the filled-in subtotal costs nothing
+	if result.Penalty != 0.2 {
+		t.Errorf("Penalty = %v, want 0.2", result.Penalty)
+	}
+	if diff := fixed.ConfidenceLevel - 0.7; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("ConfidenceLevel = %v, want 0.7", fixed.ConfidenceLevel)
+	}
+}
+
+func TestReconcileDisabled(t *testing.T) {
+	data := &ReceiptData{SubtotalAmount: 1, TotalAmount: 100}
+	if result := data.Reconcile(ReconcileOptions{Disabled: true}); !result.Consistent || len(result.Warnings) != 0 {
+		t.Errorf("Expected disabled reconciliation to report no warnings, got %v", result.Messages())
+	}
+}
@@ -0,0 +1,225 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// RepairRound records one follow-up turn asking the model to correct its answer
+type RepairRound struct {
+	Round    int           `json:"round"`
+	Problems []string      `json:"problems"`          // Validation errors sent to the model
+	Changes  []FieldChange `json:"changes,omitempty"` // Fields that differ from the previous answer
+	Error    string        `json:"error,omitempty"`   // Set when the round failed and the previous answer was kept
+}
+
+// FieldChange is a field whose value changed between two answers
+type FieldChange struct {
+	Field  string      `json:"field"` // JSON path such as "total_amount" or "items[0].unit_price"
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// repairReceipt runs up to MaxRepairRounds follow-up turns while a receipt fails validation
+// Each round sends the previous JSON answer and the concrete problems back in the same
+// conversation, so the model sees the original image again. A failed round keeps the
+// previous answer. Attempts and usage in the returned result include all rounds
+func (s *Service) repairReceipt(ctx context.Context, messages []openAIChatMessage, receipts []*ReceiptData, result *visionResult, multiple bool) ([]*ReceiptData, *visionResult, []RepairRound) {
+	var rounds []RepairRound
+	attempts := result.Attempts
+	usage := result.Usage
+	model, requestID := result.Model, result.RequestID
+
+	for round := 1; round <= s.config.MaxRepairRounds; round++ {
+		problems := s.receiptListProblems(receipts)
+		if len(problems) == 0 {
+			break
+		}
+		log.Printf("Receipt failed validation, requesting correction (round %d/%d): %s",
+			round, s.config.MaxRepairRounds, strings.Join(problems, "; "))
+
+		messages = append(messages,
+			openAIChatMessage{
+				Role:    "assistant",
+				Content: []openAIMessageContent{{Type: "text", Text: result.RawText}},
+			},
+			openAIChatMessage{
+				Role:    "user",
+				Content: []openAIMessageContent{{Type: "text", Text: buildRepairPrompt(problems)}},
+			},
+		)
+
+		repaired, repairResult, err := s.callVisionAPI(ctx, messages, multiple)
+		attempts += repairResult.Attempts
+		usage.Add(repairResult.Usage)
+		if repairResult.RequestID != "" {
+			model, requestID = repairResult.Model, repairResult.RequestID
+		}
+		record := RepairRound{Round: round, Problems: problems}
+		if err != nil {
+			log.Printf("Warning: repair round %d failed, keeping previous answer: %v", round, err)
+			record.Error = err.Error()
+			rounds = append(rounds, record)
+			break
+		}
+
+		record.Changes = diffReceiptLists(receipts, repaired)
+		rounds = append(rounds, record)
+		log.Printf("Repair round %d changed %d field(s)", round, len(record.Changes))
+
+		receipts, result = repaired, repairResult
+	}
+
+	return receipts, &visionResult{
+		RawText:   result.RawText,
+		Attempts:  attempts,
+		Usage:     usage,
+		Model:     model,
+		RequestID: requestID,
+	}, rounds
+}
+
+// receiptListProblems lists the problems of every receipt, numbered when there are several
+func (s *Service) receiptListProblems(receipts []*ReceiptData) []string {
+	if len(receipts) == 1 {
+		return s.receiptProblems(receipts[0])
+	}
+	var problems []string
+	for i, data := range receipts {
+		for _, p := range s.receiptProblems(data) {
+			problems = append(problems, fmt.Sprintf("receipt %d: %s", i+1, p))
+		}
+	}
+	return problems
+}
+
+// receiptProblems lists validation errors worth sending back to the model
+func (s *Service) receiptProblems(data *ReceiptData) []string {
+	var problems []string
+	if err := data.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	opts := s.config.Reconcile
+	opts.AutoCorrect = false
+	for _, w := range data.Reconcile(opts).Warnings {
+		// Missing amounts can be filled in locally and need no second look
+		if w.Code != WarningMissingSubtotal && w.Code != WarningMissingTotal {
+			problems = append(problems, w.Message)
+		}
+	}
+
+	for _, w := range data.ParseWarnings {
+		problems = append(problems, "unreadable value: "+w)
+	}
+	return problems
+}
+
+// buildRepairPrompt asks the model to correct its previous JSON answer
+func buildRepairPrompt(problems []string) string {
+	var b strings.Builder
+	b.WriteString("Your JSON answer for this receipt has the following problems:\n")
+	for _, p := range problems {
+		fmt.Fprintf(&b, "- %s\n", p)
+	}
+	b.WriteString(`
+Look at the receipt image again and return the complete corrected JSON object.
+Re-read the amounts, quantities and dates involved. Only change values that are wrong;
+if a value is genuinely not printed on the receipt, use null.`)
+	return b.String()
+}
+
+// diffReceiptLists returns the fields that differ between two answers listing receipts
+// Paths are prefixed with the receipt index when either answer has several receipts
+func diffReceiptLists(before, after []*ReceiptData) []FieldChange {
+	if len(before) == 1 && len(after) == 1 {
+		return DiffReceipts(before[0], after[0])
+	}
+
+	var changes []FieldChange
+	for i := 0; i < len(before) || i < len(after); i++ {
+		var b, a *ReceiptData
+		if i < len(before) {
+			b = before[i]
+		}
+		if i < len(after) {
+			a = after[i]
+		}
+		for _, change := range DiffReceipts(b, a) {
+			change.Field = fmt.Sprintf("receipts[%d].%s", i, change.Field)
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// DiffReceipts returns the fields that differ between two versions of a receipt
+func DiffReceipts(before, after *ReceiptData) []FieldChange {
+	beforeFields := flattenReceipt(before)
+	afterFields := flattenReceipt(after)
+
+	paths := make(map[string]bool)
+	for path := range beforeFields {
+		paths[path] = true
+	}
+	for path := range afterFields {
+		paths[path] = true
+	}
+
+	var changes []FieldChange
+	for path := range paths {
+		b, a := beforeFields[path], afterFields[path]
+		if !reflect.DeepEqual(b, a) {
+			changes = append(changes, FieldChange{Field: path, Before: b, After: a})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// flattenReceipt maps JSON paths to leaf values, ignoring bookkeeping fields
+func flattenReceipt(data *ReceiptData) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if data == nil {
+		return fields
+	}
+
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fields
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &tree); err != nil {
+		return fields
+	}
+	delete(tree, "raw_text")
+	delete(tree, "parse_warnings")
+
+	flattenInto(fields, "", tree)
+	return fields
+}
+
+// flattenInto walks a decoded JSON value, storing leaves under their path
+func flattenInto(fields map[string]interface{}, prefix string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			flattenInto(fields, path, child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenInto(fields, fmt.Sprintf("%s[%d]", prefix, i), child)
+		}
+	default:
+		fields[prefix] = v
+	}
+}
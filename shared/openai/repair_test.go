@@ -0,0 +1,137 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExtractReceiptDataRepairRound(t *testing.T) {
+	answers := []string{
+		`{"store_name":"Repair Mart","receipt_date":"2024-03-05T14:22:00Z","total_amount":1800,"currency":"JPY","subtotal_amount":1000,"tax_amount":100,"items":[{"name":"Rice","quantity":1,"unit_price":1000,"total_price":1000}]}`,
+		`{"store_name":"Repair Mart","receipt_date":"2024-03-05T14:22:00Z","total_amount":1100,"currency":"JPY","subtotal_amount":1000,"tax_amount":100,"items":[{"name":"Rice","quantity":1,"unit_price":1000,"total_price":1000}]}`,
+	}
+
+	var requests []openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		answer := answers[min(len(requests), len(answers))-1]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": answer}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:          "test-key",
+		BaseURL:         server.URL,
+		MaxRepairRounds: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+
+	// The second answer is consistent, so only one repair round runs
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 API calls, got %d", len(requests))
+	}
+	repairReq := requests[1]
+	if len(repairReq.Messages) != 3 {
+		t.Fatalf("Expected image, previous answer and repair prompt, got %d messages", len(repairReq.Messages))
+	}
+	if repairReq.Messages[0].Content[1].ImageURL == nil {
+		t.Error("Expected the original image to be sent again")
+	}
+	if repairReq.Messages[1].Role != "assistant" || repairReq.Messages[1].Content[0].Text != answers[0] {
+		t.Error("Expected the first JSON answer as assistant message")
+	}
+	if !contains(repairReq.Messages[2].Content[0].Text, "but total is 1800") {
+		t.Errorf("Expected concrete validation error in repair prompt, got %q", repairReq.Messages[2].Content[0].Text)
+	}
+
+	if resp.Data.TotalAmount != 1100 {
+		t.Errorf("Expected repaired total 1100, got %v", resp.Data.TotalAmount)
+	}
+	if resp.Attempts != 2 {
+		t.Errorf("Expected 2 attempts across rounds, got %d", resp.Attempts)
+	}
+	if len(resp.Repairs) != 1 {
+		t.Fatalf("Expected 1 repair round, got %d", len(resp.Repairs))
+	}
+	changes := resp.Repairs[0].Changes
+	if len(changes) != 1 || changes[0].Field != "total_amount" || changes[0].Before != 1800.0 || changes[0].After != 1100.0 {
+		t.Errorf("Expected total_amount change 1800 -> 1100, got %+v", changes)
+	}
+	if !resp.Reconciliation.Consistent {
+		t.Errorf("Expected repaired receipt to be consistent, got %v", resp.Reconciliation.Messages())
+	}
+}
+
+func TestExtractReceiptDataRepairDisabledByDefault(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{"role": "assistant", "content": `{"store_name":"","total_amount":0,"currency":"JPY"}`}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{APIKey: "test-key", BaseURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+	if calls != 1 || len(resp.Repairs) != 0 {
+		t.Errorf("Expected no repair rounds, got %d calls and %d rounds", calls, len(resp.Repairs))
+	}
+}
+
+func TestDiffReceipts(t *testing.T) {
+	before := &ReceiptData{
+		StoreName:   "Store",
+		ReceiptDate: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC),
+		Items:       []ReceiptItem{{Name: "Tea", Quantity: 1, UnitPrice: 150, TotalPrice: 150}},
+		RawText:     "first",
+	}
+	after := &ReceiptData{
+		StoreName:   "Store",
+		ReceiptDate: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC),
+		Items:       []ReceiptItem{{Name: "Tea", Quantity: 2, UnitPrice: 150, TotalPrice: 300}},
+		TaxAmount:   24,
+		RawText:     "second",
+	}
+
+	changes := DiffReceipts(before, after)
+	want := []string{"items[0].quantity", "items[0].total_price", "tax_amount"}
+	if len(changes) != len(want) {
+		t.Fatalf("Got changes %+v, want fields %v", changes, want)
+	}
+	for i, field := range want {
+		if changes[i].Field != field {
+			t.Errorf("Change %d field = %s, want %s", i, changes[i].Field, field)
+		}
+	}
+	if changes[2].Before != nil || changes[2].After != 24.0 {
+		t.Errorf("Expected tax_amount to go from nil to 24, got %+v", changes[2])
+	}
+}
@@ -0,0 +1,156 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default retry settings for vision API calls
+const (
+	DefaultMaxAttempts = 3
+	DefaultBaseDelay   = 500 * time.Millisecond
+	DefaultMaxDelay    = 20 * time.Second
+)
+
+// RetryPolicy controls how failed API calls are retried
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts including the first one (default: 3, set 1 to disable retries)
+	BaseDelay   time.Duration // Backoff before the second attempt, doubled on every retry (default: 500ms)
+	MaxDelay    time.Duration // Upper bound for a single wait, including server-provided delays (default: 20s)
+}
+
+// withDefaults returns a copy of the policy with zero values replaced by defaults
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultMaxDelay
+	}
+	return p
+}
+
+// backoff returns the jittered wait before the given retry (1 = first retry)
+// A server-provided delay takes precedence over the computed backoff
+func (p RetryPolicy) backoff(retry int, serverDelay time.Duration) time.Duration {
+	if serverDelay > 0 {
+		if serverDelay > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return serverDelay
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	// Equal jitter: wait between half and the full backoff
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// APIError is an error response returned by the OpenAI API
+type APIError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Message    string
+	RetryAfter time.Duration // Delay requested by the server, if any
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("OpenAI API error: %s", e.Message)
+	}
+	return fmt.Sprintf("OpenAI API returned status %d", e.StatusCode)
+}
+
+// Retryable reports whether the request may succeed if sent again
+func (e *APIError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests:
+		// An exhausted quota will not recover by waiting
+		return e.Code != "insufficient_quota"
+	case http.StatusRequestTimeout, http.StatusConflict,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		// 400 bad request, 401 invalid API key, 403, 404 and other client errors are fatal
+		return e.StatusCode > 500
+	}
+}
+
+// isRetryableError reports whether err from a single attempt should be retried
+// Besides retryable API errors these are network errors, responses cut off mid-body
+// and per-attempt timeouts; anything else, such as an unparsable response, fails fast
+func isRetryableError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		// The caller's context is done, retrying cannot help
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// retryDelayFromHeaders extracts the server-requested delay from rate limit headers
+// Supports Retry-After (seconds or HTTP date), retry-after-ms and x-ratelimit-reset-*
+func retryDelayFromHeaders(header http.Header, now time.Time) time.Duration {
+	if ms := header.Get("retry-after-ms"); ms != "" {
+		if v, err := strconv.ParseFloat(ms, 64); err == nil && v > 0 {
+			return time.Duration(v * float64(time.Millisecond))
+		}
+	}
+
+	if ra := header.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.ParseFloat(ra, 64); err == nil && secs > 0 {
+			return time.Duration(secs * float64(time.Second))
+		}
+		if at, err := http.ParseTime(ra); err == nil && at.After(now) {
+			return at.Sub(now)
+		}
+	}
+
+	// x-ratelimit-reset-* values look like "1s", "6m0s" or "20ms"; wait for the later one
+	var delay time.Duration
+	for _, name := range []string{"x-ratelimit-reset-requests", "x-ratelimit-reset-tokens"} {
+		if v := header.Get(name); v != "" {
+			if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil && d > delay {
+				delay = d
+			}
+		}
+	}
+	return delay
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
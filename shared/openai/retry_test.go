@@ -0,0 +1,220 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPIErrorRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *APIError
+		want bool
+	}{
+		{name: "rate limited", err: &APIError{StatusCode: 429, Code: "rate_limit_exceeded"}, want: true},
+		{name: "quota exhausted", err: &APIError{StatusCode: 429, Code: "insufficient_quota"}, want: false},
+		{name: "server error", err: &APIError{StatusCode: 500}, want: true},
+		{name: "overloaded", err: &APIError{StatusCode: 503}, want: true},
+		{name: "invalid API key", err: &APIError{StatusCode: 401, Code: "invalid_api_key"}, want: false},
+		{name: "bad request", err: &APIError{StatusCode: 400}, want: false},
+		{name: "not found", err: &APIError{StatusCode: 404}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Retryable(); got != tt.want {
+				t.Errorf("Retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var syntaxErr *json.SyntaxError
+	jsonErr := json.Unmarshal([]byte("{"), &struct{}{})
+	if !errors.As(jsonErr, &syntaxErr) {
+		t.Fatalf("json.Unmarshal() error = %v, want a syntax error", jsonErr)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "retryable API error", err: &APIError{StatusCode: 503}, want: true},
+		{name: "fatal API error", err: &APIError{StatusCode: 400}, want: false},
+		{name: "connection refused", err: fmt.Errorf("failed to call OpenAI API: %w", &url.Error{Op: "Post", URL: "https://api.openai.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}), want: true},
+		{name: "response cut off", err: fmt.Errorf("failed to read response: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "attempt timed out", err: fmt.Errorf("failed to read response: %w", context.DeadlineExceeded), want: true},
+		{name: "unparsable response", err: fmt.Errorf("failed to parse response: %w", jsonErr), want: false},
+		{name: "request not built", err: fmt.Errorf("failed to create request: %w", errors.New("invalid method")), want: false},
+		{name: "caller gave up", ctx: canceled, err: &APIError{StatusCode: 503}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if got := isRetryableError(ctx, tt.err); got != tt.want {
+				t.Errorf("isRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayFromHeaders(t *testing.T) {
+	now := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{name: "no headers", headers: nil, want: 0},
+		{name: "retry-after seconds", headers: map[string]string{"Retry-After": "2"}, want: 2 * time.Second},
+		{name: "retry-after date", headers: map[string]string{"Retry-After": now.Add(3 * time.Second).Format(http.TimeFormat)}, want: 3 * time.Second},
+		{name: "retry-after-ms", headers: map[string]string{"retry-after-ms": "150", "Retry-After": "1"}, want: 150 * time.Millisecond},
+		{name: "rate limit reset", headers: map[string]string{"x-ratelimit-reset-requests": "1s", "x-ratelimit-reset-tokens": "6m0s"}, want: 6 * time.Minute},
+		{name: "invalid values", headers: map[string]string{"Retry-After": "soon", "x-ratelimit-reset-tokens": "later"}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.headers {
+				header.Set(k, v)
+			}
+			if got := retryDelayFromHeaders(header, now); got != tt.want {
+				t.Errorf("retryDelayFromHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}.withDefaults()
+
+	for retry := 1; retry <= 6; retry++ {
+		delay := policy.backoff(retry, 0)
+		if delay <= 0 || delay > policy.MaxDelay {
+			t.Errorf("backoff(%d) = %v, want within (0, %v]", retry, delay, policy.MaxDelay)
+		}
+	}
+
+	if got := policy.backoff(1, 300*time.Millisecond); got != 300*time.Millisecond {
+		t.Errorf("Expected server delay to be honored, got %v", got)
+	}
+	if got := policy.backoff(1, time.Hour); got != policy.MaxDelay {
+		t.Errorf("Expected server delay to be capped at %v, got %v", policy.MaxDelay, got)
+	}
+}
+
+func TestExtractReceiptDataRetries(t *testing.T) {
+	content := `{"store_name":"Retry Mart","receipt_date":"2024-03-05T14:22:00Z","total_amount":500,"currency":"JPY"}`
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0.01")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`))
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"choices": []map[string]interface{}{
+					{"message": map[string]string{"role": "assistant", "content": content}},
+				},
+			})
+		}
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:  "test-key",
+		BaseURL: server.URL,
+		Retry:   RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+	if resp.Attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", resp.Attempts)
+	}
+	if resp.Data.StoreName != "Retry Mart" {
+		t.Errorf("Expected store name Retry Mart, got %s", resp.Data.StoreName)
+	}
+}
+
+func TestExtractReceiptDataFatalErrorNotRetried(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`))
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:  "bad-key",
+		BaseURL: server.URL,
+		Retry:   RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err == nil {
+		t.Fatal("Expected error for invalid API key")
+	}
+	if calls != 1 || resp.Attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d calls and %d attempts", calls, resp.Attempts)
+	}
+}
+
+func TestExtractReceiptDataUnparsableResponseNotRetried(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`<html>not the API</html>`))
+	}))
+	defer server.Close()
+
+	service, err := NewService(ServiceConfig{
+		APIKey:  "test-key",
+		BaseURL: server.URL,
+		Retry:   RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	if _, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"}); err == nil {
+		t.Fatal("Expected error for an unparsable response")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single attempt, got %d calls", calls)
+	}
+}
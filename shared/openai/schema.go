@@ -0,0 +1,136 @@
+package openai
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Response formats sent to the chat completions API
+const (
+	ResponseFormatJSONSchema = "json_schema" // Strict structured outputs generated from ReceiptData
+	ResponseFormatJSONObject = "json_object" // Plain JSON mode for endpoints without structured outputs
+)
+
+// Schema names reported to the API
+const (
+	receiptSchemaName     = "receipt_data"
+	receiptListSchemaName = "receipt_list" // Photos showing several receipts
+)
+
+// ExpenseCategories are the household budget categories a receipt can be classified into
+var ExpenseCategories = []string{"식비", "교통비", "생활용품", "의료", "문화/여가", "교육", "통신", "기타"}
+
+// receiptSchema is the strict JSON schema for ReceiptData, generated once
+var receiptSchema = GenerateJSONSchema(reflect.TypeOf(ReceiptData{}))
+
+// receiptList wraps the receipts found in one photo
+type receiptList struct {
+	Receipts []ReceiptData `json:"receipts"`
+}
+
+// receiptListSchema is the strict JSON schema for receiptList, generated once
+var receiptListSchema = GenerateJSONSchema(reflect.TypeOf(receiptList{}))
+
+// ReceiptJSONSchema returns the strict JSON schema describing ReceiptData
+func ReceiptJSONSchema() map[string]interface{} {
+	return receiptSchema
+}
+
+// ReceiptListJSONSchema returns the strict JSON schema for {"receipts": [ReceiptData...]}
+func ReceiptListJSONSchema() map[string]interface{} {
+	return receiptListSchema
+}
+
+// GenerateJSONSchema builds a strict structured-outputs JSON schema for a struct type
+//
+// Field names come from `json` tags. Fields tagged `schema:"-"` are skipped, and
+// `schema:"enum=a|b"` restricts a string to the listed values. A `description` tag
+// is copied into the schema. Strict mode requires every property to be listed as
+// required, so fields marked omitempty are made nullable instead.
+func GenerateJSONSchema(t reflect.Type) map[string]interface{} {
+	return schemaForType(t, false)
+}
+
+// schemaForType returns the schema for a Go type, optionally allowing null
+func schemaForType(t reflect.Type, nullable bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	var schema map[string]interface{}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		schema = map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Struct:
+		schema = schemaForStruct(t)
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		schema = map[string]interface{}{
+			"type":  "array",
+			"items": schemaForType(t.Elem(), false),
+		}
+	case t.Kind() == reflect.String:
+		schema = map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		schema = map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema = map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema = map[string]interface{}{"type": "number"}
+	default:
+		panic(fmt.Sprintf("openai: unsupported type %s in JSON schema", t))
+	}
+
+	if nullable {
+		schema["type"] = []interface{}{schema["type"], "null"}
+	}
+	return schema
+}
+
+// schemaForStruct returns the object schema for a struct type
+func schemaForStruct(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("schema") == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop := schemaForType(field.Type, strings.Contains(opts, "omitempty"))
+		if desc := field.Tag.Get("description"); desc != "" {
+			prop["description"] = desc
+		}
+		if enum, ok := strings.CutPrefix(field.Tag.Get("schema"), "enum="); ok {
+			values := make([]interface{}, 0)
+			for _, v := range strings.Split(enum, "|") {
+				values = append(values, v)
+			}
+			if _, isNullable := prop["type"].([]interface{}); isNullable {
+				values = append(values, nil)
+			}
+			prop["enum"] = values
+		}
+
+		properties[name] = prop
+		required = append(required, name)
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
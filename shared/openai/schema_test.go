@@ -0,0 +1,84 @@
+package openai
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReceiptJSONSchema(t *testing.T) {
+	schema := ReceiptJSONSchema()
+
+	if schema["type"] != "object" || schema["additionalProperties"] != false {
+		t.Fatalf("Expected strict object schema, got %v", schema)
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	required := schema["required"].([]string)
+	if len(required) != len(properties) {
+		t.Errorf("Strict schema must require every property: %d required, %d properties", len(required), len(properties))
+	}
+
+	for _, skipped := range []string{"raw_text", "custom_fields"} {
+		if _, ok := properties[skipped]; ok {
+			t.Errorf("Expected %s to be excluded from the schema", skipped)
+		}
+	}
+
+	// Core fields are not nullable, optional fields are
+	if got := properties["store_name"].(map[string]interface{})["type"]; got != "string" {
+		t.Errorf("store_name type = %v, want string", got)
+	}
+	if got := properties["tax_amount"].(map[string]interface{})["type"]; !reflect.DeepEqual(got, []interface{}{"number", "null"}) {
+		t.Errorf("tax_amount type = %v, want [number null]", got)
+	}
+	if got := properties["receipt_date"].(map[string]interface{})["type"]; got != "string" {
+		t.Errorf("receipt_date type = %v, want string", got)
+	}
+
+	// Items are strict objects too
+	items := properties["items"].(map[string]interface{})["items"].(map[string]interface{})
+	if items["additionalProperties"] != false {
+		t.Error("Expected item schema to disallow additional properties")
+	}
+
+	// Expense category enum matches ExpenseCategories plus null
+	enum := properties["expense_category"].(map[string]interface{})["enum"].([]interface{})
+	if len(enum) != len(ExpenseCategories)+1 {
+		t.Fatalf("Expected %d enum values, got %v", len(ExpenseCategories)+1, enum)
+	}
+	for i, category := range ExpenseCategories {
+		if enum[i] != category {
+			t.Errorf("enum[%d] = %v, want %s", i, enum[i], category)
+		}
+	}
+	if enum[len(enum)-1] != nil {
+		t.Error("Expected null to be allowed for expense_category")
+	}
+
+	// The schema must serialize for the API request
+	if _, err := json.Marshal(schema); err != nil {
+		t.Errorf("Failed to marshal schema: %v", err)
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	service, err := NewService(ServiceConfig{APIKey: "test-key"})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	format := service.responseFormat(false)
+	if format.Type != ResponseFormatJSONSchema || format.JSONSchema == nil || !format.JSONSchema.Strict {
+		t.Errorf("Expected strict json_schema by default, got %+v", format)
+	}
+
+	service.UpdateConfig(ServiceConfig{ResponseFormat: ResponseFormatJSONObject})
+	format = service.responseFormat(false)
+	if format.Type != ResponseFormatJSONObject || format.JSONSchema != nil {
+		t.Errorf("Expected json_object format, got %+v", format)
+	}
+	if prompt := service.buildReceiptExtractionPrompt(ReceiptExtractionRequest{}); !contains(prompt, `"store_name": "string"`) {
+		t.Error("Expected json_object prompt to describe the structure")
+	}
+}
@@ -0,0 +1,234 @@
+package openai
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is the token usage and estimated cost of one or more API calls
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CostUSD          float64 `json:"estimated_cost_usd"` // 0 when the model has no known price
+}
+
+// Add accumulates another usage into u
+func (u *Usage) Add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.CostUSD += other.CostUSD
+}
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	InputPerMillion  float64
+	OutputPerMillion float64
+}
+
+// DefaultModelPrices are list prices for vision-capable models
+// Dated snapshots such as gpt-4o-2024-08-06 use the price of their base model
+var DefaultModelPrices = map[string]ModelPrice{
+	"gpt-4o":       {InputPerMillion: 2.50, OutputPerMillion: 10.00},
+	"gpt-4o-mini":  {InputPerMillion: 0.15, OutputPerMillion: 0.60},
+	"gpt-4.1":      {InputPerMillion: 2.00, OutputPerMillion: 8.00},
+	"gpt-4.1-mini": {InputPerMillion: 0.40, OutputPerMillion: 1.60},
+	"gpt-4.1-nano": {InputPerMillion: 0.10, OutputPerMillion: 0.40},
+	"gpt-4-turbo":  {InputPerMillion: 10.00, OutputPerMillion: 30.00},
+	"o4-mini":      {InputPerMillion: 1.10, OutputPerMillion: 4.40},
+	"gpt-5":        {InputPerMillion: 1.25, OutputPerMillion: 10.00},
+	"gpt-5-mini":   {InputPerMillion: 0.25, OutputPerMillion: 2.00},
+	"gpt-5-nano":   {InputPerMillion: 0.05, OutputPerMillion: 0.40},
+	"o3":           {InputPerMillion: 2.00, OutputPerMillion: 8.00},
+}
+
+// PriceForModel looks up a model's price in prices, falling back to DefaultModelPrices
+// Unknown snapshots match the longest known model name they start with
+func PriceForModel(model string, prices map[string]ModelPrice) (ModelPrice, bool) {
+	for _, table := range []map[string]ModelPrice{prices, DefaultModelPrices} {
+		if price, ok := table[model]; ok {
+			return price, true
+		}
+	}
+
+	best := ""
+	var bestPrice ModelPrice
+	for _, table := range []map[string]ModelPrice{prices, DefaultModelPrices} {
+		for name, price := range table {
+			if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+				best, bestPrice = name, price
+			}
+		}
+		if best != "" {
+			return bestPrice, true
+		}
+	}
+	return ModelPrice{}, false
+}
+
+// EstimateCost returns the USD cost of the tokens used by model, or 0 if its price is unknown
+func EstimateCost(model string, promptTokens, completionTokens int, prices map[string]ModelPrice) float64 {
+	price, ok := PriceForModel(model, prices)
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.InputPerMillion + float64(completionTokens)*price.OutputPerMillion) / 1e6
+}
+
+// MonthlyUsage is the usage of all extractions recorded for one month and model
+type MonthlyUsage struct {
+	Month    string `json:"month"` // YYYY-MM
+	Model    string `json:"model"`
+	Receipts int    `json:"receipts"`
+	Usage
+}
+
+// UsageTracker aggregates usage per month and model across extractions
+// It is safe for concurrent use and lives as long as the process, so in Lambda
+// it covers all invocations handled by a warm container. SetMetrics keeps the
+// totals beyond that in CloudWatch
+type UsageTracker struct {
+	mu      sync.Mutex
+	entries map[[2]string]*MonthlyUsage
+
+	metrics   io.Writer // Receives a metric record per Record call when set
+	namespace string
+}
+
+// NewUsageTracker creates an empty usage tracker
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{
+		entries: make(map[[2]string]*MonthlyUsage),
+	}
+}
+
+// SetMetrics writes the usage of every receipt to w as a CloudWatch embedded metric
+// format record in namespace (optional)
+// In Lambda, w is standard output: CloudWatch turns the records into metrics whose
+// sum per Month dimension is the month's total across all instances and cold starts
+func (t *UsageTracker) SetMetrics(w io.Writer, namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.metrics = w
+	t.namespace = namespace
+}
+
+// Record adds the usage of one receipt to the month containing at
+func (t *UsageTracker) Record(at time.Time, model string, usage Usage) {
+	month := at.Format("2006-01")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := [2]string{month, model}
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &MonthlyUsage{Month: month, Model: model}
+		t.entries[key] = entry
+	}
+	entry.Receipts++
+	entry.Add(usage)
+
+	if t.metrics != nil {
+		t.writeMetrics(MonthlyUsage{Month: month, Model: model, Receipts: 1, Usage: usage})
+	}
+}
+
+// usageMetricNames are the metrics of a usage record and their CloudWatch units
+var usageMetricNames = []metricDefinition{
+	{Name: "Receipts", Unit: "Count"},
+	{Name: "PromptTokens", Unit: "Count"},
+	{Name: "CompletionTokens", Unit: "Count"},
+	{Name: "TotalTokens", Unit: "Count"},
+	{Name: "EstimatedCostUSD", Unit: "None"},
+}
+
+// metricDefinition names one metric of an embedded metric format record
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// metricDirective tells CloudWatch which fields of a record are metrics and dimensions
+type metricDirective struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+// usageMetricRecord is a CloudWatch embedded metric format record of one receipt's usage
+type usageMetricRecord struct {
+	AWS struct {
+		Timestamp         int64             `json:"Timestamp"` // Milliseconds since the epoch
+		CloudWatchMetrics []metricDirective `json:"CloudWatchMetrics"`
+	} `json:"_aws"`
+	Month            string  `json:"Month"`
+	Model            string  `json:"Model"`
+	Receipts         int     `json:"Receipts"`
+	PromptTokens     int     `json:"PromptTokens"`
+	CompletionTokens int     `json:"CompletionTokens"`
+	TotalTokens      int     `json:"TotalTokens"`
+	EstimatedCostUSD float64 `json:"EstimatedCostUSD"`
+}
+
+// writeMetrics writes one usage record as a line of JSON, booked to its Month dimension
+// rather than the time it is written, like the totals of the tracker
+func (t *UsageTracker) writeMetrics(usage MonthlyUsage) {
+	record := usageMetricRecord{
+		Month:            usage.Month,
+		Model:            usage.Model,
+		Receipts:         usage.Receipts,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		EstimatedCostUSD: usage.CostUSD,
+	}
+	record.AWS.Timestamp = time.Now().UnixMilli()
+	record.AWS.CloudWatchMetrics = []metricDirective{{
+		Namespace:  t.namespace,
+		Dimensions: [][]string{{"Month"}, {"Month", "Model"}},
+		Metrics:    usageMetricNames,
+	}}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = t.metrics.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to write usage metrics: %v", err)
+	}
+}
+
+// Monthly returns the recorded usage sorted by month and model
+func (t *UsageTracker) Monthly() []MonthlyUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]MonthlyUsage, 0, len(t.entries))
+	for _, entry := range t.entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Month != result[j].Month {
+			return result[i].Month < result[j].Month
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result
+}
+
+// Total returns the usage summed over all months and models
+func (t *UsageTracker) Total() MonthlyUsage {
+	var total MonthlyUsage
+	for _, entry := range t.Monthly() {
+		total.Receipts += entry.Receipts
+		total.Add(entry.Usage)
+	}
+	return total
+}
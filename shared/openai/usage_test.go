@@ -0,0 +1,167 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPriceForModel(t *testing.T) {
+	custom := map[string]ModelPrice{
+		"local-vision": {InputPerMillion: 0, OutputPerMillion: 0},
+		"gpt-4o":       {InputPerMillion: 1, OutputPerMillion: 2},
+	}
+
+	tests := []struct {
+		name   string
+		model  string
+		prices map[string]ModelPrice
+		want   ModelPrice
+		found  bool
+	}{
+		{"exact", "gpt-4o-mini", nil, DefaultModelPrices["gpt-4o-mini"], true},
+		{"dated snapshot", "gpt-4o-2024-08-06", nil, DefaultModelPrices["gpt-4o"], true},
+		{"longest prefix wins", "gpt-4o-mini-2024-07-18", nil, DefaultModelPrices["gpt-4o-mini"], true},
+		{"override", "gpt-4o", custom, ModelPrice{InputPerMillion: 1, OutputPerMillion: 2}, true},
+		{"override snapshot", "gpt-4o-2024-11-20", custom, ModelPrice{InputPerMillion: 1, OutputPerMillion: 2}, true},
+		{"custom model", "local-vision", custom, ModelPrice{}, true},
+		{"unknown", "llava", nil, ModelPrice{}, false},
+		{"no partial word match", "gpt-4oo", nil, ModelPrice{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := PriceForModel(tt.model, tt.prices)
+			if found != tt.found || got != tt.want {
+				t.Errorf("PriceForModel(%q) = %+v, %v; want %+v, %v", tt.model, got, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	// gpt-4o: $2.50 input, $10.00 output per million tokens
+	got := EstimateCost("gpt-4o", 1000, 500, nil)
+	if math.Abs(got-0.0075) > 1e-12 {
+		t.Errorf("EstimateCost() = %v, want 0.0075", got)
+	}
+	if got := EstimateCost("unknown-model", 1000, 500, nil); got != 0 {
+		t.Errorf("EstimateCost() for unknown model = %v, want 0", got)
+	}
+}
+
+func TestUsageTracker(t *testing.T) {
+	tracker := NewUsageTracker()
+	march := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tracker.Record(march, "gpt-4o", Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110, CostUSD: 0.01})
+	tracker.Record(march, "gpt-4o", Usage{PromptTokens: 200, CompletionTokens: 20, TotalTokens: 220, CostUSD: 0.02})
+	tracker.Record(april, "gpt-4o-mini", Usage{PromptTokens: 50, CompletionTokens: 5, TotalTokens: 55, CostUSD: 0.001})
+
+	monthly := tracker.Monthly()
+	if len(monthly) != 2 {
+		t.Fatalf("Expected 2 monthly entries, got %d", len(monthly))
+	}
+	if monthly[0].Month != "2024-03" || monthly[0].Receipts != 2 || monthly[0].TotalTokens != 330 {
+		t.Errorf("Unexpected March usage: %+v", monthly[0])
+	}
+	if monthly[1].Month != "2024-04" || monthly[1].Model != "gpt-4o-mini" || monthly[1].Receipts != 1 {
+		t.Errorf("Unexpected April usage: %+v", monthly[1])
+	}
+
+	total := tracker.Total()
+	if total.Receipts != 3 || total.TotalTokens != 385 || math.Abs(total.CostUSD-0.031) > 1e-9 {
+		t.Errorf("Unexpected total usage: %+v", total)
+	}
+}
+
+func TestUsageTrackerMetrics(t *testing.T) {
+	var out bytes.Buffer
+	tracker := NewUsageTracker()
+	tracker.SetMetrics(&out, "ReceiptProcessor")
+
+	march := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	tracker.Record(march, "gpt-4o", Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110, CostUSD: 0.01})
+	tracker.Record(march, "gpt-4o", Usage{PromptTokens: 200, CompletionTokens: 20, TotalTokens: 220, CostUSD: 0.02})
+
+	// One record per receipt, so CloudWatch sums them per month
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 metric records, got %q", out.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatalf("Metric record is not JSON: %v", err)
+	}
+	if record["Month"] != "2024-03" || record["Model"] != "gpt-4o" || record["Receipts"] != 1.0 || record["TotalTokens"] != 220.0 || record["EstimatedCostUSD"] != 0.02 {
+		t.Errorf("Unexpected metric record: %s", lines[1])
+	}
+
+	directive := record["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	if directive["Namespace"] != "ReceiptProcessor" || len(directive["Metrics"].([]interface{})) != 5 {
+		t.Errorf("Unexpected metric directive: %v", directive)
+	}
+	if dimensions, _ := json.Marshal(directive["Dimensions"]); string(dimensions) != `[["Month"],["Month","Model"]]` {
+		t.Errorf("Dimensions = %s", dimensions)
+	}
+
+	// The in-process totals are unaffected
+	if total := tracker.Total(); total.Receipts != 2 || total.TotalTokens != 330 {
+		t.Errorf("Unexpected total usage: %+v", total)
+	}
+}
+
+func TestExtractReceiptDataUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-request-id", "req_123")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"model": "gpt-4o-2024-08-06",
+			"choices": []map[string]interface{}{
+				{"message": map[string]string{
+					"role":    "assistant",
+					"content": `{"store_name":"Usage Mart","receipt_date":"2024-03-05T10:00:00Z","total_amount":500,"currency":"JPY"}`,
+				}},
+			},
+			"usage": map[string]int{"prompt_tokens": 1000, "completion_tokens": 500, "total_tokens": 1500},
+		})
+	}))
+	defer server.Close()
+
+	tracker := NewUsageTracker()
+	service, err := NewService(ServiceConfig{
+		APIKey:       "test-key",
+		BaseURL:      server.URL,
+		UsageTracker: tracker,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	resp, err := service.ExtractReceiptData(context.Background(), ReceiptExtractionRequest{ImageData: "base64data"})
+	if err != nil {
+		t.Fatalf("ExtractReceiptData() error = %v", err)
+	}
+
+	if resp.Model != "gpt-4o-2024-08-06" || resp.RequestID != "req_123" {
+		t.Errorf("Expected model and request ID from the API, got %q and %q", resp.Model, resp.RequestID)
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 1500 {
+		t.Fatalf("Expected usage of 1500 tokens, got %+v", resp.Usage)
+	}
+	if math.Abs(resp.Usage.CostUSD-0.0075) > 1e-12 {
+		t.Errorf("Expected estimated cost 0.0075, got %v", resp.Usage.CostUSD)
+	}
+
+	// Booked in the month of the call, not the 2024-03 receipt date
+	monthly := tracker.Monthly()
+	if want := time.Now().Format("2006-01"); len(monthly) != 1 || monthly[0].Month != want || monthly[0].Receipts != 1 {
+		t.Errorf("Expected usage booked in %s, got %+v", want, monthly)
+	}
+}
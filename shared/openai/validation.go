@@ -3,6 +3,9 @@ package openai
 import (
 	"encoding/base64"
 	"fmt"
+	"strings"
+
+	"vibe-coding-project-lambda/shared/imaging"
 )
 
 const (
@@ -117,7 +120,7 @@ func ValidateImageFormat(imageData []byte) error {
 	if !isPNG && !isJPEG && !isGIF && !isWEBP {
 		return &ImageValidationError{
 			Field:   "image_format",
-			Message: "unsupported image format. OpenAI supports: PNG, JPEG, WEBP, non-animated GIF",
+			Message: "unsupported image format. OpenAI supports: PNG, JPEG, WEBP, non-animated GIF (convert HEIC, TIFF and PDF uploads first)",
 		}
 	}
 	
@@ -205,6 +208,10 @@ func GetImageFormatInfo(imageData []byte) string {
 		imageData[8] == 0x57 && imageData[9] == 0x45 && imageData[10] == 0x42 && imageData[11] == 0x50:
 		return "WEBP"
 	default:
+		// Formats that need conversion before they can be sent
+		if format := imaging.DetectFormat(imageData); format != imaging.FormatUnknown {
+			return strings.ToUpper(string(format)) + " (needs conversion)"
+		}
 		return "Unknown/Unsupported"
 	}
 }
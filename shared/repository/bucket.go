@@ -0,0 +1,211 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Default bucket encryption
+const (
+	BucketEncryptionSSES3  = "sse-s3"  // S3-managed keys (AES256)
+	BucketEncryptionSSEKMS = "sse-kms" // AWS KMS keys, with an S3 Bucket Key to reduce KMS requests
+)
+
+// BucketOptions configures a bucket created or updated by ProvisionBucket
+type BucketOptions struct {
+	// Default encryption, BucketEncryptionSSES3 or BucketEncryptionSSEKMS
+	// Left unchanged when empty
+	Encryption string
+	// KMS key ID or ARN for BucketEncryptionSSEKMS; the AWS managed key when empty
+	KMSKeyID string
+
+	// Keep previous versions of overwritten and deleted objects
+	Versioning bool
+	// Delete previous versions after this many days; 0 keeps them
+	NoncurrentVersionDays int
+
+	// Lifecycle rules replacing the bucket's configuration; left unchanged when empty
+	Lifecycle []LifecycleRule
+}
+
+// LifecycleRule moves or deletes objects as they age
+type LifecycleRule struct {
+	ID      string
+	Prefix  string // Objects under this key prefix; every object when empty
+	MinSize int64  // Only objects larger than this many bytes; 0 for any size
+
+	TransitionDays int    // Move objects to StorageClass after this many days; 0 disables
+	StorageClass   string // Transition target, e.g. GLACIER_IR or GLACIER
+	ExpirationDays int    // Delete objects after this many days; 0 disables
+}
+
+// EnsureBucketExists creates the S3 bucket if it doesn't exist
+// A successful check is remembered, so only the first call reaches S3
+func (r *S3Repository) EnsureBucketExists(ctx context.Context) error {
+	if r.bucketReady.Load() {
+		return nil
+	}
+
+	// Check if bucket exists
+	_, err := r.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(r.bucketName),
+	})
+	if err == nil {
+		r.bucketReady.Store(true)
+		return nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to check bucket %s: %w", r.bucketName, err)
+	}
+
+	// Create bucket; us-east-1 is the default location and must not be named
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(r.bucketName),
+	}
+	if r.region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(r.region),
+		}
+	}
+	if _, err := r.client.CreateBucket(ctx, input); err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	// Wait for bucket to be created
+	waiter := s3.NewBucketExistsWaiter(r.client)
+	err = waiter.Wait(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(r.bucketName),
+	}, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to wait for bucket creation: %w", err)
+	}
+
+	r.bucketReady.Store(true)
+	return nil
+}
+
+// ProvisionBucket creates the bucket if needed and applies its encryption,
+// versioning and lifecycle settings. It is meant for a one-time setup step with
+// credentials allowed to manage buckets, not for the request path
+func (r *S3Repository) ProvisionBucket(ctx context.Context, opts BucketOptions) error {
+	encryption, err := bucketEncryption(opts)
+	if err != nil {
+		return err
+	}
+	if err := r.EnsureBucketExists(ctx); err != nil {
+		return err
+	}
+
+	if encryption != nil {
+		_, err := r.client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket:                            aws.String(r.bucketName),
+			ServerSideEncryptionConfiguration: encryption,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set bucket encryption: %w", err)
+		}
+	}
+
+	if opts.Versioning {
+		_, err := r.client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket: aws.String(r.bucketName),
+			VersioningConfiguration: &types.VersioningConfiguration{
+				Status: types.BucketVersioningStatusEnabled,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable bucket versioning: %w", err)
+		}
+	}
+
+	if rules := bucketLifecycleRules(opts); len(rules) > 0 {
+		_, err := r.client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 aws.String(r.bucketName),
+			LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set bucket lifecycle rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// bucketEncryption returns the default encryption configuration of opts, or nil to leave it unchanged
+func bucketEncryption(opts BucketOptions) (*types.ServerSideEncryptionConfiguration, error) {
+	var rule types.ServerSideEncryptionRule
+	switch strings.ToLower(opts.Encryption) {
+	case "":
+		return nil, nil
+	case BucketEncryptionSSES3:
+		rule.ApplyServerSideEncryptionByDefault = &types.ServerSideEncryptionByDefault{
+			SSEAlgorithm: types.ServerSideEncryptionAes256,
+		}
+	case BucketEncryptionSSEKMS:
+		rule.ApplyServerSideEncryptionByDefault = &types.ServerSideEncryptionByDefault{
+			SSEAlgorithm: types.ServerSideEncryptionAwsKms,
+		}
+		if opts.KMSKeyID != "" {
+			rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID = aws.String(opts.KMSKeyID)
+		}
+		rule.BucketKeyEnabled = aws.Bool(true)
+	default:
+		return nil, fmt.Errorf("unknown bucket encryption %q (want %s or %s)", opts.Encryption, BucketEncryptionSSES3, BucketEncryptionSSEKMS)
+	}
+	return &types.ServerSideEncryptionConfiguration{Rules: []types.ServerSideEncryptionRule{rule}}, nil
+}
+
+// bucketLifecycleRules converts the lifecycle settings of opts to S3 rules
+func bucketLifecycleRules(opts BucketOptions) []types.LifecycleRule {
+	var rules []types.LifecycleRule
+	for _, rule := range opts.Lifecycle {
+		s3Rule := types.LifecycleRule{
+			ID:     aws.String(rule.ID),
+			Status: types.ExpirationStatusEnabled,
+			Filter: lifecycleFilter(rule),
+		}
+		if rule.TransitionDays > 0 {
+			s3Rule.Transitions = []types.Transition{{
+				Days:         aws.Int32(int32(rule.TransitionDays)),
+				StorageClass: types.TransitionStorageClass(strings.ToUpper(rule.StorageClass)),
+			}}
+		}
+		if rule.ExpirationDays > 0 {
+			s3Rule.Expiration = &types.LifecycleExpiration{Days: aws.Int32(int32(rule.ExpirationDays))}
+		}
+		rules = append(rules, s3Rule)
+	}
+
+	if opts.Versioning && opts.NoncurrentVersionDays > 0 {
+		rules = append(rules, types.LifecycleRule{
+			ID:     aws.String("expire-noncurrent-versions"),
+			Status: types.ExpirationStatusEnabled,
+			Filter: &types.LifecycleRuleFilter{Prefix: aws.String("")},
+			NoncurrentVersionExpiration: &types.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int32(int32(opts.NoncurrentVersionDays)),
+			},
+		})
+	}
+	return rules
+}
+
+// lifecycleFilter selects the objects a rule applies to by prefix and size
+func lifecycleFilter(rule LifecycleRule) *types.LifecycleRuleFilter {
+	if rule.MinSize <= 0 {
+		return &types.LifecycleRuleFilter{Prefix: aws.String(rule.Prefix)}
+	}
+	if rule.Prefix == "" {
+		return &types.LifecycleRuleFilter{ObjectSizeGreaterThan: aws.Int64(rule.MinSize)}
+	}
+	return &types.LifecycleRuleFilter{And: &types.LifecycleRuleAndOperator{
+		Prefix:                aws.String(rule.Prefix),
+		ObjectSizeGreaterThan: aws.Int64(rule.MinSize),
+	}}
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// newRecordingS3Repository returns a repository whose requests all succeed and are
+// recorded as "METHOD path?query"
+func newRecordingS3Repository(t *testing.T) (*S3Repository, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		request := r.Method + " " + r.URL.Path
+		if r.URL.RawQuery != "" {
+			request += "?" + r.URL.RawQuery
+		}
+		requests = append(requests, request)
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "ap-northeast-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	return NewS3Repository(client, "test-bucket", "ap-northeast-1"), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestS3RepositoryUploadSkipsBucketCheck(t *testing.T) {
+	repo, requests := newRecordingS3Repository(t)
+
+	fileInfo, err := repo.Upload(context.Background(), "receipt.jpg", []byte("image"), "image/jpeg", nil)
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if got, want := requests(), []string{"PUT /test-bucket/" + fileInfo.Key + "?x-id=PutObject"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Upload() requests = %v, want %v", got, want)
+	}
+}
+
+func TestS3RepositoryProvisionBucket(t *testing.T) {
+	ctx := context.Background()
+	repo, requests := newRecordingS3Repository(t)
+
+	err := repo.ProvisionBucket(ctx, BucketOptions{
+		Encryption: BucketEncryptionSSEKMS,
+		Versioning: true,
+		Lifecycle:  []LifecycleRule{{ID: "archive", TransitionDays: 365, StorageClass: "GLACIER_IR"}},
+	})
+	if err != nil {
+		t.Fatalf("ProvisionBucket() error = %v", err)
+	}
+	// The existence check is cached
+	if err := repo.EnsureBucketExists(ctx); err != nil {
+		t.Fatalf("EnsureBucketExists() error = %v", err)
+	}
+
+	want := []string{
+		"HEAD /test-bucket",
+		"PUT /test-bucket?encryption=",
+		"PUT /test-bucket?versioning=",
+		"PUT /test-bucket?lifecycle=",
+	}
+	if got := requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProvisionBucket() requests = %v, want %v", got, want)
+	}
+
+	if err := repo.ProvisionBucket(ctx, BucketOptions{Encryption: "rot13"}); err == nil {
+		t.Error("Expected an error for an unknown encryption")
+	}
+}
+
+func TestBucketEncryption(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      BucketOptions
+		algorithm types.ServerSideEncryption
+		keyID     string
+	}{
+		{name: "unchanged", opts: BucketOptions{}},
+		{name: "SSE-S3", opts: BucketOptions{Encryption: "SSE-S3"}, algorithm: types.ServerSideEncryptionAes256},
+		{name: "SSE-KMS with a key", opts: BucketOptions{Encryption: BucketEncryptionSSEKMS, KMSKeyID: "alias/receipts"}, algorithm: types.ServerSideEncryptionAwsKms, keyID: "alias/receipts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := bucketEncryption(tt.opts)
+			if err != nil {
+				t.Fatalf("bucketEncryption() error = %v", err)
+			}
+			if tt.algorithm == "" {
+				if config != nil {
+					t.Errorf("bucketEncryption() = %+v, want nil", config)
+				}
+				return
+			}
+			rule := config.Rules[0].ApplyServerSideEncryptionByDefault
+			if rule.SSEAlgorithm != tt.algorithm || aws.ToString(rule.KMSMasterKeyID) != tt.keyID {
+				t.Errorf("bucketEncryption() = %s %q, want %s %q", rule.SSEAlgorithm, aws.ToString(rule.KMSMasterKeyID), tt.algorithm, tt.keyID)
+			}
+		})
+	}
+}
+
+func TestBucketLifecycleRules(t *testing.T) {
+	rules := bucketLifecycleRules(BucketOptions{
+		Versioning:            true,
+		NoncurrentVersionDays: 30,
+		Lifecycle: []LifecycleRule{
+			{ID: "archive", MinSize: 1024, TransitionDays: 365, StorageClass: "glacier"},
+			{ID: "expire", Prefix: "idempotency/", ExpirationDays: 2},
+			{ID: "both", Prefix: "2024-", MinSize: 1024, ExpirationDays: 10},
+		},
+	})
+	if len(rules) != 4 {
+		t.Fatalf("bucketLifecycleRules() returned %d rules, want 4", len(rules))
+	}
+
+	archive := rules[0]
+	if filter := archive.Filter; filter == nil || aws.ToInt64(filter.ObjectSizeGreaterThan) != 1024 || filter.Prefix != nil {
+		t.Errorf("archive filter = %#v", archive.Filter)
+	}
+	if len(archive.Transitions) != 1 || aws.ToInt32(archive.Transitions[0].Days) != 365 || archive.Transitions[0].StorageClass != types.TransitionStorageClassGlacier {
+		t.Errorf("archive transitions = %+v", archive.Transitions)
+	}
+	if archive.Expiration != nil {
+		t.Errorf("archive expiration = %+v, want none", archive.Expiration)
+	}
+
+	expire := rules[1]
+	if filter := expire.Filter; filter == nil || aws.ToString(filter.Prefix) != "idempotency/" {
+		t.Errorf("expire filter = %#v", expire.Filter)
+	}
+	if expire.Expiration == nil || aws.ToInt32(expire.Expiration.Days) != 2 || len(expire.Transitions) != 0 {
+		t.Errorf("expire rule = %+v", expire)
+	}
+
+	if filter := rules[2].Filter; filter == nil || filter.And == nil || aws.ToString(filter.And.Prefix) != "2024-" || aws.ToInt64(filter.And.ObjectSizeGreaterThan) != 1024 {
+		t.Errorf("combined filter = %#v", rules[2].Filter)
+	}
+
+	noncurrent := rules[3]
+	if noncurrent.NoncurrentVersionExpiration == nil || aws.ToInt32(noncurrent.NoncurrentVersionExpiration.NoncurrentDays) != 30 {
+		t.Errorf("noncurrent rule = %+v", noncurrent)
+	}
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Checksum algorithms verified on upload
+const (
+	ChecksumSHA256 = "SHA256"
+	ChecksumCRC32C = "CRC32C"
+)
+
+// newChecksumHash returns the hash computing checksums of algorithm
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q (want %s or %s)", algorithm, ChecksumSHA256, ChecksumCRC32C)
+	}
+}
+
+// normalizeChecksumAlgorithm maps names such as "sha256" or "crc32c" to a checksum algorithm
+func normalizeChecksumAlgorithm(algorithm string) (string, error) {
+	if algorithm == "" {
+		return ChecksumSHA256, nil
+	}
+	normalized := strings.ToUpper(strings.ReplaceAll(algorithm, "-", ""))
+	if _, err := newChecksumHash(normalized); err != nil {
+		return "", err
+	}
+	return normalized, nil
+}
+
+// formatChecksum formats a base64 checksum as recorded in FileInfo, e.g. "SHA256:..."
+func formatChecksum(algorithm, value string) string {
+	return algorithm + ":" + value
+}
+
+// hashingReader computes the ETag and checksum of a stored file while it is read
+// The ETag is the hex MD5 digest, as S3 reports it for single-part uploads
+type hashingReader struct {
+	reader    io.Reader
+	md5       hash.Hash
+	checksum  hash.Hash
+	algorithm string
+	size      int64
+}
+
+// newHashingReader wraps body to hash it with MD5 and the SHA-256 checksum
+func newHashingReader(body io.Reader) *hashingReader {
+	return &hashingReader{reader: body, md5: md5.New(), checksum: sha256.New(), algorithm: ChecksumSHA256}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.reader.Read(p)
+	h.md5.Write(p[:n])
+	h.checksum.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// fill records the size, ETag and checksum of everything read on fileInfo
+func (h *hashingReader) fill(fileInfo *FileInfo) {
+	fileInfo.Size = h.size
+	fileInfo.ETag = hex.EncodeToString(h.md5.Sum(nil))
+	fileInfo.Checksum = formatChecksum(h.algorithm, base64.StdEncoding.EncodeToString(h.checksum.Sum(nil)))
+}
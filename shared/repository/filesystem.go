@@ -0,0 +1,412 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileMetaDir is the hidden directory of a FileObjectStore holding object attributes
+const fileMetaDir = ".meta"
+
+// fileObjectMeta holds the attributes a file system cannot store with an object
+type fileObjectMeta struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// FileObjectStore keeps objects as files under a local directory, for running on a laptop
+// Keys map to paths below the directory; content types and metadata are kept
+// under its .meta directory. URLs are file:// URLs of the object files
+// Conditional writes are only atomic within one process
+type FileObjectStore struct {
+	root        string
+	keys        *KeyLayout
+	conditional sync.Mutex
+}
+
+// NewFileObjectStore creates a store in dir, creating the directory if needed
+func NewFileObjectStore(dir string) (*FileObjectStore, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", root, err)
+	}
+	return &FileObjectStore{root: root, keys: DefaultKeyLayout()}, nil
+}
+
+// SetKeyLayout changes the keys of later uploads
+func (f *FileObjectStore) SetKeyLayout(layout *KeyLayout) {
+	f.keys = layout
+}
+
+// Upload stores a new file under a key built by the store's KeyLayout
+func (f *FileObjectStore) Upload(ctx context.Context, originalFileName string, fileContent []byte, contentType string, metadata map[string]string) (*FileInfo, error) {
+	return f.UploadStream(ctx, originalFileName, bytes.NewReader(fileContent), contentType, metadata)
+}
+
+// UploadStream copies a new file from body to a key built by the store's KeyLayout
+func (f *FileObjectStore) UploadStream(ctx context.Context, originalFileName string, body io.Reader, contentType string, metadata map[string]string) (*FileInfo, error) {
+	uniqueFileName, uploadDate, key := newUploadKey(f.keys, originalFileName, metadata)
+	objectPath, err := f.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hashing := newHashingReader(body)
+	if err := writeFileAtomic(objectPath, hashing); err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+	if err := f.writeMeta(key, fileObjectMeta{ContentType: contentType, Metadata: copyMetadata(metadata)}); err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	fileInfo := &FileInfo{
+		OriginalName: originalFileName,
+		FileName:     uniqueFileName,
+		BucketName:   f.root,
+		Key:          key,
+		ContentType:  contentType,
+		URL:          f.objectURL(key),
+		UploadDate:   uploadDate,
+		Metadata:     metadata,
+	}
+	hashing.fill(fileInfo)
+	return fileInfo, nil
+}
+
+// Put stores content under an exact key, replacing any existing object
+func (f *FileObjectStore) Put(ctx context.Context, key string, content []byte, contentType string) error {
+	if err := f.store(key, content, contentType, nil); err != nil {
+		return fmt.Errorf("failed to put %s: %w", key, err)
+	}
+	return nil
+}
+
+// store writes an object and its attributes
+func (f *FileObjectStore) store(key string, content []byte, contentType string, metadata map[string]string) error {
+	objectPath, err := f.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(objectPath, bytes.NewReader(content)); err != nil {
+		return err
+	}
+	return f.writeMeta(key, fileObjectMeta{ContentType: contentType, Metadata: copyMetadata(metadata)})
+}
+
+// Get returns the content of an object
+// Returns ErrObjectNotFound when the key does not exist
+func (f *FileObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	objectPath, err := f.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(objectPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return content, nil
+}
+
+// GetVersion returns the content of an object with its ETag
+// Returns ErrObjectNotFound when the key does not exist
+func (f *FileObjectStore) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	content, err := f.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, contentETag(content), nil
+}
+
+// PutIfMatch stores content under an exact key while the object still has etag,
+// or with an empty etag while no object exists
+func (f *FileObjectStore) PutIfMatch(ctx context.Context, key string, content []byte, contentType, etag string) (string, error) {
+	f.conditional.Lock()
+	defer f.conditional.Unlock()
+	_, current, err := f.GetVersion(ctx, key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return "", err
+	}
+	if current != etag {
+		return "", fmt.Errorf("%w: %s", ErrPreconditionFailed, key)
+	}
+	if err := f.Put(ctx, key, content, contentType); err != nil {
+		return "", err
+	}
+	return contentETag(content), nil
+}
+
+// Head describes an object
+// Returns ErrObjectNotFound when the key does not exist
+func (f *FileObjectStore) Head(ctx context.Context, key string) (*FileInfo, error) {
+	objectPath, err := f.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(objectPath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && stat.IsDir()) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo := newStoredFileInfo(f.root, key, stat.Size(), meta.ContentType, f.objectURL(key), meta.Metadata)
+	fileInfo.UploadDate = f.keys.Date(stat.ModTime())
+	return fileInfo, nil
+}
+
+// List returns the keys of all objects under prefix, in lexical order like S3
+func (f *FileObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(f.root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if p != f.root && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && !strings.HasPrefix(path.Base(key), ".") {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ListAfter returns up to limit keys under prefix that sort after startAfter
+func (f *FileObjectStore) ListAfter(ctx context.Context, prefix, startAfter string, limit int) ([]string, error) {
+	keys, err := f.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return keysAfter(keys, startAfter, limit), nil
+}
+
+// Delete removes an object; deleting a missing key is not an error
+func (f *FileObjectStore) Delete(ctx context.Context, key string) error {
+	objectPath, err := f.objectPath(key)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{objectPath, f.metaPath(key)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Presign returns the object's file:// URL; it does not expire
+func (f *FileObjectStore) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, err := f.Head(ctx, key); err != nil {
+		return "", err
+	}
+	return f.objectURL(key), nil
+}
+
+// SetMetadata replaces the user-defined metadata of an existing object
+func (f *FileObjectStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	if _, err := f.Head(ctx, key); err != nil {
+		return err
+	}
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return err
+	}
+	meta.Metadata = copyMetadata(metadata)
+	return f.writeMeta(key, meta)
+}
+
+// GetTags returns the tags of an existing object
+func (f *FileObjectStore) GetTags(ctx context.Context, key string) (map[string]string, error) {
+	if _, err := f.Head(ctx, key); err != nil {
+		return nil, err
+	}
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Tags == nil {
+		return map[string]string{}, nil
+	}
+	return meta.Tags, nil
+}
+
+// SetTags replaces the tags of an existing object
+func (f *FileObjectStore) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	cleaned, err := cleanTags(tags)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Head(ctx, key); err != nil {
+		return err
+	}
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return err
+	}
+	meta.Tags = cleaned
+	return f.writeMeta(key, meta)
+}
+
+// Relocate moves an uploaded file and its attributes to the key built from values
+func (f *FileObjectStore) Relocate(ctx context.Context, fileInfo *FileInfo, values, metadata map[string]string) (*FileInfo, error) {
+	key := relocationKey(f.keys, fileInfo, values)
+	if key == "" {
+		return fileInfo, nil
+	}
+	from, err := f.objectPath(fileInfo.Key)
+	if err != nil {
+		return nil, err
+	}
+	to, err := f.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := moveFile(from, to); errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to relocate %s: %w", fileInfo.Key, err)
+	}
+	if err := moveFile(f.metaPath(fileInfo.Key), f.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to relocate attributes of %s: %w", fileInfo.Key, err)
+	}
+	if metadata != nil {
+		meta, err := f.readMeta(key)
+		if err != nil {
+			return nil, err
+		}
+		meta.Metadata = copyMetadata(metadata)
+		if err := f.writeMeta(key, meta); err != nil {
+			return nil, err
+		}
+	}
+	return relocatedFileInfo(fileInfo, key, f.objectURL(key), metadata), nil
+}
+
+// KeyForURL returns the key of an object from its file:// URL
+func (f *FileObjectStore) KeyForURL(objectURL string) (string, bool) {
+	prefix := f.objectURL("")
+	if !strings.HasPrefix(objectURL, prefix) || len(objectURL) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(objectURL, prefix), true
+}
+
+// objectURL returns the file:// URL of an object
+func (f *FileObjectStore) objectURL(key string) string {
+	return "file://" + filepath.ToSlash(f.root) + "/" + key
+}
+
+// objectPath returns the file holding an object, rejecting keys that would leave
+// the store's directory or reach its hidden entries
+func (f *FileObjectStore) objectPath(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.HasPrefix(segment, ".") {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+// metaPath returns the file holding an object's attributes
+func (f *FileObjectStore) metaPath(key string) string {
+	return filepath.Join(f.root, fileMetaDir, filepath.FromSlash(key)+".json")
+}
+
+// readMeta reads an object's attributes; objects copied in by hand have none
+func (f *FileObjectStore) readMeta(key string) (fileObjectMeta, error) {
+	var meta fileObjectMeta
+	content, err := os.ReadFile(f.metaPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, fmt.Errorf("failed to read attributes of %s: %w", key, err)
+	}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return meta, fmt.Errorf("failed to decode attributes of %s: %w", key, err)
+	}
+	return meta, nil
+}
+
+// writeMeta stores an object's attributes
+func (f *FileObjectStore) writeMeta(key string, meta fileObjectMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode attributes of %s: %w", key, err)
+	}
+	return writeFileAtomic(f.metaPath(key), bytes.NewReader(content))
+}
+
+// moveFile renames a file, creating the directory of its new name
+func moveFile(from, to string) error {
+	if _, err := os.Stat(from); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// writeFileAtomic copies content through a temporary file so readers never see a partial object
+func writeFileAtomic(name string, content io.Reader) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	// Timezones are resolved without relying on the system zoneinfo, which minimal
+	// Lambda runtimes lack
+	_ "time/tzdata"
+)
+
+// Default key layout: the upload date in Japan, then the file name with a timestamp
+// and random suffix, e.g. 2024-10-18/receipt_20241018_153000_1a2b3c4d.jpg
+const (
+	DefaultKeyTemplate = "{date}/{name}_{timestamp}_{rand}{ext}"
+	DefaultKeyTimezone = "Asia/Tokyo"
+)
+
+// unknownKeyValue stands in for placeholders without a value
+const unknownKeyValue = "unknown"
+
+// reservedKeySegments are the top-level prefixes holding the function's own records:
+// the S3-triggered inbox, job and idempotency records and the receipt indexes.
+// Uploads whose first key segment would be one of them get it prefixed with "_",
+// so a value such as an uploader name of "jobs" cannot overwrite or list those records
+var reservedKeySegments = map[string]bool{
+	"inbox":       true,
+	"jobs":        true,
+	"idempotency": true,
+	"index":       true,
+}
+
+// maxFileNameLength bounds the sanitized base name in bytes, leaving room for the rest of the key
+const maxFileNameLength = 100
+
+// keyPlaceholder matches a placeholder of a key template
+var keyPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// receiptKeyPlaceholders are filled from the extracted receipt; until then the dates fall
+// back to the upload time and the others to "unknown"
+var receiptKeyPlaceholders = map[string]bool{
+	"receipt_date":  true,
+	"receipt_year":  true,
+	"receipt_month": true,
+	"receipt_day":   true,
+	"category":      true,
+	"store":         true,
+}
+
+// KeyLayout builds the keys of uploaded files from a template such as
+// "{receipt_year}/{receipt_month}/{category}/{receipt_id}_{rand}{ext}"
+//
+// Placeholders:
+//   - {date} {year} {month} {day} {timestamp}: the upload time in the layout's timezone
+//   - {name} {ext}: the sanitized original file name and its extension, including the dot
+//   - {rand}: 8 random hex characters; required, so pieces of one upload never collide
+//   - {receipt_date} {receipt_year} {receipt_month} {receipt_day} {category} {store}:
+//     from the extracted receipt, see ObjectStore.Relocate
+//   - anything else: the value of that name, such as an object metadata key with
+//     dashes written as underscores ({receipt_id} for receipt-id)
+//
+// Values are sanitized into single key segments; missing ones become "unknown"
+type KeyLayout struct {
+	template string
+	location *time.Location
+	receipt  bool // The template uses receipt placeholders
+}
+
+// NewKeyLayout parses a key template in timezone, an IANA name such as "Asia/Tokyo"
+// Empty arguments select DefaultKeyTemplate and DefaultKeyTimezone
+func NewKeyLayout(template, timezone string) (*KeyLayout, error) {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+	if timezone == "" {
+		timezone = DefaultKeyTimezone
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key timezone %q: %w", timezone, err)
+	}
+
+	if strings.HasPrefix(template, "/") || strings.HasSuffix(template, "/") || strings.Contains(template, "//") {
+		return nil, fmt.Errorf("invalid key template %q: empty path segment", template)
+	}
+	if stray := keyPlaceholder.ReplaceAllString(template, ""); strings.ContainsAny(stray, "{}") {
+		return nil, fmt.Errorf("invalid key template %q: placeholders are lowercase names in braces", template)
+	}
+	if !strings.Contains(template, "{rand}") {
+		return nil, fmt.Errorf("invalid key template %q: {rand} is required to keep keys unique", template)
+	}
+	if first, _, _ := strings.Cut(template, "/"); reservedKeySegments[first] {
+		return nil, fmt.Errorf("invalid key template %q: %s/ is reserved for the function's own records", template, first)
+	}
+
+	layout := &KeyLayout{template: template, location: location}
+	for _, match := range keyPlaceholder.FindAllStringSubmatch(template, -1) {
+		if receiptKeyPlaceholders[match[1]] {
+			layout.receipt = true
+		}
+	}
+	return layout, nil
+}
+
+// DefaultKeyLayout returns the layout of DefaultKeyTemplate in DefaultKeyTimezone
+func DefaultKeyLayout() *KeyLayout {
+	layout, err := NewKeyLayout("", "")
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+// UsesReceiptValues reports whether keys depend on the extracted receipt
+func (l *KeyLayout) UsesReceiptValues() bool {
+	return l.receipt
+}
+
+// Date formats a time as a YYYY-MM-DD date in the layout's timezone
+func (l *KeyLayout) Date(t time.Time) string {
+	return t.In(l.location).Format("2006-01-02")
+}
+
+// Key returns the key of a file uploaded at the given time
+// values supply the receipt and other named placeholders and may be nil
+func (l *KeyLayout) Key(originalFileName string, at time.Time, values map[string]string) string {
+	local := at.In(l.location)
+	name := SanitizeFileName(originalFileName)
+	ext := path.Ext(name)
+	if validExtension(ext) {
+		name = strings.TrimSuffix(name, ext)
+	} else {
+		ext = ""
+	}
+
+	receiptDate := local
+	if date, err := time.Parse("2006-01-02", lookupKeyValue(values, "receipt_date")); err == nil {
+		receiptDate = date
+	}
+
+	key := keyPlaceholder.ReplaceAllStringFunc(l.template, func(placeholder string) string {
+		switch placeholder = placeholder[1 : len(placeholder)-1]; placeholder {
+		case "date":
+			return local.Format("2006-01-02")
+		case "year":
+			return local.Format("2006")
+		case "month":
+			return local.Format("01")
+		case "day":
+			return local.Format("02")
+		case "timestamp":
+			return local.Format("20060102_150405")
+		case "name":
+			return name
+		case "ext":
+			return ext
+		case "rand":
+			return randomSuffix()
+		case "receipt_date":
+			return receiptDate.Format("2006-01-02")
+		case "receipt_year":
+			return receiptDate.Format("2006")
+		case "receipt_month":
+			return receiptDate.Format("01")
+		case "receipt_day":
+			return receiptDate.Format("02")
+		}
+		if value := sanitizeKeySegment(lookupKeyValue(values, placeholder)); value != "" {
+			return value
+		}
+		return unknownKeyValue
+	})
+	if first, _, _ := strings.Cut(key, "/"); reservedKeySegments[first] {
+		key = "_" + key
+	}
+	return key
+}
+
+// lookupKeyValue returns the value of a placeholder, also accepting metadata-style dashed names
+func lookupKeyValue(values map[string]string, name string) string {
+	if value, ok := values[name]; ok {
+		return value
+	}
+	return values[strings.ReplaceAll(name, "_", "-")]
+}
+
+// SanitizeFileName makes an uploaded file name safe to use in an object key
+// Directories are dropped, control, format and other invisible characters are removed,
+// characters that are unsafe in keys or URLs become "_", and the name is shortened to
+// a bounded length. Letters of any script are kept. Returns "file" when nothing is left
+func SanitizeFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	ext := path.Ext(name)
+	if !validExtension(ext) {
+		ext = ""
+	}
+	base := sanitizeKeySegment(strings.TrimSuffix(name, ext))
+
+	// Shorten the base name on a character boundary, keeping the extension
+	for len(base) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	base = strings.TrimRight(base, ". ")
+	if base == "" {
+		base = "file"
+	}
+	return base + ext
+}
+
+// sanitizeKeySegment makes a value safe to use as a single key segment
+func sanitizeKeySegment(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.In(r, unicode.Cf, unicode.Co, unicode.Cs):
+			// Invalid UTF-8, control, bidi and zero-width characters, private use
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		case strings.ContainsRune(`/\{}^%`+"`"+`[]"<>~#|:*?&$@=+;,'!`, r):
+			b.WriteByte('_')
+		case unicode.IsLetter(r), unicode.IsNumber(r), unicode.IsMark(r), strings.ContainsRune("-_.() ", r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	segment := strings.Join(strings.Fields(b.String()), " ")
+	return strings.TrimLeft(segment, ".")
+}
+
+// validExtension reports whether ext is a short alphanumeric file extension such as ".jpg"
+func validExtension(ext string) bool {
+	if len(ext) < 2 || len(ext) > 10 {
+		return false
+	}
+	for _, r := range ext[1:] {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// randomSuffix returns 8 random hex characters (4 bytes)
+func randomSuffix() string {
+	randomBytes := make([]byte, 4)
+	rand.Read(randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
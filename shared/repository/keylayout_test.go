@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyLayoutKey(t *testing.T) {
+	// 15:30 on 2024-10-18 in Tokyo
+	uploadedAt := time.Date(2024, 10, 18, 6, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		template     string
+		timezone     string
+		originalName string
+		at           time.Time
+		values       map[string]string
+		want         string // Regular expression of the key
+	}{
+		{
+			name:         "Default layout",
+			originalName: "receipt.jpg",
+			want:         `^2024-10-18/receipt_20241018_153000_[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Filename without extension",
+			originalName: "receipt",
+			want:         `^2024-10-18/receipt_20241018_153000_[0-9a-f]{8}$`,
+		},
+		{
+			name:         "Filename with multiple dots",
+			originalName: "my.receipt.image.png",
+			want:         `^2024-10-18/my\.receipt\.image_20241018_153000_[0-9a-f]{8}\.png$`,
+		},
+		{
+			name:         "Filename with spaces",
+			originalName: "my receipt.jpg",
+			want:         `^2024-10-18/my receipt_20241018_153000_[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Filename with directories",
+			originalName: "../../etc/receipt.jpg",
+			want:         `^2024-10-18/receipt_20241018_153000_[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Configured timezone",
+			template:     "{year}/{month}/{day}/{rand}{ext}",
+			timezone:     "America/New_York",
+			originalName: "receipt.jpg",
+			want:         `^2024/10/18/[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Date differs between timezones",
+			template:     "{date}/{rand}",
+			timezone:     "UTC",
+			originalName: "receipt.jpg",
+			at:           time.Date(2024, 10, 17, 23, 0, 0, 0, time.UTC),
+			want:         `^2024-10-17/[0-9a-f]{8}$`,
+		},
+		{
+			name:         "Receipt values",
+			template:     "{user}/{receipt_year}/{receipt_month}/{category}/{receipt_id}_{rand}{ext}",
+			originalName: "receipt.jpg",
+			values:       map[string]string{"user": "alice", "receipt_date": "2024-09-30", "category": "식비", "receipt-id": "r1"},
+			want:         `^alice/2024/09/식비/r1_[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Missing receipt values",
+			template:     "{user}/{receipt_year}/{receipt_month}/{category}/{receipt_id}_{rand}{ext}",
+			originalName: "receipt.jpg",
+			want:         `^unknown/2024/10/unknown/unknown_[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Values are single segments",
+			template:     "{category}/{store}/{rand}",
+			originalName: "receipt.jpg",
+			values:       map[string]string{"category": "문화/여가", "store": "../x"},
+			want:         `^문화_여가/_x/[0-9a-f]{8}$`,
+		},
+		{
+			name:         "Values naming reserved prefixes",
+			template:     "{user}/{rand}{ext}",
+			originalName: "receipt.jpg",
+			values:       map[string]string{"user": "jobs"},
+			want:         `^_jobs/[0-9a-f]{8}\.jpg$`,
+		},
+		{
+			name:         "Reserved names below the top level",
+			template:     "{user}/{category}/{rand}",
+			originalName: "receipt.jpg",
+			values:       map[string]string{"user": "alice", "category": "index"},
+			want:         `^alice/index/[0-9a-f]{8}$`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := NewKeyLayout(tt.template, tt.timezone)
+			if err != nil {
+				t.Fatalf("NewKeyLayout() error = %v", err)
+			}
+			at := tt.at
+			if at.IsZero() {
+				at = uploadedAt
+			}
+
+			key := layout.Key(tt.originalName, at, tt.values)
+			if !regexp.MustCompile(tt.want).MatchString(key) {
+				t.Errorf("Key() = %q, want a match of %s", key, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyLayoutKeyReservedPrefixes(t *testing.T) {
+	layout, err := NewKeyLayout("{user}/{receipt_year}/{rand}{ext}", "")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+	for _, user := range []string{"inbox", "jobs", "idempotency", "index", "../jobs", ".index"} {
+		key := layout.Key("receipt.jpg", time.Now(), map[string]string{"user": user})
+		for _, reserved := range []string{"inbox/", "jobs/", "idempotency/", "index/"} {
+			if strings.HasPrefix(key, reserved) {
+				t.Errorf("Key() for user %q = %q, want it outside %s", user, key, reserved)
+			}
+		}
+	}
+}
+
+func TestKeyLayoutKey_Uniqueness(t *testing.T) {
+	layout := DefaultKeyLayout()
+	at := time.Now()
+
+	// Keys built in the same second differ by their random suffix
+	keys := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := layout.Key("test.jpg", at, nil)
+		if keys[key] {
+			t.Errorf("Generated duplicate key: %s", key)
+		}
+		keys[key] = true
+	}
+}
+
+func TestKeyLayoutDate(t *testing.T) {
+	layout := DefaultKeyLayout()
+
+	if got := layout.Date(time.Date(2024, 10, 17, 23, 0, 0, 0, time.UTC)); got != "2024-10-18" {
+		t.Errorf("Date() = %s, want the JST date 2024-10-18", got)
+	}
+}
+
+func TestNewKeyLayout(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		timezone    string
+		wantReceipt bool
+		wantErr     bool
+	}{
+		{name: "Defaults"},
+		{name: "Receipt placeholders", template: "{receipt_year}/{category}/{rand}{ext}", wantReceipt: true},
+		{name: "Metadata placeholders", template: "{receipt_id}/{rand}{ext}"},
+		{name: "Unknown timezone", timezone: "Mars/Olympus", wantErr: true},
+		{name: "Leading slash", template: "/{date}/{rand}", wantErr: true},
+		{name: "Trailing slash", template: "{date}/{rand}/", wantErr: true},
+		{name: "Empty segment", template: "{date}//{rand}", wantErr: true},
+		{name: "Uppercase placeholder", template: "{Date}/{rand}", wantErr: true},
+		{name: "Unclosed placeholder", template: "{date/{rand}", wantErr: true},
+		{name: "Missing random suffix", template: "{date}/{name}{ext}", wantErr: true},
+		{name: "Reserved prefix", template: "jobs/{date}/{rand}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := NewKeyLayout(tt.template, tt.timezone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewKeyLayout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && layout.UsesReceiptValues() != tt.wantReceipt {
+				t.Errorf("UsesReceiptValues() = %v, want %v", layout.UsesReceiptValues(), tt.wantReceipt)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "Plain", in: "receipt.jpg", want: "receipt.jpg"},
+		{name: "Unix path", in: "../../etc/passwd", want: "passwd"},
+		{name: "Windows path", in: `C:\Users\me\receipt.png`, want: "receipt.png"},
+		{name: "Non-Latin letters", in: "レシート 2024.jpg", want: "レシート 2024.jpg"},
+		{name: "Combining marks", in: "cafe\u0301.jpg", want: "cafe\u0301.jpg"},
+		{name: "Bidi override", in: "invoice\u202Egpj.exe", want: "invoicegpj.exe"},
+		{name: "Zero-width space", in: "zero\u200Bwidth.jpg", want: "zerowidth.jpg"},
+		{name: "Control characters", in: "a\x00b\tc\n.jpg", want: "abc.jpg"},
+		{name: "Invalid UTF-8", in: "\xff\xfe.jpg", want: "file.jpg"},
+		{name: "Unsafe characters", in: "what?#%{}.jpg", want: "what_____.jpg"},
+		{name: "Repeated whitespace", in: "  my \u3000 receipt  .jpg", want: "my receipt.jpg"},
+		{name: "Leading dots", in: "..receipt.jpg", want: "receipt.jpg"},
+		{name: "Only an extension", in: ".jpg", want: "file.jpg"},
+		{name: "Empty", in: "", want: "file"},
+		{name: "Invalid extension", in: "archive.tar.gz!", want: "archive.tar.gz_"},
+		{name: "Long name", in: strings.Repeat("あ", 50) + ".jpg", want: strings.Repeat("あ", 33) + ".jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFileName(tt.in); got != tt.want {
+				t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
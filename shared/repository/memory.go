@@ -0,0 +1,261 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryURLScheme prefixes the URLs of objects held by a MemoryObjectStore
+const memoryURLScheme = "memory://"
+
+// memoryObject is an object held by a MemoryObjectStore
+type memoryObject struct {
+	content     []byte
+	contentType string
+	metadata    map[string]string
+	tags        map[string]string
+	modified    time.Time
+}
+
+// MemoryObjectStore keeps objects in process memory, for tests and local runs
+// Its URLs only identify objects and cannot be fetched
+type MemoryObjectStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	keys    *KeyLayout
+}
+
+// NewMemoryObjectStore creates an empty in-memory object store
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{objects: make(map[string]memoryObject), keys: DefaultKeyLayout()}
+}
+
+// SetKeyLayout changes the keys of later uploads
+func (m *MemoryObjectStore) SetKeyLayout(layout *KeyLayout) {
+	m.keys = layout
+}
+
+// Upload stores a new file under a key built by the store's KeyLayout
+func (m *MemoryObjectStore) Upload(ctx context.Context, originalFileName string, fileContent []byte, contentType string, metadata map[string]string) (*FileInfo, error) {
+	return m.UploadStream(ctx, originalFileName, bytes.NewReader(fileContent), contentType, metadata)
+}
+
+// UploadStream stores a new file read from body under a key built by the store's KeyLayout
+func (m *MemoryObjectStore) UploadStream(ctx context.Context, originalFileName string, body io.Reader, contentType string, metadata map[string]string) (*FileInfo, error) {
+	hashing := newHashingReader(body)
+	content, err := io.ReadAll(hashing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	uniqueFileName, uploadDate, key := newUploadKey(m.keys, originalFileName, metadata)
+	m.store(key, content, contentType, metadata)
+
+	fileInfo := &FileInfo{
+		OriginalName: originalFileName,
+		FileName:     uniqueFileName,
+		BucketName:   "memory",
+		Key:          key,
+		ContentType:  contentType,
+		URL:          memoryURLScheme + key,
+		UploadDate:   uploadDate,
+		Metadata:     metadata,
+	}
+	hashing.fill(fileInfo)
+	return fileInfo, nil
+}
+
+// Put stores content under an exact key, replacing any existing object
+func (m *MemoryObjectStore) Put(ctx context.Context, key string, content []byte, contentType string) error {
+	m.store(key, content, contentType, nil)
+	return nil
+}
+
+// store copies content into the store so callers may reuse their buffers
+func (m *MemoryObjectStore) store(key string, content []byte, contentType string, metadata map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{
+		content:     append([]byte(nil), content...),
+		contentType: contentType,
+		metadata:    copyMetadata(metadata),
+		modified:    time.Now(),
+	}
+}
+
+// Get returns the content of an object
+// Returns ErrObjectNotFound when the key does not exist
+func (m *MemoryObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return append([]byte(nil), object.content...), nil
+}
+
+// GetVersion returns the content of an object with its ETag
+// Returns ErrObjectNotFound when the key does not exist
+func (m *MemoryObjectStore) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, "", ErrObjectNotFound
+	}
+	return append([]byte(nil), object.content...), contentETag(object.content), nil
+}
+
+// PutIfMatch stores content under an exact key while the object still has etag,
+// or with an empty etag while no object exists
+func (m *MemoryObjectStore) PutIfMatch(ctx context.Context, key string, content []byte, contentType, etag string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[key]
+	if ok != (etag != "") || (ok && contentETag(object.content) != etag) {
+		return "", fmt.Errorf("%w: %s", ErrPreconditionFailed, key)
+	}
+	m.objects[key] = memoryObject{
+		content:     append([]byte(nil), content...),
+		contentType: contentType,
+		modified:    time.Now(),
+	}
+	return contentETag(content), nil
+}
+
+// Head describes an object
+// Returns ErrObjectNotFound when the key does not exist
+func (m *MemoryObjectStore) Head(ctx context.Context, key string) (*FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	fileInfo := newStoredFileInfo("memory", key, int64(len(object.content)), object.contentType, memoryURLScheme+key, copyMetadata(object.metadata))
+	fileInfo.UploadDate = m.keys.Date(object.modified)
+	return fileInfo, nil
+}
+
+// List returns the keys of all objects under prefix, in lexical order like S3
+func (m *MemoryObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ListAfter returns up to limit keys under prefix that sort after startAfter
+func (m *MemoryObjectStore) ListAfter(ctx context.Context, prefix, startAfter string, limit int) ([]string, error) {
+	keys, err := m.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return keysAfter(keys, startAfter, limit), nil
+}
+
+// Delete removes an object; deleting a missing key is not an error
+func (m *MemoryObjectStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// Presign returns the object's memory:// URL; it does not expire
+func (m *MemoryObjectStore) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.objects[key]; !ok {
+		return "", ErrObjectNotFound
+	}
+	return memoryURLScheme + key, nil
+}
+
+// SetMetadata replaces the user-defined metadata of an existing object
+func (m *MemoryObjectStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	object.metadata = copyMetadata(metadata)
+	object.modified = time.Now()
+	m.objects[key] = object
+	return nil
+}
+
+// GetTags returns the tags of an existing object
+func (m *MemoryObjectStore) GetTags(ctx context.Context, key string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	tags := make(map[string]string, len(object.tags))
+	for k, v := range object.tags {
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// SetTags replaces the tags of an existing object
+func (m *MemoryObjectStore) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	cleaned, err := cleanTags(tags)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	object.tags = cleaned
+	m.objects[key] = object
+	return nil
+}
+
+// KeyForURL returns the key of an object from its memory:// URL
+func (m *MemoryObjectStore) KeyForURL(objectURL string) (string, bool) {
+	if !strings.HasPrefix(objectURL, memoryURLScheme) || len(objectURL) == len(memoryURLScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(objectURL, memoryURLScheme), true
+}
+
+// Relocate moves an uploaded file to the key built from values
+func (m *MemoryObjectStore) Relocate(ctx context.Context, fileInfo *FileInfo, values, metadata map[string]string) (*FileInfo, error) {
+	key := relocationKey(m.keys, fileInfo, values)
+	if key == "" {
+		return fileInfo, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[fileInfo.Key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	if metadata != nil {
+		object.metadata = copyMetadata(metadata)
+	}
+	m.objects[key] = object
+	delete(m.objects, fileInfo.Key)
+	return relocatedFileInfo(fileInfo, key, memoryURLScheme+key, metadata), nil
+}
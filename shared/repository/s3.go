@@ -1,19 +1,29 @@
 package repository
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"path/filepath"
+	"io"
+	"net/url"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
+// ErrObjectNotFound is returned when an S3 object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrPreconditionFailed is returned by PutIfMatch when the object changed since it was read
+var ErrPreconditionFailed = errors.New("object changed since it was read")
+
 // FileInfo contains information about an uploaded file
 type FileInfo struct {
 	OriginalName string `json:"original_name"`
@@ -22,8 +32,13 @@ type FileInfo struct {
 	Key          string `json:"key"`
 	Size         int64  `json:"size"`
 	ContentType  string `json:"content_type"`
-	URL          string `json:"url"`
+	URL          string `json:"url"` // Public object URL; only reachable when the bucket is public
 	UploadDate   string `json:"upload_date"`
+	ETag         string `json:"etag,omitempty"`     // Entity tag of the stored object, without quotes
+	Checksum     string `json:"checksum,omitempty"` // Verified checksum as "<algorithm>:<base64>"; multipart objects end in "-<parts>"
+
+	// User-defined object metadata (x-amz-meta-*), with lowercase keys
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // S3Repository handles S3 operations
@@ -31,122 +46,363 @@ type S3Repository struct {
 	client     *s3.Client
 	bucketName string
 	region     string
+
+	bucketReady atomic.Bool // The bucket was found or created; later checks are skipped
+
+	partSize          int64  // Part size of multipart uploads
+	checksumAlgorithm string // Checksum verified on upload
+
+	keys *KeyLayout // Keys of uploaded files
 }
 
 // NewS3Repository creates a new S3 repository
 func NewS3Repository(client *s3.Client, bucketName, region string) *S3Repository {
 	return &S3Repository{
-		client:     client,
-		bucketName: bucketName,
-		region:     region,
+		client:            client,
+		bucketName:        bucketName,
+		region:            region,
+		partSize:          DefaultUploadPartSize,
+		checksumAlgorithm: ChecksumSHA256,
+		keys:              DefaultKeyLayout(),
 	}
 }
 
-// EnsureBucketExists creates the S3 bucket if it doesn't exist
-func (r *S3Repository) EnsureBucketExists(ctx context.Context) error {
-	// Check if bucket exists
-	_, err := r.client.HeadBucket(ctx, &s3.HeadBucketInput{
+// SetKeyLayout changes the keys of later uploads
+func (r *S3Repository) SetKeyLayout(layout *KeyLayout) {
+	r.keys = layout
+}
+
+// Upload uploads a file to S3 under a key built by the repository's KeyLayout
+// metadata is stored as user-defined object metadata and may be nil
+// The bucket must already exist; see EnsureBucketExists and ProvisionBucket
+func (r *S3Repository) Upload(ctx context.Context, originalFileName string, fileContent []byte, contentType string, metadata map[string]string) (*FileInfo, error) {
+	return r.UploadStream(ctx, originalFileName, bytes.NewReader(fileContent), contentType, metadata)
+}
+
+// Head describes an existing object, e.g. one placed in the bucket by another client
+// Returns ErrObjectNotFound when the key does not exist
+func (r *S3Repository) Head(ctx context.Context, key string) (*FileInfo, error) {
+	output, err := r.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(key),
 	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to stat %s in S3: %w", key, err)
+	}
 
-	if err == nil {
-		return nil
+	fileInfo := newStoredFileInfo(r.bucketName, key, aws.ToInt64(output.ContentLength), aws.ToString(output.ContentType), r.objectURL(key), decodeMetadata(output.Metadata))
+	fileInfo.ETag = strings.Trim(aws.ToString(output.ETag), `"`)
+	if output.LastModified != nil {
+		fileInfo.UploadDate = r.keys.Date(*output.LastModified)
 	}
+	return fileInfo, nil
+}
 
-	// Create bucket
-	_, err = r.client.CreateBucket(ctx, &s3.CreateBucketInput{
-		Bucket: aws.String(r.bucketName),
-		CreateBucketConfiguration: &types.CreateBucketConfiguration{
-			LocationConstraint: types.BucketLocationConstraint(r.region),
-		},
-	})
+// SetMetadata replaces the user-defined metadata of an existing object
+// S3 metadata cannot be edited in place, so the object is copied onto itself;
+// this fires another ObjectCreated event for the key
+func (r *S3Repository) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	fileInfo, err := r.Head(ctx, key)
+	if err != nil {
+		return err
+	}
 
+	_, err = r.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(r.bucketName),
+		Key:               aws.String(key),
+		CopySource:        aws.String(r.copySource(key)),
+		ContentType:       aws.String(fileInfo.ContentType),
+		Metadata:          encodeMetadata(metadata),
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create bucket: %w", err)
+		return fmt.Errorf("failed to set metadata of %s in S3: %w", key, err)
 	}
+	return nil
+}
 
-	// Wait for bucket to be created
-	waiter := s3.NewBucketExistsWaiter(r.client)
-	err = waiter.Wait(ctx, &s3.HeadBucketInput{
+// GetTags returns the tags of an existing object
+// Returns ErrObjectNotFound when the key does not exist
+func (r *S3Repository) GetTags(ctx context.Context, key string) (map[string]string, error) {
+	output, err := r.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
 		Bucket: aws.String(r.bucketName),
-	}, 30*time.Second)
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get tags of %s from S3: %w", key, err)
+	}
+
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
 
+// SetTags replaces the tags of an existing object
+// Unlike SetMetadata, the object is not copied, so no ObjectCreated event fires;
+// lifecycle rules and S3 Inventory can filter on the tags
+func (r *S3Repository) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	cleaned, err := cleanTags(tags)
 	if err != nil {
-		return fmt.Errorf("failed to wait for bucket creation: %w", err)
+		return err
+	}
+	keys := make([]string, 0, len(cleaned))
+	for k := range cleaned {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
+	tagSet := make([]types.Tag, 0, len(keys))
+	for _, k := range keys {
+		tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(cleaned[k])})
+	}
+	_, err = r.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(r.bucketName),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: tagSet},
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("failed to set tags of %s in S3: %w", key, err)
+	}
 	return nil
 }
 
-// Upload uploads a file to S3 with JST date folder structure
-func (r *S3Repository) Upload(ctx context.Context, originalFileName string, fileContent []byte, contentType string) (*FileInfo, error) {
-	// Ensure bucket exists
-	if err := r.EnsureBucketExists(ctx); err != nil {
-		return nil, fmt.Errorf("failed to ensure bucket exists: %w", err)
+// Relocate moves an uploaded file to the key built from values
+// S3 cannot rename objects, so the object is copied, with metadata replacing its
+// metadata when not nil, and the original deleted; the copy is checksummed again and
+// may get a different ETag and checksum
+func (r *S3Repository) Relocate(ctx context.Context, fileInfo *FileInfo, values, metadata map[string]string) (*FileInfo, error) {
+	key := relocationKey(r.keys, fileInfo, values)
+	if key == "" {
+		return fileInfo, nil
 	}
 
-	// Generate unique filename
-	uniqueFileName := generateUniqueFileName(originalFileName)
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(r.bucketName),
+		Key:               aws.String(key),
+		CopySource:        aws.String(r.copySource(fileInfo.Key)),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		ChecksumAlgorithm: types.ChecksumAlgorithm(r.checksumAlgorithm),
+	}
+	if metadata != nil {
+		// Replacing metadata also replaces the content type, so it is sent again
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.Metadata = encodeMetadata(metadata)
+		input.ContentType = aws.String(fileInfo.ContentType)
+	}
+	output, err := r.client.CopyObject(ctx, input)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to copy %s to %s in S3: %w", fileInfo.Key, key, err)
+	}
+	if err := r.Delete(ctx, fileInfo.Key); err != nil {
+		return nil, err
+	}
 
-	// Create key with JST date folder
-	dateFolder := getJSTDateFolder()
-	key := fmt.Sprintf("%s/%s", dateFolder, uniqueFileName)
+	relocated := relocatedFileInfo(fileInfo, key, r.objectURL(key), metadata)
+	if result := output.CopyObjectResult; result != nil {
+		relocated.ETag = strings.Trim(aws.ToString(result.ETag), `"`)
+		if checksum := r.storedChecksum(result.ChecksumSHA256, result.ChecksumCRC32C); checksum != "" {
+			relocated.Checksum = formatChecksum(r.checksumAlgorithm, checksum)
+		}
+	}
+	return relocated, nil
+}
 
-	// Upload file to S3
-	_, err := r.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(r.bucketName),
-		Key:         aws.String(key),
-		Body:        strings.NewReader(string(fileContent)),
-		ContentType: aws.String(contentType),
+// Get downloads the content of an object
+// Returns ErrObjectNotFound when the key does not exist
+func (r *S3Repository) Get(ctx context.Context, key string) ([]byte, error) {
+	output, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(key),
 	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get %s from S3: %w", key, err)
+	}
+	defer output.Body.Close()
 
+	content, err := io.ReadAll(output.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload file to S3: %w", err)
+		return nil, fmt.Errorf("failed to read %s from S3: %w", key, err)
 	}
+	return content, nil
+}
 
-	// Construct file URL
-	fileURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", r.bucketName, r.region, key)
+// GetVersion downloads the content of an object with its ETag
+// Returns ErrObjectNotFound when the key does not exist
+func (r *S3Repository) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	output, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, "", ErrObjectNotFound
+		}
+		return nil, "", fmt.Errorf("failed to get %s from S3: %w", key, err)
+	}
+	defer output.Body.Close()
 
-	fileInfo := &FileInfo{
-		OriginalName: originalFileName,
-		FileName:     uniqueFileName,
-		BucketName:   r.bucketName,
-		Key:          key,
-		Size:         int64(len(fileContent)),
-		ContentType:  contentType,
-		URL:          fileURL,
-		UploadDate:   dateFolder,
+	content, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s from S3: %w", key, err)
 	}
+	return content, strings.Trim(aws.ToString(output.ETag), `"`), nil
+}
 
-	return fileInfo, nil
+// PutIfMatch stores content under an exact key with an S3 conditional write: If-Match
+// on etag, or If-None-Match when etag is empty
+func (r *S3Repository) PutIfMatch(ctx context.Context, key string, content []byte, contentType, etag string) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String(contentType),
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(`"` + etag + `"`)
+	}
+	output, err := r.client.PutObject(ctx, input)
+	if err != nil {
+		// 412 when the condition does not hold, 409 when a concurrent conditional write
+		// won, 404 when the object was deleted since it was read
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "PreconditionFailed", "ConditionalRequestConflict", "NoSuchKey":
+				return "", fmt.Errorf("%w: %s", ErrPreconditionFailed, key)
+			}
+		}
+		return "", fmt.Errorf("failed to put %s to S3: %w", key, err)
+	}
+	return strings.Trim(aws.ToString(output.ETag), `"`), nil
+}
+
+// Put stores content under an exact key, replacing any existing object
+func (r *S3Repository) Put(ctx context.Context, key string, content []byte, contentType string) error {
+	_, err := r.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put %s to S3: %w", key, err)
+	}
+	return nil
 }
 
-// getJSTDateFolder returns the current date in JST as YYYY-MM-DD format
-func getJSTDateFolder() string {
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
-	return now.Format("2006-01-02")
+// List returns the keys of all objects under prefix
+func (r *S3Repository) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(r.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in S3: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
 }
 
-// generateUniqueFileName creates a unique filename with JST timestamp and random suffix
-func generateUniqueFileName(originalName string) string {
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
+// ListAfter returns up to limit keys under prefix after startAfter, following
+// ListObjectsV2 continuation tokens until limit keys are read
+func (r *S3Repository) ListAfter(ctx context.Context, prefix, startAfter string, limit int) ([]string, error) {
+	var keys []string
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(r.bucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(int32(min(limit, 1000))),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	paginator := s3.NewListObjectsV2Paginator(r.client, input)
+	for paginator.HasMorePages() && len(keys) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in S3: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys[:min(len(keys), limit)], nil
+}
 
-	// Extract file extension and base name
-	ext := filepath.Ext(originalName)
-	baseName := strings.TrimSuffix(originalName, ext)
+// Delete removes an object; deleting a missing key is not an error
+func (r *S3Repository) Delete(ctx context.Context, key string) error {
+	_, err := r.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %w", key, err)
+	}
+	return nil
+}
 
-	// Generate random suffix (4 bytes = 8 hex characters)
-	randomBytes := make([]byte, 4)
-	rand.Read(randomBytes)
-	randomSuffix := hex.EncodeToString(randomBytes)
+// Presign returns a URL granting read access to an object for expiry
+// The URL stops working earlier if the signing credentials expire first
+func (r *S3Repository) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	request, err := s3.NewPresignClient(r.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucketName),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", key, err)
+	}
+	return request.URL, nil
+}
 
-	// Create timestamp in JST: YYYYMMDD_HHMMSS
-	timestamp := now.Format("20060102_150405")
+// KeyForURL returns the key of an object from its HTTPS URL, as returned by Upload
+func (r *S3Repository) KeyForURL(objectURL string) (string, bool) {
+	prefix := r.objectURL("")
+	if !strings.HasPrefix(objectURL, prefix) || len(objectURL) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(objectURL, prefix), true
+}
 
-	// Combine: basename_timestamp_random.ext
-	uniqueName := fmt.Sprintf("%s_%s_%s%s", baseName, timestamp, randomSuffix, ext)
+// copySource returns the CopySource of an object: "bucket/key", URL-encoded segment by segment
+func (r *S3Repository) copySource(key string) string {
+	segments := strings.Split(r.bucketName+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
 
-	return uniqueName
+// objectURL returns the HTTPS URL of an object
+func (r *S3Repository) objectURL(key string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", r.bucketName, r.region, key)
 }
@@ -1,93 +1,218 @@
 package repository
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func TestGetJSTDateFolder(t *testing.T) {
-	result := getJSTDateFolder()
+// newTestS3Repository returns a repository backed by an in-memory fake of the S3 object API
+func newTestS3Repository(t *testing.T) *S3Repository {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			current, exists := objects[r.URL.Path]
+			ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+			if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || ifMatch != `"`+contentETag(current)+`"`)) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code><Message>condition not met</Message></Error>`)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+			w.Header().Set("ETag", `"`+contentETag(body)+`"`)
+		case http.MethodGet:
+			if r.URL.Query().Get("list-type") == "2" {
+				listObjects(w, r, objects)
+				return
+			}
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`)
+				return
+			}
+			w.Header().Set("ETag", `"`+contentETag(body)+`"`)
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(server.Close)
 
-	// Should be in format YYYY-MM-DD
-	if len(result) != 10 {
-		t.Errorf("Expected date format YYYY-MM-DD, got %s", result)
+	client := s3.New(s3.Options{
+		Region:       "ap-northeast-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	return NewS3Repository(client, "test-bucket", "ap-northeast-1")
+}
+
+// listObjects answers a ListObjectsV2 request of the fake, two keys per page so
+// callers must follow continuation tokens
+func listObjects(w http.ResponseWriter, r *http.Request, objects map[string][]byte) {
+	query := r.URL.Query()
+	bucket := strings.TrimSuffix(r.URL.Path, "/") + "/"
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
 	}
+	var keys []string
+	for path := range objects {
+		key := strings.TrimPrefix(path, bucket)
+		if strings.HasPrefix(key, query.Get("prefix")) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
 
-	// Should contain hyphens at correct positions
-	if result[4] != '-' || result[7] != '-' {
-		t.Errorf("Expected date format YYYY-MM-DD, got %s", result)
+	fmt.Fprint(w, `<ListBucketResult>`)
+	for i, key := range keys {
+		if i == 2 {
+			fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>`, keys[i-1])
+			break
+		}
+		fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, key)
 	}
+	fmt.Fprint(w, `</ListBucketResult>`)
 }
 
-func TestGenerateUniqueFileName(t *testing.T) {
-	tests := []struct {
-		name         string
-		originalName string
-		wantContains []string
-	}{
-		{
-			name:         "Simple filename with extension",
-			originalName: "receipt.jpg",
-			wantContains: []string{"receipt_", ".jpg"},
-		},
-		{
-			name:         "Filename without extension",
-			originalName: "receipt",
-			wantContains: []string{"receipt_"},
-		},
-		{
-			name:         "Filename with multiple dots",
-			originalName: "my.receipt.image.png",
-			wantContains: []string{"my.receipt.image_", ".png"},
-		},
-		{
-			name:         "Filename with spaces",
-			originalName: "my receipt.jpg",
-			wantContains: []string{"my receipt_", ".jpg"},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := generateUniqueFileName(tt.originalName)
-
-			for _, want := range tt.wantContains {
-				if !contains(result, want) {
-					t.Errorf("generateUniqueFileName() = %v, should contain %v", result, want)
-				}
-			}
+func TestS3RepositoryJSON(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestS3Repository(t)
 
-			// Should have timestamp (8 digits + underscore + 6 digits)
-			// Format: basename_YYYYMMDD_HHMMSS_randomhex.ext
-			if len(result) < 20 {
-				t.Errorf("Generated filename too short: %s", result)
-			}
-		})
+	type record struct {
+		Store string  `json:"store"`
+		Total float64 `json:"total"`
+	}
+
+	if err := PutJSON(ctx, repo, "2024-10-18/receipt.jpg.json", record{Store: "Cafe", Total: 450}); err != nil {
+		t.Fatalf("PutJSON() error = %v", err)
+	}
+
+	var got record
+	if err := GetJSON(ctx, repo, "2024-10-18/receipt.jpg.json", &got); err != nil {
+		t.Fatalf("GetJSON() error = %v", err)
 	}
+	if got.Store != "Cafe" || got.Total != 450 {
+		t.Errorf("GetJSON() = %+v", got)
+	}
+
+	if err := GetJSON(ctx, repo, "missing.json", &got); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestS3RepositoryListAfter(t *testing.T) {
+	testListAfter(t, newTestS3Repository(t))
 }
 
-func TestGenerateUniqueFileName_Uniqueness(t *testing.T) {
-	// Generate multiple filenames in quick succession
-	names := make(map[string]bool)
-	for i := 0; i < 100; i++ {
-		name := generateUniqueFileName("test.jpg")
-		if names[name] {
-			t.Errorf("Generated duplicate filename: %s", name)
+func TestS3RepositoryPutIfMatch(t *testing.T) {
+	testPutIfMatch(t, newTestS3Repository(t))
+}
+
+// testCredentials signs requests with fixed keys
+type testCredentials struct{}
+
+func (testCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+}
+
+func TestS3RepositoryPresign(t *testing.T) {
+	client := s3.New(s3.Options{Region: "ap-northeast-1", Credentials: testCredentials{}})
+	repo := NewS3Repository(client, "receipts", "ap-northeast-1")
+
+	url, err := repo.Presign(context.Background(), "2024-10-18/receipt.jpg", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Presign() error = %v", err)
+	}
+	for _, want := range []string{"receipts", "2024-10-18/receipt.jpg", "X-Amz-Expires=300", "X-Amz-Signature="} {
+		if !strings.Contains(url, want) {
+			t.Errorf("Expected %q in presigned URL %s", want, url)
 		}
-		names[name] = true
-		time.Sleep(time.Millisecond)
 	}
 }
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && hasSubstring(s, substr))
+func TestS3RepositoryKeyForURL(t *testing.T) {
+	repo := NewS3Repository(nil, "receipts", "ap-northeast-1")
+
+	key, ok := repo.KeyForURL(repo.objectURL("2024-10-18/receipt.jpg"))
+	if !ok || key != "2024-10-18/receipt.jpg" {
+		t.Errorf("KeyForURL() = %q, %v", key, ok)
+	}
+	for _, url := range []string{"https://example.com/receipt.jpg", repo.objectURL(""), "2024-10-18/receipt.jpg"} {
+		if _, ok := repo.KeyForURL(url); ok {
+			t.Errorf("Expected KeyForURL(%q) to fail", url)
+		}
+	}
 }
 
-func hasSubstring(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+func TestS3RepositoryRelocate(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Method == http.MethodPut {
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"copied"</ETag><ChecksumSHA256>c2hh</ChecksumSHA256></CopyObjectResult>`)
+			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := s3.New(s3.Options{
+		Region:       "ap-northeast-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	repo := NewS3Repository(client, "test-bucket", "ap-northeast-1")
+	layout, err := NewKeyLayout("{receipt_year}/{category}/{rand}{ext}", "")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+	repo.SetKeyLayout(layout)
+
+	uploaded := &FileInfo{OriginalName: "receipt.jpg", Key: "2024/unknown/1a2b3c4d.jpg", ContentType: "image/jpeg"}
+	relocated, err := repo.Relocate(context.Background(), uploaded,
+		map[string]string{"receipt_date": "2023-12-31", "category": "food"},
+		map[string]string{"receipt-category": "식비"})
+	if err != nil {
+		t.Fatalf("Relocate() error = %v", err)
+	}
+
+	if len(requests) != 2 || requests[0].Method != http.MethodPut || requests[1].Method != http.MethodDelete {
+		t.Fatalf("Expected one copy and one delete, got %d requests", len(requests))
+	}
+	copyRequest := requests[0]
+	if !strings.HasPrefix(copyRequest.URL.Path, "/test-bucket/2023/food/") || copyRequest.Header.Get("X-Amz-Copy-Source") != "test-bucket/2024/unknown/1a2b3c4d.jpg" {
+		t.Errorf("Copy request %s from %s", copyRequest.URL.Path, copyRequest.Header.Get("X-Amz-Copy-Source"))
+	}
+	if copyRequest.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" || copyRequest.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Copy request headers %v", copyRequest.Header)
+	}
+	if got := decodeMetadata(map[string]string{"c": copyRequest.Header.Get("X-Amz-Meta-Receipt-Category")})["c"]; got != "식비" {
+		t.Errorf("Copied metadata receipt-category = %q", got)
+	}
+	if requests[1].URL.Path != "/test-bucket/2024/unknown/1a2b3c4d.jpg" {
+		t.Errorf("Deleted %s", requests[1].URL.Path)
+	}
+	if relocated.ETag != "copied" || relocated.Checksum != "SHA256:c2hh" || relocated.Metadata["receipt-category"] != "식비" {
+		t.Errorf("Relocate() = %+v", relocated)
 	}
-	return false
 }
@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Multipart upload part sizes
+const (
+	DefaultUploadPartSize = 8 << 20 // Part size of multipart uploads unless configured
+	MinUploadPartSize     = 5 << 20 // Smallest part S3 accepts, except for the last one
+)
+
+// UploadOptions tunes how S3Repository uploads files
+type UploadOptions struct {
+	// Files larger than this are sent as a multipart upload in parts of this size,
+	// one part at a time so that only one part is held in memory
+	// DefaultUploadPartSize when 0; at least MinUploadPartSize
+	PartSize int64
+	// Checksum sent with every request and verified by S3: ChecksumSHA256 (default) or ChecksumCRC32C
+	Checksum string
+}
+
+// SetUploadOptions changes the part size and checksum of later uploads
+func (r *S3Repository) SetUploadOptions(opts UploadOptions) error {
+	algorithm, err := normalizeChecksumAlgorithm(opts.Checksum)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.PartSize == 0:
+		opts.PartSize = DefaultUploadPartSize
+	case opts.PartSize < MinUploadPartSize:
+		return fmt.Errorf("upload part size %d is below the S3 minimum of %d bytes", opts.PartSize, MinUploadPartSize)
+	}
+	r.partSize = opts.PartSize
+	r.checksumAlgorithm = algorithm
+	return nil
+}
+
+// UploadStream uploads a file read from body under a key built by the repository's KeyLayout
+// The S3 transfer manager sends bodies larger than the part size as a multipart upload,
+// one part at a time so that only one part is held in memory, and aborts failed ones
+// Every request carries a checksum that S3 verifies; the object's checksum is returned
+// in FileInfo with the ETag
+// The bucket must already exist; see EnsureBucketExists and ProvisionBucket
+func (r *S3Repository) UploadStream(ctx context.Context, originalFileName string, body io.Reader, contentType string, metadata map[string]string) (*FileInfo, error) {
+	uniqueFileName, uploadDate, key := newUploadKey(r.keys, originalFileName, metadata)
+
+	uploader := manager.NewUploader(r.client, func(u *manager.Uploader) {
+		u.PartSize = r.partSize
+		u.Concurrency = 1
+	})
+	counted := &countingReader{reader: body}
+	output, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:            aws.String(r.bucketName),
+		Key:               aws.String(key),
+		Body:              counted,
+		ContentType:       aws.String(contentType),
+		Metadata:          encodeMetadata(metadata),
+		ChecksumAlgorithm: types.ChecksumAlgorithm(r.checksumAlgorithm),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file to S3: %w", err)
+	}
+
+	fileInfo := &FileInfo{
+		OriginalName: originalFileName,
+		FileName:     uniqueFileName,
+		BucketName:   r.bucketName,
+		Key:          key,
+		Size:         counted.size,
+		ContentType:  contentType,
+		URL:          r.objectURL(key),
+		UploadDate:   uploadDate,
+		ETag:         strings.Trim(aws.ToString(output.ETag), `"`),
+		Metadata:     metadata,
+	}
+	if checksum := r.storedChecksum(output.ChecksumSHA256, output.ChecksumCRC32C); checksum != "" {
+		fileInfo.Checksum = formatChecksum(r.checksumAlgorithm, checksum)
+	}
+	return fileInfo, nil
+}
+
+// countingReader counts the bytes read from an upload body of unknown size
+type countingReader struct {
+	reader io.Reader
+	size   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// storedChecksum returns the checksum S3 reported for the configured algorithm
+func (r *S3Repository) storedChecksum(sha256Value, crc32cValue *string) string {
+	if r.checksumAlgorithm == ChecksumCRC32C {
+		return aws.ToString(crc32cValue)
+	}
+	return aws.ToString(sha256Value)
+}
@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeMultipartS3 is a fake of the S3 object and multipart upload API that verifies
+// request checksums the way S3 does
+type fakeMultipartS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	parts    map[int][]byte
+	aborted  bool
+	rejectAt int // Part number answered with BadDigest; 0 accepts every part
+}
+
+func (f *fakeMultipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.parts = map[int][]byte{}
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		if partNumber == f.rejectAt || !verifyChecksum(w, r, body) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>BadDigest</Code><Message>checksum mismatch</Message></Error>`)
+			return
+		}
+		f.parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, partNumber))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []struct {
+				PartNumber     int
+				ChecksumSHA256 string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		var content []byte
+		composite := sha256.New()
+		for _, part := range complete.Parts {
+			content = append(content, f.parts[part.PartNumber]...)
+			digest, _ := base64.StdEncoding.DecodeString(part.ChecksumSHA256)
+			composite.Write(digest)
+		}
+		f.objects[r.URL.Path] = content
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"multipart-%d"</ETag><ChecksumSHA256>%s-%d</ChecksumSHA256></CompleteMultipartUploadResult>`,
+			len(complete.Parts), base64.StdEncoding.EncodeToString(composite.Sum(nil)), len(complete.Parts))
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		if !verifyChecksum(w, r, body) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>BadDigest</Code><Message>checksum mismatch</Message></Error>`)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	}
+}
+
+// verifyChecksum checks the body against the request's checksum header and echoes it
+func verifyChecksum(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if value := r.Header.Get("X-Amz-Checksum-Sha256"); value != "" {
+		sum := sha256.Sum256(body)
+		w.Header().Set("X-Amz-Checksum-Sha256", value)
+		return value == base64.StdEncoding.EncodeToString(sum[:])
+	}
+	if value := r.Header.Get("X-Amz-Checksum-Crc32c"); value != "" {
+		h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		h.Write(body)
+		w.Header().Set("X-Amz-Checksum-Crc32c", value)
+		return value == base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	return false
+}
+
+// newMultipartTestS3Repository returns a repository backed by a fakeMultipartS3
+func newMultipartTestS3Repository(t *testing.T) (*S3Repository, *fakeMultipartS3) {
+	t.Helper()
+	fake := &fakeMultipartS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "ap-northeast-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	return NewS3Repository(client, "test-bucket", "ap-northeast-1"), fake
+}
+
+func TestS3RepositoryUploadStream(t *testing.T) {
+	content := bytes.Repeat([]byte("receipt "), 5*MinUploadPartSize/2/8) // Two and a half minimum parts
+	sha := sha256.Sum256(content)
+	md5sum := md5.Sum(content)
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc.Write(content)
+
+	tests := []struct {
+		name         string
+		partSize     int64
+		checksum     string
+		wantETag     string
+		wantChecksum string
+	}{
+		{
+			name:         "single request with SHA-256",
+			partSize:     3 * MinUploadPartSize,
+			wantETag:     hex.EncodeToString(md5sum[:]),
+			wantChecksum: "SHA256:" + base64.StdEncoding.EncodeToString(sha[:]),
+		},
+		{
+			name:         "single request with CRC32C",
+			partSize:     3 * MinUploadPartSize,
+			checksum:     ChecksumCRC32C,
+			wantETag:     hex.EncodeToString(md5sum[:]),
+			wantChecksum: "CRC32C:" + base64.StdEncoding.EncodeToString(crc.Sum(nil)),
+		},
+		{
+			name:     "multipart",
+			partSize: MinUploadPartSize,
+			wantETag: "multipart-3",
+		},
+		{
+			name:     "multipart ending on a part boundary",
+			partSize: int64(len(content)) / 2,
+			wantETag: "multipart-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, fake := newMultipartTestS3Repository(t)
+			repo.partSize = tt.partSize
+			repo.checksumAlgorithm = ChecksumSHA256
+			if tt.checksum != "" {
+				repo.checksumAlgorithm = tt.checksum
+			}
+
+			// A plain reader, so the size is only known once it is drained
+			fileInfo, err := repo.UploadStream(context.Background(), "receipt.jpg", io.MultiReader(bytes.NewReader(content)), "image/jpeg", nil)
+			if err != nil {
+				t.Fatalf("UploadStream() error = %v", err)
+			}
+
+			if got := fake.objects["/test-bucket/"+fileInfo.Key]; !bytes.Equal(got, content) {
+				t.Errorf("Stored %d bytes, want the %d uploaded", len(got), len(content))
+			}
+			if fileInfo.Size != int64(len(content)) || fileInfo.ETag != tt.wantETag {
+				t.Errorf("UploadStream() size = %d, etag = %q, want %d, %q", fileInfo.Size, fileInfo.ETag, len(content), tt.wantETag)
+			}
+			if tt.wantChecksum != "" && fileInfo.Checksum != tt.wantChecksum {
+				t.Errorf("UploadStream() checksum = %q, want %q", fileInfo.Checksum, tt.wantChecksum)
+			}
+			if strings.HasPrefix(tt.wantETag, "multipart-") && !strings.HasSuffix(fileInfo.Checksum, strings.TrimPrefix(tt.wantETag, "multipart")) {
+				t.Errorf("UploadStream() checksum = %q, want a composite checksum", fileInfo.Checksum)
+			}
+		})
+	}
+}
+
+func TestS3RepositoryUploadStreamAbortsFailedMultipart(t *testing.T) {
+	repo, fake := newMultipartTestS3Repository(t)
+	repo.partSize = MinUploadPartSize
+	fake.rejectAt = 2
+
+	_, err := repo.UploadStream(context.Background(), "receipt.jpg", bytes.NewReader(make([]byte, 3*MinUploadPartSize)), "image/jpeg", nil)
+	if err == nil {
+		t.Fatal("Expected an error for a rejected part")
+	}
+	if !fake.aborted {
+		t.Error("Expected the multipart upload to be aborted")
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("Expected no stored object, got %v", fake.objects)
+	}
+}
+
+func TestS3RepositorySetUploadOptions(t *testing.T) {
+	repo := NewS3Repository(nil, "receipts", "ap-northeast-1")
+
+	if err := repo.SetUploadOptions(UploadOptions{Checksum: "crc32c"}); err != nil {
+		t.Fatalf("SetUploadOptions() error = %v", err)
+	}
+	if repo.checksumAlgorithm != ChecksumCRC32C || repo.partSize != DefaultUploadPartSize {
+		t.Errorf("SetUploadOptions() = %s, %d", repo.checksumAlgorithm, repo.partSize)
+	}
+	if err := repo.SetUploadOptions(UploadOptions{PartSize: 1 << 20}); err == nil {
+		t.Error("Expected an error for a part size below the S3 minimum")
+	}
+	if err := repo.SetUploadOptions(UploadOptions{Checksum: "md5"}); err == nil {
+		t.Error("Expected an error for an unsupported checksum")
+	}
+}
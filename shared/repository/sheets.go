@@ -59,6 +59,15 @@ func NewSheetsRepository(ctx context.Context, config SheetsConfig) (*SheetsRepos
 	}, nil
 }
 
+// NewSheetsRepositoryWithService creates a repository using an existing Sheets client,
+// such as one pointed at a test server with option.WithEndpoint
+func NewSheetsRepositoryWithService(service *sheets.Service, spreadsheetID string) *SheetsRepository {
+	return &SheetsRepository{
+		service:       service,
+		spreadsheetID: spreadsheetID,
+	}
+}
+
 // AppendRow appends a row of values to the specified sheet
 // sheetName: the name of the sheet tab (e.g., "Sheet1")
 // values: the row data to append
@@ -189,6 +198,52 @@ func (r *SheetsRepository) ClearRange(ctx context.Context, rangeNotation string)
 	return nil
 }
 
+// DeleteRow removes a row from the specified sheet, shifting the rows below it up
+// row: 1-based row number as shown in the sheet
+func (r *SheetsRepository) DeleteRow(ctx context.Context, sheetName string, row int) error {
+	if row < 1 {
+		return fmt.Errorf("invalid row number: %d", row)
+	}
+
+	// Dimension ranges address sheets by ID rather than by name
+	spreadsheet, err := r.GetSpreadsheetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	var sheetID int64 = -1
+	for _, sheet := range spreadsheet.Sheets {
+		if sheet.Properties != nil && sheet.Properties.Title == sheetName {
+			sheetID = sheet.Properties.SheetId
+			break
+		}
+	}
+	if sheetID < 0 {
+		return fmt.Errorf("sheet not found: %s", sheetName)
+	}
+
+	req := &sheets.Request{
+		DeleteDimension: &sheets.DeleteDimensionRequest{
+			Range: &sheets.DimensionRange{
+				SheetId:    sheetID,
+				Dimension:  "ROWS",
+				StartIndex: int64(row - 1),
+				EndIndex:   int64(row),
+			},
+		},
+	}
+
+	_, err = r.service.Spreadsheets.BatchUpdate(
+		r.spreadsheetID,
+		&sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{req}},
+	).Context(ctx).Do()
+
+	if err != nil {
+		return fmt.Errorf("failed to delete row: %w", err)
+	}
+
+	return nil
+}
+
 // Helper function to parse service account JSON from string
 func ParseServiceAccountJSON(jsonString string) ([]byte, error) {
 	// Validate it's valid JSON
@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ObjectStore stores receipt images and the JSON records kept next to them
+// S3Repository is the production implementation; MemoryObjectStore and
+// FileObjectStore run the receipt processor without AWS
+type ObjectStore interface {
+	// Upload stores a new file under a key built by the store's KeyLayout
+	Upload(ctx context.Context, originalFileName string, fileContent []byte, contentType string, metadata map[string]string) (*FileInfo, error)
+	// UploadStream stores a new file read from body, holding at most one part of it in memory
+	UploadStream(ctx context.Context, originalFileName string, body io.Reader, contentType string, metadata map[string]string) (*FileInfo, error)
+	// Put stores content under an exact key, replacing any existing object
+	Put(ctx context.Context, key string, content []byte, contentType string) error
+	// PutIfMatch stores content under an exact key only while the object still has the
+	// ETag GetVersion returned, or with an empty etag only when no object exists yet
+	// It returns the new ETag, or ErrPreconditionFailed when another writer got there first
+	PutIfMatch(ctx context.Context, key string, content []byte, contentType, etag string) (string, error)
+	// Get returns the content of an object, or ErrObjectNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// GetVersion returns the content of an object with its ETag, or ErrObjectNotFound
+	GetVersion(ctx context.Context, key string) ([]byte, string, error)
+	// Head describes an object without reading it, or returns ErrObjectNotFound
+	Head(ctx context.Context, key string) (*FileInfo, error)
+	// List returns the keys of all objects under prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// ListAfter returns up to limit keys under prefix that sort after startAfter, in
+	// lexical order; fewer than limit keys means the listing is complete
+	ListAfter(ctx context.Context, prefix, startAfter string, limit int) ([]string, error)
+	// Delete removes an object; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Presign returns a URL granting read access to an object for expiry
+	Presign(ctx context.Context, key string, expiry time.Duration) (string, error)
+	// SetMetadata replaces the user-defined metadata of an existing object
+	SetMetadata(ctx context.Context, key string, metadata map[string]string) error
+	// GetTags returns the tags of an existing object, or ErrObjectNotFound
+	GetTags(ctx context.Context, key string) (map[string]string, error)
+	// SetTags replaces the tags of an existing object, at most MaxObjectTags
+	// Values are cleaned of characters S3 does not accept in tags
+	SetTags(ctx context.Context, key string, tags map[string]string) error
+	// KeyForURL returns the key of an object from the URL reported in its FileInfo
+	KeyForURL(objectURL string) (string, bool)
+	// Relocate moves an uploaded file to the key its KeyLayout builds from values, such as
+	// those of the extracted receipt, and returns its new FileInfo
+	// A non-nil metadata replaces the object's metadata in the same move
+	// fileInfo is returned unchanged when the layout does not use receipt values
+	Relocate(ctx context.Context, fileInfo *FileInfo, values, metadata map[string]string) (*FileInfo, error)
+}
+
+// Compile-time checks that the backends implement ObjectStore
+var (
+	_ ObjectStore = (*S3Repository)(nil)
+	_ ObjectStore = (*MemoryObjectStore)(nil)
+	_ ObjectStore = (*FileObjectStore)(nil)
+)
+
+// PutJSON stores value encoded as JSON under key
+func PutJSON(ctx context.Context, store ObjectStore, key string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+	return store.Put(ctx, key, content, "application/json")
+}
+
+// GetJSON decodes the JSON object stored under key into value
+// Returns ErrObjectNotFound when the key does not exist
+func GetJSON(ctx context.Context, store ObjectStore, key string, value interface{}) error {
+	content, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetJSONVersion is GetJSON returning the object's ETag, for PutJSONIfMatch
+func GetJSONVersion(ctx context.Context, store ObjectStore, key string, value interface{}) (string, error) {
+	content, etag, err := store.GetVersion(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(content, value); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return etag, nil
+}
+
+// PutJSONIfMatch stores value encoded as JSON under key on the conditions of
+// ObjectStore.PutIfMatch and returns the new ETag
+func PutJSONIfMatch(ctx context.Context, store ObjectStore, key string, value interface{}, etag string) (string, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+	return store.PutIfMatch(ctx, key, content, "application/json", etag)
+}
+
+// keysAfter returns up to limit of the sorted keys that sort after startAfter
+func keysAfter(keys []string, startAfter string, limit int) []string {
+	start := sort.SearchStrings(keys, startAfter)
+	if start < len(keys) && keys[start] == startAfter {
+		start++
+	}
+	keys = keys[start:]
+	return keys[:min(len(keys), limit)]
+}
+
+// contentETag is the ETag the local stores give an object: the MD5 of its content,
+// like S3 for objects uploaded in one request
+func contentETag(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// newUploadKey returns the file name, upload date and key of a new upload under layout
+// The object's metadata fills placeholders such as {receipt_id}
+func newUploadKey(layout *KeyLayout, originalFileName string, metadata map[string]string) (string, string, string) {
+	now := time.Now()
+	key := layout.Key(originalFileName, now, metadata)
+	return path.Base(key), layout.Date(now), key
+}
+
+// relocationKey returns the key of an uploaded file under layout once values are known,
+// or "" when the layout does not use receipt values
+// values take precedence over the object's metadata
+func relocationKey(layout *KeyLayout, fileInfo *FileInfo, values map[string]string) string {
+	if !layout.UsesReceiptValues() {
+		return ""
+	}
+	merged := make(map[string]string, len(fileInfo.Metadata)+len(values))
+	for k, v := range fileInfo.Metadata {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return layout.Key(fileInfo.OriginalName, time.Now(), merged)
+}
+
+// relocatedFileInfo returns a copy of fileInfo describing the object at its new key,
+// with metadata when it is not nil
+func relocatedFileInfo(fileInfo *FileInfo, key, objectURL string, metadata map[string]string) *FileInfo {
+	relocated := *fileInfo
+	relocated.Key = key
+	relocated.FileName = path.Base(key)
+	relocated.URL = objectURL
+	if metadata != nil {
+		relocated.Metadata = copyMetadata(metadata)
+	}
+	return &relocated
+}
+
+// newStoredFileInfo describes an object found in a store rather than just uploaded
+// Its original name is unknown, so the key's base name stands in for it
+func newStoredFileInfo(bucketName, key string, size int64, contentType, objectURL string, metadata map[string]string) *FileInfo {
+	fileInfo := &FileInfo{
+		OriginalName: path.Base(key),
+		FileName:     path.Base(key),
+		BucketName:   bucketName,
+		Key:          key,
+		Size:         size,
+		ContentType:  contentType,
+		URL:          objectURL,
+	}
+	if len(metadata) > 0 {
+		fileInfo.Metadata = metadata
+	}
+	return fileInfo
+}
+
+// copyMetadata returns a copy of metadata with lowercase keys, or nil when empty
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[strings.ToLower(k)] = v
+	}
+	return copied
+}
@@ -0,0 +1,315 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store func(t *testing.T) ObjectStore
+	}{
+		{
+			name:  "memory",
+			store: func(t *testing.T) ObjectStore { return NewMemoryObjectStore() },
+		},
+		{
+			name: "local directory",
+			store: func(t *testing.T) ObjectStore {
+				store, err := NewFileObjectStore(t.TempDir())
+				if err != nil {
+					t.Fatalf("NewFileObjectStore() error = %v", err)
+				}
+				return store
+			},
+		},
+	}
+
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := tt.store(t)
+
+			fileInfo, err := store.Upload(ctx, "receipt.jpg", []byte("image"), "image/jpeg", map[string]string{"receipt-id": "abc"})
+			if err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			if !strings.HasPrefix(fileInfo.Key, fileInfo.UploadDate+"/receipt_") || fileInfo.Size != 5 {
+				t.Errorf("Upload() = %+v", fileInfo)
+			}
+			// MD5 and SHA-256 of "image"
+			if fileInfo.ETag != "78805a221a988e79ef3f42d7c5bfd418" || fileInfo.Checksum != "SHA256:YQXWzHavQAMl6U1YjOURvlv9u3O0N9xR7KQ5F9ekPj0=" {
+				t.Errorf("Upload() etag = %q, checksum = %q", fileInfo.ETag, fileInfo.Checksum)
+			}
+			if key, ok := store.KeyForURL(fileInfo.URL); !ok || key != fileInfo.Key {
+				t.Errorf("KeyForURL(%q) = %q, %v", fileInfo.URL, key, ok)
+			}
+
+			head, err := store.Head(ctx, fileInfo.Key)
+			if err != nil {
+				t.Fatalf("Head() error = %v", err)
+			}
+			if head.ContentType != "image/jpeg" || head.Size != 5 || head.Metadata["receipt-id"] != "abc" {
+				t.Errorf("Head() = %+v", head)
+			}
+
+			if err := store.SetMetadata(ctx, fileInfo.Key, map[string]string{"receipt-id": "def"}); err != nil {
+				t.Fatalf("SetMetadata() error = %v", err)
+			}
+			if head, _ := store.Head(ctx, fileInfo.Key); head.Metadata["receipt-id"] != "def" {
+				t.Errorf("Head() after SetMetadata() = %+v", head.Metadata)
+			}
+			if content, err := store.Get(ctx, fileInfo.Key); err != nil || string(content) != "image" {
+				t.Errorf("Get() after SetMetadata() = %q, %v", content, err)
+			}
+
+			if tags, err := store.GetTags(ctx, fileInfo.Key); err != nil || len(tags) != 0 {
+				t.Errorf("GetTags() of an untagged object = %v, %v", tags, err)
+			}
+			if err := store.SetTags(ctx, fileInfo.Key, map[string]string{"category": "문화/여가", "store": "Cafe & Bar"}); err != nil {
+				t.Fatalf("SetTags() error = %v", err)
+			}
+			if tags, err := store.GetTags(ctx, fileInfo.Key); err != nil || !reflect.DeepEqual(tags, map[string]string{"category": "문화/여가", "store": "Cafe _ Bar"}) {
+				t.Errorf("GetTags() = %v, %v", tags, err)
+			}
+			if head, _ := store.Head(ctx, fileInfo.Key); head.Metadata["receipt-id"] != "def" {
+				t.Errorf("Head() after SetTags() = %+v", head.Metadata)
+			}
+
+			type record struct {
+				Total int `json:"total"`
+			}
+			if err := PutJSON(ctx, store, fileInfo.Key+".json", record{Total: 450}); err != nil {
+				t.Fatalf("PutJSON() error = %v", err)
+			}
+			var got record
+			if err := GetJSON(ctx, store, fileInfo.Key+".json", &got); err != nil || got.Total != 450 {
+				t.Errorf("GetJSON() = %+v, %v", got, err)
+			}
+			if err := store.Put(ctx, "index/a.json", []byte("{}"), "application/json"); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+
+			streamed, err := store.UploadStream(ctx, "scan.pdf", strings.NewReader("document"), "application/pdf", nil)
+			if err != nil {
+				t.Fatalf("UploadStream() error = %v", err)
+			}
+			if content, _ := store.Get(ctx, streamed.Key); string(content) != "document" || streamed.Size != 8 {
+				t.Errorf("UploadStream() stored %q with size %d", content, streamed.Size)
+			}
+			if err := store.Delete(ctx, streamed.Key); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+
+			keys, err := store.List(ctx, fileInfo.UploadDate+"/")
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if want := []string{fileInfo.Key, fileInfo.Key + ".json"}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("List() = %v, want %v", keys, want)
+			}
+			if keys, _ := store.List(ctx, ""); len(keys) != 3 {
+				t.Errorf("List(\"\") = %v, want 3 keys", keys)
+			}
+
+			url, err := store.Presign(ctx, fileInfo.Key, time.Minute)
+			if err != nil || url == "" {
+				t.Errorf("Presign() = %q, %v", url, err)
+			}
+
+			if err := store.Delete(ctx, fileInfo.Key); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if err := store.Delete(ctx, fileInfo.Key); err != nil {
+				t.Errorf("Delete() of a missing key error = %v", err)
+			}
+			if _, err := store.Get(ctx, fileInfo.Key); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("Get() after Delete() error = %v, want ErrObjectNotFound", err)
+			}
+			if _, err := store.Head(ctx, fileInfo.Key); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("Head() after Delete() error = %v, want ErrObjectNotFound", err)
+			}
+			if err := store.SetMetadata(ctx, fileInfo.Key, nil); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("SetMetadata() after Delete() error = %v, want ErrObjectNotFound", err)
+			}
+			if err := store.SetTags(ctx, fileInfo.Key, nil); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("SetTags() after Delete() error = %v, want ErrObjectNotFound", err)
+			}
+			if _, err := store.GetTags(ctx, fileInfo.Key); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("GetTags() after Delete() error = %v, want ErrObjectNotFound", err)
+			}
+		})
+	}
+}
+
+func TestFileObjectStoreRejectsKeysOutsideRoot(t *testing.T) {
+	store, err := NewFileObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileObjectStore() error = %v", err)
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../escape", "a/../../escape", "a//b", ".meta/a.json", `a\b`} {
+		if err := store.Put(context.Background(), key, []byte("x"), "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+func TestObjectStoresRelocate(t *testing.T) {
+	layout, err := NewKeyLayout("{receipt_year}/{category}/{receipt_id}_{rand}{ext}", "")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+	memory := NewMemoryObjectStore()
+	memory.SetKeyLayout(layout)
+	files, err := NewFileObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileObjectStore() error = %v", err)
+	}
+	files.SetKeyLayout(layout)
+
+	for name, store := range map[string]ObjectStore{"memory": memory, "local directory": files} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			uploaded, err := store.Upload(ctx, "receipt.jpg", []byte("image"), "image/jpeg", map[string]string{"receipt-id": "abc"})
+			if err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			if !strings.Contains(uploaded.Key, "/unknown/abc_") {
+				t.Errorf("Upload() key = %q, want the category unknown until extraction", uploaded.Key)
+			}
+
+			metadata := map[string]string{"receipt-id": "abc", "receipt-category": "식비"}
+			relocated, err := store.Relocate(ctx, uploaded, map[string]string{"receipt_date": "2023-12-31", "category": "식비"}, metadata)
+			if err != nil {
+				t.Fatalf("Relocate() error = %v", err)
+			}
+			if !strings.HasPrefix(relocated.Key, "2023/식비/abc_") || !strings.HasSuffix(relocated.Key, ".jpg") {
+				t.Errorf("Relocate() key = %q", relocated.Key)
+			}
+			if key, ok := store.KeyForURL(relocated.URL); !ok || key != relocated.Key {
+				t.Errorf("Relocate() url = %q", relocated.URL)
+			}
+			if relocated.ETag != uploaded.ETag || relocated.OriginalName != "receipt.jpg" {
+				t.Errorf("Relocate() = %+v", relocated)
+			}
+
+			head, err := store.Head(ctx, relocated.Key)
+			if err != nil || head.ContentType != "image/jpeg" || !reflect.DeepEqual(head.Metadata, metadata) {
+				t.Errorf("Head() of the relocated file = %+v, %v", head, err)
+			}
+			if !reflect.DeepEqual(relocated.Metadata, metadata) {
+				t.Errorf("Relocate() metadata = %v, want %v", relocated.Metadata, metadata)
+			}
+			if _, err := store.Get(ctx, uploaded.Key); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("Get() of the uploaded key error = %v, want ErrObjectNotFound", err)
+			}
+			if _, err := store.Relocate(ctx, uploaded, nil, nil); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("Relocate() of a moved file error = %v, want ErrObjectNotFound", err)
+			}
+		})
+	}
+
+	// Layouts without receipt placeholders keep the uploaded key
+	store := NewMemoryObjectStore()
+	uploaded, _ := store.Upload(context.Background(), "receipt.jpg", []byte("image"), "image/jpeg", nil)
+	if relocated, err := store.Relocate(context.Background(), uploaded, map[string]string{"category": "식비"}, nil); err != nil || relocated.Key != uploaded.Key {
+		t.Errorf("Relocate() with the default layout = %+v, %v", relocated, err)
+	}
+}
+
+func TestObjectStoresPutIfMatch(t *testing.T) {
+	files, err := NewFileObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileObjectStore() error = %v", err)
+	}
+	for name, store := range map[string]ObjectStore{"memory": NewMemoryObjectStore(), "local directory": files} {
+		t.Run(name, func(t *testing.T) {
+			testPutIfMatch(t, store)
+		})
+	}
+}
+
+// testPutIfMatch checks that only the writer holding the current version wins
+func testPutIfMatch(t *testing.T, store ObjectStore) {
+	t.Helper()
+	ctx := context.Background()
+	key := "claims/key.json"
+
+	created, err := store.PutIfMatch(ctx, key, []byte(`{"n":1}`), "application/json", "")
+	if err != nil {
+		t.Fatalf("PutIfMatch() create error = %v", err)
+	}
+	if _, err := store.PutIfMatch(ctx, key, []byte(`{"n":2}`), "application/json", ""); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("PutIfMatch() second create error = %v, want ErrPreconditionFailed", err)
+	}
+
+	content, etag, err := store.GetVersion(ctx, key)
+	if err != nil || string(content) != `{"n":1}` || etag != created {
+		t.Fatalf("GetVersion() = %q, %q, %v, want the created version %q", content, etag, err, created)
+	}
+	replaced, err := store.PutIfMatch(ctx, key, []byte(`{"n":3}`), "application/json", etag)
+	if err != nil || replaced == etag {
+		t.Fatalf("PutIfMatch() replace = %q, %v", replaced, err)
+	}
+	if _, err := store.PutIfMatch(ctx, key, []byte(`{"n":4}`), "application/json", etag); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("PutIfMatch() stale version error = %v, want ErrPreconditionFailed", err)
+	}
+	if _, err := store.PutIfMatch(ctx, "claims/missing.json", []byte(`{}`), "application/json", etag); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("PutIfMatch() missing object error = %v, want ErrPreconditionFailed", err)
+	}
+	if content, err := store.Get(ctx, key); err != nil || string(content) != `{"n":3}` {
+		t.Errorf("Get() = %q, %v", content, err)
+	}
+	if _, _, err := store.GetVersion(ctx, "claims/missing.json"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("GetVersion() missing error = %v", err)
+	}
+}
+
+func TestObjectStoresListAfter(t *testing.T) {
+	files, err := NewFileObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileObjectStore() error = %v", err)
+	}
+	for name, store := range map[string]ObjectStore{"memory": NewMemoryObjectStore(), "local directory": files} {
+		t.Run(name, func(t *testing.T) {
+			testListAfter(t, store)
+		})
+	}
+}
+
+// testListAfter checks that pages of keys resume after the last key of the previous page
+func testListAfter(t *testing.T, store ObjectStore) {
+	t.Helper()
+	ctx := context.Background()
+	for _, key := range []string{"index/a.json", "index/b.json", "index/c.json", "index/d.json", "index/e.json", "other/f.json"} {
+		if err := store.Put(ctx, key, []byte("{}"), "application/json"); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		startAfter string
+		limit      int
+		want       []string
+	}{
+		{"", 3, []string{"index/a.json", "index/b.json", "index/c.json"}},
+		{"index/c.json", 3, []string{"index/d.json", "index/e.json"}},
+		{"index/bb", 1, []string{"index/c.json"}},
+		{"index/e.json", 3, nil},
+	}
+	for _, tt := range tests {
+		got, err := store.ListAfter(ctx, "index/", tt.startAfter, tt.limit)
+		if err != nil {
+			t.Fatalf("ListAfter(%q, %d) error = %v", tt.startAfter, tt.limit, err)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("ListAfter(%q, %d) = %v, want %v", tt.startAfter, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// S3 object tag limits
+const (
+	MaxObjectTags     = 10  // Tags per object
+	maxTagKeyLength   = 128 // Characters of a tag key
+	maxTagValueLength = 256 // Characters of a tag value
+)
+
+// cleanTags returns a copy of tags with values S3 accepts: characters other than letters,
+// numbers, spaces and + - = . _ : / @ become "_" and long values are shortened
+// Keys are kept as they are, so an invalid key or too many tags is an error
+func cleanTags(tags map[string]string) (map[string]string, error) {
+	if len(tags) > MaxObjectTags {
+		return nil, fmt.Errorf("%d tags exceed the limit of %d per object", len(tags), MaxObjectTags)
+	}
+	cleaned := make(map[string]string, len(tags))
+	for key, value := range tags {
+		if key == "" || utf8.RuneCountInString(key) > maxTagKeyLength || strings.HasPrefix(key, "aws:") || cleanTagValue(key) != key {
+			return nil, fmt.Errorf("invalid tag key %q", key)
+		}
+		value = cleanTagValue(value)
+		if utf8.RuneCountInString(value) > maxTagValueLength {
+			value = string([]rune(value)[:maxTagValueLength])
+		}
+		cleaned[key] = value
+	}
+	return cleaned, nil
+}
+
+// cleanTagValue replaces the characters S3 does not accept in tags
+func cleanTagValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || r == ' ' || strings.ContainsRune("+-=._:/@", r) {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// encodeMetadata returns metadata with non-ASCII values encoded as RFC 2047 words,
+// the form S3 expects in x-amz-meta-* headers
+func encodeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return metadata
+	}
+	encoded := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		encoded[k] = mime.QEncoding.Encode("utf-8", v)
+	}
+	return encoded
+}
+
+// decodeMetadata reverses encodeMetadata; values that are not valid RFC 2047 are kept as they are
+func decodeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return metadata
+	}
+	var decoder mime.WordDecoder
+	decoded := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if value, err := decoder.DecodeHeader(v); err == nil {
+			v = value
+		}
+		decoded[k] = v
+	}
+	return decoded
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCleanTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "Accepted characters",
+			tags: map[string]string{"category": "문화/여가", "total": "1100.5", "date": "2024-01-01", "model": "gpt-4o"},
+			want: map[string]string{"category": "문화/여가", "total": "1100.5", "date": "2024-01-01", "model": "gpt-4o"},
+		},
+		{
+			name: "Replaced characters",
+			tags: map[string]string{"store": "Cafe & Bar (Shibuya)"},
+			want: map[string]string{"store": "Cafe _ Bar _Shibuya_"},
+		},
+		{
+			name: "Long value",
+			tags: map[string]string{"store": strings.Repeat("店", 300)},
+			want: map[string]string{"store": strings.Repeat("店", 256)},
+		},
+		{name: "Empty key", tags: map[string]string{"": "x"}, wantErr: true},
+		{name: "Reserved key", tags: map[string]string{"aws:category": "x"}, wantErr: true},
+		{name: "Invalid key", tags: map[string]string{"category?": "x"}, wantErr: true},
+		{
+			name: "Too many tags",
+			tags: map[string]string{
+				"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6",
+				"g": "7", "h": "8", "i": "9", "j": "10", "k": "11",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanTags(tt.tags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cleanTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cleanTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	metadata := map[string]string{
+		"receipt-id":       "0190a5f2-7c1e-7d3a-9b1e-5f6a7b8c9d0e",
+		"receipt-store":    "スターバックス 渋谷店",
+		"receipt-category": "식비",
+		"receipt-total":    "1100",
+	}
+
+	encoded := encodeMetadata(metadata)
+	for k, v := range encoded {
+		for _, r := range v {
+			if r > '~' || r < ' ' {
+				t.Errorf("encodeMetadata()[%s] = %q, want ASCII", k, v)
+				break
+			}
+		}
+	}
+	if encoded["receipt-id"] != metadata["receipt-id"] || encoded["receipt-total"] != "1100" {
+		t.Errorf("encodeMetadata() changed ASCII values: %v", encoded)
+	}
+	if got := decodeMetadata(encoded); !reflect.DeepEqual(got, metadata) {
+		t.Errorf("decodeMetadata() = %v, want %v", got, metadata)
+	}
+}
+
+func TestS3RepositorySetTags(t *testing.T) {
+	var tagging struct {
+		Tags []struct {
+			Key   string
+			Value string
+		} `xml:"TagSet>Tag"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !r.URL.Query().Has("tagging") || r.URL.Path != "/test-bucket/2024-10-18/receipt.jpg" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		body, _ := io.ReadAll(r.Body)
+		xml.Unmarshal(body, &tagging)
+	}))
+	defer server.Close()
+
+	client := s3.New(s3.Options{
+		Region:       "ap-northeast-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	repo := NewS3Repository(client, "test-bucket", "ap-northeast-1")
+
+	err := repo.SetTags(context.Background(), "2024-10-18/receipt.jpg", map[string]string{"store": "Cafe & Bar", "category": "식비"})
+	if err != nil {
+		t.Fatalf("SetTags() error = %v", err)
+	}
+	got := map[string]string{}
+	for _, tag := range tagging.Tags {
+		got[tag.Key] = tag.Value
+	}
+	if want := map[string]string{"store": "Cafe _ Bar", "category": "식비"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sent tags %v, want %v", got, want)
+	}
+	if tagging.Tags[0].Key != "category" {
+		t.Errorf("Sent tags %v, want them sorted by key", tagging.Tags)
+	}
+}